@@ -0,0 +1,354 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package auth implements role based authorization for the agent API.
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/logging"
+)
+
+// Role is the set of API operations a client is allowed to do. Every role
+// includes the permissions of the roles before it.
+type Role int
+
+const (
+	// RoleNone cannot access the API.
+	RoleNone Role = iota
+	// RoleReadOnly can view disks, snapshots, snap stores and their settings.
+	RoleReadOnly
+	// RoleConsumer can also list and read snapshots, but can not create or
+	// delete them.
+	RoleConsumer
+	// RoleAdmin can also create and delete snapshots, cancel operations,
+	// track disks, and manage snap stores, snap store locations and mappings.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return config.RoleReadOnly
+	case RoleConsumer:
+		return config.RoleConsumer
+	case RoleAdmin:
+		return config.RoleAdmin
+	default:
+		return "none"
+	}
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case config.RoleReadOnly:
+		return RoleReadOnly, nil
+	case config.RoleConsumer:
+		return RoleConsumer, nil
+	case config.RoleAdmin:
+		return RoleAdmin, nil
+	default:
+		return RoleNone, vErrors.NewValueError("invalid role %q", name)
+	}
+}
+
+// publicRoutes can be accessed by anyone. Routes are keyed by method and path
+// template, without the trailing slash.
+var publicRoutes = map[string]bool{
+	"POST /api/v1/auth/login": true,
+	"GET /health":             true,
+	"GET /ready":              true,
+}
+
+// readOnlyRoutes holds the routes other than GET and HEAD that need the
+// read-only role.
+var readOnlyRoutes = map[string]bool{
+	"POST /api/v1/auth/logout": true,
+}
+
+// adminRoutes holds the GET and HEAD routes that need the admin role.
+var adminRoutes = map[string]bool{
+	"GET /api/v1/auth/tokens": true,
+	"GET /api/v1/audit":       true,
+}
+
+// consumerRoutes holds the routes that need the consumer role. Other GET and
+// HEAD requests need the read-only role, and all other requests need the
+// admin role.
+var consumerRoutes = map[string]bool{
+	"GET /api/v1/snapshots/{snapshotID}/changes/{trackedDiskID}":   true,
+	"GET /api/v1/snapshots/{snapshotID}/consume/{trackedDiskID}":   true,
+	"HEAD /api/v1/snapshots/{snapshotID}/consume/{trackedDiskID}":  true,
+	"GET /api/v1/snapshots/{snapshotID}/stream/{trackedDiskID}":    true,
+	"GET /api/v1/snapshots/{snapshotID}/checksums/{trackedDiskID}": true,
+	"GET /api/v1/snapshots/{snapshotID}/bitmap/{trackedDiskID}":    true,
+	"HEAD /api/v1/snapshots/{snapshotID}/bitmap/{trackedDiskID}":   true,
+}
+
+// RouteKey returns the method and the path template of the route that matched
+// r, without the trailing slash. Routes in the role maps are keyed this way.
+func RouteKey(r *http.Request) string {
+	template := ""
+	if route := mux.CurrentRoute(r); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	return r.Method + " " + strings.TrimSuffix(template, "/")
+}
+
+// RequiredRole returns the role needed to access the route that matched r.
+func RequiredRole(r *http.Request) Role {
+	key := RouteKey(r)
+	if publicRoutes[key] {
+		return RoleNone
+	}
+	if adminRoutes[key] {
+		return RoleAdmin
+	}
+	if readOnlyRoutes[key] {
+		return RoleReadOnly
+	}
+	if consumerRoutes[key] {
+		return RoleConsumer
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return RoleReadOnly
+	default:
+		return RoleAdmin
+	}
+}
+
+type rule struct {
+	role                Role
+	commonNames         map[string]bool
+	organizationalUnits map[string]bool
+	subjectAltNames     map[string]bool
+}
+
+func toSet(values []string) map[string]bool {
+	ret := make(map[string]bool, len(values))
+	for _, val := range values {
+		ret[val] = true
+	}
+	return ret
+}
+
+// matches returns true if any of the identities of cert is listed in the rule.
+func (r rule) matches(cert *x509.Certificate) bool {
+	if r.commonNames[cert.Subject.CommonName] {
+		return true
+	}
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if r.organizationalUnits[ou] {
+			return true
+		}
+	}
+
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, san := range sans {
+		if r.subjectAltNames[san] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPolicy returns a new authorization policy. If tokens is not nil, clients
+// can also authenticate with bearer tokens, which tokens validates.
+func NewPolicy(cfg config.Authorization, tokens TokenValidator) (*Policy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{
+		tokens: tokens,
+	}
+	if len(cfg.Rules) == 0 {
+		// Without rules, every certificate signed by our CA is trusted
+		// with everything, as it was before roles existed.
+		policy.defaultRole = RoleAdmin
+		return policy, nil
+	}
+
+	if cfg.DefaultRole != "" {
+		role, err := ParseRole(cfg.DefaultRole)
+		if err != nil {
+			return nil, err
+		}
+		policy.defaultRole = role
+	}
+	for _, val := range cfg.Rules {
+		role, err := ParseRole(val.Role)
+		if err != nil {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, rule{
+			role:                role,
+			commonNames:         toSet(val.CommonNames),
+			organizationalUnits: toSet(val.OrganizationalUnits),
+			subjectAltNames:     toSet(val.SubjectAltNames),
+		})
+	}
+	return policy, nil
+}
+
+// Policy maps client certificates to roles.
+type Policy struct {
+	defaultRole Role
+	rules       []rule
+	tokens      TokenValidator
+}
+
+// CertificateRole returns the role of a client certificate. If the certificate
+// matches more than one rule, the role with the most permissions is returned.
+func (p *Policy) CertificateRole(cert *x509.Certificate) Role {
+	role := RoleNone
+	matched := false
+	for _, val := range p.rules {
+		if val.matches(cert) {
+			matched = true
+			if val.role > role {
+				role = val.role
+			}
+		}
+	}
+	if !matched {
+		return p.defaultRole
+	}
+	return role
+}
+
+// BearerToken returns the bearer token sent in the Authorization header of r,
+// if any.
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Authentication methods reported in Identity.
+const (
+	AuthMethodCertificate = "certificate"
+	AuthMethodToken       = "token"
+)
+
+// Identity describes the client that sent a request.
+type Identity struct {
+	// Name is the common name of the client certificate, or the name of the
+	// credential used to get the token.
+	Name string
+	// Method is the way the client authenticated.
+	Method string
+	Role   Role
+}
+
+// RequestIdentity returns the identity of the client that sent r. Clients that
+// send a bearer token get the role of the credential used to get the token. Other
+// clients get the role of the certificate they presented.
+func (p *Policy) RequestIdentity(r *http.Request) (Identity, error) {
+	if token := BearerToken(r); token != "" {
+		if p.tokens == nil {
+			return Identity{}, vErrors.NewUnauthorizedError("token authentication is not enabled")
+		}
+		name, roleName, err := p.tokens.ValidateToken(token)
+		if err != nil {
+			return Identity{}, err
+		}
+		role, err := ParseRole(roleName)
+		if err != nil {
+			return Identity{}, err
+		}
+		return Identity{Name: name, Method: AuthMethodToken, Role: role}, nil
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return Identity{}, vErrors.NewUnauthorizedError("no client certificate or token was sent")
+	}
+	cert := r.TLS.PeerCertificates[0]
+	return Identity{
+		Name:   cert.Subject.CommonName,
+		Method: AuthMethodCertificate,
+		Role:   p.CertificateRole(cert),
+	}, nil
+}
+
+// RequestRole returns the role of the client that sent r.
+func (p *Policy) RequestRole(r *http.Request) (Role, error) {
+	identity, err := p.RequestIdentity(r)
+	if err != nil {
+		return RoleNone, err
+	}
+	return identity.Role, nil
+}
+
+func writeError(w http.ResponseWriter, status int) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(params.UnauthorizedResponse)
+}
+
+// Middleware rejects requests from clients that do not have the role needed
+// by the matched route. Requests with an invalid token are rejected with 401.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := RequiredRole(r)
+		if required == RoleNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role, err := p.RequestRole(r)
+		if err != nil {
+			logging.FromContext(r.Context()).Warnf("rejected %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeError(w, http.StatusUnauthorized)
+			return
+		}
+		if role < required {
+			logging.FromContext(r.Context()).Warnf("denied %s %s to %s (role %s, requires %s)", r.Method, r.URL.Path, ClientName(r), role, required)
+			writeError(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientName returns the common name of the client certificate, or the remote
+// address of clients that did not present one.
+func ClientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return r.RemoteAddr
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+)
+
+func newCert(cn string, ous []string, dnsNames []string, ips []net.IP, uris []string) *x509.Certificate {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         cn,
+			OrganizationalUnit: ous,
+		},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}
+	for _, val := range uris {
+		parsed, _ := url.Parse(val)
+		cert.URIs = append(cert.URIs, parsed)
+	}
+	return cert
+}
+
+func TestCertificateRole(t *testing.T) {
+	policy, err := NewPolicy(config.Authorization{
+		Rules: []config.AuthorizationRule{
+			{Role: config.RoleReadOnly, OrganizationalUnits: []string{"monitoring"}},
+			{Role: config.RoleConsumer, CommonNames: []string{"coriolis"}, SubjectAltNames: []string{"spiffe://example.com/coriolis"}},
+			{Role: config.RoleAdmin, CommonNames: []string{"admin"}, SubjectAltNames: []string{"ops.example.com", "10.0.0.1"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		role Role
+	}{
+		{"unknown certificate", newCert("someone", nil, nil, nil, nil), RoleNone},
+		{"organizational unit", newCert("prometheus", []string{"monitoring"}, nil, nil, nil), RoleReadOnly},
+		{"common name", newCert("coriolis", nil, nil, nil, nil), RoleConsumer},
+		{"URI SAN", newCert("worker", nil, nil, nil, []string{"spiffe://example.com/coriolis"}), RoleConsumer},
+		{"DNS SAN", newCert("someone", nil, []string{"ops.example.com"}, nil, nil), RoleAdmin},
+		{"IP SAN", newCert("someone", nil, nil, []net.IP{net.ParseIP("10.0.0.1")}, nil), RoleAdmin},
+		{"highest role wins", newCert("admin", []string{"monitoring"}, nil, nil, nil), RoleAdmin},
+	}
+	for _, tc := range tests {
+		if role := policy.CertificateRole(tc.cert); role != tc.role {
+			t.Errorf("%s: expected role %s, got %s", tc.name, tc.role, role)
+		}
+	}
+}
+
+func TestDefaultRole(t *testing.T) {
+	cert := newCert("someone", nil, nil, nil, nil)
+
+	policy, err := NewPolicy(config.Authorization{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role := policy.CertificateRole(cert); role != RoleAdmin {
+		t.Errorf("expected role admin without rules, got %s", role)
+	}
+
+	policy, err = NewPolicy(config.Authorization{
+		DefaultRole: config.RoleReadOnly,
+		Rules: []config.AuthorizationRule{
+			{Role: config.RoleAdmin, CommonNames: []string{"admin"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role := policy.CertificateRole(cert); role != RoleReadOnly {
+		t.Errorf("expected default role read-only, got %s", role)
+	}
+
+	if _, err := NewPolicy(config.Authorization{DefaultRole: "root"}, nil); err == nil {
+		t.Errorf("expected invalid default role to be rejected")
+	}
+	if _, err := NewPolicy(config.Authorization{
+		Rules: []config.AuthorizationRule{{Role: config.RoleAdmin}},
+	}, nil); err == nil {
+		t.Errorf("expected rule without identities to be rejected")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	policy, err := NewPolicy(config.Authorization{
+		Rules: []config.AuthorizationRule{
+			{Role: config.RoleReadOnly, CommonNames: []string{"reader"}},
+			{Role: config.RoleConsumer, CommonNames: []string{"consumer"}},
+			{Role: config.RoleAdmin, CommonNames: []string{"admin"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	router.Use(policy.Middleware)
+	router.Handle("/api/v1/snapshots", ok).Methods("GET", "POST")
+	router.Handle("/api/v1/snapshots/{snapshotID}/", ok).Methods("DELETE")
+	router.Handle("/api/v1/snapshots/{snapshotID}/consume/{trackedDiskID}/", ok).Methods("GET")
+	router.Handle("/api/v1/operations/{operationID}/cancel/", ok).Methods("POST")
+	router.Handle("/api/v1/disks", ok).Methods("POST")
+	router.Handle("/health", ok).Methods("GET")
+
+	tests := []struct {
+		method string
+		path   string
+		client string
+		status int
+	}{
+		{"GET", "/api/v1/snapshots", "reader", http.StatusOK},
+		{"GET", "/api/v1/snapshots", "nobody", http.StatusForbidden},
+		{"GET", "/api/v1/snapshots", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/snapshots", "reader", http.StatusForbidden},
+		{"POST", "/api/v1/snapshots", "consumer", http.StatusForbidden},
+		{"POST", "/api/v1/snapshots", "admin", http.StatusOK},
+		{"DELETE", "/api/v1/snapshots/1/", "consumer", http.StatusForbidden},
+		{"DELETE", "/api/v1/snapshots/1/", "admin", http.StatusOK},
+		{"POST", "/api/v1/operations/1/cancel/", "consumer", http.StatusForbidden},
+		{"POST", "/api/v1/operations/1/cancel/", "admin", http.StatusOK},
+		{"GET", "/api/v1/snapshots/1/consume/disk/", "reader", http.StatusForbidden},
+		{"GET", "/api/v1/snapshots/1/consume/disk/", "consumer", http.StatusOK},
+		{"POST", "/api/v1/disks", "consumer", http.StatusForbidden},
+		{"POST", "/api/v1/disks", "admin", http.StatusOK},
+		{"GET", "/health", "", http.StatusOK},
+		{"GET", "/health", "nobody", http.StatusOK},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.client == "" {
+			req.TLS = nil
+		} else {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{newCert(tc.client, nil, nil, nil, nil)},
+			}
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s as %q: expected status %d, got %d", tc.method, tc.path, tc.client, tc.status, rec.Code)
+			continue
+		}
+		if rec.Code == http.StatusForbidden {
+			var apiErr params.APIErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&apiErr); err != nil || apiErr != params.UnauthorizedResponse {
+				t.Errorf("%s %s as %q: unexpected response body %+v (%v)", tc.method, tc.path, tc.client, apiErr, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// TokenClaims is the signed content of an API token.
+type TokenClaims struct {
+	// ID identifies the token.
+	ID string `json:"jti"`
+	// Name is the name of the credential used to get the token.
+	Name      string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenValidator validates bearer tokens. It returns the name of the credential
+// used to get the token, and the name of its role.
+type TokenValidator interface {
+	ValidateToken(token string) (name string, role string, err error)
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+func tokenSignature(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// SignToken returns a token holding claims, signed with key.
+func SignToken(key []byte, claims TokenClaims) (string, error) {
+	asJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling token claims")
+	}
+	payload := tokenEncoding.EncodeToString(asJSON)
+	return payload + "." + tokenEncoding.EncodeToString(tokenSignature(key, payload)), nil
+}
+
+// ParseToken checks the signature and the expiry of a token, and returns its claims.
+func ParseToken(key []byte, token string, now time.Time) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return TokenClaims{}, vErrors.NewUnauthorizedError("malformed token")
+	}
+	signature, err := tokenEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, tokenSignature(key, parts[0])) {
+		return TokenClaims{}, vErrors.NewUnauthorizedError("invalid token signature")
+	}
+
+	asJSON, err := tokenEncoding.DecodeString(parts[0])
+	if err != nil {
+		return TokenClaims{}, vErrors.NewUnauthorizedError("malformed token")
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(asJSON, &claims); err != nil {
+		return TokenClaims{}, vErrors.NewUnauthorizedError("malformed token")
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return TokenClaims{}, vErrors.NewUnauthorizedError("token has expired")
+	}
+	return claims, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-snapshot-agent/config"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+func TestSignAndParseToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Unix(1600000000, 0)
+	claims := TokenClaims{
+		ID:        "id",
+		Name:      "backup",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+
+	token, err := SignToken(key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseToken(key, token, now)
+	if err != nil {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	if parsed != claims {
+		t.Errorf("expected claims %+v, got %+v", claims, parsed)
+	}
+
+	if _, err := ParseToken([]byte("another key, just as long as key"), token, now); err == nil {
+		t.Errorf("expected token signed with another key to be rejected")
+	}
+	if _, err := ParseToken(key, "x"+token, now); err == nil {
+		t.Errorf("expected tampered token to be rejected")
+	}
+	if _, err := ParseToken(key, token, now.Add(time.Hour)); err == nil {
+		t.Errorf("expected expired token to be rejected")
+	}
+}
+
+type fakeTokens map[string]string
+
+func (f fakeTokens) ValidateToken(token string) (string, string, error) {
+	role, ok := f[token]
+	if !ok {
+		return "", "", vErrors.NewUnauthorizedError("invalid token")
+	}
+	return token, role, nil
+}
+
+func TestMiddlewareTokens(t *testing.T) {
+	tokens := fakeTokens{
+		"reader":   config.RoleReadOnly,
+		"consumer": config.RoleConsumer,
+		"admin":    config.RoleAdmin,
+	}
+	policy, err := NewPolicy(config.Authorization{}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	router.Use(policy.Middleware)
+	router.Handle("/api/v1/auth/login", ok).Methods("POST")
+	router.Handle("/api/v1/auth/logout", ok).Methods("POST")
+	router.Handle("/api/v1/auth/tokens", ok).Methods("GET")
+	router.Handle("/api/v1/snapshots", ok).Methods("GET", "POST")
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"POST", "/api/v1/auth/login", "", http.StatusOK},
+		{"POST", "/api/v1/auth/logout", "reader", http.StatusOK},
+		{"GET", "/api/v1/auth/tokens", "consumer", http.StatusForbidden},
+		{"GET", "/api/v1/auth/tokens", "admin", http.StatusOK},
+		{"GET", "/api/v1/snapshots", "reader", http.StatusOK},
+		{"GET", "/api/v1/snapshots", "revoked", http.StatusUnauthorized},
+		{"GET", "/api/v1/snapshots", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/snapshots", "reader", http.StatusForbidden},
+		{"POST", "/api/v1/snapshots", "consumer", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.TLS = nil
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s with token %q: expected status %d, got %d", tc.method, tc.path, tc.token, tc.status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+
+	// uncompressedLengthHeader holds the length of the response body
+	// before compression was applied.
+	uncompressedLengthHeader = "X-Uncompressed-Length"
+)
+
+// supportedEncodings lists the content encodings we support, in order
+// of preference.
+var supportedEncodings = []string{encodingZstd, encodingGzip}
+
+// negotiateEncoding returns the preferred content encoding accepted by the client,
+// or an empty string if the response should not be compressed.
+func negotiateEncoding(r *http.Request) string {
+	header := r.Header.Get("Accept-Encoding")
+	if header == "" {
+		return ""
+	}
+
+	accepted := map[string]float64{}
+	for _, val := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(val), ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		quality := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err == nil {
+				quality = q
+			}
+		}
+		accepted[name] = quality
+	}
+
+	var selected string
+	var selectedQuality float64
+	for _, encoding := range supportedEncodings {
+		quality, ok := accepted[encoding]
+		if !ok {
+			quality, ok = accepted["*"]
+		}
+		if !ok || quality <= 0 {
+			continue
+		}
+		if quality > selectedQuality {
+			selected = encoding
+			selectedQuality = quality
+		}
+	}
+	return selected
+}
+
+// newEncoder returns a writer that compresses data written to it, using the
+// requested encoding. The writer must be closed to flush all data.
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		enc, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating gzip writer")
+		}
+		return enc, nil
+	case encodingZstd:
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "creating zstd writer")
+		}
+		return enc, nil
+	}
+	return nil, errors.Errorf("unsupported encoding: %s", encoding)
+}
+
+// parseSingleRange parses the value of a Range header holding exactly one
+// satisfiable byte range. It returns false for multiple ranges, and for ranges
+// that are invalid or not satisfiable. The returned length is always greater
+// than zero.
+func parseSingleRange(header string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, 0, false
+	}
+	startStr := strings.TrimSpace(spec[:dash])
+	endStr := strings.TrimSpace(spec[dash+1:])
+
+	var start, end int64
+	if startStr == "" {
+		// suffix range; the last N bytes.
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		start = size - suffix
+		end = size - 1
+	} else {
+		var err error
+		start, err = strconv.ParseInt(startStr, 10, 64)
+		if err != nil || start < 0 {
+			return 0, 0, false
+		}
+		end = size - 1
+		if endStr != "" {
+			end, err = strconv.ParseInt(endStr, 10, 64)
+			if err != nil || end < start {
+				return 0, 0, false
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+	}
+
+	if start >= size || end < start {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+// serveCompressed writes length bytes of src, starting at offset, compressed using
+// encoding. Each call produces a self contained compressed stream, so every
+// range requested by a client can be decompressed independently.
+func serveCompressed(w http.ResponseWriter, src io.ReaderAt, offset, length int64, encoding string) error {
+	enc, err := newEncoder(w, encoding)
+	if err != nil {
+		return errors.Wrap(err, "creating encoder")
+	}
+
+	if _, err := io.Copy(enc, io.NewSectionReader(src, offset, length)); err != nil {
+		enc.Close()
+		return errors.Wrap(err, "compressing data")
+	}
+
+	if err := enc.Close(); err != nil {
+		return errors.Wrap(err, "flushing compressed data")
+	}
+	return nil
+}
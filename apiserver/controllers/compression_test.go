@@ -0,0 +1,100 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"br", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"zstd", "zstd"},
+		// zstd is preferred when both have the same quality.
+		{"gzip, zstd", "zstd"},
+		{"*", "zstd"},
+		// Higher quality wins.
+		{"gzip;q=0.8, zstd;q=0.5", "gzip"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"*;q=0.5, gzip", "gzip"},
+		// q=0 means not acceptable.
+		{"zstd;q=0", ""},
+		{"zstd;q=0, gzip;q=0.1", "gzip"},
+		{"*;q=0", ""},
+		{"*, zstd;q=0", "gzip"},
+		// Refusing uncompressed data does not change the choice among the
+		// encodings we support.
+		{"identity;q=0", ""},
+		{"identity;q=0, gzip", "gzip"},
+		{"identity;q=0, *", "zstd"},
+		// Invalid quality values are ignored.
+		{"gzip;q=abc", "gzip"},
+		{" gzip ; q=0.3 , zstd ; q=0.2 ", "gzip"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			r.Header.Set("Accept-Encoding", tc.header)
+		}
+		if got := negotiateEncoding(r); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.header, tc.want, got)
+		}
+	}
+}
+
+func TestParseSingleRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header         string
+		offset, length int64
+		ok             bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=100-199", 100, 100, true},
+		{"bytes= 100 - 199 ", 100, 100, true},
+		// Open ended and suffix ranges.
+		{"bytes=900-", 900, 100, true},
+		{"bytes=-100", 900, 100, true},
+		{"bytes=-2000", 0, size, true},
+		// Ranges past the end are cut to the size of the image.
+		{"bytes=900-5000", 900, 100, true},
+		{"bytes=999-999", 999, 1, true},
+		// Multiple ranges are not compressed.
+		{"bytes=0-9,20-29", 0, 0, false},
+		// Invalid and unsatisfiable ranges.
+		{"items=0-9", 0, 0, false},
+		{"bytes=9", 0, 0, false},
+		{"bytes=abc-", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=20-10", 0, 0, false},
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=-1-5", 0, 0, false},
+	}
+	for _, tc := range tests {
+		offset, length, ok := parseSingleRange(tc.header, size)
+		if ok != tc.ok || offset != tc.offset || length != tc.length {
+			t.Errorf("%q: expected (%d, %d, %v), got (%d, %d, %v)", tc.header, tc.offset, tc.length, tc.ok, offset, length, ok)
+		}
+	}
+}
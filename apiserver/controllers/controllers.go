@@ -16,32 +16,62 @@
 package controllers
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"coriolis-snapshot-agent/apiserver/auth"
+	"coriolis-snapshot-agent/apiserver/openapi"
 	"coriolis-snapshot-agent/apiserver/params"
 	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/audit"
+	"coriolis-snapshot-agent/internal/cbt"
+	"coriolis-snapshot-agent/internal/checksum"
+	"coriolis-snapshot-agent/internal/logging"
+	"coriolis-snapshot-agent/internal/metrics"
+	"coriolis-snapshot-agent/internal/stream"
 	"coriolis-snapshot-agent/internal/system"
+	"coriolis-snapshot-agent/internal/throttle"
 	"coriolis-snapshot-agent/worker/manager"
 )
 
 // NewAPIController returns a new instance of APIController
 func NewAPIController(mgr *manager.Snapshot) (*APIController, error) {
+	// Resource metrics are read from this manager, while counters are shared
+	// by the whole process.
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(mgr.MetricsCollector()); err != nil {
+		return nil, errors.Wrap(err, "registering metrics collector")
+	}
+	gatherers := prometheus.Gatherers{metrics.Registry, registry}
 	return &APIController{
 		mgr: mgr,
+		metricsHandler: promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+			ErrorLog: log.Default(),
+		}),
 	}, nil
 }
 
 // APIController implements all API handlers.
 type APIController struct {
-	mgr *manager.Snapshot
+	mgr            *manager.Snapshot
+	metricsHandler http.Handler
 }
 
 // ListVMsHandler lists all VMs from all repositories on the system.
@@ -52,8 +82,8 @@ func (a *APIController) ListDisksHandler(w http.ResponseWriter, r *http.Request)
 	includeSwap := parseBoolParam(includeSwapArg, false)
 	disks, err := a.mgr.ListDisks(includeVirtual, includeSwap)
 	if err != nil {
-		log.Printf("failed to list disks: %q", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to list disks: %q", err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(disks)
@@ -69,55 +99,246 @@ func (a *APIController) GetDiskHandler(w http.ResponseWriter, r *http.Request) {
 
 	disk, err := a.mgr.GetTrackedDisk(diskID)
 	if err != nil {
-		log.Printf("failed to get disk: %q", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to get disk: %q", err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(disk)
 }
 
+func (a *APIController) AddTrackedDiskHandler(w http.ResponseWriter, r *http.Request) {
+	var newDisk params.AddTrackedDiskRequest
+	if err := json.NewDecoder(r.Body).Decode(&newDisk); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	if newDisk.DevicePath == "" {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	disk, err := a.mgr.AddTrackedDisk(r.Context(), newDisk)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to add disk to tracking: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	audit.AddResourceID(r, "trackedDiskID", disk.TrackingID)
+	json.NewEncoder(w).Encode(disk)
+}
+
+func (a *APIController) RemoveTrackedDiskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	diskID, ok := vars["diskTrackingID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := a.mgr.RemoveTrackedDisk(r.Context(), diskID); err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to remove disk from tracking: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
 func (a *APIController) ListSnapStoreLocations(w http.ResponseWriter, r *http.Request) {
 	locations, err := a.mgr.ListAvailableSnapStoreLocations()
 	if err != nil {
-		log.Printf("failed to list virtual machines: %q", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to list virtual machines: %q", err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(locations)
 }
 
+func (a *APIController) AddSnapStoreLocationHandler(w http.ResponseWriter, r *http.Request) {
+	var newLocation params.AddSnapStoreLocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&newLocation); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	if newLocation.Path == "" {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	location, err := a.mgr.AddSnapStoreLocation(newLocation.Path)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to add snap store location: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(location)
+}
+
+// snapStoreLocationPath returns the snap store location path from the URL. The leading
+// slash of the location path is omitted in the URL.
+func snapStoreLocationPath(r *http.Request) (string, bool) {
+	vars := mux.Vars(r)
+	locationPath, ok := vars["locationPath"]
+	if !ok {
+		return "", false
+	}
+	return filepath.Clean("/" + locationPath), true
+}
+
+func (a *APIController) GetSnapStoreLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationPath, ok := snapStoreLocationPath(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	location, err := a.mgr.GetSnapStoreLocation(locationPath)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get snap store location: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(location)
+}
+
+func (a *APIController) UpdateSnapStoreLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationPath, ok := snapStoreLocationPath(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var updateParams params.UpdateSnapStoreLocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateParams); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	location, err := a.mgr.UpdateSnapStoreLocation(locationPath, updateParams)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to update snap store location: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(location)
+}
+
+func (a *APIController) DrainSnapStoreLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationPath, ok := snapStoreLocationPath(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	drainStatus, err := a.mgr.DrainSnapStoreLocation(locationPath)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to drain snap store location: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(drainStatus)
+}
+
+func (a *APIController) RemoveSnapStoreLocationHandler(w http.ResponseWriter, r *http.Request) {
+	locationPath, ok := snapStoreLocationPath(r)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := a.mgr.RemoveSnapStoreLocation(locationPath); err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to remove snap store location: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
 func (a *APIController) ListSnapStoreHandler(w http.ResponseWriter, r *http.Request) {
 	snapStores, err := a.mgr.ListSnapStores()
 	if err != nil {
-		log.Printf("failed to get disk: %+v", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to get disk: %+v", err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(snapStores)
 }
 
+func (a *APIController) GetSnapStoreHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	snapStoreID, ok := vars["snapStoreID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	snapStore, err := a.mgr.GetSnapStore(snapStoreID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get snap store: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(snapStore)
+}
+
+func (a *APIController) AddSnapStoreCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	snapStoreID, ok := vars["snapStoreID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var storageParams params.AddSnapStoreStorageRequest
+	if err := json.NewDecoder(r.Body).Decode(&storageParams); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	if storageParams.Size <= 0 {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	if storageParams.SnapStoreID != "" && storageParams.SnapStoreID != snapStoreID {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("snap store ID in body does not match URL"))
+		return
+	}
+
+	op, err := a.mgr.AddCapacityToSnapStore(r.Context(), snapStoreID, uint64(storageParams.Size))
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to add capacity to snap store: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	writeOperation(w, r, op)
+}
+
 // Snapshots
 func (a *APIController) CreateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	var newSnapshot params.CreateSnapshotRequest
 	if err := json.NewDecoder(r.Body).Decode(&newSnapshot); err != nil {
-		handleError(w, vErrors.ErrBadRequest)
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
 		return
 	}
 
-	snap, err := a.mgr.CreateSnapshot(newSnapshot)
+	op, err := a.mgr.CreateSnapshot(r.Context(), newSnapshot)
 	if err != nil {
-		log.Printf("failed to get disk: %+v", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to create snapshot: %+v", err)
+		handleError(r.Context(), w, err)
 		return
 	}
-	json.NewEncoder(w).Encode(snap)
+	writeOperation(w, r, op)
 }
 
 func (a *APIController) ListSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	snaps, err := a.mgr.ListSnapshots()
 	if err != nil {
-		log.Printf("failed to get disk: %+v", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to get disk: %+v", err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(snaps)
@@ -133,7 +354,7 @@ func (a *APIController) GetSnapshotHandler(w http.ResponseWriter, r *http.Reques
 
 	snap, err := a.mgr.GetSnapshot(snapshotID)
 	if err != nil {
-		handleError(w, err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(snap)
@@ -146,13 +367,166 @@ func (a *APIController) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Req
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := a.mgr.DeleteSnapshot(snapshotID); err != nil {
-		log.Printf("failed to get disk: %+v", err)
-		handleError(w, err)
+	op, err := a.mgr.DeleteSnapshot(r.Context(), snapshotID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to delete snapshot: %+v", err)
+		handleError(r.Context(), w, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	writeOperation(w, r, op)
+}
+
+// Operations
+
+func (a *APIController) ListOperationsHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(a.mgr.ListOperations())
+}
+
+func (a *APIController) GetOperationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	operationID, ok := vars["operationID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	op, err := a.mgr.GetOperation(operationID)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(op)
+}
+
+func (a *APIController) CancelOperationHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	operationID, ok := vars["operationID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	op, err := a.mgr.CancelOperation(operationID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to cancel operation: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	writeOperation(w, r, op)
+}
+
+// Events
+
+// EventsHandler streams events to the client, using Server-Sent Events. The types query
+// arg holds a comma separated list of event types to subscribe to. By default, all events
+// are sent. The stream ends when the agent shuts down.
+func (a *APIController) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logging.FromContext(r.Context()).Errorf("response writer does not support flushing")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	eventTypes := manager.EventTypes
+	if arg := r.URL.Query().Get("types"); arg != "" {
+		eventTypes = nil
+		for _, name := range strings.Split(arg, ",") {
+			eventType := manager.NotificationType(strings.TrimSpace(name))
+			found := false
+			for _, known := range manager.EventTypes {
+				if known == eventType {
+					found = true
+					break
+				}
+			}
+			if !found {
+				handleError(r.Context(), w, vErrors.NewBadRequestError("unknown event type: %s", eventType))
+				return
+			}
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+
+	// Event IDs start over when the agent restarts. Clients that resume a
+	// stream of a previous agent process get a reset event first, so they
+	// know events were lost. The last event ID is read before subscribing,
+	// so events sent in between show up as a gap in the IDs.
+	var reset *params.Event
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		epoch, seq := a.mgr.LastEvent()
+		if manager.EventIDEpoch(lastEventID) != epoch {
+			data, _ := json.Marshal(params.ResetEvent{PreviousEventID: lastEventID})
+			reset = &params.Event{
+				ID:        seq,
+				Type:      string(manager.ResetEvent),
+				Timestamp: time.Now().UTC(),
+				Epoch:     epoch,
+				Data:      data,
+			}
+		}
+	}
+
+	events := make(chan interface{}, 100)
+	for _, eventType := range eventTypes {
+		a.mgr.RegisterNotificationChannel(eventType, events)
+	}
+	defer a.mgr.UnregisterNotificationChannel(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
+	if reset != nil {
+		frame, err := formatEvent(*reset)
+		if err != nil {
+			logging.FromContext(r.Context()).Errorf("failed to marshal event: %q", err)
+			return
+		}
+		if _, err := w.Write(frame); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	// Send a comment every now and then, so proxies do not close idle connections.
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg := <-events:
+			evt, ok := msg.(params.Event)
+			if !ok {
+				continue
+			}
+			frame, err := formatEvent(evt)
+			if err != nil {
+				logging.FromContext(r.Context()).Errorf("failed to marshal event: %q", err)
+				continue
+			}
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-a.mgr.ShuttingDown():
+			return
+		}
+	}
+}
+
+// formatEvent returns an event as sent to event stream clients.
+func formatEvent(evt params.Event) ([]byte, error) {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshaling event")
+	}
+	return []byte(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", manager.FormatEventID(evt.Epoch, evt.ID), evt.Type, data)), nil
 }
 
 // Snap store mappings
@@ -161,34 +535,97 @@ func (a *APIController) CreateSnapStoreMappingHandler(w http.ResponseWriter, r *
 	// CreateSnapStore
 	var newSnapData params.CreateSnapStoreMappingRequest
 	if err := json.NewDecoder(r.Body).Decode(&newSnapData); err != nil {
-		handleError(w, vErrors.ErrBadRequest)
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
 		return
 	}
 
 	if newSnapData.SnapStoreLocation == "" || newSnapData.TrackedDisk == "" {
-		handleError(w, vErrors.ErrBadRequest)
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
 		return
 	}
 
 	response, err := a.mgr.CreateSnapStoreMapping(newSnapData)
 	if err != nil {
-		log.Printf("failed to get disk: %+v", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to get disk: %+v", err)
+		handleError(r.Context(), w, err)
 		return
 	}
+	audit.AddResourceID(r, "mappingID", response.ID)
 	json.NewEncoder(w).Encode(response)
 }
 
 func (a *APIController) ListSnapStoreMappingsHandler(w http.ResponseWriter, r *http.Request) {
 	snapStores, err := a.mgr.ListSnapStoreMappings()
 	if err != nil {
-		log.Printf("failed to get disk: %+v", err)
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed to get disk: %+v", err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(snapStores)
 }
 
+func (a *APIController) GetSnapStoreMappingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	mappingID, ok := vars["mappingID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	mapping, err := a.mgr.GetSnapStoreMapping(mappingID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get snap store mapping: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(mapping)
+}
+
+func (a *APIController) UpdateSnapStoreMappingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	mappingID, ok := vars["mappingID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var updateParams params.UpdateSnapStoreMappingRequest
+	if err := json.NewDecoder(r.Body).Decode(&updateParams); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	if updateParams.SnapStoreLocation == "" {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	mapping, err := a.mgr.UpdateSnapStoreMapping(mappingID, updateParams)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to update snap store mapping: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(mapping)
+}
+
+func (a *APIController) DeleteSnapStoreMappingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	mappingID, ok := vars["mappingID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := a.mgr.DeleteSnapStoreMapping(mappingID); err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to delete snap store mapping: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
 func (a *APIController) GetChangedSectorsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	snapshotID := vars["snapshotID"]
@@ -205,12 +642,303 @@ func (a *APIController) GetChangedSectorsHandler(w http.ResponseWriter, r *http.
 	prevGenID := r.URL.Query().Get("previousGenerationID")
 	prevNum, _ := strconv.ParseUint(r.URL.Query().Get("previousNumber"), 10, 32)
 
-	ranges, err := a.mgr.GetChangedSectors(snapshotID, trackedDisk, prevGenID, uint32(prevNum))
+	opts := manager.ChangedSectorsOptions{
+		DetectZeroes:  parseBoolParam(r.URL.Query().Get("detectZeroes"), false),
+		AllocatedOnly: parseBoolParam(r.URL.Query().Get("allocatedOnly"), false),
+		PageToken:     r.URL.Query().Get("pageToken"),
+	}
+
+	var err error
+	if opts.Offset, err = parseUintParam(r.URL.Query().Get("offset")); err != nil {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("invalid offset: %v", err))
+		return
+	}
+	if opts.Length, err = parseUintParam(r.URL.Query().Get("length")); err != nil {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("invalid length: %v", err))
+		return
+	}
+	maxRanges, err := parseUintParam(r.URL.Query().Get("maxRanges"))
+	if err != nil || maxRanges > math.MaxInt32 {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("invalid maxRanges: %s", r.URL.Query().Get("maxRanges")))
+		return
+	}
+	opts.MaxRanges = int(maxRanges)
+
+	if !wantsNDJSON(r) {
+		changes, err := a.mgr.GetChangedSectors(r.Context(), snapshotID, trackedDisk, prevGenID, uint32(prevNum), opts)
+		if err != nil {
+			handleError(r.Context(), w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(changes)
+		return
+	}
+
+	listing, err := a.mgr.ListChangedSectors(r.Context(), snapshotID, trackedDisk, prevGenID, uint32(prevNum), opts)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+	defer listing.Close()
+
+	// In NDJSON mode, every range is sent on its own line, in offset order, as soon as
+	// it is found. Zero ranges are interleaved with data ranges, and are flagged as such.
+	// The continuation token is only known once the walk ends, so it is sent as a trailer.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Backup-Type", string(listing.BackupType))
+	w.Header().Set("X-CBT-Block-Size", strconv.Itoa(listing.CBTBlockSize))
+	w.Header().Set("Trailer", "X-Next-Page-Token")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	nextPageToken, err := listing.Walk(func(rng params.ChangedRange) error {
+		return enc.Encode(rng)
+	})
+	if err != nil {
+		// The status was already sent. Abort the response, so the client does
+		// not mistake a partial listing for a complete one.
+		logging.FromContext(r.Context()).Errorf("failed to send changed ranges: %q", err)
+		panic(http.ErrAbortHandler)
+	}
+	if nextPageToken != "" {
+		w.Header().Set("X-Next-Page-Token", nextPageToken)
+	}
+}
+
+// StreamChangedSectorsHandler sends all changed ranges of a disk in a single response. Ranges
+// are encoded using the framing described in the stream package. The previousGenerationID
+// and previousNumber query args have the same meaning as for GetChangedSectorsHandler.
+func (a *APIController) StreamChangedSectorsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	snapshotID := vars["snapshotID"]
+	if snapshotID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	trackedDisk := vars["trackedDiskID"]
+	if trackedDisk == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	prevGenID := r.URL.Query().Get("previousGenerationID")
+	prevNum, _ := strconv.ParseUint(r.URL.Query().Get("previousNumber"), 10, 32)
+
+	opts := manager.ChangedSectorsOptions{
+		AllocatedOnly: parseBoolParam(r.URL.Query().Get("allocatedOnly"), false),
+	}
+
+	changes, err := a.mgr.GetChangedSectors(r.Context(), snapshotID, trackedDisk, prevGenID, uint32(prevNum), opts)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+
+	slot, err := a.mgr.AcquireStream(r.Context(), trackedDisk)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+	defer slot.Release()
+	volSnap, release, err := a.mgr.AcquireSnapshotRead(snapshotID, trackedDisk)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+	defer release()
+
+	imgPath := volSnap.SnapshotImage.DevicePath
+
+	fp, err := os.Open(imgPath)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed open snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+	src := slot.Reader(r.Context(), fp)
+
+	diskSize, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get snapshot size: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ranges, totalBytes := clipRanges(changes.Ranges, uint64(diskSize))
+	streamLength := uint64(stream.FrameHeaderSize*(len(ranges)+1)) + totalBytes
+
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Backup-Type", string(changes.BackupType))
+	w.Header().Set("X-CBT-Block-Size", strconv.Itoa(changes.CBTBlockSize))
+	w.Header().Set("X-Changed-Ranges", strconv.Itoa(len(ranges)))
+	w.Header().Set("X-Changed-Bytes", strconv.FormatUint(totalBytes, 10))
+	w.Header().Set(uncompressedLengthHeader, strconv.FormatUint(streamLength, 10))
+
+	var out io.Writer = w
+	if encoding := negotiateEncoding(r); encoding != "" {
+		enc, err := newEncoder(w, encoding)
+		if err != nil {
+			handleError(r.Context(), w, err)
+			return
+		}
+		defer enc.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		out = enc
+	}
+	w.WriteHeader(http.StatusOK)
+
+	for _, rng := range ranges {
+		if err := stream.WriteFrame(out, src, rng.StartOffset, rng.Length); err != nil {
+			// Headers have already been sent. The missing end of stream
+			// frame will let the client know the transfer is incomplete.
+			logging.FromContext(r.Context()).Errorf("failed to stream changes for %s: %+v", imgPath, err)
+			return
+		}
+	}
+
+	if err := stream.WriteEnd(out, uint64(diskSize)); err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to stream changes for %s: %+v", imgPath, err)
+	}
+}
+
+// ChecksumManifestHandler sends a checksum for every CBT block of a disk snapshot, as
+// newline delimited JSON. If previousGenerationID and previousNumber are set, only the
+// blocks that changed since that snapshot are hashed.
+func (a *APIController) ChecksumManifestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	snapshotID := vars["snapshotID"]
+	if snapshotID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	trackedDisk := vars["trackedDiskID"]
+	if trackedDisk == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	algorithm := r.URL.Query().Get("algorithm")
+	if algorithm == "" {
+		algorithm = checksum.AlgorithmSHA256
+	}
+	hasher, err := checksum.NewHash(algorithm)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+
+	prevGenID := r.URL.Query().Get("previousGenerationID")
+	prevNum, _ := strconv.ParseUint(r.URL.Query().Get("previousNumber"), 10, 32)
+
+	opts := manager.ChangedSectorsOptions{
+		AllocatedOnly: parseBoolParam(r.URL.Query().Get("allocatedOnly"), false),
+	}
+
+	changes, err := a.mgr.GetChangedSectors(r.Context(), snapshotID, trackedDisk, prevGenID, uint32(prevNum), opts)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+
+	slot, err := a.mgr.AcquireStream(r.Context(), trackedDisk)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+	defer slot.Release()
+	volSnap, release, err := a.mgr.AcquireSnapshotRead(snapshotID, trackedDisk)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+	defer release()
+
+	imgPath := volSnap.SnapshotImage.DevicePath
+
+	fp, err := os.Open(imgPath)
 	if err != nil {
-		handleError(w, err)
+		logging.FromContext(r.Context()).Errorf("failed open snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+	src := slot.Reader(r.Context(), fp)
+
+	diskSize, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get snapshot size: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(ranges)
+
+	ranges, _ := clipRanges(changes.Ranges, uint64(diskSize))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Backup-Type", string(changes.BackupType))
+	w.Header().Set("X-CBT-Block-Size", strconv.Itoa(changes.CBTBlockSize))
+	w.Header().Set("X-Checksum-Algorithm", algorithm)
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	writeEntry := func(offset, length uint64, sum []byte) error {
+		return enc.Encode(params.BlockChecksum{
+			Offset:   offset,
+			Length:   length,
+			Checksum: hex.EncodeToString(sum),
+		})
+	}
+	for _, rng := range ranges {
+		if err := checksum.SumBlocks(src, rng.StartOffset, rng.Length, changes.CBTBlockSize, hasher, writeEntry); err != nil {
+			// Headers have already been sent. The client will get a truncated manifest.
+			logging.FromContext(r.Context()).Errorf("failed to compute checksums for %s: %+v", imgPath, err)
+			return
+		}
+	}
+}
+
+// GetCBTBitmapHandler sends the CBT bitmap of a disk snapshot, with one byte per CBT block.
+// The encoding query arg selects the raw, rle or roaring encoding, described in the cbt package.
+func (a *APIController) GetCBTBitmapHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	snapshotID := vars["snapshotID"]
+	if snapshotID == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	trackedDisk := vars["trackedDiskID"]
+	if trackedDisk == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	encoding := r.URL.Query().Get("encoding")
+	if encoding == "" {
+		encoding = cbt.EncodingRaw
+	}
+
+	volSnap, cbtBlkSize, err := a.mgr.GetCBTBitmap(snapshotID, trackedDisk)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get CBT bitmap: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := cbt.Encode(&buf, volSnap.Bitmap, encoding); err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to encode CBT bitmap: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Snapshot-Number", strconv.FormatUint(uint64(volSnap.SnapshotNumber), 10))
+	w.Header().Set("X-Generation-ID", volSnap.GenerationID)
+	w.Header().Set("X-CBT-Block-Size", strconv.Itoa(cbtBlkSize))
+	w.Header().Set("X-CBT-Blocks", strconv.Itoa(len(volSnap.Bitmap)))
+	w.Header().Set("X-Bitmap-Encoding", encoding)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
 }
 
 func (a *APIController) ConsumeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
@@ -226,30 +954,260 @@ func (a *APIController) ConsumeSnapshotHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	volSnap, err := a.mgr.FindVolumeSnapshotForDisk(snapshotID, trackedDisk)
+	// HEAD requests do not read any data, and are not throttled.
+	var slot *throttle.Stream
+	if r.Method != http.MethodHead {
+		var err error
+		slot, err = a.mgr.AcquireStream(r.Context(), trackedDisk)
+		if err != nil {
+			handleError(r.Context(), w, err)
+			return
+		}
+		defer slot.Release()
+	}
+	volSnap, release, err := a.mgr.AcquireSnapshotRead(snapshotID, trackedDisk)
 	if err != nil {
-		handleError(w, err)
+		handleError(r.Context(), w, err)
 		return
 	}
-	a.mgr.Lock()
-	defer a.mgr.Unlock()
+	defer release()
 
 	imgPath := volSnap.SnapshotImage.DevicePath
 
 	fp, err := os.Open(imgPath)
 	if err != nil {
-		log.Printf("failed open snapshot file: %q", err)
+		logging.FromContext(r.Context()).Errorf("failed open snapshot file: %q", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer fp.Close()
-	http.ServeContent(w, r, imgPath, time.Time{}, fp)
+	src := slot.Reader(r.Context(), fp)
+
+	w = &countingResponseWriter{
+		ResponseWriter: w,
+		counter:        metrics.BytesServed.WithLabelValues(trackedDisk),
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r)
+	if encoding == "" || r.Method == http.MethodHead {
+		http.ServeContent(w, r, imgPath, time.Time{}, src)
+		return
+	}
+
+	size, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to get snapshot size: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var offset int64
+	length := size
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var ok bool
+		offset, length, ok = parseSingleRange(rangeHeader, size)
+		if !ok {
+			// Multiple ranges are served uncompressed. Invalid and
+			// unsatisfiable ranges are rejected by ServeContent.
+			http.ServeContent(w, r, imgPath, time.Time{}, src)
+			return
+		}
+		// Only the requested range is compressed, as a self contained
+		// stream. Content-Range refers to the uncompressed data.
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set(uncompressedLengthHeader, strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if err := serveCompressed(w, src, offset, length, encoding); err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to send compressed data for %s: %+v", imgPath, err)
+	}
+}
+
+// GetThrottleHandler returns the snapshot read limits in effect.
+func (a *APIController) GetThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.mgr.GetThrottle())
+}
+
+// SetThrottleHandler overrides the snapshot read limits set in the config.
+func (a *APIController) SetThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	var throttleParams params.SetThrottleRequest
+	if err := json.NewDecoder(r.Body).Decode(&throttleParams); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+
+	response, err := a.mgr.SetThrottleOverride(throttleParams)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to set throttle limits: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RemoveThrottleHandler goes back to the snapshot read limits set in the config.
+func (a *APIController) RemoveThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.mgr.RemoveThrottleOverride())
+}
+
+// LoginHandler exchanges a credential for an API token.
+func (a *APIController) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	var loginParams params.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&loginParams); err != nil {
+		handleError(r.Context(), w, vErrors.ErrBadRequest)
+		return
+	}
+	if loginParams.Name == "" || loginParams.Secret == "" {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("name and secret are mandatory"))
+		return
+	}
+
+	response, err := a.mgr.Login(loginParams)
+	if err != nil {
+		logging.FromContext(r.Context()).Warnf("failed login for %s from %s: %s", loginParams.Name, r.RemoteAddr, err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	audit.AddResourceID(r, "tokenID", response.TokenID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// LogoutHandler revokes the token used to authenticate the request.
+func (a *APIController) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	token := auth.BearerToken(r)
+	if token == "" {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("logout requires a bearer token"))
+		return
+	}
+	tokenID, err := a.mgr.TokenID(token)
+	if err != nil {
+		handleError(r.Context(), w, err)
+		return
+	}
+
+	response, err := a.mgr.RevokeToken(tokenID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to revoke token: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListTokensHandler lists the API tokens that have not yet expired.
+func (a *APIController) ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens, err := a.mgr.ListTokens()
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to list tokens: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// QueryAuditLogHandler returns the most recent audit log entries that match
+// the query args.
+func (a *APIController) QueryAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	auditQuery := params.AuditQuery{
+		Client:     query.Get("client"),
+		Operation:  query.Get("operation"),
+		ResourceID: query.Get("resourceID"),
+	}
+	for name, dest := range map[string]**time.Time{"since": &auditQuery.Since, "until": &auditQuery.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				handleError(r.Context(), w, vErrors.NewBadRequestError("invalid %s: %s", name, value))
+				return
+			}
+			*dest = &parsed
+		}
+	}
+	limit, err := parseUintParam(query.Get("limit"))
+	if err != nil {
+		handleError(r.Context(), w, vErrors.NewBadRequestError("invalid limit"))
+		return
+	}
+	auditQuery.Limit = int(limit)
+
+	entries, err := a.mgr.QueryAuditLog(auditQuery)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to query audit log: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// RevokeTokenHandler revokes an API token.
+func (a *APIController) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tokenID, ok := vars["tokenID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	response, err := a.mgr.RevokeToken(tokenID)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("failed to revoke token: %+v", err)
+		handleError(r.Context(), w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// OpenAPIHandler serves the OpenAPI document describing this API.
+func (a *APIController) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapi.Spec)
+}
+
+// MetricsHandler exposes agent metrics in the prometheus text format.
+func (a *APIController) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	a.metricsHandler.ServeHTTP(w, r)
+}
+
+// HealthHandler reports whether the agent is alive. It returns 503 if any
+// check failed.
+func (a *APIController) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, a.mgr.Health())
+}
+
+// ReadyHandler reports whether the agent is ready to serve requests. It returns
+// 503 if any check failed.
+func (a *APIController) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, a.mgr.Ready())
+}
+
+func writeHealthResponse(w http.ResponseWriter, resp params.HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != params.HealthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (a *APIController) SystemInfoHandler(w http.ResponseWriter, r *http.Request) {
-	info, err := system.GetSystemInfo(a.mgr)
+	info, err := system.GetSystemInfo(r.Context(), a.mgr)
 	if err != nil {
-		handleError(w, err)
+		handleError(r.Context(), w, err)
 		return
 	}
 	json.NewEncoder(w).Encode(info)
@@ -264,7 +1222,69 @@ func parseBoolParam(arg string, defaultValue bool) bool {
 	return parsed
 }
 
-func handleError(w http.ResponseWriter, err error) {
+// writeOperation sends a 202 Accepted response, pointing the client to the operation
+// that will carry out its request.
+func writeOperation(w http.ResponseWriter, r *http.Request, op params.OperationResponse) {
+	audit.AddResourceID(r, "operationID", op.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/operations/%s", op.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+// parseUintParam parses an optional unsigned integer query arg. An empty value
+// is treated as 0.
+func parseUintParam(arg string) (uint64, error) {
+	if arg == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(arg, 10, 64)
+}
+
+// wantsNDJSON returns true if the client asked for newline delimited JSON, either
+// through the format query arg, or through the Accept header.
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// clipRanges removes empty ranges and truncates ranges that extend beyond the end of
+// the disk. It returns the resulting ranges and their total length.
+func clipRanges(ranges []params.DiskRange, diskSize uint64) ([]params.DiskRange, uint64) {
+	var total uint64
+	ret := []params.DiskRange{}
+	for _, rng := range ranges {
+		if rng.StartOffset >= diskSize {
+			continue
+		}
+		if rng.StartOffset+rng.Length > diskSize {
+			rng.Length = diskSize - rng.StartOffset
+		}
+		if rng.Length == 0 {
+			continue
+		}
+		total += rng.Length
+		ret = append(ret, rng)
+	}
+	return ret, total
+}
+
+// countingResponseWriter adds the number of body bytes written to a response
+// to a prometheus counter.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter prometheus.Counter
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+func handleError(ctx context.Context, w http.ResponseWriter, err error) {
 	w.Header().Add("Content-Type", "application/json")
 	origErr := errors.Cause(err)
 	apiErr := params.APIErrorResponse{
@@ -284,8 +1304,13 @@ func handleError(w http.ResponseWriter, err error) {
 	case *vErrors.ConflictError:
 		w.WriteHeader(http.StatusConflict)
 		apiErr.Error = "Conflict"
+	case *vErrors.TooManyRequestsError:
+		retryAfter := int64(math.Ceil(origErr.(*vErrors.TooManyRequestsError).RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		w.WriteHeader(http.StatusTooManyRequests)
+		apiErr.Error = "Too Many Requests"
 	default:
-		log.Printf("Unhandled error: %+v", err)
+		logging.FromContext(ctx).Errorf("Unhandled error: %+v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		apiErr.Error = "Server error"
 	}
@@ -0,0 +1,27 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package openapi holds the OpenAPI 3 document describing the agent API.
+package openapi
+
+import (
+	_ "embed"
+)
+
+// Spec is the OpenAPI document, in JSON format. When adding or changing a
+// route, or a type in apiserver/params, update openapi.json as well.
+//
+//go:embed openapi.json
+var Spec []byte
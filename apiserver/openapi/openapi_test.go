@@ -0,0 +1,148 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/system"
+)
+
+type schema struct {
+	Type       string                     `json:"type"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// schemaTypes maps component schemas to the types they describe.
+var schemaTypes = map[string]interface{}{
+	"APIErrorResponse":               params.APIErrorResponse{},
+	"ErrorResponse":                  params.ErrorResponse{},
+	"LoginRequest":                   params.LoginRequest{},
+	"LoginResponse":                  params.LoginResponse{},
+	"TokenResponse":                  params.TokenResponse{},
+	"AddTrackedDiskRequest":          params.AddTrackedDiskRequest{},
+	"Partition":                      params.Partition{},
+	"BlockVolume":                    params.BlockVolume{},
+	"AddSnapStoreLocationRequest":    params.AddSnapStoreLocationRequest{},
+	"UpdateSnapStoreLocationRequest": params.UpdateSnapStoreLocationRequest{},
+	"SnapStoreLocation":              params.SnapStoreLocation{},
+	"SnapStoreLocationDrainResponse": params.SnapStoreLocationDrainResponse{},
+	"AddSnapStoreStorageRequest":     params.AddSnapStoreStorageRequest{},
+	"SnapStoreFile":                  params.SnapStoreFile{},
+	"SnapStoreResponse":              params.SnapStoreResponse{},
+	"CreateSnapStoreMappingRequest":  params.CreateSnapStoreMappingRequest{},
+	"UpdateSnapStoreMappingRequest":  params.UpdateSnapStoreMappingRequest{},
+	"SnapStoreMappingResponse":       params.SnapStoreMappingResponse{},
+	"CreateSnapshotRequest":          params.CreateSnapshotRequest{},
+	"SnapshotImage":                  params.SnapshotImage{},
+	"TrackedDevice":                  params.TrackedDevice{},
+	"VolumeSnapshot":                 params.VolumeSnapshot{},
+	"SnapshotResponse":               params.SnapshotResponse{},
+	"DiskRange":                      params.DiskRange{},
+	"ChangesResponse":                params.ChangesResponse{},
+	"ChangedRange":                   params.ChangedRange{},
+	"BlockChecksum":                  params.BlockChecksum{},
+	"OperationStep":                  params.OperationStep{},
+	"OperationResponse":              params.OperationResponse{},
+	"Event":                          params.Event{},
+	"SnapshotEvent":                  params.SnapshotEvent{},
+	"SnapStoreFileEvent":             params.SnapStoreFileEvent{},
+	"SnapStoreOverflowEvent":         params.SnapStoreOverflowEvent{},
+	"WatcherErrorEvent":              params.WatcherErrorEvent{},
+	"DiskEvent":                      params.DiskEvent{},
+	"ThrottleLimits":                 params.ThrottleLimits{},
+	"SetThrottleRequest":             params.SetThrottleRequest{},
+	"ThrottleResponse":               params.ThrottleResponse{},
+	"HealthCheck":                    params.HealthCheck{},
+	"AuditEntry":                     params.AuditEntry{},
+	"HealthResponse":                 params.HealthResponse{},
+	"CPUInfo":                        system.CPUInfo{},
+	"NetworkInterface":               system.NetworkInterface{},
+	"OSInfo":                         system.OSInfo{},
+	"SystemInfo":                     system.SystemInfo{},
+}
+
+// jsonFields returns the names of the JSON fields of a struct.
+func jsonFields(typ reflect.Type) []string {
+	var ret []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestSchemasMatchTypes(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas map[string]schema `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(Spec, &spec); err != nil {
+		t.Fatalf("failed to parse OpenAPI spec: %s", err)
+	}
+
+	for name, val := range schemaTypes {
+		sch, ok := spec.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is missing", name)
+			continue
+		}
+		var documented []string
+		for prop := range sch.Properties {
+			documented = append(documented, prop)
+		}
+		sort.Strings(documented)
+
+		fields := jsonFields(reflect.TypeOf(val))
+		if !reflect.DeepEqual(fields, documented) {
+			t.Errorf("schema %s has properties %v, but %T has fields %v", name, documented, val, fields)
+		}
+	}
+}
+
+func TestReferencesResolve(t *testing.T) {
+	var spec map[string]interface{}
+	if err := json.Unmarshal(Spec, &spec); err != nil {
+		t.Fatalf("failed to parse OpenAPI spec: %s", err)
+	}
+
+	refPattern := regexp.MustCompile(`"\$ref":\s*"#/components/(schemas|responses)/([^"]+)"`)
+	components := spec["components"].(map[string]interface{})
+	for _, match := range refPattern.FindAllStringSubmatch(string(Spec), -1) {
+		section := components[match[1]].(map[string]interface{})
+		if _, ok := section[match[2]]; !ok {
+			t.Errorf("reference to missing component %s/%s", match[1], match[2])
+		}
+	}
+}
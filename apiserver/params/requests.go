@@ -15,6 +15,8 @@
 
 package params
 
+import "time"
+
 type AddTrackedDiskRequest struct {
 	DevicePath string `json:"device_path"`
 }
@@ -24,6 +26,18 @@ type CreateSnapStoreMappingRequest struct {
 	TrackedDisk       string `json:"tracked_disk_id"`
 }
 
+type UpdateSnapStoreMappingRequest struct {
+	SnapStoreLocation string `json:"snapstore_location_id"`
+}
+
+type AddSnapStoreLocationRequest struct {
+	Path string `json:"path"`
+}
+
+type UpdateSnapStoreLocationRequest struct {
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
 type AddSnapStoreStorageRequest struct {
 	SnapStoreID string `json:"snapstore_id"`
 	Size        int64  `json:"size_bytes"`
@@ -32,3 +46,36 @@ type AddSnapStoreStorageRequest struct {
 type CreateSnapshotRequest struct {
 	TrackedDiskIDs []string `json:"tracked_disk_ids"`
 }
+
+// LoginRequest exchanges a credential for an API token.
+type LoginRequest struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	// Lifetime is the number of seconds the token is valid for. If not
+	// set, the default lifetime configured in the agent is used.
+	Lifetime int `json:"lifetime,omitempty"`
+}
+
+// SetThrottleRequest overrides the throttle limits set in the agent config.
+type SetThrottleRequest struct {
+	Limits ThrottleLimits `json:"limits"`
+	// Duration is the number of seconds the override stays in place. If
+	// not set, it stays until it is removed, or the agent restarts.
+	Duration int `json:"duration,omitempty"`
+}
+
+// AuditQuery filters the entries of the audit log. Empty fields match
+// all entries.
+type AuditQuery struct {
+	// Client is the name of the client that made the call.
+	Client string
+	// Operation matches entries whose operation contains it.
+	Operation string
+	// ResourceID matches entries that affected the resource.
+	ResourceID string
+	Since      *time.Time
+	Until      *time.Time
+	// Limit is the largest number of entries returned. The most recent
+	// entries are returned.
+	Limit int
+}
@@ -15,6 +15,11 @@
 
 package params
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type BackupType string
 
 const (
@@ -38,6 +43,19 @@ var (
 // LoginResponse is the response clients get on successful login.
 type LoginResponse struct {
 	Token string `json:"token"`
+	// TokenID identifies the token, and can be used to revoke it.
+	TokenID   string    `json:"token_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenResponse describes an API token that was issued, and has not yet expired.
+type TokenResponse struct {
+	ID string `json:"id"`
+	// Name is the name of the credential used to get the token.
+	Name      string    `json:"name"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Revoked   bool      `json:"revoked"`
 }
 
 // ErrorResponse holds any errors generated during
@@ -173,6 +191,28 @@ type SnapStoreLocation struct {
 	// Minor is the minor number of the device which is mounted
 	// in Path.
 	Minor uint32 `json:"minor"`
+	// Enabled indicates whether or not new snap stores can be created
+	// in this location, and whether existing snap stores are allowed
+	// to grow.
+	Enabled bool `json:"enabled"`
+}
+
+type SnapStoreLocationDrainResponse struct {
+	// Path is the path on the filesystem to the folder where
+	// snap store storage is allocated.
+	Path string `json:"path"`
+	// Enabled indicates whether or not the location accepts new
+	// allocations. A location that is being drained, is always disabled.
+	Enabled bool `json:"enabled"`
+	// SnapStores is a list of snap store IDs which still hold files
+	// in this location.
+	SnapStores []string `json:"snap_stores"`
+	// AllocatedCapacity is the amount of disk space still allocated
+	// to snap stores in this location.
+	AllocatedCapacity uint64 `json:"allocated_capacity"`
+	// Drained is true when no snap store files remain in this location,
+	// and the location can be safely removed.
+	Drained bool `json:"drained"`
 }
 
 type SnapStoreResponse struct {
@@ -181,6 +221,18 @@ type SnapStoreResponse struct {
 	StorageLocationID  string `json:"storage_location"`
 	AllocatedDiskSpace uint64 `json:"allocated_disk_space"`
 	StorageUsage       uint64 `json:"used_disk_space"`
+	// Files is the list of files allocated to this snap store. This
+	// is only populated when fetching a single snap store.
+	Files []SnapStoreFile `json:"files,omitempty"`
+}
+
+type SnapStoreFile struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Size uint64 `json:"size"`
+	// Extents is the number of physical extents that make up the
+	// file on disk.
+	Extents int `json:"extents"`
 }
 
 type SnapStoreMappingResponse struct {
@@ -232,10 +284,233 @@ type DiskRange struct {
 	Length      uint64 `json:"length"`
 }
 
+// BlockChecksum is one entry of a checksum manifest.
+type BlockChecksum struct {
+	Offset   uint64 `json:"offset"`
+	Length   uint64 `json:"length"`
+	Checksum string `json:"checksum"`
+}
+
 type ChangesResponse struct {
 	TrackedDiskID string      `json:"tracked_disk_id"`
 	SnapshotID    string      `json:"snapshot_id"`
 	CBTBlockSize  int         `json:"cbt_block_size_bytes"`
 	BackupType    BackupType  `json:"backup_type"`
 	Ranges        []DiskRange `json:"ranges"`
+	// ZeroRanges holds changed ranges that contain only zeroes. This is
+	// only populated if zero detection was requested. When populated,
+	// these ranges are not included in Ranges.
+	ZeroRanges []DiskRange `json:"zero_ranges,omitempty"`
+	// NextPageToken is set when the number of ranges was capped. Pass it
+	// back as the pageToken query arg to fetch the next page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// ChangedRange is one entry of a changed ranges listing, in NDJSON format.
+type ChangedRange struct {
+	StartOffset uint64 `json:"start_offset"`
+	Length      uint64 `json:"length"`
+	// Zero is true if the range holds only zeroes.
+	Zero bool `json:"zero,omitempty"`
+}
+
+// OperationType is the kind of work an operation performs.
+type OperationType string
+
+const (
+	OperationTypeCreateSnapshot       OperationType = "create_snapshot"
+	OperationTypeDeleteSnapshot       OperationType = "delete_snapshot"
+	OperationTypeAddSnapStoreCapacity OperationType = "add_snap_store_capacity"
+)
+
+// OperationStatus is the status of an operation, or of one of its steps.
+type OperationStatus string
+
+const (
+	OperationStatusPending   OperationStatus = "pending"
+	OperationStatusRunning   OperationStatus = "running"
+	OperationStatusSucceeded OperationStatus = "succeeded"
+	OperationStatusFailed    OperationStatus = "failed"
+	OperationStatusCancelled OperationStatus = "cancelled"
+)
+
+// OperationStep is one step of an operation.
+type OperationStep struct {
+	Name       string          `json:"name"`
+	Status     OperationStatus `json:"status"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// OperationResponse holds the state of a long running operation.
+type OperationResponse struct {
+	ID string `json:"id"`
+	// RequestID is the ID of the API request that started the operation.
+	// Log lines written by the operation carry the same ID.
+	RequestID string          `json:"request_id,omitempty"`
+	Type      OperationType   `json:"type"`
+	Status    OperationStatus `json:"status"`
+	// ResourceID is the ID of the resource this operation acts upon. For
+	// snapshot creation, it is set once the snapshot is created.
+	ResourceID string          `json:"resource_id,omitempty"`
+	Steps      []OperationStep `json:"steps"`
+	Error      string          `json:"error,omitempty"`
+	// Result holds the resource that was created or updated by a successful
+	// operation.
+	Result    json.RawMessage `json:"result,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// Event is a notification sent to event stream subscribers.
+type Event struct {
+	// ID is a sequence number. It increases by one with every event, so
+	// subscribers can detect events they have missed.
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// Epoch identifies the agent process that sent the event. IDs start
+	// over at 1 when the agent restarts, and a new epoch begins.
+	Epoch string `json:"epoch"`
+	// Data holds one of the event payloads below, depending on Type.
+	Data json.RawMessage `json:"data"`
+}
+
+// SnapshotEvent is sent when a snapshot is created or deleted.
+type SnapshotEvent struct {
+	SnapshotID     string   `json:"snapshot_id"`
+	TrackedDiskIDs []string `json:"tracked_disk_ids,omitempty"`
+}
+
+// ResetEvent is sent to event stream clients that resume a stream of a previous
+// agent process. Events of that process are lost, and the client should refresh
+// its state through the API.
+type ResetEvent struct {
+	PreviousEventID string `json:"previous_event_id"`
+}
+
+// SnapStoreFileEvent is sent when a new file is added to a snap store.
+type SnapStoreFileEvent struct {
+	SnapStoreID string `json:"snap_store_id"`
+	FilePath    string `json:"file_path"`
+	FileSize    uint64 `json:"file_size"`
+	// FillStatus is the number of bytes used in the snap store, as reported
+	// by the kernel module. It is only set when the file was added in response
+	// to a half-fill event.
+	FillStatus *uint64 `json:"fill_status_bytes,omitempty"`
+}
+
+// SnapStoreOverflowEvent is sent when a snap store overflows. The snapshots
+// using that snap store are no longer valid.
+type SnapStoreOverflowEvent struct {
+	SnapStoreID string   `json:"snap_store_id"`
+	SnapshotIDs []string `json:"snapshot_ids"`
+	Error       string   `json:"error"`
+}
+
+// WatcherErrorEvent is sent when a snap store watcher encounters an error.
+type WatcherErrorEvent struct {
+	SnapStoreID string `json:"snap_store_id"`
+	Error       string `json:"error"`
+}
+
+// DiskEvent is sent when a block device is added to, or removed from, the system.
+type DiskEvent struct {
+	DevicePath string `json:"device_path"`
+	Major      uint32 `json:"major"`
+	Minor      uint32 `json:"minor"`
+}
+
+// ThrottleLimits are limits on snapshot reads. A limit of 0 means unlimited.
+type ThrottleLimits struct {
+	MaxStreams        int `json:"max_streams"`
+	MaxStreamsPerDisk int `json:"max_streams_per_disk"`
+	// MaxBandwidth and MaxBandwidthPerDisk are in MiB/s.
+	MaxBandwidth        int64 `json:"max_bandwidth_mib"`
+	MaxBandwidthPerDisk int64 `json:"max_bandwidth_per_disk_mib"`
+}
+
+// ThrottleSource is where the throttle limits in effect come from.
+type ThrottleSource string
+
+const (
+	ThrottleSourceConfig   ThrottleSource = "config"
+	ThrottleSourceSchedule ThrottleSource = "schedule"
+	ThrottleSourceOverride ThrottleSource = "override"
+)
+
+// ThrottleResponse holds the throttle limits in effect, and the number of
+// snapshot reads they apply to.
+type ThrottleResponse struct {
+	Limits ThrottleLimits `json:"limits"`
+	Source ThrottleSource `json:"source"`
+	// Schedule is the name of the active schedule, if Source is schedule.
+	Schedule string `json:"schedule,omitempty"`
+	// OverrideExpiresAt is set if Source is override, and the override
+	// was set with a duration.
+	OverrideExpiresAt *time.Time `json:"override_expires_at,omitempty"`
+	ActiveStreams     int        `json:"active_streams"`
+	QueuedStreams     int        `json:"queued_streams"`
+}
+
+// HealthStatus is the outcome of a health check.
+type HealthStatus string
+
+const (
+	HealthStatusOK     HealthStatus = "ok"
+	HealthStatusFailed HealthStatus = "failed"
+)
+
+// HealthCheck is the result of a single health check. Reason explains
+// why a check failed.
+type HealthCheck struct {
+	Name   string       `json:"name"`
+	Status HealthStatus `json:"status"`
+	Reason string       `json:"reason,omitempty"`
+}
+
+// HealthResponse holds the results of the health or readiness checks. Status
+// is failed if any of the checks failed.
+type HealthResponse struct {
+	Status HealthStatus  `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// AuditResult is the outcome of an audited call.
+type AuditResult string
+
+const (
+	AuditResultSuccess AuditResult = "success"
+	AuditResultFailure AuditResult = "failure"
+)
+
+// AuditEntry records an API call that changed the state of the agent, or
+// read snapshot data. Operations that run in the background are recorded
+// again when they finish, with no client.
+type AuditEntry struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// RequestID is the ID of the API request. Entries of background operations
+	// hold the ID of the request that started them.
+	RequestID string `json:"request_id,omitempty"`
+	// Client is the common name of the client certificate, or the name of
+	// the credential used to get a token.
+	Client     string `json:"client"`
+	AuthMethod string `json:"auth_method,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Operation is the method and route of the call, or the type of a
+	// background operation.
+	Operation string `json:"operation"`
+	// Parameters is the request body. Secrets are redacted.
+	Parameters json.RawMessage   `json:"parameters,omitempty"`
+	Query      map[string]string `json:"query,omitempty"`
+	// ResourceIDs holds the IDs of the resources the call acted upon.
+	ResourceIDs map[string]string `json:"resource_ids,omitempty"`
+	// Status is the HTTP status code of the response.
+	Status    int         `json:"status,omitempty"`
+	Result    AuditResult `json:"result"`
+	Error     string      `json:"error,omitempty"`
+	BytesSent int64       `json:"bytes_sent,omitempty"`
+	// Duration is the time it took to handle the call, in seconds.
+	Duration float64 `json:"duration_seconds"`
 }
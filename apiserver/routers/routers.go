@@ -18,23 +18,89 @@ package routers
 import (
 	"io"
 	"net/http"
+	"time"
 
+	"coriolis-snapshot-agent/apiserver/auth"
 	"coriolis-snapshot-agent/apiserver/controllers"
+	"coriolis-snapshot-agent/internal/audit"
+	"coriolis-snapshot-agent/internal/logging"
 
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
-// NewAPIRouter returns a new gorilla mux router.
-func NewAPIRouter(han *controllers.APIController, logWriter io.Writer) *mux.Router {
+// writeAccessLog logs a request that was served, with the request ID and the
+// other fields of the logger in the request context.
+func writeAccessLog(writer io.Writer, params gorillaHandlers.LogFormatterParams) {
+	req := params.Request
+	uri := req.RequestURI
+	if uri == "" {
+		uri = params.URL.RequestURI()
+	}
+	logger := logging.FromContext(req.Context()).WithOutput(writer).With(
+		"remote_addr", req.RemoteAddr,
+		"size", params.Size,
+		"duration_seconds", time.Since(params.TimeStamp).Seconds(),
+		"user_agent", req.UserAgent(),
+	)
+	logger.Infof("%s %s %s %d", req.Method, uri, req.Proto, params.StatusCode)
+}
+
+// NewAPIRouter returns a new gorilla mux router. Every request is checked
+// against the authorization policy. Requests that change the state of the agent,
+// or read snapshot data, are recorded in the audit log, if not nil. Every request
+// gets an ID, that is returned in the X-Request-ID header, and logged with the
+// lines written while serving it.
+func NewAPIRouter(han *controllers.APIController, policy *auth.Policy, auditLog *audit.Log, logWriter io.Writer) *mux.Router {
 	router := mux.NewRouter()
-	log := gorillaHandlers.CombinedLoggingHandler
+	router.Use(logging.RequestIDMiddleware)
+	// The audit log goes before the policy, so requests denied by the policy are recorded.
+	router.Use(auditLog.Middleware(policy))
+	router.Use(policy.Middleware)
+	log := func(out io.Writer, handler http.Handler) http.Handler {
+		return gorillaHandlers.CustomLoggingHandler(out, handler, writeAccessLog)
+	}
+
+	// Prometheus metrics.
+	router.Handle("/metrics", log(logWriter, http.HandlerFunc(han.MetricsHandler))).Methods("GET")
+
+	// Health and readiness checks.
+	router.Handle("/health", log(logWriter, http.HandlerFunc(han.HealthHandler))).Methods("GET")
+	router.Handle("/ready", log(logWriter, http.HandlerFunc(han.ReadyHandler))).Methods("GET")
 
 	apiSubRouter := router.PathPrefix("/api/v1").Subrouter()
 
 	// Private API endpoints
 	apiRouter := apiSubRouter.PathPrefix("").Subrouter()
 
+	// Snapshot read limits
+	apiRouter.Handle("/throttle", log(logWriter, http.HandlerFunc(han.GetThrottleHandler))).Methods("GET")
+	apiRouter.Handle("/throttle/", log(logWriter, http.HandlerFunc(han.GetThrottleHandler))).Methods("GET")
+	apiRouter.Handle("/throttle", log(logWriter, http.HandlerFunc(han.SetThrottleHandler))).Methods("PUT")
+	apiRouter.Handle("/throttle/", log(logWriter, http.HandlerFunc(han.SetThrottleHandler))).Methods("PUT")
+	apiRouter.Handle("/throttle", log(logWriter, http.HandlerFunc(han.RemoveThrottleHandler))).Methods("DELETE")
+	apiRouter.Handle("/throttle/", log(logWriter, http.HandlerFunc(han.RemoveThrottleHandler))).Methods("DELETE")
+
+	// Audit log
+	apiRouter.Handle("/audit", log(logWriter, http.HandlerFunc(han.QueryAuditLogHandler))).Methods("GET")
+	apiRouter.Handle("/audit/", log(logWriter, http.HandlerFunc(han.QueryAuditLogHandler))).Methods("GET")
+
+	// Token authentication
+	apiRouter.Handle("/auth/login", log(logWriter, http.HandlerFunc(han.LoginHandler))).Methods("POST")
+	apiRouter.Handle("/auth/login/", log(logWriter, http.HandlerFunc(han.LoginHandler))).Methods("POST")
+
+	apiRouter.Handle("/auth/logout", log(logWriter, http.HandlerFunc(han.LogoutHandler))).Methods("POST")
+	apiRouter.Handle("/auth/logout/", log(logWriter, http.HandlerFunc(han.LogoutHandler))).Methods("POST")
+
+	apiRouter.Handle("/auth/tokens", log(logWriter, http.HandlerFunc(han.ListTokensHandler))).Methods("GET")
+	apiRouter.Handle("/auth/tokens/", log(logWriter, http.HandlerFunc(han.ListTokensHandler))).Methods("GET")
+
+	apiRouter.Handle("/auth/tokens/{tokenID}", log(logWriter, http.HandlerFunc(han.RevokeTokenHandler))).Methods("DELETE")
+	apiRouter.Handle("/auth/tokens/{tokenID}/", log(logWriter, http.HandlerFunc(han.RevokeTokenHandler))).Methods("DELETE")
+
+	// API description
+	apiRouter.Handle("/openapi.json", log(logWriter, http.HandlerFunc(han.OpenAPIHandler))).Methods("GET")
+
 	// list disks
 	apiRouter.Handle("/disks", log(logWriter, http.HandlerFunc(han.ListDisksHandler))).Methods("GET")
 	apiRouter.Handle("/disks/", log(logWriter, http.HandlerFunc(han.ListDisksHandler))).Methods("GET")
@@ -43,10 +109,17 @@ func NewAPIRouter(han *controllers.APIController, logWriter io.Writer) *mux.Rout
 	apiRouter.Handle("/disks/{diskTrackingID}", log(logWriter, http.HandlerFunc(han.GetDiskHandler))).Methods("GET")
 	apiRouter.Handle("/disks/{diskTrackingID}/", log(logWriter, http.HandlerFunc(han.GetDiskHandler))).Methods("GET")
 
+	// Add a disk to tracking.
+	apiRouter.Handle("/disks", log(logWriter, http.HandlerFunc(han.AddTrackedDiskHandler))).Methods("POST")
+	apiRouter.Handle("/disks/", log(logWriter, http.HandlerFunc(han.AddTrackedDiskHandler))).Methods("POST")
+
+	// Remove a disk from tracking. Disks with snapshots or snap stores cannot be removed.
+	apiRouter.Handle("/disks/{diskTrackingID}", log(logWriter, http.HandlerFunc(han.RemoveTrackedDiskHandler))).Methods("DELETE")
+	apiRouter.Handle("/disks/{diskTrackingID}/", log(logWriter, http.HandlerFunc(han.RemoveTrackedDiskHandler))).Methods("DELETE")
+
 	///////////////
 	// Snapshots //
 	///////////////
-	// view or delete a single snapshot.
 	// Create and view snapshots endpoint.
 	apiRouter.Handle("/snapshots", log(logWriter, http.HandlerFunc(han.ListSnapshotsHandler))).Methods("GET")
 	apiRouter.Handle("/snapshots/", log(logWriter, http.HandlerFunc(han.ListSnapshotsHandler))).Methods("GET")
@@ -54,29 +127,67 @@ func NewAPIRouter(han *controllers.APIController, logWriter io.Writer) *mux.Rout
 	apiRouter.Handle("/snapshots", log(logWriter, http.HandlerFunc(han.CreateSnapshotHandler))).Methods("POST")
 	apiRouter.Handle("/snapshots/", log(logWriter, http.HandlerFunc(han.CreateSnapshotHandler))).Methods("POST")
 
+	// view or delete a single snapshot.
 	apiRouter.Handle("/snapshots/{snapshotID}", log(logWriter, http.HandlerFunc(han.DeleteSnapshotHandler))).Methods("DELETE")
 	apiRouter.Handle("/snapshots/{snapshotID}/", log(logWriter, http.HandlerFunc(han.DeleteSnapshotHandler))).Methods("DELETE")
 
 	apiRouter.Handle("/snapshots/{snapshotID}", log(logWriter, http.HandlerFunc(han.GetSnapshotHandler))).Methods("GET")
 	apiRouter.Handle("/snapshots/{snapshotID}/", log(logWriter, http.HandlerFunc(han.GetSnapshotHandler))).Methods("GET")
 
-	apiRouter.Handle("/snapshots/{snapshotID}", log(logWriter, http.HandlerFunc(han.DeleteSnapshotHandler))).Methods("DELETE")
-	apiRouter.Handle("/snapshots/{snapshotID}/", log(logWriter, http.HandlerFunc(han.DeleteSnapshotHandler))).Methods("DELETE")
-
 	apiRouter.Handle("/snapshots/{snapshotID}/changes/{trackedDiskID}", log(logWriter, http.HandlerFunc(han.GetChangedSectorsHandler))).Methods("GET")
 	apiRouter.Handle("/snapshots/{snapshotID}/changes/{trackedDiskID}/", log(logWriter, http.HandlerFunc(han.GetChangedSectorsHandler))).Methods("GET")
 
 	apiRouter.Handle("/snapshots/{snapshotID}/consume/{trackedDiskID}", log(logWriter, http.HandlerFunc(han.ConsumeSnapshotHandler))).Methods("GET", "HEAD")
 	apiRouter.Handle("/snapshots/{snapshotID}/consume/{trackedDiskID}/", log(logWriter, http.HandlerFunc(han.ConsumeSnapshotHandler))).Methods("GET", "HEAD")
 
+	apiRouter.Handle("/snapshots/{snapshotID}/stream/{trackedDiskID}", log(logWriter, http.HandlerFunc(han.StreamChangedSectorsHandler))).Methods("GET")
+	apiRouter.Handle("/snapshots/{snapshotID}/stream/{trackedDiskID}/", log(logWriter, http.HandlerFunc(han.StreamChangedSectorsHandler))).Methods("GET")
+
+	apiRouter.Handle("/snapshots/{snapshotID}/checksums/{trackedDiskID}", log(logWriter, http.HandlerFunc(han.ChecksumManifestHandler))).Methods("GET")
+	apiRouter.Handle("/snapshots/{snapshotID}/checksums/{trackedDiskID}/", log(logWriter, http.HandlerFunc(han.ChecksumManifestHandler))).Methods("GET")
+
+	apiRouter.Handle("/snapshots/{snapshotID}/bitmap/{trackedDiskID}", log(logWriter, http.HandlerFunc(han.GetCBTBitmapHandler))).Methods("GET", "HEAD")
+	apiRouter.Handle("/snapshots/{snapshotID}/bitmap/{trackedDiskID}/", log(logWriter, http.HandlerFunc(han.GetCBTBitmapHandler))).Methods("GET", "HEAD")
+
+	// operations
+	apiRouter.Handle("/operations", log(logWriter, http.HandlerFunc(han.ListOperationsHandler))).Methods("GET")
+	apiRouter.Handle("/operations/", log(logWriter, http.HandlerFunc(han.ListOperationsHandler))).Methods("GET")
+
+	apiRouter.Handle("/operations/{operationID}", log(logWriter, http.HandlerFunc(han.GetOperationHandler))).Methods("GET")
+	apiRouter.Handle("/operations/{operationID}/", log(logWriter, http.HandlerFunc(han.GetOperationHandler))).Methods("GET")
+
+	apiRouter.Handle("/operations/{operationID}/cancel", log(logWriter, http.HandlerFunc(han.CancelOperationHandler))).Methods("POST")
+	apiRouter.Handle("/operations/{operationID}/cancel/", log(logWriter, http.HandlerFunc(han.CancelOperationHandler))).Methods("POST")
+
+	// events
+	apiRouter.Handle("/events", log(logWriter, http.HandlerFunc(han.EventsHandler))).Methods("GET")
+	apiRouter.Handle("/events/", log(logWriter, http.HandlerFunc(han.EventsHandler))).Methods("GET")
+
 	// snap store management.
 	// Read snap stores
 	apiRouter.Handle("/snapstores", log(logWriter, http.HandlerFunc(han.ListSnapStoreHandler))).Methods("GET")
 	apiRouter.Handle("/snapstores/", log(logWriter, http.HandlerFunc(han.ListSnapStoreHandler))).Methods("GET")
 
+	apiRouter.Handle("/snapstores/{snapStoreID}", log(logWriter, http.HandlerFunc(han.GetSnapStoreHandler))).Methods("GET")
+	apiRouter.Handle("/snapstores/{snapStoreID}/", log(logWriter, http.HandlerFunc(han.GetSnapStoreHandler))).Methods("GET")
+
+	apiRouter.Handle("/snapstores/{snapStoreID}/capacity", log(logWriter, http.HandlerFunc(han.AddSnapStoreCapacityHandler))).Methods("POST")
+	apiRouter.Handle("/snapstores/{snapStoreID}/capacity/", log(logWriter, http.HandlerFunc(han.AddSnapStoreCapacityHandler))).Methods("POST")
+
 	apiRouter.Handle("/snapstorelocations", log(logWriter, http.HandlerFunc(han.ListSnapStoreLocations))).Methods("GET")
 	apiRouter.Handle("/snapstorelocations/", log(logWriter, http.HandlerFunc(han.ListSnapStoreLocations))).Methods("GET")
 
+	apiRouter.Handle("/snapstorelocations", log(logWriter, http.HandlerFunc(han.AddSnapStoreLocationHandler))).Methods("POST")
+	apiRouter.Handle("/snapstorelocations/", log(logWriter, http.HandlerFunc(han.AddSnapStoreLocationHandler))).Methods("POST")
+
+	// Snap store locations are identified by their path, with the leading slash omitted.
+	apiRouter.Handle("/snapstorelocations/{locationPath:.+}/drain", log(logWriter, http.HandlerFunc(han.DrainSnapStoreLocationHandler))).Methods("POST")
+	apiRouter.Handle("/snapstorelocations/{locationPath:.+}/drain/", log(logWriter, http.HandlerFunc(han.DrainSnapStoreLocationHandler))).Methods("POST")
+
+	apiRouter.Handle("/snapstorelocations/{locationPath:.+}", log(logWriter, http.HandlerFunc(han.GetSnapStoreLocationHandler))).Methods("GET")
+	apiRouter.Handle("/snapstorelocations/{locationPath:.+}", log(logWriter, http.HandlerFunc(han.UpdateSnapStoreLocationHandler))).Methods("PUT")
+	apiRouter.Handle("/snapstorelocations/{locationPath:.+}", log(logWriter, http.HandlerFunc(han.RemoveSnapStoreLocationHandler))).Methods("DELETE")
+
 	// snap store mappings
 	apiRouter.Handle("/snapstoremappings", log(logWriter, http.HandlerFunc(han.ListSnapStoreMappingsHandler))).Methods("GET")
 	apiRouter.Handle("/snapstoremappings/", log(logWriter, http.HandlerFunc(han.ListSnapStoreMappingsHandler))).Methods("GET")
@@ -84,6 +195,15 @@ func NewAPIRouter(han *controllers.APIController, logWriter io.Writer) *mux.Rout
 	apiRouter.Handle("/snapstoremappings", log(logWriter, http.HandlerFunc(han.CreateSnapStoreMappingHandler))).Methods("POST")
 	apiRouter.Handle("/snapstoremappings/", log(logWriter, http.HandlerFunc(han.CreateSnapStoreMappingHandler))).Methods("POST")
 
+	apiRouter.Handle("/snapstoremappings/{mappingID}", log(logWriter, http.HandlerFunc(han.GetSnapStoreMappingHandler))).Methods("GET")
+	apiRouter.Handle("/snapstoremappings/{mappingID}/", log(logWriter, http.HandlerFunc(han.GetSnapStoreMappingHandler))).Methods("GET")
+
+	apiRouter.Handle("/snapstoremappings/{mappingID}", log(logWriter, http.HandlerFunc(han.UpdateSnapStoreMappingHandler))).Methods("PUT")
+	apiRouter.Handle("/snapstoremappings/{mappingID}/", log(logWriter, http.HandlerFunc(han.UpdateSnapStoreMappingHandler))).Methods("PUT")
+
+	apiRouter.Handle("/snapstoremappings/{mappingID}", log(logWriter, http.HandlerFunc(han.DeleteSnapStoreMappingHandler))).Methods("DELETE")
+	apiRouter.Handle("/snapstoremappings/{mappingID}/", log(logWriter, http.HandlerFunc(han.DeleteSnapStoreMappingHandler))).Methods("DELETE")
+
 	// System info
 	apiRouter.Handle("/systeminfo", log(logWriter, http.HandlerFunc(han.SystemInfoHandler))).Methods("GET")
 	apiRouter.Handle("/systeminfo/", log(logWriter, http.HandlerFunc(han.SystemInfoHandler))).Methods("GET")
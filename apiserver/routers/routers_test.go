@@ -0,0 +1,102 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package routers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-snapshot-agent/apiserver/auth"
+	"coriolis-snapshot-agent/apiserver/controllers"
+	"coriolis-snapshot-agent/apiserver/openapi"
+	"coriolis-snapshot-agent/config"
+)
+
+// routeVarPattern matches route variables that have a pattern, like {locationPath:.+}.
+var routeVarPattern = regexp.MustCompile(`\{([^:}]+):[^}]*\}`)
+
+// specPath converts a route template to the form used in the OpenAPI document.
+func specPath(tpl string) string {
+	path := routeVarPattern.ReplaceAllString(tpl, "{$1}")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	return path
+}
+
+func TestRoutesMatchOpenAPISpec(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openapi.Spec, &spec); err != nil {
+		t.Fatalf("failed to parse OpenAPI spec: %s", err)
+	}
+
+	policy, err := auth.NewPolicy(config.Authorization{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewAPIRouter(&controllers.APIController{}, policy, nil, ioutil.Discard)
+
+	registered := map[string]bool{}
+	routed := map[string]bool{}
+	err = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouters and the not found handler match any method.
+			return nil
+		}
+
+		path := specPath(tpl)
+		for _, method := range methods {
+			key := method + " " + tpl
+			if registered[key] {
+				t.Errorf("route %s is registered more than once", key)
+			}
+			registered[key] = true
+
+			method = strings.ToLower(method)
+			routed[method+" "+path] = true
+			if _, ok := spec.Paths[path][method]; !ok {
+				t.Errorf("route %s %s is missing from the OpenAPI spec", strings.ToUpper(method), tpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk router: %s", err)
+	}
+
+	for path, item := range spec.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			if !routed[method+" "+path] {
+				t.Errorf("%s %s is in the OpenAPI spec, but is not routed", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"sort"
+	"strings"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+var (
+	auditQuery params.AuditQuery
+	auditSince string
+	auditUntil string
+)
+
+// parseAuditTime parses an RFC3339 timestamp. An empty value returns nil.
+func parseAuditTime(name, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, vErrors.NewValueError("invalid -%s %q, expected an RFC3339 timestamp", name, value)
+	}
+	return &parsed, nil
+}
+
+// formatResourceIDs formats resource IDs as a sorted list of name=value pairs.
+func formatResourceIDs(ids map[string]string) string {
+	pairs := make([]string, 0, len(ids))
+	for name, id := range ids {
+		pairs = append(pairs, name+"="+id)
+	}
+	sort.Strings(pairs)
+	return valueOrDash(strings.Join(pairs, ","))
+}
+
+var auditCmd = command{
+	description: "Show the most recent audit log entries, oldest first.",
+	maxArgs:     0,
+	setFlags: func(fs *flag.FlagSet) {
+		fs.StringVar(&auditQuery.Client, "client", "", "only show calls made by this client")
+		fs.StringVar(&auditQuery.Operation, "operation", "", "only show operations that contain this text, like /snapshots or create_snapshot")
+		fs.StringVar(&auditQuery.ResourceID, "resource-id", "", "only show calls that affected this resource")
+		fs.StringVar(&auditSince, "since", "", "only show entries recorded after this RFC3339 timestamp")
+		fs.StringVar(&auditUntil, "until", "", "only show entries recorded before this RFC3339 timestamp")
+		fs.IntVar(&auditQuery.Limit, "limit", 0, "largest number of entries to show. The agent defaults to 100")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		var err error
+		if auditQuery.Since, err = parseAuditTime("since", auditSince); err != nil {
+			return err
+		}
+		if auditQuery.Until, err = parseAuditTime("until", auditUntil); err != nil {
+			return err
+		}
+
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		entries, err := cli.QueryAuditLog(ctx, auditQuery)
+		if err != nil {
+			return err
+		}
+		return env.print(entries, []string{"TIME", "CLIENT", "OPERATION", "RESOURCES", "RESULT", "ERROR"}, func(add func(cells ...interface{})) {
+			for _, entry := range entries {
+				add(entry.Time.Format(time.RFC3339), valueOrDash(entry.Client), entry.Operation, formatResourceIDs(entry.ResourceIDs), entry.Result, valueOrDash(entry.Error))
+			}
+		})
+	},
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+var tokenLifetime int
+
+// readSecret reads a secret from the first line of the standard input.
+func (e *environment) readSecret() (string, error) {
+	line, err := bufio.NewReader(e.in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.Wrap(err, "reading secret")
+	}
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return "", vErrors.NewValueError("empty secret")
+	}
+	return secret, nil
+}
+
+var authLoginCmd = command{
+	usage:       "<credential name>",
+	description: "Log in with a credential, and print the API token. The secret is read from the standard input.",
+	minArgs:     1,
+	maxArgs:     1,
+	setFlags: func(fs *flag.FlagSet) {
+		fs.IntVar(&tokenLifetime, "lifetime", 0, "token lifetime in seconds. Defaults to the token lifetime set in the agent config")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		secret, err := env.readSecret()
+		if err != nil {
+			return err
+		}
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		resp, err := cli.Login(ctx, args[0], secret, tokenLifetime)
+		if err != nil {
+			return err
+		}
+		return env.print(resp, []string{"TOKEN ID", "EXPIRES AT", "TOKEN"}, func(add func(cells ...interface{})) {
+			add(resp.TokenID, resp.ExpiresAt.Format(time.RFC3339), resp.Token)
+		})
+	},
+}
+
+var authLogoutCmd = command{
+	description: "Revoke the token passed with -token.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		if env.token == "" {
+			return vErrors.NewValueError("logout requires -token")
+		}
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		return cli.Logout(ctx)
+	},
+}
+
+func printTokens(env *environment, tokens []params.TokenResponse) error {
+	return env.print(tokens, []string{"ID", "NAME", "ISSUED AT", "EXPIRES AT", "REVOKED"}, func(add func(cells ...interface{})) {
+		for _, token := range tokens {
+			add(token.ID, token.Name, token.IssuedAt.Format(time.RFC3339), token.ExpiresAt.Format(time.RFC3339), token.Revoked)
+		}
+	})
+}
+
+var authTokensCmd = command{
+	description: "List the API tokens that have not yet expired.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		tokens, err := cli.ListTokens(ctx)
+		if err != nil {
+			return err
+		}
+		return printTokens(env, tokens)
+	},
+}
+
+var authRevokeCmd = command{
+	usage:       "<token ID>",
+	description: "Revoke an API token.",
+	minArgs:     1,
+	maxArgs:     1,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		token, err := cli.RevokeToken(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return printTokens(env, []params.TokenResponse{token})
+	},
+}
+
+var authHashSecretCmd = command{
+	description: "Print the hash of a credential secret, to be used in the agent config. The secret is read from the standard input.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		secret, err := env.readSecret()
+		if err != nil {
+			return err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return errors.Wrap(err, "hashing secret")
+		}
+		fmt.Fprintln(env.out, string(hash))
+		return nil
+	},
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"math"
+	"sort"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/client"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+var (
+	previousGenerationID string
+	previousNumber       uint
+	allocatedOnly        bool
+	detectZeroes         bool
+)
+
+func setPreviousSnapshotFlags(fs *flag.FlagSet) {
+	fs.StringVar(&previousGenerationID, "previous-generation-id", "", "generation ID of the snapshot to compare against. If not set, all ranges of the disk are used")
+	fs.UintVar(&previousNumber, "previous-number", 0, "number of the snapshot to compare against")
+	fs.BoolVar(&allocatedOnly, "allocated-only", false, "skip ranges that are not allocated by a known filesystem, when all ranges of the disk are used")
+}
+
+func changesOptions() (client.ChangesOptions, error) {
+	if previousNumber > math.MaxUint32 {
+		return client.ChangesOptions{}, vErrors.NewValueError("invalid snapshot number %d", previousNumber)
+	}
+	return client.ChangesOptions{
+		PreviousGenerationID: previousGenerationID,
+		PreviousNumber:       uint32(previousNumber),
+		AllocatedOnly:        allocatedOnly,
+		DetectZeroes:         detectZeroes,
+	}, nil
+}
+
+// listChanges fetches all pages of changed ranges.
+func listChanges(ctx context.Context, cli *client.Client, snapshotID, diskID string, opts client.ChangesOptions) (params.ChangesResponse, error) {
+	var ret params.ChangesResponse
+	for {
+		changes, err := cli.GetChangedSectors(ctx, snapshotID, diskID, opts)
+		if err != nil {
+			return params.ChangesResponse{}, err
+		}
+		ranges := append(ret.Ranges, changes.Ranges...)
+		zeroRanges := append(ret.ZeroRanges, changes.ZeroRanges...)
+		ret = changes
+		ret.Ranges = ranges
+		ret.ZeroRanges = zeroRanges
+
+		if changes.NextPageToken == "" {
+			ret.NextPageToken = ""
+			return ret, nil
+		}
+		opts.PageToken = changes.NextPageToken
+	}
+}
+
+var changesCmd = command{
+	usage:       "SNAPSHOT_ID DISK_ID",
+	description: "List the ranges of a disk that changed since a previous snapshot.",
+	minArgs:     2,
+	maxArgs:     2,
+	setFlags: func(fs *flag.FlagSet) {
+		setPreviousSnapshotFlags(fs)
+		fs.BoolVar(&detectZeroes, "detect-zeroes", false, "show ranges that hold only zeroes separately")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		opts, err := changesOptions()
+		if err != nil {
+			return err
+		}
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		changes, err := listChanges(ctx, cli, args[0], args[1], opts)
+		if err != nil {
+			return err
+		}
+
+		rows := make([]params.ChangedRange, 0, len(changes.Ranges)+len(changes.ZeroRanges))
+		for _, rng := range changes.Ranges {
+			rows = append(rows, params.ChangedRange{StartOffset: rng.StartOffset, Length: rng.Length})
+		}
+		for _, rng := range changes.ZeroRanges {
+			rows = append(rows, params.ChangedRange{StartOffset: rng.StartOffset, Length: rng.Length, Zero: true})
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i].StartOffset < rows[j].StartOffset
+		})
+		return env.print(changes, []string{"START", "LENGTH", "ZERO"}, func(add func(cells ...interface{})) {
+			for _, rng := range rows {
+				add(rng.StartOffset, rng.Length, rng.Zero)
+			}
+		})
+	},
+}
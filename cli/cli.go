@@ -0,0 +1,279 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package cli implements the subcommands used to manage a running agent
+// through its API.
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/client"
+	"coriolis-snapshot-agent/config"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// command is a subcommand. The run function gets the arguments left after
+// parsing flags.
+type command struct {
+	usage       string
+	description string
+	// minArgs and maxArgs are the number of arguments the command accepts.
+	// A maxArgs of -1 means there is no upper limit.
+	minArgs  int
+	maxArgs  int
+	setFlags func(fs *flag.FlagSet)
+	run      func(ctx context.Context, env *environment, args []string) error
+}
+
+// environment holds the settings shared by all subcommands.
+type environment struct {
+	configFile string
+
+	endpoint string
+	cert     string
+	key      string
+	caCert   string
+	token    string
+	format   string
+
+	in  io.Reader
+	out io.Writer
+}
+
+func (e *environment) setFlags(fs *flag.FlagSet) {
+	fs.StringVar(&e.endpoint, "endpoint", "", "agent API endpoint (https://host:port). Defaults to the address in the agent config")
+	fs.StringVar(&e.cert, "cert", "", "client certificate. Defaults to the certificate in the agent config")
+	fs.StringVar(&e.key, "key", "", "client certificate key. Defaults to the key in the agent config")
+	fs.StringVar(&e.caCert, "cacert", "", "CA certificate used to validate the agent. Defaults to the CA certificate in the agent config")
+	fs.StringVar(&e.token, "token", "", "API token. Clients that send a token do not need a client certificate")
+	fs.StringVar(&e.format, "format", formatTable, "output format (table or json)")
+}
+
+// client returns an API client. Settings that were not passed as flags are
+// read from the agent config file, which makes it possible to run commands on
+// the agent host without any arguments. When a token is passed, the client
+// certificate is only sent if it was passed as a flag.
+func (e *environment) client() (*client.Client, error) {
+	tlsConfig := config.TLSConfig{
+		Cert:   e.cert,
+		Key:    e.key,
+		CACert: e.caCert,
+	}
+	endpoint := e.endpoint
+	useCert := e.token == "" && (tlsConfig.Cert == "" || tlsConfig.Key == "")
+
+	if endpoint == "" || useCert || tlsConfig.CACert == "" {
+		cfg, err := config.ParseConfig(e.configFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing config %s", e.configFile)
+		}
+		if endpoint == "" {
+			endpoint = agentEndpoint(cfg.APIServer)
+		}
+		if useCert && tlsConfig.Cert == "" {
+			tlsConfig.Cert = cfg.APIServer.TLSConfig.Cert
+		}
+		if useCert && tlsConfig.Key == "" {
+			tlsConfig.Key = cfg.APIServer.TLSConfig.Key
+		}
+		if tlsConfig.CACert == "" {
+			tlsConfig.CACert = cfg.APIServer.TLSConfig.CACert
+		}
+	}
+
+	cli, err := client.NewClient(endpoint, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	cli.Token = e.token
+	return cli, nil
+}
+
+// agentEndpoint returns the URL of an agent that listens on the address in
+// the API server config. Agents that listen on all addresses are reached
+// through the loopback interface.
+func agentEndpoint(apiServer config.APIServer) string {
+	host := apiServer.Bind
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return fmt.Sprintf("https://%s", net.JoinHostPort(host, fmt.Sprintf("%d", apiServer.Port)))
+}
+
+// print writes data as indented JSON, or as a table with the given header. The
+// rows function adds the rows of the table.
+func (e *environment) print(data interface{}, header []string, rows func(add func(cells ...interface{}))) error {
+	switch e.format {
+	case formatJSON:
+		enc := json.NewEncoder(e.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	case formatTable:
+		w := tabwriter.NewWriter(e.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		rows(func(cells ...interface{}) {
+			asStrings := make([]string, len(cells))
+			for idx, cell := range cells {
+				asStrings[idx] = fmt.Sprintf("%v", cell)
+			}
+			fmt.Fprintln(w, strings.Join(asStrings, "\t"))
+		})
+		return w.Flush()
+	default:
+		return vErrors.NewValueError("invalid output format %q", e.format)
+	}
+}
+
+// commands holds all subcommands, by group and name. Commands that have no
+// group are registered under the empty name.
+var commands = map[string]map[string]command{
+	"audit": {
+		"": auditCmd,
+	},
+	"auth": {
+		"login":       authLoginCmd,
+		"logout":      authLogoutCmd,
+		"tokens":      authTokensCmd,
+		"revoke":      authRevokeCmd,
+		"hash-secret": authHashSecretCmd,
+	},
+	"disks": {
+		"list": disksListCmd,
+	},
+	"snapshots": {
+		"list":   snapshotsListCmd,
+		"show":   snapshotsShowCmd,
+		"create": snapshotsCreateCmd,
+		"delete": snapshotsDeleteCmd,
+	},
+	"snapstores": {
+		"list": snapStoresListCmd,
+	},
+	"changes": {
+		"": changesCmd,
+	},
+	"download": {
+		"": downloadCmd,
+	},
+	"health": {
+		"": healthCmd,
+	},
+	"ready": {
+		"": readyCmd,
+	},
+	"throttle": {
+		"show":  throttleShowCmd,
+		"set":   throttleSetCmd,
+		"clear": throttleClearCmd,
+	},
+}
+
+// Usage writes the list of subcommands to w.
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "Commands:\n")
+	var groups []string
+	for group := range commands {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, group := range groups {
+		var names []string
+		for name := range commands[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd := commands[group][name]
+			fmt.Fprintf(tw, "  %s\t%s\n", strings.Join(strings.Fields(group+" "+name+" "+cmd.usage), " "), cmd.description)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun a command with -h to see its flags.\n")
+}
+
+// Run runs the subcommand in args. Settings that are not passed as flags are
+// read from the agent config in configFile.
+func Run(ctx context.Context, configFile string, args []string) error {
+	if len(args) == 0 {
+		return vErrors.NewValueError("missing command")
+	}
+
+	group, ok := commands[args[0]]
+	if !ok {
+		return vErrors.NewValueError("unknown command %q", args[0])
+	}
+	name := args[0]
+	args = args[1:]
+
+	cmd, ok := group[""]
+	if !ok {
+		if len(args) == 0 {
+			return vErrors.NewValueError("missing %s subcommand", name)
+		}
+		cmd, ok = group[args[0]]
+		if !ok {
+			return vErrors.NewValueError("unknown %s subcommand %q", name, args[0])
+		}
+		name = name + " " + args[0]
+		args = args[1:]
+	}
+
+	env := &environment{
+		configFile: configFile,
+		in:         os.Stdin,
+		out:        os.Stdout,
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] %s\n\n%s\n\nFlags:\n", name, cmd.usage, cmd.description)
+		fs.PrintDefaults()
+	}
+	env.setFlags(fs)
+	if cmd.setFlags != nil {
+		cmd.setFlags(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+
+	cmdArgs := fs.Args()
+	if len(cmdArgs) < cmd.minArgs || (cmd.maxArgs >= 0 && len(cmdArgs) > cmd.maxArgs) {
+		fs.Usage()
+		return vErrors.NewValueError("wrong number of arguments for %s", name)
+	}
+	return cmd.run(ctx, env, cmdArgs)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+var (
+	includeVirtual bool
+	includeSwap    bool
+)
+
+var disksListCmd = command{
+	description: "List the disks of the agent host. Tracked disks have an ID.",
+	maxArgs:     0,
+	setFlags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&includeVirtual, "virtual", false, "include virtual disks")
+		fs.BoolVar(&includeSwap, "swap", false, "include swap disks")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		disks, err := cli.ListDisks(ctx, includeVirtual, includeSwap)
+		if err != nil {
+			return err
+		}
+		return env.print(disks, []string{"ID", "PATH", "SIZE", "DEVICE", "PARTITIONS", "VIRTUAL"}, func(add func(cells ...interface{})) {
+			for _, disk := range disks {
+				add(valueOrDash(disk.TrackingID), disk.Path, disk.Size, devNumber(disk), len(disk.Partitions), disk.IsVirtual)
+			}
+		})
+	},
+}
+
+func devNumber(disk params.BlockVolume) string {
+	return fmt.Sprintf("%d:%d", disk.Major, disk.Minor)
+}
+
+func valueOrDash(val string) string {
+	if val == "" {
+		return "-"
+	}
+	return val
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// downloadChunkSize is the size of the reads used to download changed ranges.
+const downloadChunkSize = 4 * 1024 * 1024
+
+var output string
+
+// downloadCmd downloads a disk snapshot. When a previous snapshot is given, only
+// the ranges that changed since then are written to the output file, which should
+// already hold the data of the previous snapshot.
+var downloadCmd = command{
+	usage:       "SNAPSHOT_ID DISK_ID",
+	description: "Download a disk snapshot, or the ranges that changed since a previous snapshot.",
+	minArgs:     2,
+	maxArgs:     2,
+	setFlags: func(fs *flag.FlagSet) {
+		setPreviousSnapshotFlags(fs)
+		fs.StringVar(&output, "output", "", "file the data is written to. Use - for stdout, when downloading the whole disk")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		if output == "" {
+			return vErrors.NewValueError("missing output file")
+		}
+		opts, err := changesOptions()
+		if err != nil {
+			return err
+		}
+		if output == "-" && opts.PreviousGenerationID != "" {
+			return vErrors.NewValueError("changed ranges can only be written to a file")
+		}
+
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		reader, err := cli.OpenSnapshot(ctx, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		var written int64
+		if opts.PreviousGenerationID == "" {
+			written, err = downloadDisk(reader, output)
+		} else {
+			changes, listErr := listChanges(ctx, cli, args[0], args[1], opts)
+			if listErr != nil {
+				return listErr
+			}
+			written, err = downloadRanges(reader, changes.Ranges, output)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "wrote %d bytes to %s\n", written, output)
+		return nil
+	},
+}
+
+// downloadDisk writes the whole disk to path.
+func downloadDisk(reader io.Reader, path string) (int64, error) {
+	if path == "-" {
+		return io.Copy(os.Stdout, reader)
+	}
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening output file")
+	}
+	written, err := io.Copy(fp, reader)
+	if err != nil {
+		fp.Close()
+		return written, errors.Wrap(err, "downloading snapshot")
+	}
+	return written, errors.Wrap(fp.Close(), "closing output file")
+}
+
+// rangeReader reads ranges of a snapshot.
+type rangeReader interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// downloadRanges writes the given ranges of a disk at the same offsets in the
+// file at path. Data outside those ranges is left untouched.
+func downloadRanges(reader rangeReader, ranges []params.DiskRange, path string) (int64, error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "opening output file")
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "fetching output file info")
+	}
+	if info.Mode().IsRegular() && info.Size() < reader.Size() {
+		if err := fp.Truncate(reader.Size()); err != nil {
+			return 0, errors.Wrap(err, "resizing output file")
+		}
+	}
+
+	var written int64
+	buf := make([]byte, downloadChunkSize)
+	for _, rng := range ranges {
+		offset := int64(rng.StartOffset)
+		end := offset + int64(rng.Length)
+		for offset < end {
+			chunk := buf
+			if remaining := end - offset; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+			n, err := reader.ReadAt(chunk, offset)
+			if err != nil && !(errors.Is(err, io.EOF) && n == len(chunk)) {
+				return written, errors.Wrapf(err, "reading snapshot at offset %d", offset)
+			}
+			if _, err := fp.WriteAt(chunk[:n], offset); err != nil {
+				return written, errors.Wrapf(err, "writing output file at offset %d", offset)
+			}
+			offset += int64(n)
+			written += int64(n)
+		}
+	}
+	return written, errors.Wrap(fp.Close(), "closing output file")
+}
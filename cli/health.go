@@ -0,0 +1,73 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// printHealth prints the result of the health checks. It returns an error if
+// any check failed, so the command exits with a non zero code.
+func printHealth(env *environment, health params.HealthResponse) error {
+	err := env.print(health, []string{"CHECK", "STATUS", "REASON"}, func(add func(cells ...interface{})) {
+		for _, check := range health.Checks {
+			add(check.Name, check.Status, check.Reason)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if health.Status != params.HealthStatusOK {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+var healthCmd = command{
+	description: "Check whether the agent is alive.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		health, err := cli.Health(ctx)
+		if err != nil {
+			return err
+		}
+		return printHealth(env, health)
+	},
+}
+
+var readyCmd = command{
+	description: "Check whether the agent is ready to serve requests.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		health, err := cli.Ready(ctx)
+		if err != nil {
+			return err
+		}
+		return printHealth(env, health)
+	},
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+	"flag"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/client"
+)
+
+// noWait makes create and delete return as soon as the operation is started.
+var noWait bool
+
+func printSnapshots(env *environment, snapshots []params.SnapshotResponse) error {
+	return env.print(snapshots, []string{"SNAPSHOT", "DISK", "DEVICE", "IMAGE", "GENERATION", "NUMBER"}, func(add func(cells ...interface{})) {
+		for _, snapshot := range snapshots {
+			for _, vol := range snapshot.VolumeSnapshots {
+				add(snapshot.SnapshotID, vol.OriginalDevice.TrackingID, vol.OriginalDevice.DevicePath, vol.SnapshotImage.DevicePath, vol.GenerationID, vol.SnapshotNumber)
+			}
+		}
+	})
+}
+
+func printOperations(env *environment, operations []params.OperationResponse) error {
+	return env.print(operations, []string{"OPERATION", "TYPE", "STATUS", "RESOURCE", "ERROR"}, func(add func(cells ...interface{})) {
+		for _, op := range operations {
+			add(op.ID, op.Type, op.Status, valueOrDash(op.ResourceID), valueOrDash(op.Error))
+		}
+	})
+}
+
+var snapshotsListCmd = command{
+	description: "List snapshots. Every disk in a snapshot is shown on its own row.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		snapshots, err := cli.ListSnapshots(ctx)
+		if err != nil {
+			return err
+		}
+		return printSnapshots(env, snapshots)
+	},
+}
+
+var snapshotsShowCmd = command{
+	usage:       "SNAPSHOT_ID",
+	description: "Show a snapshot.",
+	minArgs:     1,
+	maxArgs:     1,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		snapshot, err := cli.GetSnapshot(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return printSnapshots(env, []params.SnapshotResponse{snapshot})
+	},
+}
+
+var snapshotsCreateCmd = command{
+	usage:       "DISK_ID [DISK_ID...]",
+	description: "Create a snapshot of one or more tracked disks, and wait for it to finish.",
+	minArgs:     1,
+	maxArgs:     -1,
+	setFlags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&noWait, "no-wait", false, "print the snapshot operation, without waiting for it to finish")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		if noWait {
+			op, err := cli.CreateSnapshot(ctx, args)
+			if err != nil {
+				return err
+			}
+			return printOperations(env, []params.OperationResponse{op})
+		}
+
+		snapshot, err := cli.CreateSnapshotAndWait(ctx, args)
+		if err != nil {
+			return err
+		}
+		return printSnapshots(env, []params.SnapshotResponse{snapshot})
+	},
+}
+
+var snapshotsDeleteCmd = command{
+	usage:       "SNAPSHOT_ID [SNAPSHOT_ID...]",
+	description: "Delete one or more snapshots, and wait for the deletion to finish.",
+	minArgs:     1,
+	maxArgs:     -1,
+	setFlags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&noWait, "no-wait", false, "print the delete operations, without waiting for them to finish")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+
+		var operations []params.OperationResponse
+		for _, snapshotID := range args {
+			op, err := cli.DeleteSnapshot(ctx, snapshotID)
+			if err != nil {
+				return err
+			}
+			operations = append(operations, op)
+		}
+
+		if noWait {
+			return printOperations(env, operations)
+		}
+
+		// Failed deletions are shown along with the rest, instead of stopping
+		// at the first one.
+		var failed int
+		for idx, op := range operations {
+			finished, err := cli.WaitOperation(ctx, op.ID)
+			if err != nil {
+				var opErr *client.OperationError
+				if !errors.As(err, &opErr) {
+					return err
+				}
+				failed++
+			}
+			operations[idx] = finished
+		}
+		if err := printOperations(env, operations); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return errors.Errorf("failed to delete %d of %d snapshots", failed, len(operations))
+		}
+		return nil
+	},
+}
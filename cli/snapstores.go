@@ -0,0 +1,40 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+)
+
+var snapStoresListCmd = command{
+	description: "List snap stores, along with the disk space they use.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		stores, err := cli.ListSnapStores(ctx)
+		if err != nil {
+			return err
+		}
+		return env.print(stores, []string{"ID", "DISK", "LOCATION", "ALLOCATED", "USED"}, func(add func(cells ...interface{})) {
+			for _, store := range stores {
+				add(store.ID, store.TrackedDiskID, store.StorageLocationID, store.AllocatedDiskSpace, store.StorageUsage)
+			}
+		})
+	},
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+var (
+	throttleLimits   params.ThrottleLimits
+	throttleDuration int
+)
+
+func printThrottle(env *environment, throttle params.ThrottleResponse) error {
+	source := string(throttle.Source)
+	if throttle.Schedule != "" {
+		source += " (" + throttle.Schedule + ")"
+	}
+	expires := "-"
+	if throttle.OverrideExpiresAt != nil {
+		expires = throttle.OverrideExpiresAt.Format(time.RFC3339)
+	}
+	limits := throttle.Limits
+	return env.print(throttle, []string{"SOURCE", "STREAMS", "STREAMS PER DISK", "MIB/S", "MIB/S PER DISK", "ACTIVE", "QUEUED", "EXPIRES AT"}, func(add func(cells ...interface{})) {
+		add(source, limits.MaxStreams, limits.MaxStreamsPerDisk, limits.MaxBandwidth, limits.MaxBandwidthPerDisk, throttle.ActiveStreams, throttle.QueuedStreams, expires)
+	})
+}
+
+var throttleShowCmd = command{
+	description: "Show the snapshot read limits in effect. A limit of 0 means unlimited.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		throttle, err := cli.GetThrottle(ctx)
+		if err != nil {
+			return err
+		}
+		return printThrottle(env, throttle)
+	},
+}
+
+var throttleSetCmd = command{
+	description: "Override the snapshot read limits set in the agent config. Limits that are not passed are unlimited.",
+	maxArgs:     0,
+	setFlags: func(fs *flag.FlagSet) {
+		fs.IntVar(&throttleLimits.MaxStreams, "max-streams", 0, "number of snapshot reads that can run at the same time")
+		fs.IntVar(&throttleLimits.MaxStreamsPerDisk, "max-streams-per-disk", 0, "number of reads of the same disk that can run at the same time")
+		fs.Int64Var(&throttleLimits.MaxBandwidth, "max-bandwidth", 0, "bandwidth in MiB/s shared by all reads")
+		fs.Int64Var(&throttleLimits.MaxBandwidthPerDisk, "max-bandwidth-per-disk", 0, "bandwidth in MiB/s shared by the reads of the same disk")
+		fs.IntVar(&throttleDuration, "duration", 0, "number of seconds the override stays in place. If 0, it stays until it is cleared, or the agent restarts")
+	},
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		throttle, err := cli.SetThrottle(ctx, throttleLimits, throttleDuration)
+		if err != nil {
+			return err
+		}
+		return printThrottle(env, throttle)
+	},
+}
+
+var throttleClearCmd = command{
+	description: "Remove the override, and go back to the snapshot read limits set in the agent config.",
+	maxArgs:     0,
+	run: func(ctx context.Context, env *environment, args []string) error {
+		cli, err := env.client()
+		if err != nil {
+			return err
+		}
+		throttle, err := cli.RemoveThrottle(ctx)
+		if err != nil {
+			return err
+		}
+		return printThrottle(env, throttle)
+	},
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// QueryAuditLog returns the most recent audit log entries that match query,
+// oldest first.
+func (c *Client) QueryAuditLog(ctx context.Context, query params.AuditQuery) ([]params.AuditEntry, error) {
+	values := url.Values{}
+	if query.Client != "" {
+		values.Set("client", query.Client)
+	}
+	if query.Operation != "" {
+		values.Set("operation", query.Operation)
+	}
+	if query.ResourceID != "" {
+		values.Set("resourceID", query.ResourceID)
+	}
+	if query.Since != nil {
+		values.Set("since", query.Since.Format(time.RFC3339))
+	}
+	if query.Until != nil {
+		values.Set("until", query.Until.Format(time.RFC3339))
+	}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	var entries []params.AuditEntry
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(values, "audit"), nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// Login exchanges a credential for an API token. The token is saved in
+// c.Token, and sent with all further requests. A lifetime of 0 requests the
+// default token lifetime of the agent.
+func (c *Client) Login(ctx context.Context, name, secret string, lifetime int) (params.LoginResponse, error) {
+	req := params.LoginRequest{
+		Name:     name,
+		Secret:   secret,
+		Lifetime: lifetime,
+	}
+	var resp params.LoginResponse
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "auth", "login"), req, &resp); err != nil {
+		return params.LoginResponse{}, err
+	}
+	c.Token = resp.Token
+	return resp, nil
+}
+
+// Logout revokes the token in c.Token.
+func (c *Client) Logout(ctx context.Context) error {
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "auth", "logout"), nil, nil); err != nil {
+		return err
+	}
+	c.Token = ""
+	return nil
+}
+
+// ListTokens lists the API tokens that have not yet expired.
+func (c *Client) ListTokens(ctx context.Context) ([]params.TokenResponse, error) {
+	var tokens []params.TokenResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "auth", "tokens"), nil, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeToken revokes an API token.
+func (c *Client) RevokeToken(ctx context.Context, tokenID string) (params.TokenResponse, error) {
+	var token params.TokenResponse
+	if err := c.doJSON(ctx, http.MethodDelete, c.apiURL(nil, "auth", "tokens", tokenID), nil, &token); err != nil {
+		return params.TokenResponse{}, err
+	}
+	return token, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package client implements a client for the snapshot agent API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+const (
+	// DefaultRetries is the number of times a failed snapshot read is retried.
+	DefaultRetries = 5
+	// DefaultRetryDelay is the time we wait before retrying a failed snapshot read.
+	DefaultRetryDelay = 1 * time.Second
+	// DefaultPollInterval is how often WaitOperation fetches the state of an operation.
+	DefaultPollInterval = 1 * time.Second
+
+	apiPrefix = "/api/v1"
+	// maxErrorBodySize is the largest error response body we read.
+	maxErrorBodySize = 1 << 20
+)
+
+// NewClient returns a client for the agent at endpoint (https://host:port). The
+// TLS config holds the client certificate and key, and the CA certificate used
+// to validate the agent. The certificate and key can be left empty, for agents
+// that accept tokens.
+func NewClient(endpoint string, tlsConfig config.TLSConfig) (*Client, error) {
+	tlsCfg, err := tlsConfig.ClientTLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading TLS config")
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsCfg,
+		},
+	}
+	return NewClientWithHTTPClient(endpoint, httpClient)
+}
+
+// NewClientWithHTTPClient returns a client for the agent at endpoint, that sends
+// requests using httpClient.
+func NewClientWithHTTPClient(endpoint string, httpClient *http.Client) (*Client, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing endpoint")
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return nil, vErrors.NewValueError("invalid endpoint %q", endpoint)
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+
+	return &Client{
+		endpoint:     parsed,
+		http:         httpClient,
+		Retries:      DefaultRetries,
+		RetryDelay:   DefaultRetryDelay,
+		PollInterval: DefaultPollInterval,
+	}, nil
+}
+
+// Client is a snapshot agent API client.
+type Client struct {
+	endpoint *url.URL
+	http     *http.Client
+
+	// Retries is the number of times a snapshot reader retries a failed read,
+	// before giving up.
+	Retries int
+	// RetryDelay is the time a snapshot reader waits before retrying a failed
+	// read.
+	RetryDelay time.Duration
+	// PollInterval is how often WaitOperation fetches the state of an operation.
+	PollInterval time.Duration
+	// Token is sent as a bearer token with every request, if set. Login sets
+	// it to the token it gets from the agent.
+	Token string
+}
+
+// apiURL returns the URL of an API resource. Every path segment is escaped.
+func (c *Client) apiURL(query url.Values, segments ...string) string {
+	escaped := make([]string, len(segments))
+	for idx, segment := range segments {
+		escaped[idx] = url.PathEscape(segment)
+	}
+
+	ret := fmt.Sprintf("%s://%s%s%s/%s", c.endpoint.Scheme, c.endpoint.Host, c.endpoint.EscapedPath(), apiPrefix, strings.Join(escaped, "/"))
+	if len(query) > 0 {
+		ret += "?" + query.Encode()
+	}
+	return ret
+}
+
+// newRequest creates a new API request. If body is not nil, it is sent as JSON.
+func (c *Client) newRequest(ctx context.Context, method string, reqURL string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		asJSON, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "marshaling request body")
+		}
+		reader = bytes.NewReader(asJSON)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// do sends a request. Responses with a status code other than 2xx are returned
+// as errors.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sending %s request", req.Method)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+// doJSON sends a request, and decodes the JSON response into out, if out is not nil.
+func (c *Client) doJSON(ctx context.Context, method string, reqURL string, body interface{}, out interface{}) error {
+	req, err := c.newRequest(ctx, method, reqURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrap(err, "decoding response")
+	}
+	return nil
+}
+
+// decodeError converts an error response into one of the types in the errors package.
+func decodeError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	details := strings.TrimSpace(string(body))
+	var apiErr params.APIErrorResponse
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Details != "" {
+		details = apiErr.Details
+	}
+	if details == "" {
+		details = resp.Status
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return vErrors.NewNotFoundError("%s", details)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return vErrors.NewUnauthorizedError("%s", details)
+	case http.StatusBadRequest, http.StatusRequestedRangeNotSatisfiable:
+		return vErrors.NewBadRequestError("%s", details)
+	case http.StatusConflict:
+		return vErrors.NewConflictError("%s", details)
+	case http.StatusTooManyRequests:
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return vErrors.NewTooManyRequestsError(time.Duration(seconds)*time.Second, "%s", details)
+	default:
+		return errors.Errorf("agent returned %s: %s", resp.Status, details)
+	}
+}
@@ -0,0 +1,989 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"coriolis-snapshot-agent/apiserver/auth"
+	"coriolis-snapshot-agent/apiserver/controllers"
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/apiserver/routers"
+	"coriolis-snapshot-agent/config"
+	"coriolis-snapshot-agent/db"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/storage"
+	"coriolis-snapshot-agent/internal/util"
+	"coriolis-snapshot-agent/worker/manager"
+)
+
+const (
+	testSnapshotID = "1"
+	testDiskID     = "4ad8dc2e-7f47-4c8e-8b5b-8a4e0b6a9c11"
+	testImageSize  = 3*1024*1024 + 123
+)
+
+// faultInjector aborts the connection of snapshot reads after part of the body
+// was sent, for as long as it has faults left.
+type faultInjector struct {
+	mux    sync.Mutex
+	faults int
+	after  int
+}
+
+func (f *faultInjector) set(faults, after int) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.faults = faults
+	f.after = after
+}
+
+func (f *faultInjector) next() (int, bool) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.faults == 0 {
+		return 0, false
+	}
+	f.faults--
+	return f.after, true
+}
+
+func (f *faultInjector) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/consume/") {
+			if after, ok := f.next(); ok {
+				w = &abortingWriter{ResponseWriter: w, left: after}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// abortingWriter sends left bytes of the body, then drops the connection.
+type abortingWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (a *abortingWriter) Write(p []byte) (int, error) {
+	if len(p) > a.left {
+		a.ResponseWriter.Write(p[:a.left])
+		a.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	a.left -= len(p)
+	return a.ResponseWriter.Write(p)
+}
+
+type testEnv struct {
+	client   *Client
+	mgr      *manager.Snapshot
+	faults   *faultInjector
+	image    []byte
+	location string
+	tlsCfg   config.TLSConfig
+	url      string
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newCert creates a certificate signed by parent, and writes it, along with its
+// key, in dir. If parent is nil, a self signed CA is created.
+func newCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, name+"-pub.pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func createCerts(t *testing.T, dir string) (server, client config.TLSConfig) {
+	t.Helper()
+	ca, caKey := newCert(t, dir, "ca", nil, nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	newCert(t, dir, "server", ca, caKey, &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	newCert(t, dir, "client", ca, caKey, &x509.Certificate{
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	tlsCfg := func(name string) config.TLSConfig {
+		return config.TLSConfig{
+			Cert:   filepath.Join(dir, name+"-pub.pem"),
+			Key:    filepath.Join(dir, name+"-key.pem"),
+			CACert: filepath.Join(dir, "ca-pub.pem"),
+		}
+	}
+	return tlsCfg("server"), tlsCfg("client")
+}
+
+// populateDB adds a tracked disk, a snap store location and a snapshot of the
+// disk to a new database. The snapshot image is a regular file.
+func populateDB(t *testing.T, dbFile, imagePath, location string) {
+	t.Helper()
+	database, err := db.NewDatabase(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	disk, err := database.CreateTrackedDisk(db.TrackedDisk{
+		TrackingID: testDiskID,
+		Path:       "/dev/vdb",
+		Major:      252,
+		Minor:      16,
+		SectorSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateSnapStoreFileLocation(db.SnapStoreFilesLocation{
+		Path:       location,
+		DevicePath: "/dev/vdc",
+		Enabled:    true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.CreateSnapshot(db.Snapshot{
+		SnapshotID: testSnapshotID,
+		VolumeSnapshots: []db.VolumeSnapshot{
+			{
+				TrackingID:     "volume-snapshot",
+				SnapshotNumber: 1,
+				GenerationID:   "generation",
+				OriginalDevice: disk,
+				SnapshotImage: db.SnapshotImage{
+					TrackingID: "snapshot-image",
+					DevicePath: imagePath,
+					SnapshotID: testSnapshotID,
+				},
+				SnapshotID: testSnapshotID,
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestEnv starts an agent API server backed by a manager that uses a pre
+// populated database. The kernel module is not needed, as long as the tests
+// do not touch snapshots or snap stores. The options can change the agent config.
+func newTestEnv(t *testing.T, options ...func(cfg *config.Config)) *testEnv {
+	t.Helper()
+	// The database must be on a tmpfs.
+	dbDir, err := ioutil.TempDir("/dev/shm", "snapshot-agent-client-test")
+	if err != nil {
+		t.Skipf("tmpfs not available: %q", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dbDir) })
+	if info, err := util.GetFileSystemInfoFromPath(dbDir); err != nil || info.Type != storage.TMPFS_MAGIC {
+		t.Skip("/dev/shm is not a tmpfs")
+	}
+
+	dir := t.TempDir()
+	serverTLS, clientTLS := createCerts(t, dir)
+
+	image := make([]byte, testImageSize)
+	if _, err := rand.Read(image); err != nil {
+		t.Fatal(err)
+	}
+	imagePath := filepath.Join(dir, "snapshot-image")
+	if err := ioutil.WriteFile(imagePath, image, 0600); err != nil {
+		t.Fatal(err)
+	}
+	location := filepath.Join(dir, "cow", "destination")
+	if err := os.MkdirAll(location, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		DBFile: filepath.Join(dbDir, "agent.db"),
+		APIServer: config.APIServer{
+			Bind:      "127.0.0.1",
+			Port:      9999,
+			TLSConfig: serverTLS,
+		},
+	}
+	for _, option := range options {
+		option(cfg)
+	}
+	populateDB(t, cfg.DBFile, imagePath, location)
+
+	mgr, err := manager.NewManager(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatalf("failed to create manager: %+v", err)
+	}
+	if err := mgr.Start(); err != nil {
+		t.Fatalf("failed to start manager: %+v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := mgr.Stop(ctx); err != nil {
+			t.Errorf("failed to stop manager: %+v", err)
+		}
+		if err := mgr.Wait(ctx); err != nil {
+			t.Errorf("failed to wait for manager: %+v", err)
+		}
+		if err := mgr.Close(); err != nil {
+			t.Errorf("failed to close manager: %+v", err)
+		}
+	})
+
+	controller, err := controllers.NewAPIController(mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens auth.TokenValidator
+	if cfg.APIServer.TokenAuth.Enabled() {
+		tokens = mgr
+	}
+	policy, err := auth.NewPolicy(cfg.APIServer.Authorization, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faults := &faultInjector{}
+	srv := httptest.NewUnstartedServer(faults.wrap(routers.NewAPIRouter(controller, policy, mgr.AuditLog(), ioutil.Discard)))
+	srv.TLS, err = cfg.APIServer.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	cli, err := NewClient(srv.URL, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.RetryDelay = 10 * time.Millisecond
+	cli.PollInterval = 10 * time.Millisecond
+
+	return &testEnv{
+		client:   cli,
+		mgr:      mgr,
+		faults:   faults,
+		image:    image,
+		location: location,
+		tlsCfg:   clientTLS,
+		url:      srv.URL,
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	snapshots, err := env.client.ListSnapshots(ctx)
+	if err != nil {
+		t.Fatalf("listing snapshots: %+v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].SnapshotID != testSnapshotID {
+		t.Fatalf("unexpected snapshots: %+v", snapshots)
+	}
+
+	snapshot, err := env.client.GetSnapshot(ctx, testSnapshotID)
+	if err != nil {
+		t.Fatalf("fetching snapshot: %+v", err)
+	}
+	if len(snapshot.VolumeSnapshots) != 1 || snapshot.VolumeSnapshots[0].OriginalDevice.TrackingID != testDiskID {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+
+	if _, err := env.client.GetSnapshot(ctx, "12345"); !errors.Is(err, &vErrors.NotFoundError{}) {
+		t.Fatalf("expected not found error, got %+v", err)
+	}
+
+	if _, err := env.client.CreateSnapshot(ctx, nil); !errors.Is(err, &vErrors.BadRequestError{}) {
+		t.Fatalf("expected bad request error, got %+v", err)
+	}
+
+	// Deleting a snapshot that does not exist does not start an operation.
+	if _, err := env.client.DeleteSnapshot(ctx, "12345"); !errors.Is(err, &vErrors.NotFoundError{}) {
+		t.Fatalf("expected not found error, got %+v", err)
+	}
+	operations, err := env.client.ListOperations(ctx)
+	if err != nil {
+		t.Fatalf("listing operations: %+v", err)
+	}
+	if len(operations) != 0 {
+		t.Fatalf("unexpected operations: %+v", operations)
+	}
+
+	// The kernel module is not available, so deleting the snapshot fails.
+	if err := env.client.DeleteSnapshotAndWait(ctx, testSnapshotID); err == nil {
+		t.Fatal("expected the delete operation to fail")
+	}
+	operations, err = env.client.ListOperations(ctx)
+	if err != nil {
+		t.Fatalf("listing operations: %+v", err)
+	}
+	if len(operations) != 1 || operations[0].Status != params.OperationStatusFailed {
+		t.Fatalf("unexpected operations: %+v", operations)
+	}
+	if _, err := env.client.CancelOperation(ctx, operations[0].ID); !errors.Is(err, &vErrors.ConflictError{}) {
+		t.Fatalf("expected conflict error, got %+v", err)
+	}
+}
+
+func TestSnapshotReaderResumes(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	reader, err := env.client.OpenSnapshot(ctx, testSnapshotID, testDiskID)
+	if err != nil {
+		t.Fatalf("opening snapshot: %+v", err)
+	}
+	defer reader.Close()
+	if reader.Size() != testImageSize {
+		t.Fatalf("expected size %d, got %d", testImageSize, reader.Size())
+	}
+
+	// Every request is cut short, until the retries run out.
+	env.faults.set(env.client.Retries, 1024*1024)
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading snapshot: %+v", err)
+	}
+	if !bytes.Equal(data, env.image) {
+		t.Fatalf("snapshot data does not match")
+	}
+
+	env.faults.set(2, 4096)
+	buf := make([]byte, 1024*1024+17)
+	offset := int64(123456)
+	n, err := reader.ReadAt(buf, offset)
+	if err != nil {
+		t.Fatalf("reading snapshot range: %+v", err)
+	}
+	if n != len(buf) || !bytes.Equal(buf, env.image[offset:offset+int64(len(buf))]) {
+		t.Fatalf("snapshot range does not match")
+	}
+
+	// Reads fail once we run out of retries.
+	env.faults.set(env.client.Retries+1, 0)
+	if _, err := reader.ReadAt(buf, 0); err == nil {
+		t.Fatalf("expected read to fail")
+	}
+	env.faults.set(0, 0)
+
+	if _, err := env.client.OpenSnapshot(ctx, testSnapshotID, "missing-disk"); !errors.Is(err, &vErrors.NotFoundError{}) {
+		t.Fatalf("expected not found error, got %+v", err)
+	}
+}
+
+func TestConsumeCompression(t *testing.T) {
+	env := newTestEnv(t)
+
+	tlsCfg, err := env.tlsCfg.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpCli := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	consumeURL := env.url + "/api/v1/snapshots/" + testSnapshotID + "/consume/" + testDiskID + "/"
+
+	get := func(encoding, rangeHeader string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("GET", consumeURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", encoding+", identity;q=0")
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := httpCli.Do(req)
+		if err != nil {
+			t.Fatalf("failed to get %q: %+v", rangeHeader, err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read %q: %+v", rangeHeader, err)
+		}
+		return resp, body
+	}
+	decompress := func(encoding string, body []byte) []byte {
+		t.Helper()
+		var dec io.Reader
+		switch encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec = gz
+		case "zstd":
+			zd, err := zstd.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zd.Close()
+			dec = zd
+		}
+		data, err := ioutil.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("failed to decompress %s data: %+v", encoding, err)
+		}
+		return data
+	}
+
+	// The entire image is compressed.
+	resp, body := get("gzip", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a compressed response, got %d %q", resp.StatusCode, resp.Header.Get("Content-Encoding"))
+	}
+	if !bytes.Equal(decompress("gzip", body), env.image) {
+		t.Fatalf("decompressed image does not match")
+	}
+
+	// A single range is compressed on its own. Content-Range and the
+	// uncompressed length refer to the uncompressed data.
+	size := int64(len(env.image))
+	ranges := []struct {
+		encoding   string
+		header     string
+		start, end int64
+	}{
+		{"gzip", "bytes=100-199", 100, 199},
+		{"zstd", "bytes=100-199", 100, 199},
+		{"gzip", "bytes=100-", 100, size - 1},
+		{"zstd", "bytes=-100", size - 100, size - 1},
+		{"gzip", "bytes=100-" + strconv.FormatInt(size+100, 10), 100, size - 1},
+	}
+	for _, tc := range ranges {
+		resp, body := get(tc.encoding, tc.header)
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Encoding") != tc.encoding {
+			t.Fatalf("%s: expected a %s partial response, got %d %q", tc.header, tc.encoding, resp.StatusCode, resp.Header.Get("Content-Encoding"))
+		}
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", tc.start, tc.end, size)
+		if resp.Header.Get("Content-Range") != contentRange {
+			t.Fatalf("%s: expected content range %q, got %q", tc.header, contentRange, resp.Header.Get("Content-Range"))
+		}
+		length := strconv.FormatInt(tc.end-tc.start+1, 10)
+		if resp.Header.Get("X-Uncompressed-Length") != length {
+			t.Fatalf("%s: expected uncompressed length %s, got %q", tc.header, length, resp.Header.Get("X-Uncompressed-Length"))
+		}
+		if !bytes.Equal(decompress(tc.encoding, body), env.image[tc.start:tc.end+1]) {
+			t.Fatalf("%s: data does not match", tc.header)
+		}
+	}
+
+	// Multiple ranges are served uncompressed.
+	resp, _ = get("gzip", "bytes=0-9,20-29")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Encoding") != "" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("expected an uncompressed multipart response, got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Encoding"), resp.Header.Get("Content-Type"))
+	}
+
+	resp, _ = get("gzip", fmt.Sprintf("bytes=%d-", size))
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected range past the end to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	env := newTestEnv(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events, err := env.client.Events(ctx, string(manager.SnapshotDeletedEvent))
+	if err != nil {
+		t.Fatalf("subscribing to events: %+v", err)
+	}
+	defer events.Close()
+
+	data, _ := json.Marshal(params.SnapshotEvent{SnapshotID: testSnapshotID})
+	epoch, _ := env.mgr.LastEvent()
+	env.mgr.SendNotify(manager.SnapshotDeletedEvent, params.Event{
+		ID:        42,
+		Epoch:     epoch,
+		Type:      string(manager.SnapshotDeletedEvent),
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	})
+
+	evt, err := events.Next()
+	if err != nil {
+		t.Fatalf("reading event: %+v", err)
+	}
+	if evt.ID != 42 || evt.Type != string(manager.SnapshotDeletedEvent) {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+	if events.LastEventID() != manager.FormatEventID(epoch, 42) {
+		t.Fatalf("unexpected last event ID: %s", events.LastEventID())
+	}
+
+	if _, err := env.client.Events(ctx, "no_such_event"); !errors.Is(err, &vErrors.BadRequestError{}) {
+		t.Fatalf("expected bad request error, got %+v", err)
+	}
+
+	// Event streams end when the agent shuts down.
+	env.mgr.BeginShutdown()
+	if _, err := events.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the stream to end, got %+v", err)
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	env := newTestEnv(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Resuming a stream of a previous agent process starts with a reset.
+	previous := manager.FormatEventID("previous-epoch", 7)
+	events, err := env.client.ResumeEvents(ctx, previous, string(manager.SnapshotDeletedEvent))
+	if err != nil {
+		t.Fatalf("subscribing to events: %+v", err)
+	}
+	evt, err := events.Next()
+	events.Close()
+	if err != nil {
+		t.Fatalf("reading event: %+v", err)
+	}
+	epoch, seq := env.mgr.LastEvent()
+	var reset params.ResetEvent
+	if err := json.Unmarshal(evt.Data, &reset); err != nil {
+		t.Fatalf("decoding reset event: %+v", err)
+	}
+	if evt.Type != string(manager.ResetEvent) || evt.Epoch != epoch || evt.ID != seq || reset.PreviousEventID != previous {
+		t.Fatalf("unexpected reset event: %+v", evt)
+	}
+
+	// Resuming a stream of this agent process does not.
+	events, err = env.client.ResumeEvents(ctx, events.LastEventID(), string(manager.SnapshotDeletedEvent))
+	if err != nil {
+		t.Fatalf("subscribing to events: %+v", err)
+	}
+	defer events.Close()
+	data, _ := json.Marshal(params.SnapshotEvent{SnapshotID: testSnapshotID})
+	env.mgr.SendNotify(manager.SnapshotDeletedEvent, params.Event{
+		ID:        seq + 1,
+		Epoch:     epoch,
+		Type:      string(manager.SnapshotDeletedEvent),
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	})
+	evt, err = events.Next()
+	if err != nil {
+		t.Fatalf("reading event: %+v", err)
+	}
+	if evt.Type != string(manager.SnapshotDeletedEvent) || evt.ID != seq+1 {
+		t.Fatalf("unexpected event: %+v", evt)
+	}
+}
+
+func TestSnapStoreLocationsAndMappings(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	// Location paths hold slashes, which must be escaped.
+	location, err := env.client.GetSnapStoreLocation(ctx, env.location)
+	if err != nil {
+		t.Fatalf("fetching location: %+v", err)
+	}
+	if location.Path != env.location {
+		t.Fatalf("unexpected location: %+v", location)
+	}
+
+	mapping, err := env.client.CreateSnapStoreMapping(ctx, env.location, testDiskID)
+	if err != nil {
+		t.Fatalf("creating mapping: %+v", err)
+	}
+	if mapping.TrackedDiskID != testDiskID || mapping.StorageLocationID != env.location {
+		t.Fatalf("unexpected mapping: %+v", mapping)
+	}
+	if _, err := env.client.CreateSnapStoreMapping(ctx, env.location, testDiskID); !errors.Is(err, &vErrors.ConflictError{}) {
+		t.Fatalf("expected conflict error, got %+v", err)
+	}
+
+	fetched, err := env.client.GetSnapStoreMapping(ctx, mapping.ID)
+	if err != nil {
+		t.Fatalf("fetching mapping: %+v", err)
+	}
+	if fetched != mapping {
+		t.Fatalf("expected %+v, got %+v", mapping, fetched)
+	}
+
+	if err := env.client.DeleteSnapStoreMapping(ctx, mapping.ID); err != nil {
+		t.Fatalf("deleting mapping: %+v", err)
+	}
+	mappings, err := env.client.ListSnapStoreMappings(ctx)
+	if err != nil {
+		t.Fatalf("listing mappings: %+v", err)
+	}
+	if len(mappings) != 0 {
+		t.Fatalf("unexpected mappings: %+v", mappings)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	env := newTestEnv(t)
+
+	tlsCfg, err := env.tlsCfg.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg.Certificates = nil
+	cli, err := NewClientWithHTTPClient(env.url, &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.ListSnapshots(context.Background()); err == nil {
+		t.Fatalf("expected request without a client certificate to fail")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.APIServer.TokenAuth = config.TokenAuth{
+			DefaultLifetime: config.DefaultTokenLifetime,
+			MaxLifetime:     config.DefaultMaxTokenLifetime,
+			Credentials: []config.Credential{
+				{Name: "reader", SecretHash: string(hash), Role: config.RoleReadOnly},
+			},
+		}
+	})
+	ctx := context.Background()
+
+	// Clients that log in do not need a client certificate.
+	tlsCfg := env.tlsCfg
+	tlsCfg.Cert = ""
+	tlsCfg.Key = ""
+	cli, err := NewClient(env.url, tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.ListSnapshots(ctx); !errors.Is(err, vErrors.ErrUnauthorized) {
+		t.Fatalf("expected request without credentials to be unauthorized, got %v", err)
+	}
+	if _, err := cli.Login(ctx, "reader", "wrong", 0); !errors.Is(err, vErrors.ErrUnauthorized) {
+		t.Fatalf("expected login with a wrong secret to fail, got %v", err)
+	}
+	if _, err := cli.Login(ctx, "reader", "secret", config.DefaultMaxTokenLifetime+1); !errors.Is(err, vErrors.ErrBadRequest) {
+		t.Fatalf("expected login with a long lifetime to fail, got %v", err)
+	}
+
+	login, err := cli.Login(ctx, "reader", "secret", 60)
+	if err != nil {
+		t.Fatalf("failed to log in: %+v", err)
+	}
+	if _, err := cli.ListSnapshots(ctx); err != nil {
+		t.Fatalf("failed to list snapshots with token: %+v", err)
+	}
+	if _, err := cli.DeleteSnapshot(ctx, testSnapshotID); !errors.Is(err, vErrors.ErrUnauthorized) {
+		t.Fatalf("expected read-only token to be denied, got %v", err)
+	}
+
+	// Clients with a certificate keep working, and can manage tokens.
+	tokens, err := env.client.ListTokens(ctx)
+	if err != nil {
+		t.Fatalf("failed to list tokens: %+v", err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != login.TokenID || tokens[0].Name != "reader" {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+
+	token := cli.Token
+	if err := cli.Logout(ctx); err != nil {
+		t.Fatalf("failed to log out: %+v", err)
+	}
+	cli.Token = token
+	if _, err := cli.ListSnapshots(ctx); !errors.Is(err, vErrors.ErrUnauthorized) {
+		t.Fatalf("expected revoked token to be rejected, got %v", err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Throttle.RetryAfter = 7
+	})
+	ctx := context.Background()
+
+	throttle, err := env.client.SetThrottle(ctx, params.ThrottleLimits{MaxStreams: 1, MaxBandwidth: 1}, 0)
+	if err != nil {
+		t.Fatalf("failed to set throttle: %+v", err)
+	}
+	if throttle.Source != params.ThrottleSourceOverride || throttle.Limits.MaxStreams != 1 {
+		t.Fatalf("unexpected throttle: %+v", throttle)
+	}
+
+	// A slow read holds the only stream slot.
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	consumeURL := env.client.apiURL(nil, "snapshots", testSnapshotID, "consume", testDiskID)
+	req, err := env.client.newRequest(readCtx, http.MethodGet, consumeURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := env.client.do(req)
+	if err != nil {
+		t.Fatalf("failed to start read: %+v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := resp.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	throttle, err = env.client.GetThrottle(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.ActiveStreams != 1 {
+		t.Fatalf("expected 1 active stream, got %+v", throttle)
+	}
+
+	req, err = env.client.newRequest(ctx, http.MethodGet, consumeURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.client.do(req)
+	var tooMany *vErrors.TooManyRequestsError
+	if !errors.As(err, &tooMany) || tooMany.RetryAfter != 7*time.Second {
+		t.Fatalf("expected second read to be rejected with a retry delay, got %v", err)
+	}
+	cancel()
+
+	throttle, err = env.client.RemoveThrottle(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.Source != params.ThrottleSourceConfig || throttle.Limits != (params.ThrottleLimits{}) {
+		t.Fatalf("unexpected throttle: %+v", throttle)
+	}
+}
+
+func healthChecks(health params.HealthResponse) map[string]params.HealthCheck {
+	ret := map[string]params.HealthCheck{}
+	for _, check := range health.Checks {
+		ret[check.Name] = check
+	}
+	return ret
+}
+
+func TestHealth(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.Health.MinFreeSpace = 1 << 40
+	})
+	ctx := context.Background()
+
+	// The test manager has no udev monitor, so the agent is never healthy.
+	health, err := env.client.Health(ctx)
+	if err != nil {
+		t.Fatalf("failed to get health: %+v", err)
+	}
+	checks := healthChecks(health)
+	if health.Status != params.HealthStatusFailed || len(checks) != 3 {
+		t.Fatalf("unexpected health: %+v", health)
+	}
+	if checks["database"].Status != params.HealthStatusOK || checks["snap_store_watchers"].Status != params.HealthStatusOK {
+		t.Fatalf("unexpected health: %+v", health)
+	}
+	if checks["udev_monitor"].Status != params.HealthStatusFailed || checks["udev_monitor"].Reason == "" {
+		t.Fatalf("expected udev monitor check to fail: %+v", health)
+	}
+
+	ready, err := env.client.Ready(ctx)
+	if err != nil {
+		t.Fatalf("failed to get readiness: %+v", err)
+	}
+	checks = healthChecks(ready)
+	if ready.Status != params.HealthStatusFailed || len(checks) != 6 {
+		t.Fatalf("unexpected readiness: %+v", ready)
+	}
+	if locations := checks["snap_store_locations"]; locations.Status != params.HealthStatusFailed || !strings.Contains(locations.Reason, env.location) {
+		t.Fatalf("expected snap store location check to fail: %+v", locations)
+	}
+
+	// Health checks do not need a client certificate, and return 503 when a
+	// check failed.
+	tlsCfg, err := env.tlsCfg.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg.Certificates = nil
+	httpCli := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+	for _, endpoint := range []string{"health", "ready"} {
+		resp, err := httpCli.Get(env.url + "/" + endpoint)
+		if err != nil {
+			t.Fatalf("failed to get %s without a client certificate: %+v", endpoint, err)
+		}
+		var result params.HealthResponse
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode %s response: %+v", endpoint, err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable || result.Status != params.HealthStatusFailed {
+			t.Fatalf("expected %s to return 503, got %d: %+v", endpoint, resp.StatusCode, result)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	disabled := newTestEnv(t)
+	if _, err := disabled.client.QueryAuditLog(context.Background(), params.AuditQuery{}); !errors.Is(err, &vErrors.NotFoundError{}) {
+		t.Fatalf("expected not found error, got %+v", err)
+	}
+
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	})
+	ctx := context.Background()
+
+	// Missing snapshots are rejected before an operation is started.
+	if _, err := env.client.DeleteSnapshot(ctx, "12345"); !errors.Is(err, &vErrors.NotFoundError{}) {
+		t.Fatalf("expected not found error, got %+v", err)
+	}
+	entries, err := env.client.QueryAuditLog(ctx, params.AuditQuery{ResourceID: "12345"})
+	if err != nil {
+		t.Fatalf("querying audit log: %+v", err)
+	}
+	if len(entries) != 1 || entries[0].Status != http.StatusNotFound {
+		t.Fatalf("expected one rejected request, got %+v", entries)
+	}
+
+	// The kernel module is not available, so the delete operation fails, and
+	// leaves the snapshot in place.
+	var opErr *OperationError
+	if err := env.client.DeleteSnapshotAndWait(ctx, testSnapshotID); !errors.As(err, &opErr) {
+		t.Fatalf("expected the delete operation to fail, got %+v", err)
+	}
+
+	// The operation is recorded once it finishes, which can be a little
+	// after the client sees it finished.
+	for attempt := 0; attempt < 50; attempt++ {
+		entries, err = env.client.QueryAuditLog(ctx, params.AuditQuery{ResourceID: testSnapshotID})
+		if err != nil {
+			t.Fatalf("querying audit log: %+v", err)
+		}
+		if len(entries) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	request, finished := entries[0], entries[1]
+	if request.Operation != "DELETE /api/v1/snapshots/{snapshotID}" || request.Client != "client" || request.Status != http.StatusAccepted {
+		t.Fatalf("unexpected request entry: %+v", request)
+	}
+	if finished.Operation != string(params.OperationTypeDeleteSnapshot) || finished.Result != params.AuditResultFailure ||
+		finished.ResourceIDs["operationID"] != request.ResourceIDs["operationID"] {
+		t.Fatalf("unexpected operation entry: %+v", finished)
+	}
+	// The operation carries the ID of the request that started it.
+	if request.RequestID == "" || finished.RequestID != request.RequestID {
+		t.Fatalf("expected request ID %q in operation entry: %+v", request.RequestID, finished)
+	}
+
+	reader, err := env.client.OpenSnapshot(ctx, testSnapshotID, testDiskID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+
+	entries, err = env.client.QueryAuditLog(ctx, params.AuditQuery{Operation: "/consume/"})
+	if err != nil {
+		t.Fatalf("querying audit log: %+v", err)
+	}
+	var sent int64
+	for _, entry := range entries {
+		if entry.ResourceIDs["snapshotID"] != testSnapshotID || entry.ResourceIDs["trackedDiskID"] != testDiskID {
+			t.Fatalf("unexpected consume entry: %+v", entry)
+		}
+		sent += entry.BytesSent
+	}
+	if sent != testImageSize {
+		t.Fatalf("expected %d bytes to be read, got %d in %+v", testImageSize, sent, entries)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/system"
+)
+
+// ListDisks lists the disks on the system. Virtual devices and swap devices are
+// only included if requested.
+func (c *Client) ListDisks(ctx context.Context, includeVirtual, includeSwap bool) ([]params.BlockVolume, error) {
+	query := url.Values{}
+	query.Set("includeVirtual", strconv.FormatBool(includeVirtual))
+	query.Set("includeSwap", strconv.FormatBool(includeSwap))
+
+	var disks []params.BlockVolume
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(query, "disks"), nil, &disks); err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
+// GetDisk returns a disk that was added to tracking.
+func (c *Client) GetDisk(ctx context.Context, diskID string) (params.BlockVolume, error) {
+	var disk params.BlockVolume
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "disks", diskID), nil, &disk); err != nil {
+		return params.BlockVolume{}, err
+	}
+	return disk, nil
+}
+
+// AddTrackedDisk adds the disk at devicePath to tracking.
+func (c *Client) AddTrackedDisk(ctx context.Context, devicePath string) (params.BlockVolume, error) {
+	req := params.AddTrackedDiskRequest{
+		DevicePath: devicePath,
+	}
+	var disk params.BlockVolume
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "disks"), req, &disk); err != nil {
+		return params.BlockVolume{}, err
+	}
+	return disk, nil
+}
+
+// RemoveTrackedDisk removes a disk from tracking.
+func (c *Client) RemoveTrackedDisk(ctx context.Context, diskID string) error {
+	return c.doJSON(ctx, http.MethodDelete, c.apiURL(nil, "disks", diskID), nil, nil)
+}
+
+// GetSystemInfo returns information about the system the agent runs on.
+func (c *Client) GetSystemInfo(ctx context.Context) (system.SystemInfo, error) {
+	var info system.SystemInfo
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "systeminfo"), nil, &info); err != nil {
+		return system.SystemInfo{}, err
+	}
+	return info, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// Events subscribes to agent events. If no event types are given, all events
+// are received.
+func (c *Client) Events(ctx context.Context, eventTypes ...string) (*EventStream, error) {
+	return c.ResumeEvents(ctx, "", eventTypes...)
+}
+
+// ResumeEvents subscribes to agent events, like Events, resuming a stream that
+// last received lastEventID. If that event was sent by a previous agent process,
+// the first event received is a reset event.
+func (c *Client) ResumeEvents(ctx context.Context, lastEventID string, eventTypes ...string) (*EventStream, error) {
+	query := url.Values{}
+	if len(eventTypes) > 0 {
+		query.Set("types", strings.Join(eventTypes, ","))
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, c.apiURL(query, "events"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{
+		body:        resp.Body,
+		reader:      bufio.NewReader(resp.Body),
+		lastEventID: lastEventID,
+	}, nil
+}
+
+// EventStream reads events sent by the agent.
+type EventStream struct {
+	body        io.ReadCloser
+	reader      *bufio.Reader
+	lastEventID string
+}
+
+// LastEventID returns the ID of the last event received. It can be passed to
+// ResumeEvents to resume the stream.
+func (s *EventStream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Next blocks until the next event is received. It returns io.EOF when the
+// agent closes the stream.
+func (s *EventStream) Next() (params.Event, error) {
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return params.Event{}, io.EOF
+			}
+			return params.Event{}, errors.Wrap(err, "reading event stream")
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// A blank line ends an event. Comments and keepalives have no data.
+			if len(data) == 0 {
+				continue
+			}
+			var evt params.Event
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &evt); err != nil {
+				return params.Event{}, errors.Wrap(err, "decoding event")
+			}
+			return evt, nil
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case strings.HasPrefix(line, "id:"):
+			s.lastEventID = strings.TrimPrefix(strings.TrimPrefix(line, "id:"), " ")
+		}
+		// The event field is also part of the JSON payload.
+	}
+}
+
+// Close closes the event stream.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
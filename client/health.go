@@ -0,0 +1,65 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// Health runs the liveness checks of the agent. Failed checks are not returned
+// as an error; the Status of the response is failed instead.
+func (c *Client) Health(ctx context.Context) (params.HealthResponse, error) {
+	return c.healthCheck(ctx, "health")
+}
+
+// Ready runs the readiness checks of the agent. Failed checks are not returned
+// as an error; the Status of the response is failed instead.
+func (c *Client) Ready(ctx context.Context) (params.HealthResponse, error) {
+	return c.healthCheck(ctx, "ready")
+}
+
+// healthCheck fetches a health endpoint. These live outside the API prefix, and
+// return 503 along with the check results if any check failed.
+func (c *Client) healthCheck(ctx context.Context, endpoint string) (params.HealthResponse, error) {
+	reqURL := fmt.Sprintf("%s://%s%s/%s", c.endpoint.Scheme, c.endpoint.Host, c.endpoint.EscapedPath(), endpoint)
+	req, err := c.newRequest(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return params.HealthResponse{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return params.HealthResponse{}, errors.Wrapf(err, "sending %s request", req.Method)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return params.HealthResponse{}, decodeError(resp)
+	}
+
+	var health params.HealthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return params.HealthResponse{}, errors.Wrap(err, "decoding response")
+	}
+	return health, nil
+}
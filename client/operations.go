@@ -0,0 +1,89 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// OperationError is returned when an operation fails, or is cancelled.
+type OperationError struct {
+	Operation params.OperationResponse
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %s (%s) %s: %s", e.Operation.ID, e.Operation.Type, e.Operation.Status, e.Operation.Error)
+}
+
+// ListOperations lists running operations, and operations that finished recently.
+func (c *Client) ListOperations(ctx context.Context) ([]params.OperationResponse, error) {
+	var ops []params.OperationResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "operations"), nil, &ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// GetOperation returns the current state of an operation.
+func (c *Client) GetOperation(ctx context.Context, operationID string) (params.OperationResponse, error) {
+	var op params.OperationResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "operations", operationID), nil, &op); err != nil {
+		return params.OperationResponse{}, err
+	}
+	return op, nil
+}
+
+// CancelOperation requests the cancellation of a running operation. Use WaitOperation
+// to wait for the operation to stop.
+func (c *Client) CancelOperation(ctx context.Context, operationID string) (params.OperationResponse, error) {
+	var op params.OperationResponse
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "operations", operationID, "cancel"), nil, &op); err != nil {
+		return params.OperationResponse{}, err
+	}
+	return op, nil
+}
+
+// WaitOperation polls an operation until it finishes. If the operation fails or
+// is cancelled, an *OperationError is returned, along with the final state of
+// the operation.
+func (c *Client) WaitOperation(ctx context.Context, operationID string) (params.OperationResponse, error) {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		op, err := c.GetOperation(ctx, operationID)
+		if err != nil {
+			return params.OperationResponse{}, err
+		}
+		switch op.Status {
+		case params.OperationStatusSucceeded:
+			return op, nil
+		case params.OperationStatusFailed, params.OperationStatusCancelled:
+			return op, &OperationError{Operation: op}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return op, ctx.Err()
+		}
+	}
+}
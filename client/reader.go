@@ -0,0 +1,296 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// OpenSnapshot returns a reader for the data of a disk snapshot. Failed reads are
+// retried, resuming from the last byte that was received. The reader uses ctx for
+// all requests it makes.
+func (c *Client) OpenSnapshot(ctx context.Context, snapshotID, diskID string) (*SnapshotReader, error) {
+	reqURL := c.apiURL(nil, "snapshots", snapshotID, "consume", diskID)
+	req, err := c.newRequest(ctx, http.MethodHead, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.ContentLength < 0 {
+		return nil, errors.Errorf("agent did not return the size of snapshot %s", snapshotID)
+	}
+	return &SnapshotReader{
+		client: c,
+		ctx:    ctx,
+		url:    reqURL,
+		size:   resp.ContentLength,
+	}, nil
+}
+
+// SnapshotReader reads the data of a disk snapshot. It implements io.ReadSeeker,
+// io.ReaderAt and io.Closer. ReadAt does not use the read offset, and can be
+// called concurrently, to download multiple ranges in parallel.
+type SnapshotReader struct {
+	client *Client
+	ctx    context.Context
+	url    string
+	size   int64
+
+	// offset is the offset of the next Read.
+	offset int64
+	// body is the response body Read uses. Its next byte is at offset.
+	body io.ReadCloser
+}
+
+// Size returns the size of the snapshot, in bytes.
+func (r *SnapshotReader) Size() int64 {
+	return r.size
+}
+
+// Read reads data from the current offset. If the connection to the agent breaks,
+// the read is retried, starting from the current offset.
+func (r *SnapshotReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= r.client.Retries; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(r.ctx, r.client.retryDelay(lastErr)); err != nil {
+				return 0, err
+			}
+		}
+
+		if r.body == nil {
+			body, err := r.openRange(r.ctx, r.offset, r.size-1)
+			if err != nil {
+				if isPermanent(err) {
+					return 0, err
+				}
+				lastErr = err
+				continue
+			}
+			r.body = body
+		}
+
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == nil {
+			return n, nil
+		}
+		r.closeBody()
+		if err == io.EOF && r.offset >= r.size {
+			return n, nil
+		}
+		if n > 0 {
+			// Return what we have. The next Read resumes from the new offset.
+			return n, nil
+		}
+		lastErr = err
+	}
+	return 0, errors.Wrapf(lastErr, "reading snapshot at offset %d", r.offset)
+}
+
+// ReadAt reads len(p) bytes starting at off. Interrupted reads are retried,
+// resuming after the last byte that was received.
+func (r *SnapshotReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, vErrors.NewValueError("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	want := p
+	if remaining := r.size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+
+	var read int
+	var lastErr error
+	for attempt := 0; attempt <= r.client.Retries && read < len(want); attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(r.ctx, r.client.retryDelay(lastErr)); err != nil {
+				return read, err
+			}
+		}
+
+		start := off + int64(read)
+		body, err := r.openRange(r.ctx, start, off+int64(len(want))-1)
+		if err != nil {
+			if isPermanent(err) {
+				return read, err
+			}
+			lastErr = err
+			continue
+		}
+
+		n, err := io.ReadFull(body, want[read:])
+		body.Close()
+		read += n
+		if err != nil {
+			lastErr = err
+			if n > 0 {
+				// We made progress, so start counting attempts again.
+				attempt = 0
+			}
+		}
+	}
+
+	if read < len(want) {
+		return read, errors.Wrapf(lastErr, "reading snapshot at offset %d", off+int64(read))
+	}
+	if len(want) < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Seek sets the offset of the next Read.
+func (r *SnapshotReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = r.offset + offset
+	case io.SeekEnd:
+		newOffset = r.size + offset
+	default:
+		return 0, vErrors.NewValueError("invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return 0, vErrors.NewValueError("negative offset %d", newOffset)
+	}
+
+	if newOffset != r.offset {
+		r.closeBody()
+		r.offset = newOffset
+	}
+	return newOffset, nil
+}
+
+// Close releases the connection used by Read.
+func (r *SnapshotReader) Close() error {
+	r.closeBody()
+	return nil
+}
+
+func (r *SnapshotReader) closeBody() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+}
+
+// openRange requests the bytes between start and end, inclusive.
+func (r *SnapshotReader) openRange(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	req, err := r.client.newRequest(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	// Ask for uncompressed data, so the transport does not ask for gzip on our
+	// behalf. Reads are resumed at byte offsets of the uncompressed data.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := r.client.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		rangeStart, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil || rangeStart != start {
+			resp.Body.Close()
+			return nil, errors.Errorf("agent returned range %q, expected one starting at %d", resp.Header.Get("Content-Range"), start)
+		}
+	case http.StatusOK:
+		// The whole snapshot was sent. This is fine, as long as that is what we asked for.
+		if start != 0 {
+			resp.Body.Close()
+			return nil, errors.Errorf("agent ignored range request for offset %d", start)
+		}
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("unexpected response status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// contentRangeStart returns the first byte of a "bytes start-end/size" Content-Range header.
+func contentRangeStart(header string) (int64, error) {
+	rng := strings.TrimPrefix(header, "bytes ")
+	if rng == header {
+		return 0, errors.Errorf("invalid content range %q", header)
+	}
+	dash := strings.Index(rng, "-")
+	if dash < 0 {
+		return 0, errors.Errorf("invalid content range %q", header)
+	}
+	return strconv.ParseInt(rng[:dash], 10, 64)
+}
+
+// isPermanent returns true for errors that will not go away if the request is retried.
+func isPermanent(err error) bool {
+	return errors.Is(err, &vErrors.NotFoundError{}) ||
+		errors.Is(err, &vErrors.BadRequestError{}) ||
+		errors.Is(err, &vErrors.UnauthorizedError{}) ||
+		errors.Is(err, &vErrors.ConflictError{}) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// retryDelay returns the time to wait before retrying a request that failed
+// with err. Agents that limit snapshot reads tell us how long to wait.
+func (c *Client) retryDelay(err error) time.Duration {
+	var tooMany *vErrors.TooManyRequestsError
+	if errors.As(err, &tooMany) && tooMany.RetryAfter > c.RetryDelay {
+		return tooMany.RetryAfter
+	}
+	return c.RetryDelay
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/stream"
+)
+
+// ListSnapshots lists all snapshots.
+func (c *Client) ListSnapshots(ctx context.Context) ([]params.SnapshotResponse, error) {
+	var snapshots []params.SnapshotResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapshots"), nil, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// GetSnapshot returns a snapshot.
+func (c *Client) GetSnapshot(ctx context.Context, snapshotID string) (params.SnapshotResponse, error) {
+	var snapshot params.SnapshotResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapshots", snapshotID), nil, &snapshot); err != nil {
+		return params.SnapshotResponse{}, err
+	}
+	return snapshot, nil
+}
+
+// CreateSnapshot starts an operation that snapshots the given tracked disks. The
+// snapshot is saved in the result of the operation.
+func (c *Client) CreateSnapshot(ctx context.Context, diskIDs []string) (params.OperationResponse, error) {
+	req := params.CreateSnapshotRequest{
+		TrackedDiskIDs: diskIDs,
+	}
+	var op params.OperationResponse
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "snapshots"), req, &op); err != nil {
+		return params.OperationResponse{}, err
+	}
+	return op, nil
+}
+
+// CreateSnapshotAndWait snapshots the given tracked disks, and waits for the
+// operation to finish.
+func (c *Client) CreateSnapshotAndWait(ctx context.Context, diskIDs []string) (params.SnapshotResponse, error) {
+	op, err := c.CreateSnapshot(ctx, diskIDs)
+	if err != nil {
+		return params.SnapshotResponse{}, err
+	}
+	op, err = c.WaitOperation(ctx, op.ID)
+	if err != nil {
+		return params.SnapshotResponse{}, err
+	}
+
+	var snapshot params.SnapshotResponse
+	if err := json.Unmarshal(op.Result, &snapshot); err != nil {
+		return params.SnapshotResponse{}, errors.Wrap(err, "decoding operation result")
+	}
+	return snapshot, nil
+}
+
+// DeleteSnapshot starts an operation that deletes a snapshot.
+func (c *Client) DeleteSnapshot(ctx context.Context, snapshotID string) (params.OperationResponse, error) {
+	var op params.OperationResponse
+	if err := c.doJSON(ctx, http.MethodDelete, c.apiURL(nil, "snapshots", snapshotID), nil, &op); err != nil {
+		return params.OperationResponse{}, err
+	}
+	return op, nil
+}
+
+// DeleteSnapshotAndWait deletes a snapshot, and waits for the operation to finish.
+func (c *Client) DeleteSnapshotAndWait(ctx context.Context, snapshotID string) error {
+	op, err := c.DeleteSnapshot(ctx, snapshotID)
+	if err != nil {
+		return err
+	}
+	_, err = c.WaitOperation(ctx, op.ID)
+	return err
+}
+
+// ChangesOptions selects the ranges returned by GetChangedSectors, StreamChangedSectors
+// and GetChecksumManifest.
+type ChangesOptions struct {
+	// PreviousGenerationID and PreviousNumber identify the snapshot to compare
+	// against. If not set, all ranges of the disk are returned.
+	PreviousGenerationID string
+	PreviousNumber       uint32
+	// AllocatedOnly skips ranges that are not allocated by any known
+	// filesystem, when all ranges of the disk are returned.
+	AllocatedOnly bool
+
+	// The options below are only used by GetChangedSectors.
+
+	// DetectZeroes returns ranges that hold only zeroes separately.
+	DetectZeroes bool
+	// Offset and Length limit the listing to a window of the disk. A Length
+	// of 0 means the end of the disk.
+	Offset uint64
+	Length uint64
+	// MaxRanges caps the number of ranges returned. If there are more, the
+	// response holds a token for the next page.
+	MaxRanges int
+	// PageToken is the NextPageToken of a previous response.
+	PageToken string
+}
+
+func (o ChangesOptions) query() url.Values {
+	query := url.Values{}
+	if o.PreviousGenerationID != "" {
+		query.Set("previousGenerationID", o.PreviousGenerationID)
+		query.Set("previousNumber", strconv.FormatUint(uint64(o.PreviousNumber), 10))
+	}
+	if o.AllocatedOnly {
+		query.Set("allocatedOnly", "true")
+	}
+	if o.DetectZeroes {
+		query.Set("detectZeroes", "true")
+	}
+	if o.Offset > 0 {
+		query.Set("offset", strconv.FormatUint(o.Offset, 10))
+	}
+	if o.Length > 0 {
+		query.Set("length", strconv.FormatUint(o.Length, 10))
+	}
+	if o.MaxRanges > 0 {
+		query.Set("maxRanges", strconv.Itoa(o.MaxRanges))
+	}
+	if o.PageToken != "" {
+		query.Set("pageToken", o.PageToken)
+	}
+	return query
+}
+
+// GetChangedSectors returns the ranges of a disk that changed since a previous
+// snapshot.
+func (c *Client) GetChangedSectors(ctx context.Context, snapshotID, diskID string, opts ChangesOptions) (params.ChangesResponse, error) {
+	var changes params.ChangesResponse
+	reqURL := c.apiURL(opts.query(), "snapshots", snapshotID, "changes", diskID)
+	if err := c.doJSON(ctx, http.MethodGet, reqURL, nil, &changes); err != nil {
+		return params.ChangesResponse{}, err
+	}
+	return changes, nil
+}
+
+// StreamChangedSectors requests all changed ranges of a disk, along with their
+// data, in a single response.
+func (c *Client) StreamChangedSectors(ctx context.Context, snapshotID, diskID string, opts ChangesOptions) (*ChangesStream, error) {
+	reqURL := c.apiURL(opts.query(), "snapshots", snapshotID, "stream", diskID)
+	req, err := c.newRequest(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangesStream{body: resp.Body}, nil
+}
+
+// ChangesStream reads the ranges sent by StreamChangedSectors.
+type ChangesStream struct {
+	body io.ReadCloser
+	// remaining is the amount of data of the current range that was not yet read.
+	remaining uint64
+	diskSize  uint64
+	done      bool
+}
+
+// Next returns the next range in the stream. The data of the range can then be
+// read from the stream. Any data of the previous range that was not read is
+// skipped. Next returns io.EOF after the last range, and io.ErrUnexpectedEOF if
+// the stream was interrupted.
+func (s *ChangesStream) Next() (params.DiskRange, error) {
+	if s.done {
+		return params.DiskRange{}, io.EOF
+	}
+	if s.remaining > 0 {
+		if _, err := io.CopyN(ioutil.Discard, s.body, int64(s.remaining)); err != nil {
+			return params.DiskRange{}, io.ErrUnexpectedEOF
+		}
+		s.remaining = 0
+	}
+
+	header, err := stream.ReadFrameHeader(s.body)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return params.DiskRange{}, io.ErrUnexpectedEOF
+		}
+		return params.DiskRange{}, errors.Wrap(err, "reading frame header")
+	}
+	if header.IsEnd() {
+		s.done = true
+		s.diskSize = header.Offset
+		return params.DiskRange{}, io.EOF
+	}
+	s.remaining = header.Length
+	return params.DiskRange{
+		StartOffset: header.Offset,
+		Length:      header.Length,
+	}, nil
+}
+
+// Read reads data of the current range. It returns io.EOF at the end of the range.
+func (s *ChangesStream) Read(p []byte) (int, error) {
+	if s.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.body.Read(p)
+	s.remaining -= uint64(n)
+	if err == io.EOF {
+		if s.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// DiskSize returns the size of the disk. It is only known once Next has returned
+// io.EOF.
+func (s *ChangesStream) DiskSize() uint64 {
+	return s.diskSize
+}
+
+// Close closes the stream.
+func (s *ChangesStream) Close() error {
+	return s.body.Close()
+}
+
+// GetChecksumManifest returns a checksum for every CBT block in the changed ranges
+// of a disk. If algorithm is empty, the agent default is used.
+func (c *Client) GetChecksumManifest(ctx context.Context, snapshotID, diskID, algorithm string, opts ChangesOptions) ([]params.BlockChecksum, error) {
+	query := opts.query()
+	if algorithm != "" {
+		query.Set("algorithm", algorithm)
+	}
+	reqURL := c.apiURL(query, "snapshots", snapshotID, "checksums", diskID)
+	req, err := c.newRequest(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ret := []params.BlockChecksum{}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var entry params.BlockChecksum
+		if err := dec.Decode(&entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, errors.Wrap(err, "decoding checksum manifest")
+		}
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+// CBTBitmap is the CBT bitmap of a disk, as it was when a snapshot was taken.
+type CBTBitmap struct {
+	SnapshotNumber uint32
+	GenerationID   string
+	// BlockSize is the size in bytes of a CBT block.
+	BlockSize int
+	// Blocks is the number of CBT blocks in the bitmap.
+	Blocks int
+	// Encoding is the encoding of Data.
+	Encoding string
+	Data     []byte
+}
+
+// GetCBTBitmap exports the CBT bitmap of a disk snapshot. If encoding is empty,
+// the bitmap is sent raw.
+func (c *Client) GetCBTBitmap(ctx context.Context, snapshotID, diskID, encoding string) (CBTBitmap, error) {
+	query := url.Values{}
+	if encoding != "" {
+		query.Set("encoding", encoding)
+	}
+	reqURL := c.apiURL(query, "snapshots", snapshotID, "bitmap", diskID)
+	req, err := c.newRequest(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return CBTBitmap{}, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return CBTBitmap{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return CBTBitmap{}, errors.Wrap(err, "reading bitmap")
+	}
+
+	snapshotNumber, _ := strconv.ParseUint(resp.Header.Get("X-Snapshot-Number"), 10, 32)
+	blockSize, _ := strconv.Atoi(resp.Header.Get("X-CBT-Block-Size"))
+	blocks, _ := strconv.Atoi(resp.Header.Get("X-CBT-Blocks"))
+	return CBTBitmap{
+		SnapshotNumber: uint32(snapshotNumber),
+		GenerationID:   resp.Header.Get("X-Generation-ID"),
+		BlockSize:      blockSize,
+		Blocks:         blocks,
+		Encoding:       resp.Header.Get("X-Bitmap-Encoding"),
+		Data:           data,
+	}, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// ListSnapStores lists all snap stores.
+func (c *Client) ListSnapStores(ctx context.Context) ([]params.SnapStoreResponse, error) {
+	var stores []params.SnapStoreResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapstores"), nil, &stores); err != nil {
+		return nil, err
+	}
+	return stores, nil
+}
+
+// GetSnapStore returns a snap store, along with the files allocated to it.
+func (c *Client) GetSnapStore(ctx context.Context, snapStoreID string) (params.SnapStoreResponse, error) {
+	var store params.SnapStoreResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapstores", snapStoreID), nil, &store); err != nil {
+		return params.SnapStoreResponse{}, err
+	}
+	return store, nil
+}
+
+// AddSnapStoreCapacity starts an operation that adds size bytes of disk space to a
+// snap store.
+func (c *Client) AddSnapStoreCapacity(ctx context.Context, snapStoreID string, size int64) (params.OperationResponse, error) {
+	req := params.AddSnapStoreStorageRequest{
+		SnapStoreID: snapStoreID,
+		Size:        size,
+	}
+	var op params.OperationResponse
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "snapstores", snapStoreID, "capacity"), req, &op); err != nil {
+		return params.OperationResponse{}, err
+	}
+	return op, nil
+}
+
+// AddSnapStoreCapacityAndWait adds disk space to a snap store, and waits for the
+// operation to finish.
+func (c *Client) AddSnapStoreCapacityAndWait(ctx context.Context, snapStoreID string, size int64) (params.SnapStoreResponse, error) {
+	op, err := c.AddSnapStoreCapacity(ctx, snapStoreID, size)
+	if err != nil {
+		return params.SnapStoreResponse{}, err
+	}
+	op, err = c.WaitOperation(ctx, op.ID)
+	if err != nil {
+		return params.SnapStoreResponse{}, err
+	}
+
+	var store params.SnapStoreResponse
+	if err := json.Unmarshal(op.Result, &store); err != nil {
+		return params.SnapStoreResponse{}, errors.Wrap(err, "decoding operation result")
+	}
+	return store, nil
+}
+
+// locationSegments splits the path of a snap store location into URL path segments.
+// Locations are identified by their path, without the leading slash.
+func locationSegments(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// ListSnapStoreLocations lists all snap store locations.
+func (c *Client) ListSnapStoreLocations(ctx context.Context) ([]params.SnapStoreLocation, error) {
+	var locations []params.SnapStoreLocation
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapstorelocations"), nil, &locations); err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// AddSnapStoreLocation adds a new snap store location, at path.
+func (c *Client) AddSnapStoreLocation(ctx context.Context, path string) (params.SnapStoreLocation, error) {
+	req := params.AddSnapStoreLocationRequest{
+		Path: path,
+	}
+	var location params.SnapStoreLocation
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "snapstorelocations"), req, &location); err != nil {
+		return params.SnapStoreLocation{}, err
+	}
+	return location, nil
+}
+
+// GetSnapStoreLocation returns the snap store location at path.
+func (c *Client) GetSnapStoreLocation(ctx context.Context, path string) (params.SnapStoreLocation, error) {
+	var location params.SnapStoreLocation
+	segments := append([]string{"snapstorelocations"}, locationSegments(path)...)
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, segments...), nil, &location); err != nil {
+		return params.SnapStoreLocation{}, err
+	}
+	return location, nil
+}
+
+// UpdateSnapStoreLocation enables or disables the snap store location at path.
+func (c *Client) UpdateSnapStoreLocation(ctx context.Context, path string, enabled bool) (params.SnapStoreLocation, error) {
+	req := params.UpdateSnapStoreLocationRequest{
+		Enabled: &enabled,
+	}
+	var location params.SnapStoreLocation
+	segments := append([]string{"snapstorelocations"}, locationSegments(path)...)
+	if err := c.doJSON(ctx, http.MethodPut, c.apiURL(nil, segments...), req, &location); err != nil {
+		return params.SnapStoreLocation{}, err
+	}
+	return location, nil
+}
+
+// DrainSnapStoreLocation disables the snap store location at path, and returns the
+// snap stores that still use it.
+func (c *Client) DrainSnapStoreLocation(ctx context.Context, path string) (params.SnapStoreLocationDrainResponse, error) {
+	var status params.SnapStoreLocationDrainResponse
+	segments := append([]string{"snapstorelocations"}, locationSegments(path)...)
+	segments = append(segments, "drain")
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, segments...), nil, &status); err != nil {
+		return params.SnapStoreLocationDrainResponse{}, err
+	}
+	return status, nil
+}
+
+// RemoveSnapStoreLocation removes the snap store location at path.
+func (c *Client) RemoveSnapStoreLocation(ctx context.Context, path string) error {
+	segments := append([]string{"snapstorelocations"}, locationSegments(path)...)
+	return c.doJSON(ctx, http.MethodDelete, c.apiURL(nil, segments...), nil, nil)
+}
+
+// ListSnapStoreMappings lists all snap store mappings.
+func (c *Client) ListSnapStoreMappings(ctx context.Context) ([]params.SnapStoreMappingResponse, error) {
+	var mappings []params.SnapStoreMappingResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapstoremappings"), nil, &mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// CreateSnapStoreMapping maps a tracked disk to a snap store location.
+func (c *Client) CreateSnapStoreMapping(ctx context.Context, locationPath, diskID string) (params.SnapStoreMappingResponse, error) {
+	req := params.CreateSnapStoreMappingRequest{
+		SnapStoreLocation: locationPath,
+		TrackedDisk:       diskID,
+	}
+	var mapping params.SnapStoreMappingResponse
+	if err := c.doJSON(ctx, http.MethodPost, c.apiURL(nil, "snapstoremappings"), req, &mapping); err != nil {
+		return params.SnapStoreMappingResponse{}, err
+	}
+	return mapping, nil
+}
+
+// GetSnapStoreMapping returns a snap store mapping.
+func (c *Client) GetSnapStoreMapping(ctx context.Context, mappingID string) (params.SnapStoreMappingResponse, error) {
+	var mapping params.SnapStoreMappingResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "snapstoremappings", mappingID), nil, &mapping); err != nil {
+		return params.SnapStoreMappingResponse{}, err
+	}
+	return mapping, nil
+}
+
+// UpdateSnapStoreMapping points a snap store mapping to a different location.
+func (c *Client) UpdateSnapStoreMapping(ctx context.Context, mappingID, locationPath string) (params.SnapStoreMappingResponse, error) {
+	req := params.UpdateSnapStoreMappingRequest{
+		SnapStoreLocation: locationPath,
+	}
+	var mapping params.SnapStoreMappingResponse
+	if err := c.doJSON(ctx, http.MethodPut, c.apiURL(nil, "snapstoremappings", mappingID), req, &mapping); err != nil {
+		return params.SnapStoreMappingResponse{}, err
+	}
+	return mapping, nil
+}
+
+// DeleteSnapStoreMapping deletes a snap store mapping.
+func (c *Client) DeleteSnapStoreMapping(ctx context.Context, mappingID string) error {
+	return c.doJSON(ctx, http.MethodDelete, c.apiURL(nil, "snapstoremappings", mappingID), nil, nil)
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// GetThrottle returns the snapshot read limits in effect.
+func (c *Client) GetThrottle(ctx context.Context) (params.ThrottleResponse, error) {
+	var resp params.ThrottleResponse
+	if err := c.doJSON(ctx, http.MethodGet, c.apiURL(nil, "throttle"), nil, &resp); err != nil {
+		return params.ThrottleResponse{}, err
+	}
+	return resp, nil
+}
+
+// SetThrottle overrides the snapshot read limits set in the agent config. A
+// duration of 0 keeps the override until it is removed, or the agent restarts.
+func (c *Client) SetThrottle(ctx context.Context, limits params.ThrottleLimits, duration int) (params.ThrottleResponse, error) {
+	req := params.SetThrottleRequest{
+		Limits:   limits,
+		Duration: duration,
+	}
+	var resp params.ThrottleResponse
+	if err := c.doJSON(ctx, http.MethodPut, c.apiURL(nil, "throttle"), req, &resp); err != nil {
+		return params.ThrottleResponse{}, err
+	}
+	return resp, nil
+}
+
+// RemoveThrottle removes the override set with SetThrottle.
+func (c *Client) RemoveThrottle(ctx context.Context) (params.ThrottleResponse, error) {
+	var resp params.ThrottleResponse
+	if err := c.doJSON(ctx, http.MethodDelete, c.apiURL(nil, "throttle"), nil, &resp); err != nil {
+		return params.ThrottleResponse{}, err
+	}
+	return resp, nil
+}
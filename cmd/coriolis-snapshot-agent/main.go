@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -24,11 +25,15 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"coriolis-snapshot-agent/apiserver/auth"
 	"coriolis-snapshot-agent/apiserver/controllers"
 	"coriolis-snapshot-agent/apiserver/routers"
+	"coriolis-snapshot-agent/cli"
 	"coriolis-snapshot-agent/config"
 	"coriolis-snapshot-agent/internal/ioctl"
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/internal/storage"
 	"coriolis-snapshot-agent/scripts"
 	"coriolis-snapshot-agent/util"
@@ -44,12 +49,30 @@ var (
 var Version string
 
 func main() {
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nWithout a command, the agent is started.\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(out)
+		cli.Usage(out)
+	}
 	flag.Parse()
 	if *version {
 		fmt.Println(Version)
 		return
 	}
 
+	if flag.NArg() > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		err := cli.Run(ctx, *conf, flag.Args())
+		stop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *install {
 		scripts.RunInstall()
 		return
@@ -68,11 +91,19 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.SetOutput(logWriter)
+	logger, err := cfg.Logging.NewLogger(logWriter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetDefault(logger)
+	// Lines logged with the standard library logger go through the structured
+	// logger, so the whole log has the same format.
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	if err := ioctl.SetMissingKernelEntries(); err != nil {
+	if err := ioctl.SetMissingKernelEntries(ctx); err != nil {
 		log.Fatalf("Error setting missing kernel entries: %+v\n", err)
 	}
 
@@ -100,9 +131,25 @@ func main() {
 		log.Fatalf("failed to create controller: %+v", err)
 	}
 
-	router := routers.NewAPIRouter(controller, logWriter)
+	var tokens auth.TokenValidator
+	if cfg.APIServer.TokenAuth.Enabled() {
+		tokens = mgr
+	}
+	policy, err := auth.NewPolicy(cfg.APIServer.Authorization, tokens)
+	if err != nil {
+		log.Fatalf("failed to load authorization policy: %+v", err)
+	}
+	if len(cfg.APIServer.Authorization.Rules) == 0 {
+		logger.Warnf("no authorization rules are defined. All clients have the admin role")
+	}
+
+	if cfg.AuditLogFile == "" {
+		logger.Warnf("audit_log_file is not set. API calls will not be audited")
+	}
+
+	router := routers.NewAPIRouter(controller, policy, mgr.AuditLog(), logWriter)
 
-	tlsCfg, err := cfg.APIServer.TLSConfig.TLSConfig()
+	tlsCfg, err := cfg.APIServer.ServerTLSConfig()
 	if err != nil {
 		log.Fatalf("failed to get TLS config: %q", err)
 	}
@@ -113,16 +160,54 @@ func main() {
 		// Pass our instance of gorilla/mux in.
 		Handler: router,
 	}
+	// Event streams never end on their own. They are closed when the server
+	// starts shutting down.
+	srv.RegisterOnShutdown(mgr.BeginShutdown)
 	go func() {
 		if err := srv.ListenAndServeTLS(
 			cfg.APIServer.TLSConfig.Cert,
-			cfg.APIServer.TLSConfig.Key); err != nil {
+			cfg.APIServer.TLSConfig.Key); err != nil && !errors.Is(err, http.ErrServerClosed) {
 
 			log.Fatal(err)
 		}
 	}()
 
-	<-stop
+	sig := <-stop
+	logger.Infof("got %s signal, shutting down", sig)
+	go func() {
+		sig := <-stop
+		logger.Errorf("got %s signal while shutting down, exiting", sig)
+		os.Exit(1)
+	}()
+	shutdown(srv, mgr, time.Duration(cfg.ShutdownTimeout)*time.Second)
 	cancel()
 	// snapStorageWorker.Wait()
 }
+
+// shutdown stops accepting API requests, and waits up to timeout for the ones in
+// flight, like snapshot reads, to finish. Connections still open after that are
+// closed. The manager is then stopped, and gets up to timeout for its operations,
+// workers, snap store watchers and remaining snapshot reads to stop, before the
+// database is closed.
+func shutdown(srv *http.Server, mgr *manager.Snapshot, timeout time.Duration) {
+	logger := logging.Default()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warnf("failed to finish API requests in %s, closing connections: %q", timeout, err)
+		srv.Close()
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), timeout)
+	defer waitCancel()
+	if err := mgr.Stop(waitCtx); err != nil {
+		logger.Errorf("failed to stop manager: %+v", err)
+	}
+	if err := mgr.Wait(waitCtx); err != nil {
+		logger.Errorf("failed to stop manager: %+v", err)
+	}
+	if err := mgr.Close(); err != nil {
+		logger.Errorf("failed to close manager: %+v", err)
+	}
+	logger.Infof("shutdown complete")
+}
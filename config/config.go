@@ -19,15 +19,21 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 
 	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/internal/storage"
 	"coriolis-snapshot-agent/internal/types"
 	"coriolis-snapshot-agent/internal/util"
@@ -50,6 +56,35 @@ const (
 	// DefaultSnapStoreFileSize is the default allocation size for new chunks that get
 	// added to a snap store.
 	DefaultSnapStoreFileSize uint64 = 2 * 1024 * 1024 * 1024 // 2GB
+
+	// DefaultWebhookMaxRetries is the default number of times we retry sending
+	// an event to a webhook, before giving up.
+	DefaultWebhookMaxRetries = 10
+
+	// DefaultWebhookTimeout is the default timeout, in seconds, for a single
+	// webhook request.
+	DefaultWebhookTimeout = 10
+
+	// DefaultWebhookQueueFile is the default location of the webhook delivery
+	// queue. Unlike the DB file, it must survive reboots, so queued events
+	// are not lost.
+	DefaultWebhookQueueFile = "/var/lib/coriolis-snapshot-agent/webhook-queue.db"
+
+	// DefaultTokenLifetime is the default lifetime, in seconds, of API tokens.
+	DefaultTokenLifetime = 3600
+
+	// DefaultMaxTokenLifetime is the default for the longest lifetime, in seconds,
+	// a client can ask for when logging in.
+	DefaultMaxTokenLifetime = 86400
+
+	// DefaultThrottleRetryAfter is the default number of seconds clients are
+	// asked to wait, when a snapshot read is rejected because of a limit.
+	DefaultThrottleRetryAfter = 30
+
+	// DefaultShutdownTimeout is the default number of seconds the agent waits
+	// for API requests, and then for background workers, to finish when it
+	// shuts down.
+	DefaultShutdownTimeout = 60
 )
 
 // ParseConfig parses the file passed in as cfgFile and returns
@@ -91,6 +126,39 @@ func ParseConfig(cfgFile string) (*Config, error) {
 		config.SnapStoreFileSize = DefaultSnapStoreFileSize
 	}
 
+	if config.WebhookQueueFile == "" {
+		config.WebhookQueueFile = DefaultWebhookQueueFile
+	}
+
+	for idx := range config.Webhooks {
+		if config.Webhooks[idx].MaxRetries == 0 {
+			config.Webhooks[idx].MaxRetries = DefaultWebhookMaxRetries
+		}
+		if config.Webhooks[idx].Timeout == 0 {
+			config.Webhooks[idx].Timeout = DefaultWebhookTimeout
+		}
+	}
+
+	if config.APIServer.TokenAuth.DefaultLifetime == 0 {
+		config.APIServer.TokenAuth.DefaultLifetime = DefaultTokenLifetime
+	}
+	if config.APIServer.TokenAuth.MaxLifetime == 0 {
+		config.APIServer.TokenAuth.MaxLifetime = DefaultMaxTokenLifetime
+	}
+
+	if config.Throttle.RetryAfter == 0 {
+		config.Throttle.RetryAfter = DefaultThrottleRetryAfter
+	}
+
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	if config.Health.MinFreeSpace == 0 {
+		// A location should have room for at least one more snap store chunk.
+		config.Health.MinFreeSpace = config.SnapStoreFileSize / (1024 * 1024)
+	}
+
 	if err := config.Validate(); err != nil {
 		return nil, errors.Wrap(err, "validating config")
 	}
@@ -125,6 +193,17 @@ type Config struct {
 	APIServer APIServer `toml:"api"`
 	// LogFile is the location of the log file
 	LogFile string `toml:"log_file"`
+	// Logging sets the format and the level of the log.
+	Logging Logging `toml:"logging"`
+	// ShutdownTimeout is the number of seconds the agent waits for API
+	// requests that are in flight, like snapshot reads, to finish when it
+	// shuts down. It then waits as long for background workers and
+	// operations to stop.
+	ShutdownTimeout int `toml:"shutdown_timeout"`
+	// AuditLogFile is the location of the audit log. API calls that change
+	// the state of the agent, or read snapshot data, are recorded here. If
+	// empty, no audit log is kept.
+	AuditLogFile string `toml:"audit_log_file"`
 	// CoWDestination is the path to a folder where snap storage
 	// extents will be pre-allocated via files. This folder must
 	// live on a separate disk, which will be excluded from being
@@ -144,6 +223,18 @@ type Config struct {
 	// mappings.
 	SnapStoreMappings []SnapStoreMapping `toml:"snapstore_mapping"`
 	SnapStoreFileSize uint64             `toml:"snap_store_file_size"`
+	// Webhooks is a list of HTTPS endpoints that agent events are
+	// posted to.
+	Webhooks []Webhook `toml:"webhook"`
+	// WebhookQueueFile is the path to the database that holds the events
+	// waiting to be delivered to webhooks. It must not be on a tmpfs
+	// filesystem, so queued events survive reboots.
+	WebhookQueueFile string `toml:"webhook_queue_file"`
+	// Throttle limits the bandwidth and the number of concurrent snapshot
+	// reads.
+	Throttle Throttle `toml:"throttle"`
+	// Health configures the health and readiness checks.
+	Health Health `toml:"health"`
 
 	cowDestinationDevicePaths []string
 }
@@ -189,6 +280,55 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	webhookNames := map[string]bool{}
+	for _, webhook := range c.Webhooks {
+		if err := webhook.Validate(); err != nil {
+			return errors.Wrapf(err, "validating webhook %s", webhook.Name)
+		}
+		if webhookNames[webhook.Name] {
+			return vErrors.NewValueError("duplicate webhook name %s", webhook.Name)
+		}
+		webhookNames[webhook.Name] = true
+	}
+	if len(c.Webhooks) > 0 {
+		if err := c.validateWebhookQueueFile(); err != nil {
+			return errors.Wrap(err, "validating webhook_queue_file")
+		}
+	}
+
+	if err := c.Throttle.Validate(); err != nil {
+		return errors.Wrap(err, "validating throttle section")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return vErrors.NewValueError("invalid shutdown_timeout %d", c.ShutdownTimeout)
+	}
+
+	if err := c.Logging.Validate(); err != nil {
+		return errors.Wrap(err, "validating logging section")
+	}
+
+	return nil
+}
+
+func (c *Config) validateWebhookQueueFile() error {
+	if c.WebhookQueueFile == "" {
+		return vErrors.NewValueError("missing webhook_queue_file")
+	}
+
+	parentDir := filepath.Dir(c.WebhookQueueFile)
+	if _, err := os.Stat(parentDir); err != nil {
+		return errors.Wrapf(err, "webhook queue file parent dir %s does not exist", parentDir)
+	}
+
+	parentDirInfo, err := util.GetFileSystemInfoFromPath(parentDir)
+	if err != nil {
+		return errors.Wrap(err, "getting webhook queue dir info")
+	}
+
+	if parentDirInfo.Type == storage.TMPFS_MAGIC {
+		return vErrors.NewValueError("webhook queue file path is on a tmpfs filesystem")
+	}
 	return nil
 }
 
@@ -198,6 +338,24 @@ type APIServer struct {
 	Bind      string    `toml:"bind"`
 	Port      int       `toml:"port"`
 	TLSConfig TLSConfig `toml:"tls"`
+	// Authorization maps client certificates to roles.
+	Authorization Authorization `toml:"authorization"`
+	// TokenAuth allows clients without a certificate to log in, and use
+	// bearer tokens.
+	TokenAuth TokenAuth `toml:"token_auth"`
+}
+
+// ServerTLSConfig returns the *tls.Config used by the API server. Client
+// certificates are verified if sent, but are optional, so health checks and
+// token logins can reach the agent. The authorization policy rejects requests
+// without a certificate or token to any other route.
+func (a *APIServer) ServerTLSConfig() (*tls.Config, error) {
+	tlsCfg, err := a.TLSConfig.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsCfg, nil
 }
 
 // BindAddress returns a host:port string.
@@ -221,9 +379,153 @@ func (a *APIServer) Validate() error {
 	if err := a.TLSConfig.Validate(); err != nil {
 		return errors.Wrap(err, "validating TLS config")
 	}
+	if err := a.Authorization.Validate(); err != nil {
+		return errors.Wrap(err, "validating authorization config")
+	}
+	if err := a.TokenAuth.Validate(); err != nil {
+		return errors.Wrap(err, "validating token auth config")
+	}
+	return nil
+}
+
+const (
+	// RoleReadOnly can view disks, snapshots, snap stores and their
+	// settings, but cannot read snapshot data.
+	RoleReadOnly = "read-only"
+	// RoleConsumer can do everything RoleReadOnly can, and can also create,
+	// delete and read snapshots.
+	RoleConsumer = "consumer"
+	// RoleAdmin can do anything, including tracking disks and managing snap
+	// store locations and mappings.
+	RoleAdmin = "admin"
+)
+
+// Authorization maps client certificates to roles.
+type Authorization struct {
+	// DefaultRole is given to client certificates that match none of
+	// the rules. If empty, those certificates are denied access. When
+	// no rules are defined, all certificates get the admin role.
+	DefaultRole string `toml:"default_role"`
+	// Rules map certificate identities to roles. If a certificate matches
+	// more than one rule, it gets the role with the most permissions.
+	Rules []AuthorizationRule `toml:"rule"`
+}
+
+// Validate validates the authorization config
+func (a *Authorization) Validate() error {
+	if a.DefaultRole != "" {
+		if err := validateRole(a.DefaultRole); err != nil {
+			return err
+		}
+	}
+	for idx, rule := range a.Rules {
+		if err := rule.Validate(); err != nil {
+			return errors.Wrapf(err, "validating rule %d", idx)
+		}
+	}
+	return nil
+}
+
+// AuthorizationRule gives a role to client certificates. A certificate
+// matches the rule if any of its identities is listed.
+type AuthorizationRule struct {
+	// Role is one of read-only, consumer or admin.
+	Role string `toml:"role"`
+	// CommonNames is a list of certificate subject common names.
+	CommonNames []string `toml:"common_names"`
+	// OrganizationalUnits is a list of certificate subject organizational units.
+	OrganizationalUnits []string `toml:"organizational_units"`
+	// SubjectAltNames is a list of DNS names, email addresses, URIs or IP
+	// addresses, found in the subject alternative names of certificates.
+	SubjectAltNames []string `toml:"subject_alt_names"`
+}
+
+// Validate validates the authorization rule
+func (a *AuthorizationRule) Validate() error {
+	if err := validateRole(a.Role); err != nil {
+		return err
+	}
+	if len(a.CommonNames) == 0 && len(a.OrganizationalUnits) == 0 && len(a.SubjectAltNames) == 0 {
+		return vErrors.NewValueError("rule for role %s does not match any certificate", a.Role)
+	}
 	return nil
 }
 
+// TokenAuth holds the settings for bearer token authentication.
+type TokenAuth struct {
+	// SigningKeyFile is a file holding the key used to sign tokens. If
+	// empty, a random key is generated every time the agent starts, and
+	// tokens do not survive restarts.
+	SigningKeyFile string `toml:"signing_key_file"`
+	// DefaultLifetime is the lifetime, in seconds, of tokens for which
+	// the client did not ask for a specific lifetime.
+	DefaultLifetime int `toml:"default_lifetime"`
+	// MaxLifetime is the longest lifetime, in seconds, a client can ask for.
+	MaxLifetime int `toml:"max_lifetime"`
+	// Credentials are the accounts clients can log in with.
+	Credentials []Credential `toml:"credential"`
+}
+
+// Enabled returns true if clients can log in with a credential.
+func (t *TokenAuth) Enabled() bool {
+	return len(t.Credentials) > 0
+}
+
+// Validate validates the token auth config
+func (t *TokenAuth) Validate() error {
+	if t.DefaultLifetime < 0 || t.MaxLifetime < 0 || t.DefaultLifetime > t.MaxLifetime {
+		return vErrors.NewValueError("invalid token lifetimes")
+	}
+	if t.SigningKeyFile != "" {
+		if _, err := os.Stat(t.SigningKeyFile); err != nil {
+			return errors.Wrapf(err, "signing key file %s", t.SigningKeyFile)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, credential := range t.Credentials {
+		if err := credential.Validate(); err != nil {
+			return errors.Wrapf(err, "validating credential %s", credential.Name)
+		}
+		if names[credential.Name] {
+			return vErrors.NewValueError("duplicate credential name %s", credential.Name)
+		}
+		names[credential.Name] = true
+	}
+	return nil
+}
+
+// Credential is an account clients can log in with, to get a token.
+type Credential struct {
+	// Name identifies the credential.
+	Name string `toml:"name"`
+	// SecretHash is the bcrypt hash of the secret. Hashes can be generated
+	// with the "auth hash-secret" command.
+	SecretHash string `toml:"secret_hash"`
+	// Role is the role of clients that log in with this credential.
+	Role string `toml:"role"`
+}
+
+// Validate validates the credential
+func (c *Credential) Validate() error {
+	if c.Name == "" {
+		return vErrors.NewValueError("missing credential name")
+	}
+	if _, err := bcrypt.Cost([]byte(c.SecretHash)); err != nil {
+		return errors.Wrap(err, "parsing secret hash")
+	}
+	return validateRole(c.Role)
+}
+
+func validateRole(role string) error {
+	switch role {
+	case RoleReadOnly, RoleConsumer, RoleAdmin:
+		return nil
+	default:
+		return vErrors.NewValueError("invalid role %q", role)
+	}
+}
+
 // TLSConfig is the API server TLS config
 type TLSConfig struct {
 	Cert   string `toml:"certificate"`
@@ -263,6 +565,111 @@ func (t *TLSConfig) TLSConfig() (*tls.Config, error) {
 	}, nil
 }
 
+// ClientTLSConfig returns a *tls.Config for clients of the agent API. The
+// CA certificate is used to validate the agent certificate, and the
+// certificate and key, if set, are presented to the agent.
+func (t *TLSConfig) ClientTLSConfig() (*tls.Config, error) {
+	caCertPEM, err := ioutil.ReadFile(t.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	ok := roots.AppendCertsFromPEM(caCertPEM)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse CA cert")
+	}
+
+	tlsCfg := &tls.Config{
+		RootCAs: roots,
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// Webhook is an HTTPS endpoint that agent events are posted to.
+type Webhook struct {
+	// Name uniquely identifies this webhook.
+	Name string `toml:"name"`
+	// URL is the HTTPS URL events are posted to.
+	URL string `toml:"url"`
+	// Events is the list of event types sent to this webhook. If empty,
+	// all events are sent.
+	Events []string `toml:"events"`
+	// CACert is the CA certificate used to validate the webhook server
+	// certificate. If empty, the system CA bundle is used.
+	CACert string `toml:"ca_certificate"`
+	// Cert and Key are an optional client certificate and key, presented
+	// to the webhook server.
+	Cert string `toml:"certificate"`
+	Key  string `toml:"key"`
+	// MaxRetries is the number of times we retry sending an event, before
+	// giving up.
+	MaxRetries int `toml:"max_retries"`
+	// Timeout is the timeout, in seconds, for a single request.
+	Timeout int `toml:"timeout"`
+}
+
+// Validate validates the webhook config
+func (w *Webhook) Validate() error {
+	if w.Name == "" {
+		return vErrors.NewValueError("missing webhook name")
+	}
+
+	parsed, err := url.Parse(w.URL)
+	if err != nil {
+		return errors.Wrap(err, "parsing webhook URL")
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return vErrors.NewValueError("webhook URL must be an https URL")
+	}
+
+	if (w.Cert == "") != (w.Key == "") {
+		return vErrors.NewValueError("webhook certificate and key must be set together")
+	}
+
+	if w.MaxRetries < 0 || w.Timeout < 0 {
+		return vErrors.NewValueError("invalid retry or timeout settings")
+	}
+
+	if _, err := w.TLSConfig(); err != nil {
+		return errors.Wrap(err, "loading webhook TLS config")
+	}
+	return nil
+}
+
+// TLSConfig returns a client side *tls.Config used to connect to the webhook.
+func (w *Webhook) TLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+	if w.CACert != "" {
+		caCertPEM, err := ioutil.ReadFile(w.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if ok := roots.AppendCertsFromPEM(caCertPEM); !ok {
+			return nil, fmt.Errorf("failed to parse CA cert")
+		}
+		tlsCfg.RootCAs = roots
+	}
+
+	if w.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(w.Cert, w.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
 // Dump dumps the config to a file
 func (c *Config) Dump(destination string) error {
 	fd, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE, 00700)
@@ -276,3 +683,233 @@ func (c *Config) Dump(destination string) error {
 	}
 	return nil
 }
+
+// ThrottleLimits are limits on snapshot reads. A limit of 0 means unlimited.
+type ThrottleLimits struct {
+	// MaxStreams is the number of snapshot reads that can run at the same time.
+	MaxStreams int `toml:"max_streams"`
+	// MaxStreamsPerDisk is the number of reads of the same disk that can run
+	// at the same time.
+	MaxStreamsPerDisk int `toml:"max_streams_per_disk"`
+	// MaxBandwidth is the read bandwidth, in MiB/s, shared by all reads.
+	MaxBandwidth int64 `toml:"max_bandwidth_mib"`
+	// MaxBandwidthPerDisk is the read bandwidth, in MiB/s, shared by the
+	// reads of the same disk.
+	MaxBandwidthPerDisk int64 `toml:"max_bandwidth_per_disk_mib"`
+}
+
+// Validate validates the limits
+func (t *ThrottleLimits) Validate() error {
+	if t.MaxStreams < 0 || t.MaxStreamsPerDisk < 0 || t.MaxBandwidth < 0 || t.MaxBandwidthPerDisk < 0 {
+		return vErrors.NewValueError("throttle limits must not be negative")
+	}
+	return nil
+}
+
+// Throttle holds the limits applied to snapshot reads. The limits of the
+// first schedule that is active replace the default limits.
+type Throttle struct {
+	ThrottleLimits
+	// QueueTimeout is the number of seconds a read waits for a free slot,
+	// when the stream limits are reached. If 0, reads are rejected right away.
+	QueueTimeout int `toml:"queue_timeout"`
+	// RetryAfter is the number of seconds clients are asked to wait before
+	// retrying a rejected read.
+	RetryAfter int `toml:"retry_after"`
+	// Schedules change the limits during some hours of the day.
+	Schedules []ThrottleSchedule `toml:"schedule"`
+}
+
+// Validate validates the throttle config
+func (t *Throttle) Validate() error {
+	if err := t.ThrottleLimits.Validate(); err != nil {
+		return err
+	}
+	if t.QueueTimeout < 0 || t.RetryAfter < 0 {
+		return vErrors.NewValueError("invalid queue_timeout or retry_after")
+	}
+	for idx := range t.Schedules {
+		if err := t.Schedules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating schedule %s", t.Schedules[idx].Name)
+		}
+	}
+	return nil
+}
+
+// LimitsAt returns the limits in effect at the given time, along with the
+// name of the schedule they come from. The name is empty if no schedule is
+// active.
+func (t *Throttle) LimitsAt(now time.Time) (ThrottleLimits, string) {
+	for _, schedule := range t.Schedules {
+		if schedule.Active(now) {
+			return schedule.Apply(t.ThrottleLimits), schedule.Name
+		}
+	}
+	return t.ThrottleLimits, ""
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseClock parses a HH:MM time of day, and returns the number of minutes
+// since midnight.
+func parseClock(val string) (int, error) {
+	parsed, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, vErrors.NewValueError("invalid time of day %q", val)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// ThrottleSchedule replaces the throttle limits between two times of day.
+// Limits that are not set keep their default value.
+type ThrottleSchedule struct {
+	// Name identifies the schedule.
+	Name string `toml:"name"`
+	// Days is the list of days (mon, tue, ...) the schedule applies to. If
+	// empty, the schedule applies to every day.
+	Days []string `toml:"days"`
+	// Start and End are HH:MM times of day, in the local time of the agent
+	// host. If End is before Start, the schedule ends on the next day.
+	Start string `toml:"start"`
+	End   string `toml:"end"`
+
+	MaxStreams          *int   `toml:"max_streams"`
+	MaxStreamsPerDisk   *int   `toml:"max_streams_per_disk"`
+	MaxBandwidth        *int64 `toml:"max_bandwidth_mib"`
+	MaxBandwidthPerDisk *int64 `toml:"max_bandwidth_per_disk_mib"`
+}
+
+// Validate validates the schedule
+func (s *ThrottleSchedule) Validate() error {
+	if s.Name == "" {
+		return vErrors.NewValueError("missing schedule name")
+	}
+	for _, day := range s.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return vErrors.NewValueError("invalid day %q", day)
+		}
+	}
+	if _, err := parseClock(s.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(s.End); err != nil {
+		return err
+	}
+	limits := s.Apply(ThrottleLimits{})
+	return limits.Validate()
+}
+
+// Active returns true if the schedule applies at the given time.
+func (s *ThrottleSchedule) Active(now time.Time) bool {
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	var inWindow bool
+	switch {
+	case start < end:
+		inWindow = minute >= start && minute < end
+	case start > end:
+		// The part of the window after midnight belongs to the day
+		// the window started on.
+		inWindow = minute >= start || minute < end
+		if minute < end {
+			day = (day + 6) % 7
+		}
+	default:
+		inWindow = true
+	}
+	if !inWindow {
+		return false
+	}
+
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, val := range s.Days {
+		if weekdays[strings.ToLower(val)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns limits, with the limits set in the schedule replaced.
+func (s *ThrottleSchedule) Apply(limits ThrottleLimits) ThrottleLimits {
+	if s.MaxStreams != nil {
+		limits.MaxStreams = *s.MaxStreams
+	}
+	if s.MaxStreamsPerDisk != nil {
+		limits.MaxStreamsPerDisk = *s.MaxStreamsPerDisk
+	}
+	if s.MaxBandwidth != nil {
+		limits.MaxBandwidth = *s.MaxBandwidth
+	}
+	if s.MaxBandwidthPerDisk != nil {
+		limits.MaxBandwidthPerDisk = *s.MaxBandwidthPerDisk
+	}
+	return limits
+}
+
+// Health configures the health and readiness checks.
+type Health struct {
+	// MinFreeSpace is the amount of free disk space, in MiB, each snap
+	// store location needs for the agent to be ready. Defaults to the
+	// snap store file size.
+	MinFreeSpace uint64 `toml:"min_free_space_mib"`
+}
+
+// MinFreeSpaceBytes returns MinFreeSpace in bytes.
+func (h *Health) MinFreeSpaceBytes() uint64 {
+	return h.MinFreeSpace * 1024 * 1024
+}
+
+// Logging sets the format and the level of the log.
+type Logging struct {
+	// Format is the layout of log lines. One of text, logfmt or json.
+	// Defaults to text.
+	Format string `toml:"format"`
+	// Level is the lowest level that gets logged. One of debug, info,
+	// warn or error. Defaults to info.
+	Level string `toml:"level"`
+}
+
+// Validate validates the logging section.
+func (l *Logging) Validate() error {
+	if _, err := logging.ParseFormat(l.Format); err != nil {
+		return err
+	}
+	if _, err := logging.ParseLevel(l.Level); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NewLogger returns a logger that writes to writer, using the configured
+// format and level.
+func (l *Logging) NewLogger(writer io.Writer) (*logging.Logger, error) {
+	format, err := logging.ParseFormat(l.Format)
+	if err != nil {
+		return nil, err
+	}
+	level, err := logging.ParseLevel(l.Level)
+	if err != nil {
+		return nil, err
+	}
+	return logging.New(writer, format, level), nil
+}
@@ -16,7 +16,6 @@
 package db
 
 import (
-	"log"
 	"regexp"
 	"time"
 
@@ -25,7 +24,6 @@ import (
 	"go.etcd.io/bbolt"
 
 	vErrors "coriolis-snapshot-agent/errors"
-	"coriolis-snapshot-agent/internal/types"
 )
 
 // Open opens the database at path and returns a *bolt.DB object
@@ -60,6 +58,23 @@ type Database struct {
 	con      *bolthold.Store
 }
 
+// Close closes the database. Data is synced to disk on every update, so
+// no writes are lost on close.
+func (d *Database) Close() error {
+	if err := d.con.Close(); err != nil {
+		return errors.Wrap(err, "closing database")
+	}
+	return nil
+}
+
+// Ping verifies that the database is open and that a read transaction can be started.
+func (d *Database) Ping() error {
+	if err := d.con.Bolt().View(func(tx *bbolt.Tx) error { return nil }); err != nil {
+		return errors.Wrap(err, "reading database")
+	}
+	return nil
+}
+
 /////////////////
 // TrackedDisk //
 /////////////////
@@ -102,7 +117,13 @@ func (d *Database) CreateTrackedDisk(device TrackedDisk) (TrackedDisk, error) {
 }
 
 // RemoveTrackedDisk removes a tracked disk entity from the database.
-func (d *Database) RemoveTrackedDisk(device types.DevID) error {
+func (d *Database) RemoveTrackedDisk(trackingID string) error {
+	param := TrackedDisk{}
+	if err := d.con.Delete(trackingID, &param); err != nil {
+		if !errors.Is(err, bolthold.ErrNotFound) {
+			return errors.Wrap(err, "deleting tracked disk from db")
+		}
+	}
 	return nil
 }
 
@@ -114,7 +135,7 @@ func (d *Database) GetSnapshot(snapID string) (Snapshot, error) {
 	var snapshot Snapshot
 	if err := d.con.FindOne(&snapshot, bolthold.Where("SnapshotID").Eq(snapID)); err != nil {
 		if errors.Is(err, bolthold.ErrNotFound) {
-			return snapshot, vErrors.NewNotFoundError("snapshot ID %d not found in db", snapID)
+			return snapshot, vErrors.NewNotFoundError("snapshot ID %s not found in db", snapID)
 		}
 		return snapshot, errors.Wrap(err, "finding location in db")
 	}
@@ -277,7 +298,7 @@ func (d *Database) GetSnapshotImageBySnapshotID(snapshotID uint64) (SnapshotImag
 	var snapshotImage SnapshotImage
 	if err := d.con.FindOne(&snapshotImage, bolthold.Where("SnapshotID").Eq(snapshotID)); err != nil {
 		if errors.Is(err, bolthold.ErrNotFound) {
-			return SnapshotImage{}, vErrors.NewNotFoundError("snapshot image for snapshot ID %s not found", snapshotID)
+			return SnapshotImage{}, vErrors.NewNotFoundError("snapshot image for snapshot ID %d not found", snapshotID)
 		}
 		return SnapshotImage{}, errors.Wrap(err, "fetching snapshot image")
 	}
@@ -335,6 +356,15 @@ func (d *Database) ListSnapStores() ([]SnapStore, error) {
 	return stores, nil
 }
 
+// ListSnapStoresForLocation fetches all snap stores that were created in a snap store location.
+func (d *Database) ListSnapStoresForLocation(locationID string) ([]SnapStore, error) {
+	var stores []SnapStore
+	if err := d.con.Find(&stores, bolthold.Where("StorageLocation.Path").Eq(locationID)); err != nil {
+		return nil, errors.Wrap(err, "listing snapstores for location")
+	}
+	return stores, nil
+}
+
 func (d *Database) FindSnapStoreFiles(storeID string) ([]SnapStoreFile, error) {
 	var files []SnapStoreFile
 	if err := d.con.Find(&files, bolthold.Where("SnapStore.SnapStoreID").Eq(storeID)); err != nil {
@@ -390,7 +420,6 @@ func (d *Database) DeleteSnapStoreFile(fileID string) error {
 		if !errors.Is(err, bolthold.ErrNotFound) {
 			return errors.Wrap(err, "deleting snap store file from db")
 		}
-		log.Printf("snapstore file %s not found", fileID)
 	}
 	return nil
 }
@@ -462,6 +491,25 @@ func (d *Database) CreateSnapStoreFileLocation(snapStore SnapStoreFilesLocation)
 	return snapStore, nil
 }
 
+// UpdateSnapStoreFilesLocation updates a snap store file location.
+func (d *Database) UpdateSnapStoreFilesLocation(location SnapStoreFilesLocation) error {
+	if err := d.con.Update(location.Path, &location); err != nil {
+		return errors.Wrap(err, "updating snap store location in db")
+	}
+	return nil
+}
+
+// DeleteSnapStoreFilesLocation deletes a snap store file location from the database.
+func (d *Database) DeleteSnapStoreFilesLocation(path string) error {
+	param := SnapStoreFilesLocation{}
+	if err := d.con.Delete(path, &param); err != nil {
+		if !errors.Is(err, bolthold.ErrNotFound) {
+			return errors.Wrap(err, "deleting snap store location from db")
+		}
+	}
+	return nil
+}
+
 // ListSnapStoreFilesLocations lists all known snap store files locations.
 func (d *Database) ListSnapStoreFilesLocations() ([]SnapStoreFilesLocation, error) {
 	var allLocations []SnapStoreFilesLocation
@@ -489,12 +537,24 @@ func (d *Database) GetSnapStoreMappingByDeviceID(deviceID string) (SnapStoreMapp
 	return mapping, nil
 }
 
-func (d *Database) GetSnapStoreMappingByLocationID(locationID string) (SnapStoreMapping, error) {
-	return SnapStoreMapping{}, nil
+func (d *Database) ListSnapStoreMappingsByLocationID(locationID string) ([]SnapStoreMapping, error) {
+	var storeMappings []SnapStoreMapping
+	if err := d.con.Find(&storeMappings, bolthold.Where("SnapStoreFilesLocation.Path").Eq(locationID)); err != nil {
+		return nil, errors.Wrap(err, "fetching snap store mappings")
+	}
+	return storeMappings, nil
 }
 
 func (d *Database) GetSnapStoreMappingByID(trackingID string) (SnapStoreMapping, error) {
-	return SnapStoreMapping{}, nil
+	var mapping SnapStoreMapping
+
+	if err := d.con.FindOne(&mapping, bolthold.Where("TrackingID").Eq(trackingID)); err != nil {
+		if errors.Is(err, bolthold.ErrNotFound) {
+			return SnapStoreMapping{}, vErrors.NewNotFoundError("mapping %s not found in db", trackingID)
+		}
+		return SnapStoreMapping{}, errors.Wrap(err, "finding mapping in db")
+	}
+	return mapping, nil
 }
 
 func (d *Database) CreateSnapStoreMapping(param SnapStoreMapping) (SnapStoreMapping, error) {
@@ -504,6 +564,14 @@ func (d *Database) CreateSnapStoreMapping(param SnapStoreMapping) (SnapStoreMapp
 	return param, nil
 }
 
+// UpdateSnapStoreMapping updates an existing snap store mapping.
+func (d *Database) UpdateSnapStoreMapping(mapping SnapStoreMapping) error {
+	if err := d.con.Update(mapping.TrackingID, &mapping); err != nil {
+		return errors.Wrap(err, "updating snap store mapping in db")
+	}
+	return nil
+}
+
 func (d *Database) ListSnapStoreMappings() ([]SnapStoreMapping, error) {
 	var storeMappings []SnapStoreMapping
 	re := regexp.MustCompile(".*")
@@ -520,3 +588,94 @@ func (d *Database) DeleteSnapStoreMapping(trackingID string) error {
 	}
 	return nil
 }
+
+////////////////////////
+// Webhook deliveries //
+////////////////////////
+
+// CreateWebhookDelivery queues a new webhook delivery.
+func (d *Database) CreateWebhookDelivery(param WebhookDelivery) (WebhookDelivery, error) {
+	if err := d.con.Insert(param.TrackingID, &param); err != nil {
+		return WebhookDelivery{}, errors.Wrap(err, "inserting new webhook delivery into db")
+	}
+	return param, nil
+}
+
+// UpdateWebhookDelivery updates an existing webhook delivery.
+func (d *Database) UpdateWebhookDelivery(param WebhookDelivery) error {
+	if err := d.con.Update(param.TrackingID, &param); err != nil {
+		return errors.Wrap(err, "updating webhook delivery in db")
+	}
+	return nil
+}
+
+// DeleteWebhookDelivery removes a webhook delivery from the queue.
+func (d *Database) DeleteWebhookDelivery(trackingID string) error {
+	var delivery WebhookDelivery
+	if err := d.con.Delete(trackingID, &delivery); err != nil {
+		if !errors.Is(err, bolthold.ErrNotFound) {
+			return errors.Wrap(err, "deleting webhook delivery from db")
+		}
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the deliveries queued for a webhook, oldest first.
+func (d *Database) ListWebhookDeliveries(webhook string) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	query := bolthold.Where("Webhook").Eq(webhook).SortBy("CreatedAt", "EventID")
+	if err := d.con.Find(&deliveries, query); err != nil {
+		return nil, errors.Wrap(err, "fetching webhook deliveries")
+	}
+	return deliveries, nil
+}
+
+////////////////
+// API tokens //
+////////////////
+
+// CreateAPIToken records a newly issued API token.
+func (d *Database) CreateAPIToken(param APIToken) (APIToken, error) {
+	if err := d.con.Insert(param.TrackingID, &param); err != nil {
+		return APIToken{}, errors.Wrap(err, "inserting new API token into db")
+	}
+	return param, nil
+}
+
+// GetAPIToken returns an API token.
+func (d *Database) GetAPIToken(trackingID string) (APIToken, error) {
+	var token APIToken
+	if err := d.con.Get(trackingID, &token); err != nil {
+		if errors.Is(err, bolthold.ErrNotFound) {
+			return APIToken{}, vErrors.NewNotFoundError("token %s not found", trackingID)
+		}
+		return APIToken{}, errors.Wrap(err, "fetching API token")
+	}
+	return token, nil
+}
+
+// UpdateAPIToken updates an existing API token.
+func (d *Database) UpdateAPIToken(param APIToken) error {
+	if err := d.con.Update(param.TrackingID, &param); err != nil {
+		return errors.Wrap(err, "updating API token in db")
+	}
+	return nil
+}
+
+// ListAPITokens returns all API tokens, oldest first.
+func (d *Database) ListAPITokens() ([]APIToken, error) {
+	var tokens []APIToken
+	if err := d.con.Find(&tokens, (&bolthold.Query{}).SortBy("IssuedAt")); err != nil {
+		return nil, errors.Wrap(err, "fetching API tokens")
+	}
+	return tokens, nil
+}
+
+// DeleteExpiredAPITokens removes the tokens that expired before now.
+func (d *Database) DeleteExpiredAPITokens(now time.Time) error {
+	var token APIToken
+	if err := d.con.DeleteMatching(&token, bolthold.Where("ExpiresAt").Lt(now)); err != nil {
+		return errors.Wrap(err, "deleting expired API tokens")
+	}
+	return nil
+}
@@ -15,7 +15,10 @@
 
 package db
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"time"
+)
 
 type VolumeStatus string
 
@@ -92,6 +95,12 @@ type SnapStoreFilesLocation struct {
 	// allocate new extents. This is an administrative flag that allows
 	// operators control over where allocations can and cannot be done.
 	Enabled bool
+
+	// Devices holds the paths in /dev of all the block devices involved
+	// in hosting this location. If the location is on a device mapper,
+	// this includes all disks that make up that device mapper. These
+	// devices cannot be added to tracking.
+	Devices []string
 }
 
 // SnapStoreFile is a file that was pre-allocated on disk, the extents of
@@ -158,3 +167,33 @@ type Snapshot struct {
 	// are included in this snapshot.
 	VolumeSnapshots []VolumeSnapshot
 }
+
+// WebhookDelivery is an event that is queued for delivery to a webhook.
+// Deliveries are removed once the webhook accepts them, or once all
+// retries are exhausted.
+type WebhookDelivery struct {
+	TrackingID string
+	// Webhook is the name of the webhook this event is sent to.
+	Webhook    string
+	EventID    uint64
+	EventEpoch string
+	EventType  string
+	// Payload is the JSON encoded event.
+	Payload []byte
+
+	CreatedAt   time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+// APIToken is a token issued to a client that logged in with a credential.
+// Tokens are removed once they expire.
+type APIToken struct {
+	TrackingID string
+	// Name is the name of the credential used to get the token.
+	Name      string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Revoked   bool
+}
@@ -3,7 +3,10 @@
 
 package errors
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 var (
 	// ErrUnauthorized is returned when a user does not have
@@ -213,6 +216,33 @@ func (b *ConflictError) Is(target error) bool {
 	return ok
 }
 
+// NewTooManyRequestsError returns a new TooManyRequestsError. Clients should
+// wait for retryAfter before trying again.
+func NewTooManyRequestsError(retryAfter time.Duration, msg string, a ...interface{}) error {
+	return &TooManyRequestsError{
+		baseError: baseError{
+			msg: fmt.Sprintf(msg, a...),
+		},
+		RetryAfter: retryAfter,
+	}
+}
+
+// TooManyRequestsError is returned when a request is rejected because a
+// limit was reached.
+type TooManyRequestsError struct {
+	baseError
+
+	RetryAfter time.Duration
+}
+
+func (b *TooManyRequestsError) Is(target error) bool {
+	if target == nil {
+		return false
+	}
+	_, ok := target.(*TooManyRequestsError)
+	return ok
+}
+
 // NewValueError returns a new ValueError
 func NewValueError(msg string, a ...interface{}) error {
 	return &ValueError{
@@ -4,20 +4,24 @@ go 1.16
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/RoaringBitmap/roaring v1.2.1
 	github.com/StackExchange/wmi v0.0.0-20210224194228-fe8f1750fd46 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/farjump/go-libudev v0.0.0-20171109190736-8b0739cd6d0b
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/jkeiser/iter v0.0.0-20200628201005-c8aa0ae784d1 // indirect
+	github.com/klauspost/compress v1.15.9
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.12.2
 	github.com/rancher/go-fibmap v0.0.0-20160418233256-5fc9f8c1ed47
 	github.com/shirou/gopsutil/v3 v3.21.5
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/timshannon/bolthold v0.0.0-20200817130212-4a25ab140645
 	github.com/tklauser/go-sysconf v0.3.6 // indirect
 	go.etcd.io/bbolt v1.3.6
-	golang.org/x/sys v0.0.0-20210608053332-aa57babbf139
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
-	gopkg.in/yaml.v2 v2.0.0-20170712054546-1be3d31502d6 // indirect
 )
@@ -0,0 +1,240 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package audit keeps an append-only record of the API calls that change the
+// state of the agent, or read snapshot data. Entries are written as JSON lines.
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/util"
+)
+
+const (
+	// DefaultQueryLimit is the number of entries returned by Query, if the
+	// query sets no limit.
+	DefaultQueryLimit = 100
+	// MaxQueryLimit is the largest number of entries returned by Query.
+	MaxQueryLimit = 10000
+
+	// backupTimeFormat is the format of the timestamp lumberjack adds to the
+	// name of rotated files.
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	// maxEntrySize is the largest line we read from the log.
+	maxEntrySize = 1 << 20
+)
+
+// NewLog returns an audit log that appends to the file at path. The file is
+// rotated like the main log.
+func NewLog(path string) (*Log, error) {
+	writer, err := util.NewRotatingFileWriter(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening audit log")
+	}
+	return &Log{
+		path:   path,
+		writer: writer,
+	}, nil
+}
+
+// Log is an audit log. A nil *Log records nothing.
+type Log struct {
+	path   string
+	writer *lumberjack.Logger
+	mux    sync.Mutex
+}
+
+// Record appends an entry to the log. The ID and the time of the entry are set,
+// if empty.
+func (l *Log) Record(entry params.AuditEntry) error {
+	if l == nil {
+		return nil
+	}
+	if entry.ID == "" {
+		entry.ID = uuid.New().String()
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "marshaling audit entry")
+	}
+	line = append(line, '\n')
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.writer.Write(line); err != nil {
+		return errors.Wrap(err, "writing audit entry")
+	}
+	return nil
+}
+
+// Close closes the current log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.writer.Close(); err != nil {
+		return errors.Wrap(err, "closing audit log")
+	}
+	return nil
+}
+
+// files returns the rotated log files, oldest first, followed by the current file.
+func (l *Log) files() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	prefix := strings.TrimSuffix(l.path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing rotated audit logs")
+	}
+
+	var backups []string
+	for _, match := range matches {
+		name := strings.TrimSuffix(match, ".gz")
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.Parse(backupTimeFormat, timestamp); err != nil {
+			continue
+		}
+		backups = append(backups, match)
+	}
+	sort.Strings(backups)
+	return append(backups, l.path), nil
+}
+
+// readEntries calls fn for every entry in a log file. Lines that can not be
+// decoded, like a line that is still being written, are skipped.
+func readEntries(path string, fn func(entry params.AuditEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Rotated away, or nothing was recorded yet.
+			return nil
+		}
+		return errors.Wrap(err, "opening audit log")
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gzReader, err := gzip.NewReader(file)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", path)
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+	for scanner.Scan() {
+		var entry params.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		fn(entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "reading %s", path)
+	}
+	return nil
+}
+
+func matches(entry params.AuditEntry, query params.AuditQuery) bool {
+	if query.Client != "" && entry.Client != query.Client {
+		return false
+	}
+	if query.Operation != "" && !strings.Contains(entry.Operation, query.Operation) {
+		return false
+	}
+	if query.ResourceID != "" {
+		found := false
+		for _, id := range entry.ResourceIDs {
+			if id == query.ResourceID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if query.Since != nil && entry.Time.Before(*query.Since) {
+		return false
+	}
+	if query.Until != nil && entry.Time.After(*query.Until) {
+		return false
+	}
+	return true
+}
+
+// Query returns the most recent entries that match query, oldest first. Rotated
+// files are searched as well.
+func (l *Log) Query(query params.AuditQuery) ([]params.AuditEntry, error) {
+	if l == nil {
+		return nil, vErrors.NewNotFoundError("audit log is not enabled")
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultQueryLimit
+	}
+	if limit > MaxQueryLimit {
+		limit = MaxQueryLimit
+	}
+
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	ret := []params.AuditEntry{}
+	for _, file := range files {
+		err := readEntries(file, func(entry params.AuditEntry) {
+			if !matches(entry, query) {
+				return
+			}
+			ret = append(ret, entry)
+			if len(ret) > limit {
+				ret = ret[1:]
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
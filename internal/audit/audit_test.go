@@ -0,0 +1,192 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-snapshot-agent/apiserver/auth"
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+)
+
+func newTestLog(t *testing.T) *Log {
+	t.Helper()
+	auditLog, err := NewLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auditLog.Close() })
+	return auditLog
+}
+
+func operations(entries []params.AuditEntry) string {
+	ops := make([]string, len(entries))
+	for idx, entry := range entries {
+		ops[idx] = entry.Operation
+	}
+	return strings.Join(ops, ",")
+}
+
+func TestQuery(t *testing.T) {
+	auditLog := newTestLog(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Entries in a compressed, rotated file come before the current file. The
+	// file is named as if it was rotated recently, or lumberjack removes it
+	// for being older than MaxAge.
+	rotatedAt := time.Now().UTC().Add(-time.Hour).Format(backupTimeFormat)
+	backup, err := os.Create(strings.TrimSuffix(auditLog.path, ".log") + "-" + rotatedAt + ".log.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzWriter := gzip.NewWriter(backup)
+	json.NewEncoder(gzWriter).Encode(params.AuditEntry{ID: "old", Time: start.Add(-time.Hour), Client: "admin", Operation: "rotated"})
+	gzWriter.Close()
+	backup.Close()
+
+	records := []params.AuditEntry{
+		{Time: start, Client: "admin", Operation: "POST /api/v1/snapshots", ResourceIDs: map[string]string{"operationID": "op1"}},
+		{Time: start.Add(time.Minute), Client: "coriolis", Operation: "create_snapshot", ResourceIDs: map[string]string{"operationID": "op1", "resourceID": "snap1"}},
+		{Time: start.Add(2 * time.Minute), Client: "coriolis", Operation: "DELETE /api/v1/snapshots/{snapshotID}", ResourceIDs: map[string]string{"snapshotID": "snap1"}},
+	}
+	for _, entry := range records {
+		if err := auditLog.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := start.Add(30 * time.Second)
+	until := start.Add(90 * time.Second)
+	tests := []struct {
+		query    params.AuditQuery
+		expected string
+	}{
+		{params.AuditQuery{}, "rotated,POST /api/v1/snapshots,create_snapshot,DELETE /api/v1/snapshots/{snapshotID}"},
+		{params.AuditQuery{Limit: 2}, "create_snapshot,DELETE /api/v1/snapshots/{snapshotID}"},
+		{params.AuditQuery{Client: "admin"}, "rotated,POST /api/v1/snapshots"},
+		{params.AuditQuery{Operation: "/snapshots"}, "POST /api/v1/snapshots,DELETE /api/v1/snapshots/{snapshotID}"},
+		{params.AuditQuery{ResourceID: "snap1"}, "create_snapshot,DELETE /api/v1/snapshots/{snapshotID}"},
+		{params.AuditQuery{Since: &since, Until: &until}, "create_snapshot"},
+	}
+	for _, tc := range tests {
+		entries, err := auditLog.Query(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := operations(entries); got != tc.expected {
+			t.Errorf("query %+v: expected %q, got %q", tc.query, tc.expected, got)
+		}
+	}
+
+	var disabled *Log
+	if _, err := disabled.Query(params.AuditQuery{}); err == nil {
+		t.Fatal("expected query of a disabled audit log to fail")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	auditLog := newTestLog(t)
+	policy, err := auth.NewPolicy(config.Authorization{
+		Rules: []config.AuthorizationRule{
+			{Role: config.RoleAdmin, CommonNames: []string{"admin"}},
+			{Role: config.RoleReadOnly, CommonNames: []string{"monitoring"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	router.Use(auditLog.Middleware(policy))
+	router.Use(policy.Middleware)
+	router.HandleFunc("/api/v1/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		var req params.LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Secret != "hunter2" {
+			t.Errorf("handler did not get the request body: %+v %v", req, err)
+		}
+		AddResourceID(r, "tokenID", "token1")
+	}).Methods("POST")
+	router.HandleFunc("/api/v1/disks", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET", "POST")
+	router.HandleFunc("/api/v1/snapshots/{snapshotID}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(params.APIErrorResponse{Error: "Not Found", Details: "snapshot not found"})
+	}).Methods("DELETE")
+
+	send := func(method, path, body, cn string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}},
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("POST", "/api/v1/auth/login", `{"name": "coriolis", "secret": "hunter2"}`, "admin")
+	send("GET", "/api/v1/disks", "", "admin")
+	send("DELETE", "/api/v1/snapshots/snap1", "", "admin")
+	send("POST", "/api/v1/disks?force=true", `{"device_path": "/dev/vdb"}`, "monitoring")
+
+	raw, err := ioutil.ReadFile(auditLog.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "hunter2") {
+		t.Fatal("secret was written to the audit log")
+	}
+
+	entries, err := auditLog.Query(params.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+
+	login := entries[0]
+	if login.Operation != "POST /api/v1/auth/login" || login.Client != "admin" || login.AuthMethod != auth.AuthMethodCertificate ||
+		login.Result != params.AuditResultSuccess || login.ResourceIDs["tokenID"] != "token1" {
+		t.Errorf("unexpected login entry: %+v", login)
+	}
+	if !strings.Contains(string(login.Parameters), `"name":"coriolis"`) {
+		t.Errorf("expected login parameters to be recorded: %s", login.Parameters)
+	}
+
+	deleted := entries[1]
+	if deleted.Status != http.StatusNotFound || deleted.Result != params.AuditResultFailure ||
+		deleted.Error != "snapshot not found" || deleted.ResourceIDs["snapshotID"] != "snap1" {
+		t.Errorf("unexpected delete entry: %+v", deleted)
+	}
+
+	// Calls denied by the policy are recorded too.
+	denied := entries[2]
+	if denied.Client != "monitoring" || denied.Status != http.StatusForbidden || denied.Query["force"] != "true" ||
+		!strings.Contains(string(denied.Parameters), "/dev/vdb") {
+		t.Errorf("unexpected denied entry: %+v", denied)
+	}
+}
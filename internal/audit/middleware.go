@@ -0,0 +1,241 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-snapshot-agent/apiserver/auth"
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/logging"
+)
+
+// maxRecordedBody is the largest request or error response body that is
+// saved in an entry.
+const maxRecordedBody = 64 * 1024
+
+// auditedReads holds the GET routes that read snapshot data. They are recorded
+// along with all requests other than GET and HEAD. Routes are keyed like in the
+// auth package.
+var auditedReads = map[string]bool{
+	"GET /api/v1/snapshots/{snapshotID}/consume/{trackedDiskID}": true,
+	"GET /api/v1/snapshots/{snapshotID}/stream/{trackedDiskID}":  true,
+}
+
+// redactedFields are request body fields that are never written to the log.
+var redactedFields = map[string]bool{
+	"secret": true,
+}
+
+func audited(r *http.Request, key string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return auditedReads[key]
+	default:
+		return true
+	}
+}
+
+type callKey struct{}
+
+// call holds the resource IDs handlers add to the entry of a request.
+type call struct {
+	resourceIDs map[string]string
+}
+
+// AddResourceID records the ID of a resource that was created or affected by
+// the request. It does nothing if the request is not audited.
+func AddResourceID(r *http.Request, name, id string) {
+	c, ok := r.Context().Value(callKey{}).(*call)
+	if !ok || id == "" {
+		return
+	}
+	c.resourceIDs[name] = id
+}
+
+// responseRecorder saves the status code and the size of a response, and the
+// body of error responses.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	errBody bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 400 && rec.errBody.Len() < maxRecordedBody {
+		toSave := p
+		if left := maxRecordedBody - rec.errBody.Len(); len(toSave) > left {
+			toSave = toSave[:left]
+		}
+		rec.errBody.Write(toSave)
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// errorDetails returns the error sent to the client.
+func (rec *responseRecorder) errorDetails() string {
+	var apiErr params.APIErrorResponse
+	if err := json.Unmarshal(rec.errBody.Bytes(), &apiErr); err == nil && apiErr.Details != "" {
+		return apiErr.Details
+	}
+	if details := strings.TrimSpace(rec.errBody.String()); details != "" {
+		return details
+	}
+	return http.StatusText(rec.status)
+}
+
+func redact(value interface{}) interface{} {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		for key, field := range val {
+			if redactedFields[strings.ToLower(key)] {
+				val[key] = "<redacted>"
+				continue
+			}
+			val[key] = redact(field)
+		}
+	case []interface{}:
+		for idx, item := range val {
+			val[idx] = redact(item)
+		}
+	}
+	return value
+}
+
+// readParameters returns the JSON body of r, with secrets redacted. The body is
+// put back, so handlers can read it. Bodies that are not JSON, or that are too
+// large, are not returned.
+func readParameters(r *http.Request) json.RawMessage {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRecordedBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) > maxRecordedBody {
+		return nil
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redact(decoded))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// Middleware records requests that change the state of the agent, and requests
+// that read snapshot data. The client is identified using policy. Requests that
+// are rejected by the authorization policy are recorded as well, as long as this
+// middleware runs first.
+func (l *Log) Middleware(policy *auth.Policy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if l == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := auth.RouteKey(r)
+			if !audited(r, key) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			c := &call{resourceIDs: map[string]string{}}
+			for name, value := range mux.Vars(r) {
+				c.resourceIDs[name] = value
+			}
+			entry := params.AuditEntry{
+				Time:       start.UTC(),
+				RequestID:  logging.RequestID(r.Context()),
+				Client:     auth.ClientName(r),
+				RemoteAddr: r.RemoteAddr,
+				Operation:  key,
+				Parameters: readParameters(r),
+			}
+			if identity, err := policy.RequestIdentity(r); err == nil {
+				entry.Client = identity.Name
+				entry.AuthMethod = identity.Method
+			}
+			if query := r.URL.Query(); len(query) > 0 {
+				entry.Query = map[string]string{}
+				for name := range query {
+					entry.Query[name] = query.Get(name)
+				}
+			}
+
+			rec := &responseRecorder{ResponseWriter: w}
+			defer func() {
+				if rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				entry.Status = rec.status
+				entry.BytesSent = rec.written
+				entry.Duration = time.Since(start).Seconds()
+				if len(c.resourceIDs) > 0 {
+					entry.ResourceIDs = c.resourceIDs
+				}
+				entry.Result = params.AuditResultSuccess
+				switch {
+				case rec.status >= 400:
+					entry.Result = params.AuditResultFailure
+					entry.Error = rec.errorDetails()
+				case r.Context().Err() != nil:
+					// The client went away before the response was sent.
+					entry.Result = params.AuditResultFailure
+					entry.Error = r.Context().Err().Error()
+				}
+				if err := l.Record(entry); err != nil {
+					logging.FromContext(r.Context()).Errorf("failed to record %s in audit log: %+v", key, err)
+				}
+			}()
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), callKey{}, c)))
+		})
+	}
+}
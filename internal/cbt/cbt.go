@@ -0,0 +1,122 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package cbt encodes CBT bitmaps for export. A CBT bitmap holds one byte for
+// every tracked block. The value of that byte is the number of the last
+// snapshot in which the block changed, or 0 if it never changed.
+//
+// Three encodings are supported:
+//
+// raw: the bitmap, as returned by the kernel module.
+//
+// rle: a sequence of runs. Every run is an unsigned varint (as written by
+// encoding/binary.PutUvarint) holding the number of blocks in the run,
+// followed by a single byte holding their value.
+//
+// roaring: a sequence of sets, one for every value present in the bitmap,
+// other than 0. Every set is a single byte holding the value, a big endian
+// uint32 holding the length of the serialized bitmap, followed by the roaring
+// bitmap in its portable serialization format. The bitmap holds the indexes of
+// the blocks that have that value. Sets are sorted by value.
+package cbt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/pkg/errors"
+
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+const (
+	// EncodingRaw sends the bitmap as is.
+	EncodingRaw = "raw"
+	// EncodingRLE run-length encodes the bitmap.
+	EncodingRLE = "rle"
+	// EncodingRoaring encodes the bitmap as a list of roaring bitmaps.
+	EncodingRoaring = "roaring"
+)
+
+// Encode writes bitmap to w, using the requested encoding.
+func Encode(w io.Writer, bitmap []byte, encoding string) error {
+	switch encoding {
+	case EncodingRaw:
+		_, err := w.Write(bitmap)
+		return err
+	case EncodingRLE:
+		return encodeRLE(w, bitmap)
+	case EncodingRoaring:
+		return encodeRoaring(w, bitmap)
+	}
+	return vErrors.NewBadRequestError("unsupported bitmap encoding: %s", encoding)
+}
+
+func encodeRLE(w io.Writer, bitmap []byte) error {
+	buf := make([]byte, binary.MaxVarintLen64+1)
+	for i := 0; i < len(bitmap); {
+		value := bitmap[i]
+		run := 1
+		for i+run < len(bitmap) && bitmap[i+run] == value {
+			run++
+		}
+		n := binary.PutUvarint(buf, uint64(run))
+		buf[n] = value
+		if _, err := w.Write(buf[:n+1]); err != nil {
+			return errors.Wrap(err, "writing run")
+		}
+		i += run
+	}
+	return nil
+}
+
+func encodeRoaring(w io.Writer, bitmap []byte) error {
+	var sets [256]*roaring.Bitmap
+	for idx, value := range bitmap {
+		if value == 0 {
+			continue
+		}
+		if sets[value] == nil {
+			sets[value] = roaring.New()
+		}
+		sets[value].Add(uint32(idx))
+	}
+
+	var buf bytes.Buffer
+	for value, set := range sets {
+		if set == nil {
+			continue
+		}
+		set.RunOptimize()
+
+		buf.Reset()
+		if _, err := set.WriteTo(&buf); err != nil {
+			return errors.Wrap(err, "serializing bitmap")
+		}
+
+		var hdr [5]byte
+		hdr[0] = byte(value)
+		binary.BigEndian.PutUint32(hdr[1:], uint32(buf.Len()))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return errors.Wrap(err, "writing set header")
+		}
+		if _, err := buf.WriteTo(w); err != nil {
+			return errors.Wrap(err, "writing set")
+		}
+	}
+	return nil
+}
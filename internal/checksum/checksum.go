@@ -0,0 +1,79 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package checksum
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+const (
+	// AlgorithmSHA256 is the SHA-256 cryptographic hash.
+	AlgorithmSHA256 = "sha256"
+	// AlgorithmXXHash64 is the 64 bit xxHash. It is not a cryptographic hash,
+	// but is much faster than SHA-256.
+	AlgorithmXXHash64 = "xxhash64"
+)
+
+// NewHash returns a new hash.Hash for the requested algorithm.
+func NewHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case AlgorithmSHA256:
+		return sha256.New(), nil
+	case AlgorithmXXHash64:
+		return xxhash.New(), nil
+	}
+	return nil, vErrors.NewBadRequestError("unsupported checksum algorithm: %s", algorithm)
+}
+
+// BlockFunc is called for every block that was hashed.
+type BlockFunc func(offset, length uint64, sum []byte) error
+
+// SumBlocks reads length bytes from src, starting at offset, and hashes every block of
+// blockSize bytes independently. The last block may be shorter than blockSize if the
+// length is not a multiple of blockSize. For every block, fn is called with the
+// offset, length and checksum of that block.
+func SumBlocks(src io.ReaderAt, offset, length uint64, blockSize int, h hash.Hash, fn BlockFunc) error {
+	if blockSize <= 0 {
+		return errors.Errorf("invalid block size: %d", blockSize)
+	}
+
+	buf := make([]byte, blockSize)
+	end := offset + length
+	for pos := offset; pos < end; pos += uint64(blockSize) {
+		toRead := uint64(blockSize)
+		if pos+toRead > end {
+			toRead = end - pos
+		}
+
+		if _, err := src.ReadAt(buf[:toRead], int64(pos)); err != nil {
+			return errors.Wrapf(err, "reading block at offset %d", pos)
+		}
+
+		h.Reset()
+		h.Write(buf[:toRead])
+		if err := fn(pos, toRead, h.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
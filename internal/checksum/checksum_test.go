@@ -0,0 +1,119 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package checksum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+type block struct {
+	offset uint64
+	length uint64
+	sum    string
+}
+
+func sumBlocks(t *testing.T, data string, offset, length uint64, blockSize int, algorithm string) []block {
+	h, err := NewHash(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []block
+	err = SumBlocks(bytes.NewReader([]byte(data)), offset, length, blockSize, h, func(offset, length uint64, sum []byte) error {
+		ret = append(ret, block{offset: offset, length: length, sum: hex.EncodeToString(sum)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func checkBlocks(t *testing.T, expected, got []block) {
+	t.Helper()
+	if len(expected) != len(got) {
+		t.Fatalf("expected %d blocks, got %d: %+v", len(expected), len(got), got)
+	}
+	for idx := range expected {
+		if expected[idx] != got[idx] {
+			t.Fatalf("block %d: expected %+v, got %+v", idx, expected[idx], got[idx])
+		}
+	}
+}
+
+func TestSumBlocksSHA256(t *testing.T) {
+	// The last block holds a single byte.
+	got := sumBlocks(t, "abcabca", 0, 7, 3, AlgorithmSHA256)
+	checkBlocks(t, []block{
+		{0, 3, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{3, 3, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{6, 1, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+	}, got)
+}
+
+func TestSumBlocksXXHash64(t *testing.T) {
+	got := sumBlocks(t, "abcabca", 0, 7, 3, AlgorithmXXHash64)
+	checkBlocks(t, []block{
+		{0, 3, "44bc2cf5ad770999"},
+		{3, 3, "44bc2cf5ad770999"},
+		{6, 1, "d24ec4f1a98c6e5b"},
+	}, got)
+}
+
+func TestSumBlocksOffset(t *testing.T) {
+	// Blocks start at the requested offset, and the range ends before the
+	// end of the data.
+	got := sumBlocks(t, "xxabcaxx", 2, 4, 3, AlgorithmSHA256)
+	checkBlocks(t, []block{
+		{2, 3, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{5, 1, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"},
+	}, got)
+
+	if got := sumBlocks(t, "abc", 0, 0, 3, AlgorithmSHA256); len(got) != 0 {
+		t.Fatalf("expected no blocks for an empty range, got %+v", got)
+	}
+}
+
+func TestSumBlocksErrors(t *testing.T) {
+	h, _ := NewHash(AlgorithmSHA256)
+	noop := func(offset, length uint64, sum []byte) error { return nil }
+
+	if err := SumBlocks(bytes.NewReader([]byte("abc")), 0, 3, 0, h, noop); err == nil {
+		t.Fatal("expected an error for a block size of 0")
+	}
+	if err := SumBlocks(bytes.NewReader([]byte("abc")), 0, 6, 3, h, noop); err == nil {
+		t.Fatal("expected an error for a range past the end of the data")
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := SumBlocks(bytes.NewReader([]byte("abcabc")), 0, 6, 3, h, func(offset, length uint64, sum []byte) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("expected the callback error after 1 call, got %v after %d calls", err, calls)
+	}
+
+	if _, err := NewHash("md5"); !errors.Is(err, vErrors.ErrBadRequest) {
+		t.Fatalf("expected a bad request error for an unknown algorithm, got %v", err)
+	}
+}
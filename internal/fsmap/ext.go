@@ -0,0 +1,231 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fsmap
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	extSuperblockOffset = 1024
+	extSuperblockSize   = 1024
+	extMagic            = 0xEF53
+
+	extFeatureCompatSparseSuper2  = 0x200
+	extFeatureIncompatRecover     = 0x4
+	extFeatureIncompatJournalDev  = 0x8
+	extFeatureIncompatMetaBG      = 0x10
+	extFeatureIncompat64Bit       = 0x80
+	extFeatureROCompatSparseSuper = 0x1
+	extFeatureROCompatBigAlloc    = 0x200
+
+	extBGBlockUninit = 0x2
+
+	extMinDescSize   = 32
+	extMinDescSize64 = 64
+)
+
+// extSuperblock holds the fields of the ext2/3/4 superblock we care about.
+type extSuperblock struct {
+	blocksCount       uint64
+	firstDataBlock    uint64
+	blockSize         uint64
+	blocksPerGroup    uint64
+	inodesPerGroup    uint64
+	inodeSize         uint64
+	featureCompat     uint32
+	featureIncompat   uint32
+	featureROCompat   uint32
+	reservedGDTBlocks uint64
+	descSize          uint64
+	backupBGs         [2]uint32
+}
+
+func (s extSuperblock) groupCount() uint64 {
+	return (s.blocksCount - s.firstDataBlock + s.blocksPerGroup - 1) / s.blocksPerGroup
+}
+
+func (s extSuperblock) gdtBlocks() uint64 {
+	return (s.groupCount()*s.descSize + s.blockSize - 1) / s.blockSize
+}
+
+// hasSuperBackup returns true if group holds a copy of the superblock and of
+// the group descriptor table.
+func (s extSuperblock) hasSuperBackup(group uint64) bool {
+	if group == 0 {
+		return true
+	}
+	if s.featureCompat&extFeatureCompatSparseSuper2 != 0 {
+		return group == uint64(s.backupBGs[0]) || group == uint64(s.backupBGs[1])
+	}
+	if s.featureROCompat&extFeatureROCompatSparseSuper == 0 || group == 1 {
+		return true
+	}
+	if group&1 == 0 {
+		return false
+	}
+	for _, base := range []uint64{3, 5, 7} {
+		pow := base
+		for pow < group {
+			pow *= base
+		}
+		if pow == group {
+			return true
+		}
+	}
+	return false
+}
+
+func readExtSuperblock(src io.ReaderAt) (extSuperblock, error) {
+	buf := make([]byte, extSuperblockSize)
+	if _, err := src.ReadAt(buf, extSuperblockOffset); err != nil {
+		return extSuperblock{}, errors.Wrap(err, "reading superblock")
+	}
+
+	if binary.LittleEndian.Uint16(buf[0x38:]) != extMagic {
+		return extSuperblock{}, errors.Wrap(ErrUnsupported, "invalid superblock magic")
+	}
+
+	sb := extSuperblock{
+		blocksCount:       uint64(binary.LittleEndian.Uint32(buf[0x4:])),
+		firstDataBlock:    uint64(binary.LittleEndian.Uint32(buf[0x14:])),
+		blockSize:         1024 << binary.LittleEndian.Uint32(buf[0x18:]),
+		blocksPerGroup:    uint64(binary.LittleEndian.Uint32(buf[0x20:])),
+		inodesPerGroup:    uint64(binary.LittleEndian.Uint32(buf[0x28:])),
+		inodeSize:         uint64(binary.LittleEndian.Uint16(buf[0x58:])),
+		featureCompat:     binary.LittleEndian.Uint32(buf[0x5C:]),
+		featureIncompat:   binary.LittleEndian.Uint32(buf[0x60:]),
+		featureROCompat:   binary.LittleEndian.Uint32(buf[0x64:]),
+		reservedGDTBlocks: uint64(binary.LittleEndian.Uint16(buf[0xCE:])),
+		descSize:          extMinDescSize,
+		backupBGs: [2]uint32{
+			binary.LittleEndian.Uint32(buf[0x24C:]),
+			binary.LittleEndian.Uint32(buf[0x250:]),
+		},
+	}
+	if sb.inodeSize == 0 {
+		// revision 0 filesystems have a fixed inode size.
+		sb.inodeSize = 128
+	}
+
+	if sb.featureIncompat&extFeatureIncompat64Bit != 0 {
+		sb.blocksCount |= uint64(binary.LittleEndian.Uint32(buf[0x150:])) << 32
+		if descSize := uint64(binary.LittleEndian.Uint16(buf[0xFE:])); descSize >= extMinDescSize64 {
+			sb.descSize = descSize
+		}
+	}
+
+	if sb.blocksPerGroup == 0 || sb.blocksPerGroup > sb.blockSize*8 || sb.blockSize > 65536 || sb.firstDataBlock >= sb.blocksCount {
+		return extSuperblock{}, errors.Wrap(ErrUnsupported, "invalid superblock")
+	}
+	return sb, nil
+}
+
+// extUsedRanges reads the block bitmaps of an ext2/3/4 filesystem and returns
+// the ranges that are allocated.
+func extUsedRanges(src io.ReaderAt, size uint64) ([]Range, error) {
+	sb, err := readExtSuperblock(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if sb.featureIncompat&extFeatureIncompatRecover != 0 {
+		// The journal holds changes that were not yet written to their
+		// final location. The block bitmaps may be stale.
+		return nil, errors.Wrap(ErrUnsupported, "filesystem needs journal recovery")
+	}
+	if sb.featureIncompat&(extFeatureIncompatMetaBG|extFeatureIncompatJournalDev) != 0 {
+		return nil, errors.Wrap(ErrUnsupported, "unsupported ext features")
+	}
+	if sb.featureROCompat&extFeatureROCompatBigAlloc != 0 {
+		return nil, errors.Wrap(ErrUnsupported, "bigalloc is not supported")
+	}
+	if sb.blocksCount*sb.blockSize > size {
+		return nil, errors.Wrap(ErrUnsupported, "filesystem is larger than its partition")
+	}
+
+	groups := sb.groupCount()
+	gdt := make([]byte, sb.gdtBlocks()*sb.blockSize)
+	if _, err := src.ReadAt(gdt, int64((sb.firstDataBlock+1)*sb.blockSize)); err != nil {
+		return nil, errors.Wrap(err, "reading group descriptors")
+	}
+
+	// The boot block and the primary superblock are always in use.
+	ranges := []Range{{Offset: 0, Length: extSuperblockOffset + extSuperblockSize}}
+	addBlocks := func(start, count uint64) {
+		ranges = append(ranges, Range{
+			Offset: start * sb.blockSize,
+			Length: count * sb.blockSize,
+		})
+	}
+
+	inodeTableBlocks := (sb.inodesPerGroup*sb.inodeSize + sb.blockSize - 1) / sb.blockSize
+	bitmap := make([]byte, sb.blockSize)
+	for group := uint64(0); group < groups; group++ {
+		desc := gdt[group*sb.descSize : (group+1)*sb.descSize]
+		blockBitmap := uint64(binary.LittleEndian.Uint32(desc[0x0:]))
+		inodeBitmap := uint64(binary.LittleEndian.Uint32(desc[0x4:]))
+		inodeTable := uint64(binary.LittleEndian.Uint32(desc[0x8:]))
+		flags := binary.LittleEndian.Uint16(desc[0x12:])
+		if sb.descSize >= extMinDescSize64 {
+			blockBitmap |= uint64(binary.LittleEndian.Uint32(desc[0x20:])) << 32
+			inodeBitmap |= uint64(binary.LittleEndian.Uint32(desc[0x24:])) << 32
+			inodeTable |= uint64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+		}
+
+		groupStart := sb.firstDataBlock + group*sb.blocksPerGroup
+		groupBlocks := sb.blocksPerGroup
+		if groupStart+groupBlocks > sb.blocksCount {
+			groupBlocks = sb.blocksCount - groupStart
+		}
+		inGroup := func(block uint64) bool {
+			return block >= groupStart && block < groupStart+groupBlocks
+		}
+
+		if flags&extBGBlockUninit != 0 {
+			// The block bitmap of this group was never initialized. The only
+			// blocks in use are the superblock and group descriptor backups, and
+			// the bitmaps and inode table of this group, if they live here.
+			if sb.hasSuperBackup(group) {
+				addBlocks(groupStart, 1+sb.gdtBlocks()+sb.reservedGDTBlocks)
+			}
+			if inGroup(blockBitmap) {
+				addBlocks(blockBitmap, 1)
+			}
+			if inGroup(inodeBitmap) {
+				addBlocks(inodeBitmap, 1)
+			}
+			if inGroup(inodeTable) {
+				addBlocks(inodeTable, inodeTableBlocks)
+			}
+			continue
+		}
+
+		if blockBitmap >= sb.blocksCount {
+			return nil, errors.Wrapf(ErrUnsupported, "invalid block bitmap location for group %d", group)
+		}
+		if _, err := src.ReadAt(bitmap, int64(blockBitmap*sb.blockSize)); err != nil {
+			return nil, errors.Wrapf(err, "reading block bitmap for group %d", group)
+		}
+		bitmapRuns(bitmap, groupBlocks, func(start, count uint64) {
+			addBlocks(groupStart+start, count)
+		})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fsmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// The images in testdata were created with mke2fs 1.47, and populated with debugfs:
+//
+//	mke2fs -t ext4 -b 4096 -g 2048 -N 512 ext4-flexbg-64bit.img          # 24 MiB
+//	mke2fs -t ext4 -b 1024 -g 1024 -N 256 \
+//	    -O ^64bit,^flex_bg,^metadata_csum,uninit_bg ext4-32bit-uninit.img # 12 MiB
+//	mke2fs -t ext2 -b 1024 -g 2048 -N 128 ext2.img                        # 8 MiB
+//	debugfs -w -R "write data1 f1" <image>                               # 300000 bytes
+//	debugfs -w -R "write data2 f2" <image>                               # 70000 bytes
+//	debugfs -w -R "mkdir d" <image>
+//
+// The expected ranges are the blocks that dumpe2fs does not list as free.
+var extImages = []struct {
+	name      string
+	blockSize uint64
+	used      []blockRange
+}{
+	{
+		// flex_bg places the bitmaps and inode tables of all groups in
+		// group 0. Group 1 is BLOCK_UNINIT, and only holds a superblock
+		// backup. The journal lives in group 2.
+		name:      "ext4-flexbg-64bit",
+		blockSize: 4096,
+		used: []blockRange{
+			{0, 186},
+			{2048, 2096},
+			{4096, 5119},
+		},
+	},
+	{
+		// 32 byte group descriptors, and no flex_bg. Most groups are
+		// BLOCK_UNINIT, with or without a superblock backup.
+		name:      "ext4-32bit-uninit",
+		blockSize: 1024,
+		used: []blockRange{
+			{0, 643},
+			{1025, 1290},
+			{2049, 2056},
+			{3073, 3338},
+			{4097, 5394},
+			{6145, 6152},
+			{7169, 7434},
+			{8193, 8200},
+			{9217, 9482},
+			{10241, 10248},
+			{11265, 11272},
+		},
+	},
+	{
+		// No uninit groups. Every block bitmap is read.
+		name:      "ext2",
+		blockSize: 1024,
+		used: []blockRange{
+			{0, 520},
+			{2049, 2187},
+			{4097, 4106},
+			{6145, 6283},
+		},
+	},
+}
+
+func TestExtUsedRanges(t *testing.T) {
+	for _, tc := range extImages {
+		t.Run(tc.name, func(t *testing.T) {
+			image := loadImage(t, tc.name)
+			used, err := UsedRanges(bytes.NewReader(image), "ext4", 0, uint64(len(image)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRanges(t, toRanges(tc.used, tc.blockSize), used)
+			checkNonZeroCovered(t, image, used, tc.blockSize)
+		})
+	}
+}
+
+func TestExtUsedRangesInPartition(t *testing.T) {
+	image := loadImage(t, "ext2")
+
+	// The filesystem starts 1 MiB into the disk, and is followed by 64 KiB
+	// that are not part of the partition.
+	const partStart = 1024 * 1024
+	disk := make([]byte, partStart+len(image)+64*1024)
+	copy(disk[partStart:], image)
+	for idx := range disk[:partStart] {
+		disk[idx] = 0xFF
+	}
+
+	used, err := UsedRanges(bytes.NewReader(disk), "ext2", partStart, uint64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ranges are relative to the start of the filesystem.
+	checkRanges(t, toRanges(extImages[2].used, 1024), used)
+}
+
+func TestExtUnsupported(t *testing.T) {
+	image := loadImage(t, "ext4-flexbg-64bit")
+
+	// The journal holds changes that are not in the block bitmaps yet.
+	dirty := append([]byte{}, image...)
+	incompat := binary.LittleEndian.Uint32(dirty[extSuperblockOffset+0x60:])
+	binary.LittleEndian.PutUint32(dirty[extSuperblockOffset+0x60:], incompat|extFeatureIncompatRecover)
+	if _, err := UsedRanges(bytes.NewReader(dirty), "ext4", 0, uint64(len(dirty))); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected a filesystem that needs recovery to be unsupported, got %v", err)
+	}
+
+	// The filesystem is larger than its partition.
+	if _, err := UsedRanges(bytes.NewReader(image), "ext4", 0, uint64(len(image))-4096); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected a truncated filesystem to be unsupported, got %v", err)
+	}
+
+	// No ext superblock.
+	blank := make([]byte, 64*1024)
+	if _, err := UsedRanges(bytes.NewReader(blank), "ext4", 0, uint64(len(blank))); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected a missing superblock to be unsupported, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package fsmap reads the allocation metadata of a filesystem, directly
+// from a block device or image, and returns the ranges that are in use.
+// Only filesystems that are in a consistent state on disk are mapped. A
+// filesystem that needs journal or log recovery is reported as unsupported,
+// as the on disk allocation maps may not reflect recent allocations.
+package fsmap
+
+import (
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupported is returned when the allocation map of a filesystem cannot
+// be safely determined. Callers should treat the whole filesystem as used.
+var ErrUnsupported = errors.New("unsupported filesystem")
+
+// Range is a byte range, relative to the start of the filesystem.
+type Range struct {
+	Offset uint64
+	Length uint64
+}
+
+// End returns the offset of the first byte after this range.
+func (r Range) End() uint64 {
+	return r.Offset + r.Length
+}
+
+// UsedRanges returns the ranges in use by the filesystem of type fsType, that starts
+// at offset in src and is size bytes long. The returned ranges are relative to offset.
+// ErrUnsupported is returned for unknown filesystem types, or for filesystems
+// that cannot be safely mapped.
+func UsedRanges(src io.ReaderAt, fsType string, offset, size uint64) ([]Range, error) {
+	reader := io.NewSectionReader(src, int64(offset), int64(size))
+
+	var ranges []Range
+	var err error
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		ranges, err = extUsedRanges(reader, size)
+	case "xfs":
+		ranges, err = xfsUsedRanges(reader, size)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Merge(ranges), nil
+}
+
+// Merge sorts a list of ranges and merges the ones that overlap or are
+// contiguous.
+func Merge(ranges []Range) []Range {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Offset < ranges[j].Offset
+	})
+
+	ret := []Range{ranges[0]}
+	for _, rng := range ranges[1:] {
+		if rng.Length == 0 {
+			continue
+		}
+		last := &ret[len(ret)-1]
+		if rng.Offset <= last.End() {
+			if rng.End() > last.End() {
+				last.Length = rng.End() - last.Offset
+			}
+			continue
+		}
+		ret = append(ret, rng)
+	}
+	return ret
+}
+
+// bitmapRuns calls fn for every run of set bits in a little endian bitmap.
+// Only the first nbits bits are considered.
+func bitmapRuns(bitmap []byte, nbits uint64, fn func(start, count uint64)) {
+	var runStart uint64
+	inRun := false
+	for i := uint64(0); i < nbits; i++ {
+		set := bitmap[i/8]&(1<<(i%8)) != 0
+		if set && !inRun {
+			runStart = i
+			inRun = true
+		} else if !set && inRun {
+			fn(runStart, i-runStart)
+			inRun = false
+		}
+	}
+	if inRun {
+		fn(runStart, nbits-runStart)
+	}
+}
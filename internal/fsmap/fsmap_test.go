@@ -0,0 +1,140 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fsmap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// blockRange is an inclusive range of filesystem blocks, used to write the
+// expected results in a readable way.
+type blockRange struct {
+	first, last uint64
+}
+
+func toRanges(blocks []blockRange, blockSize uint64) []Range {
+	ret := make([]Range, len(blocks))
+	for idx, blk := range blocks {
+		ret[idx] = Range{
+			Offset: blk.first * blockSize,
+			Length: (blk.last - blk.first + 1) * blockSize,
+		}
+	}
+	return ret
+}
+
+func checkRanges(t *testing.T, expected, got []Range) {
+	t.Helper()
+	if len(expected) != len(got) {
+		t.Fatalf("expected %d ranges, got %d: %+v", len(expected), len(got), got)
+	}
+	for idx := range expected {
+		if expected[idx] != got[idx] {
+			t.Fatalf("range %d: expected %+v, got %+v", idx, expected[idx], got[idx])
+		}
+	}
+}
+
+// checkNonZeroCovered fails if any block of data that is not all zeroes is outside
+// of the used ranges. Skipping a block that holds data means losing it in a backup.
+func checkNonZeroCovered(t *testing.T, image []byte, used []Range, blockSize uint64) {
+	t.Helper()
+	zero := make([]byte, blockSize)
+	idx := 0
+	for offset := uint64(0); offset < uint64(len(image)); offset += blockSize {
+		for idx < len(used) && used[idx].End() <= offset {
+			idx++
+		}
+		if idx < len(used) && used[idx].Offset <= offset {
+			continue
+		}
+		if !bytes.Equal(image[offset:offset+blockSize], zero) {
+			t.Fatalf("block at offset %d holds data, but is not in use", offset)
+		}
+	}
+}
+
+// loadImage returns the contents of a gzip compressed filesystem image from testdata.
+func loadImage(t *testing.T, name string) []byte {
+	fp, err := os.Open(filepath.Join("testdata", name+".img.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	reader, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestMerge(t *testing.T) {
+	got := Merge([]Range{
+		{Offset: 100, Length: 10},
+		{Offset: 0, Length: 10},
+		{Offset: 10, Length: 5},
+		{Offset: 50, Length: 0},
+		{Offset: 105, Length: 2},
+		{Offset: 108, Length: 10},
+	})
+	checkRanges(t, []Range{
+		{Offset: 0, Length: 15},
+		{Offset: 100, Length: 18},
+	}, got)
+
+	if got := Merge(nil); len(got) != 0 {
+		t.Fatalf("expected no ranges, got %+v", got)
+	}
+}
+
+func TestBitmapRuns(t *testing.T) {
+	// Bits are numbered from the least significant bit of the first byte.
+	bitmap := []byte{0x0E, 0xFF, 0x01, 0x80}
+	var got []blockRange
+	bitmapRuns(bitmap, 31, func(start, count uint64) {
+		got = append(got, blockRange{start, start + count - 1})
+	})
+	expected := []blockRange{{1, 3}, {8, 16}}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Fatalf("expected runs %+v, got %+v", expected, got)
+	}
+
+	// A run that reaches the last bit is reported.
+	got = nil
+	bitmapRuns(bitmap, 32, func(start, count uint64) {
+		got = append(got, blockRange{start, start + count - 1})
+	})
+	if len(got) != 3 || got[2] != (blockRange{31, 31}) {
+		t.Fatalf("expected the last bit to be a run, got %+v", got)
+	}
+}
+
+func TestUsedRangesUnknownFilesystem(t *testing.T) {
+	_, err := UsedRanges(bytes.NewReader(make([]byte, 4096)), "btrfs", 0, 4096)
+	if err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+}
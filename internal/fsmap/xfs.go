@@ -0,0 +1,307 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fsmap
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	xfsSuperblockSize = 512
+	xfsSBMagic        = 0x58465342 // XFSB
+	xfsAGFMagic       = 0x58414746 // XAGF
+	xfsABTBMagic      = 0x41425442 // ABTB
+	xfsABTB3Magic     = 0x41423342 // AB3B
+	xfsVersion5       = 5
+
+	xfsBtreeShortHdrSize    = 16
+	xfsBtreeShortHdrSizeCRC = 56
+	xfsAllocRecSize         = 8
+	xfsAllocPtrSize         = 4
+	xfsNullAGBlock          = 0xFFFFFFFF
+
+	xfsLogBasicBlockSize = 512
+	xfsLogHeaderMagic    = 0xFEEDBABE
+	xfsLogVersion2       = 2
+	xfsLogHeaderCycle    = 32 * 1024
+	xfsLogUnmountTrans   = 0x20
+	xfsLogReadChunk      = 1024 * 1024
+)
+
+// xfsSuperblock holds the fields of the XFS superblock we care about.
+type xfsSuperblock struct {
+	blockSize  uint64
+	dataBlocks uint64
+	logStart   uint64
+	agBlocks   uint64
+	agCount    uint64
+	logBlocks  uint64
+	version    uint16
+	sectSize   uint64
+	agBlockLog uint8
+}
+
+// agBlockOffset returns the byte offset of a block in an allocation group.
+func (s xfsSuperblock) agBlockOffset(ag, block uint64) uint64 {
+	return (ag*s.agBlocks + block) * s.blockSize
+}
+
+func readXFSSuperblock(src io.ReaderAt) (xfsSuperblock, error) {
+	buf := make([]byte, xfsSuperblockSize)
+	if _, err := src.ReadAt(buf, 0); err != nil {
+		return xfsSuperblock{}, errors.Wrap(err, "reading superblock")
+	}
+
+	if binary.BigEndian.Uint32(buf[0:]) != xfsSBMagic {
+		return xfsSuperblock{}, errors.Wrap(ErrUnsupported, "invalid superblock magic")
+	}
+
+	sb := xfsSuperblock{
+		blockSize:  uint64(binary.BigEndian.Uint32(buf[4:])),
+		dataBlocks: binary.BigEndian.Uint64(buf[8:]),
+		logStart:   binary.BigEndian.Uint64(buf[48:]),
+		agBlocks:   uint64(binary.BigEndian.Uint32(buf[84:])),
+		agCount:    uint64(binary.BigEndian.Uint32(buf[88:])),
+		logBlocks:  uint64(binary.BigEndian.Uint32(buf[96:])),
+		version:    binary.BigEndian.Uint16(buf[100:]) & 0xF,
+		sectSize:   uint64(binary.BigEndian.Uint16(buf[102:])),
+		agBlockLog: buf[124],
+	}
+
+	if sb.blockSize == 0 || sb.agBlocks == 0 || sb.sectSize == 0 {
+		return xfsSuperblock{}, errors.Wrap(ErrUnsupported, "invalid superblock")
+	}
+	return sb, nil
+}
+
+// xfsUsedRanges walks the free space B+tree of every allocation group of an XFS
+// filesystem, and returns the ranges that are not free.
+func xfsUsedRanges(src io.ReaderAt, size uint64) ([]Range, error) {
+	sb, err := readXFSSuperblock(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if sb.dataBlocks*sb.blockSize > size {
+		return nil, errors.Wrap(ErrUnsupported, "filesystem is larger than its partition")
+	}
+
+	if sb.logStart == 0 {
+		return nil, errors.Wrap(ErrUnsupported, "external logs are not supported")
+	}
+
+	clean, err := xfsLogIsClean(src, sb)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking log")
+	}
+	if !clean {
+		// The log may hold allocations that were not yet written to
+		// the free space B+trees.
+		return nil, errors.Wrap(ErrUnsupported, "filesystem log is dirty")
+	}
+
+	var ranges []Range
+	for ag := uint64(0); ag < sb.agCount; ag++ {
+		agRanges, err := xfsAGUsedRanges(src, sb, ag)
+		if err != nil {
+			return nil, errors.Wrapf(err, "mapping allocation group %d", ag)
+		}
+		ranges = append(ranges, agRanges...)
+	}
+	return ranges, nil
+}
+
+// xfsAGUsedRanges returns the used ranges of one allocation group.
+func xfsAGUsedRanges(src io.ReaderAt, sb xfsSuperblock, ag uint64) ([]Range, error) {
+	agf := make([]byte, sb.sectSize)
+	if _, err := src.ReadAt(agf, int64(sb.agBlockOffset(ag, 0)+sb.sectSize)); err != nil {
+		return nil, errors.Wrap(err, "reading AGF")
+	}
+	if binary.BigEndian.Uint32(agf[0:]) != xfsAGFMagic {
+		return nil, errors.Wrap(ErrUnsupported, "invalid AGF magic")
+	}
+	agLength := uint64(binary.BigEndian.Uint32(agf[12:]))
+	root := binary.BigEndian.Uint32(agf[16:])
+
+	hdrSize := uint64(xfsBtreeShortHdrSize)
+	expectedMagic := uint32(xfsABTBMagic)
+	if sb.version == xfsVersion5 {
+		hdrSize = xfsBtreeShortHdrSizeCRC
+		expectedMagic = xfsABTB3Magic
+	}
+	maxRecs := (sb.blockSize - hdrSize) / (xfsAllocRecSize + xfsAllocPtrSize)
+
+	block := make([]byte, sb.blockSize)
+	readBlock := func(agBlock uint32) (uint16, uint16, uint32, error) {
+		if uint64(agBlock) >= agLength {
+			return 0, 0, 0, errors.Wrapf(ErrUnsupported, "invalid btree block %d", agBlock)
+		}
+		if _, err := src.ReadAt(block, int64(sb.agBlockOffset(ag, uint64(agBlock)))); err != nil {
+			return 0, 0, 0, errors.Wrap(err, "reading btree block")
+		}
+		if binary.BigEndian.Uint32(block[0:]) != expectedMagic {
+			return 0, 0, 0, errors.Wrap(ErrUnsupported, "invalid btree block magic")
+		}
+		level := binary.BigEndian.Uint16(block[4:])
+		numRecs := binary.BigEndian.Uint16(block[6:])
+		rightSib := binary.BigEndian.Uint32(block[12:])
+		if uint64(numRecs) > maxRecs {
+			return 0, 0, 0, errors.Wrap(ErrUnsupported, "invalid btree record count")
+		}
+		return level, numRecs, rightSib, nil
+	}
+
+	// Follow the leftmost pointers down to the first leaf.
+	current := root
+	for {
+		level, _, _, err := readBlock(current)
+		if err != nil {
+			return nil, err
+		}
+		if level == 0 {
+			break
+		}
+		current = binary.BigEndian.Uint32(block[hdrSize+maxRecs*xfsAllocRecSize:])
+	}
+
+	// Walk the leaves from left to right. Free extents are sorted by their
+	// start block, so used ranges are the gaps between them.
+	var ranges []Range
+	var next uint64
+	agOffset := sb.agBlockOffset(ag, 0)
+	addUsed := func(start, end uint64) {
+		if end > start {
+			ranges = append(ranges, Range{
+				Offset: agOffset + start*sb.blockSize,
+				Length: (end - start) * sb.blockSize,
+			})
+		}
+	}
+	for visited := uint64(0); ; visited++ {
+		if visited > agLength {
+			return nil, errors.Wrap(ErrUnsupported, "btree loop detected")
+		}
+		_, numRecs, rightSib, err := readBlock(current)
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < uint64(numRecs); i++ {
+			rec := block[hdrSize+i*xfsAllocRecSize:]
+			start := uint64(binary.BigEndian.Uint32(rec[0:]))
+			count := uint64(binary.BigEndian.Uint32(rec[4:]))
+			if start < next || start+count > agLength {
+				return nil, errors.Wrap(ErrUnsupported, "invalid free space record")
+			}
+			addUsed(next, start)
+			next = start + count
+		}
+		if rightSib == xfsNullAGBlock {
+			break
+		}
+		current = rightSib
+	}
+	addUsed(next, agLength)
+	return ranges, nil
+}
+
+// xfsLogIsClean returns true if the last record written to the log is an unmount
+// record. This is the case when the filesystem was cleanly unmounted, or quiesced.
+func xfsLogIsClean(src io.ReaderAt, sb xfsSuperblock) (bool, error) {
+	logAG := sb.logStart >> sb.agBlockLog
+	logAGBlock := sb.logStart & (1<<sb.agBlockLog - 1)
+	logOffset := sb.agBlockOffset(logAG, logAGBlock)
+	logSize := sb.logBlocks * sb.blockSize
+	numBlocks := logSize / xfsLogBasicBlockSize
+	if numBlocks == 0 {
+		return false, errors.Wrap(ErrUnsupported, "invalid log size")
+	}
+
+	// The log is written in a circular fashion. Every basic block is stamped with
+	// the cycle number of the pass that wrote it. The head of the log is the first
+	// block whose cycle number differs from that of the first block.
+	cycles := make([]uint32, 0, numBlocks)
+	isHeader := make([]bool, 0, numBlocks)
+	chunk := make([]byte, xfsLogReadChunk)
+	for pos := uint64(0); pos < logSize; pos += xfsLogReadChunk {
+		toRead := uint64(xfsLogReadChunk)
+		if pos+toRead > logSize {
+			toRead = logSize - pos
+		}
+		if _, err := src.ReadAt(chunk[:toRead], int64(logOffset+pos)); err != nil {
+			return false, errors.Wrap(err, "reading log")
+		}
+		for off := uint64(0); off+xfsLogBasicBlockSize <= toRead; off += xfsLogBasicBlockSize {
+			word := binary.BigEndian.Uint32(chunk[off:])
+			if word == xfsLogHeaderMagic {
+				cycles = append(cycles, binary.BigEndian.Uint32(chunk[off+4:]))
+				isHeader = append(isHeader, true)
+			} else {
+				cycles = append(cycles, word)
+				isHeader = append(isHeader, false)
+			}
+		}
+	}
+
+	head := uint64(0)
+	for i := uint64(1); i < uint64(len(cycles)); i++ {
+		if cycles[i] != cycles[0] {
+			head = i
+			break
+		}
+	}
+
+	// Find the header of the last record written before the head.
+	recordBlock := int64(-1)
+	for i := uint64(1); i <= numBlocks; i++ {
+		idx := (head + numBlocks - i) % numBlocks
+		if isHeader[idx] {
+			recordBlock = int64(idx)
+			break
+		}
+	}
+	if recordBlock < 0 {
+		return false, nil
+	}
+
+	header := make([]byte, xfsLogBasicBlockSize)
+	if _, err := src.ReadAt(header, int64(logOffset+uint64(recordBlock)*xfsLogBasicBlockSize)); err != nil {
+		return false, errors.Wrap(err, "reading log record header")
+	}
+	version := binary.BigEndian.Uint32(header[8:])
+	numLogOps := binary.BigEndian.Uint32(header[40:])
+	headerSize := uint64(binary.BigEndian.Uint32(header[320:]))
+	if numLogOps != 1 {
+		return false, nil
+	}
+
+	headerBlocks := uint64(1)
+	if version&xfsLogVersion2 != 0 && headerSize > xfsLogHeaderCycle {
+		headerBlocks = (headerSize + xfsLogHeaderCycle - 1) / xfsLogHeaderCycle
+	}
+	dataBlock := (uint64(recordBlock) + headerBlocks) % numBlocks
+
+	data := make([]byte, xfsLogBasicBlockSize)
+	if _, err := src.ReadAt(data, int64(logOffset+dataBlock*xfsLogBasicBlockSize)); err != nil {
+		return false, errors.Wrap(err, "reading log record")
+	}
+	// The flags of the first operation header follow the transaction ID,
+	// the length and the client ID.
+	opFlags := data[9]
+	return opFlags&xfsLogUnmountTrans != 0, nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package fsmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	testXFSBlockSize = 4096
+	testXFSAGBlocks  = 64
+	testXFSAGLog     = 6
+	testXFSSectSize  = 512
+	// The log is 4 blocks long, and starts at block 32 of AG 1.
+	testXFSLogAGBlock = 32
+	testXFSLogBlocks  = 4
+)
+
+// xfsLogRecord is a log record written to a test image.
+type xfsLogRecord struct {
+	block   int
+	cycle   uint32
+	numOps  uint32
+	unmount bool
+}
+
+// testXFS builds a version 5 XFS image. freeSpace holds the leaves of the free
+// space B+tree of every AG, as lists of {start, count} records. AGs with more
+// than one leaf get a root node.
+type testXFS struct {
+	agLengths []uint64
+	freeSpace [][][][2]uint32
+	// logCycle is stamped on every log block not covered by a record.
+	logCycle uint32
+	records  []xfsLogRecord
+}
+
+func (x testXFS) agOffset(ag int) int {
+	return ag * testXFSAGBlocks * testXFSBlockSize
+}
+
+func (x testXFS) build() []byte {
+	var dataBlocks uint64
+	for _, length := range x.agLengths {
+		dataBlocks += length
+	}
+	image := make([]byte, dataBlocks*testXFSBlockSize)
+
+	sb := image[:xfsSuperblockSize]
+	binary.BigEndian.PutUint32(sb[0:], xfsSBMagic)
+	binary.BigEndian.PutUint32(sb[4:], testXFSBlockSize)
+	binary.BigEndian.PutUint64(sb[8:], dataBlocks)
+	binary.BigEndian.PutUint64(sb[48:], 1<<testXFSAGLog|testXFSLogAGBlock)
+	binary.BigEndian.PutUint32(sb[84:], testXFSAGBlocks)
+	binary.BigEndian.PutUint32(sb[88:], uint32(len(x.agLengths)))
+	binary.BigEndian.PutUint32(sb[96:], testXFSLogBlocks)
+	binary.BigEndian.PutUint16(sb[100:], 0xB4A5)
+	binary.BigEndian.PutUint16(sb[102:], testXFSSectSize)
+	sb[124] = testXFSAGLog
+
+	for ag, length := range x.agLengths {
+		agStart := x.agOffset(ag)
+		agf := image[agStart+testXFSSectSize:]
+		binary.BigEndian.PutUint32(agf[0:], xfsAGFMagic)
+		binary.BigEndian.PutUint32(agf[12:], uint32(length))
+
+		leaves := x.freeSpace[ag]
+		// Leaves start at block 2. Block 1 holds the root node, if any.
+		root := uint32(2)
+		if len(leaves) > 1 {
+			root = 1
+			node := image[agStart+testXFSBlockSize : agStart+2*testXFSBlockSize]
+			x.writeBtreeHeader(node, 1, len(leaves), xfsNullAGBlock)
+			maxRecs := (testXFSBlockSize - xfsBtreeShortHdrSizeCRC) / (xfsAllocRecSize + xfsAllocPtrSize)
+			for idx, leaf := range leaves {
+				binary.BigEndian.PutUint32(node[xfsBtreeShortHdrSizeCRC+idx*xfsAllocRecSize:], leaf[0][0])
+				binary.BigEndian.PutUint32(node[xfsBtreeShortHdrSizeCRC+maxRecs*xfsAllocRecSize+idx*xfsAllocPtrSize:], uint32(2+idx))
+			}
+		}
+		binary.BigEndian.PutUint32(agf[16:], root)
+
+		for idx, leaf := range leaves {
+			rightSib := uint32(xfsNullAGBlock)
+			if idx < len(leaves)-1 {
+				rightSib = uint32(3 + idx)
+			}
+			blockStart := agStart + (2+idx)*testXFSBlockSize
+			block := image[blockStart : blockStart+testXFSBlockSize]
+			x.writeBtreeHeader(block, 0, len(leaf), rightSib)
+			for recIdx, rec := range leaf {
+				binary.BigEndian.PutUint32(block[xfsBtreeShortHdrSizeCRC+recIdx*xfsAllocRecSize:], rec[0])
+				binary.BigEndian.PutUint32(block[xfsBtreeShortHdrSizeCRC+recIdx*xfsAllocRecSize+4:], rec[1])
+			}
+		}
+	}
+
+	logStart := x.agOffset(1) + testXFSLogAGBlock*testXFSBlockSize
+	numBlocks := testXFSLogBlocks * testXFSBlockSize / xfsLogBasicBlockSize
+	for idx := 0; idx < numBlocks; idx++ {
+		binary.BigEndian.PutUint32(image[logStart+idx*xfsLogBasicBlockSize:], x.logCycle)
+	}
+	for _, rec := range x.records {
+		header := image[logStart+rec.block*xfsLogBasicBlockSize:]
+		binary.BigEndian.PutUint32(header[0:], xfsLogHeaderMagic)
+		binary.BigEndian.PutUint32(header[4:], rec.cycle)
+		binary.BigEndian.PutUint32(header[8:], xfsLogVersion2)
+		binary.BigEndian.PutUint32(header[40:], rec.numOps)
+		binary.BigEndian.PutUint32(header[320:], xfsLogHeaderCycle)
+
+		data := image[logStart+(rec.block+1)*xfsLogBasicBlockSize:]
+		binary.BigEndian.PutUint32(data[0:], rec.cycle)
+		if rec.unmount {
+			data[9] = xfsLogUnmountTrans
+		}
+	}
+	return image
+}
+
+func (x testXFS) writeBtreeHeader(block []byte, level, numRecs int, rightSib uint32) {
+	binary.BigEndian.PutUint32(block[0:], xfsABTB3Magic)
+	binary.BigEndian.PutUint16(block[4:], uint16(level))
+	binary.BigEndian.PutUint16(block[6:], uint16(numRecs))
+	binary.BigEndian.PutUint32(block[8:], xfsNullAGBlock)
+	binary.BigEndian.PutUint32(block[12:], rightSib)
+}
+
+// newTestXFS returns a cleanly unmounted filesystem with three AGs. The last AG
+// is shorter than the others. The free space B+tree of AG 0 has two levels.
+func newTestXFS() testXFS {
+	return testXFS{
+		agLengths: []uint64{testXFSAGBlocks, testXFSAGBlocks, 40},
+		freeSpace: [][][][2]uint32{
+			{
+				{{10, 5}, {20, 4}},
+				{{40, 10}, {60, 4}},
+			},
+			{
+				{{8, 24}, {36, 28}},
+			},
+			{
+				{{4, 36}},
+			},
+		},
+		logCycle: 1,
+		records: []xfsLogRecord{
+			{block: 0, cycle: 1, numOps: 1, unmount: true},
+		},
+	}
+}
+
+func xfsBlocks(ag int, first, last uint64) blockRange {
+	agStart := uint64(ag * testXFSAGBlocks)
+	return blockRange{agStart + first, agStart + last}
+}
+
+var testXFSUsed = []blockRange{
+	xfsBlocks(0, 0, 9),
+	xfsBlocks(0, 15, 19),
+	xfsBlocks(0, 24, 39),
+	xfsBlocks(0, 50, 59),
+	// The log.
+	xfsBlocks(1, 0, 7),
+	xfsBlocks(1, 32, 35),
+	xfsBlocks(2, 0, 3),
+}
+
+func TestXFSUsedRanges(t *testing.T) {
+	image := newTestXFS().build()
+	used, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRanges(t, toRanges(testXFSUsed, testXFSBlockSize), used)
+	checkNonZeroCovered(t, image, used, testXFSBlockSize)
+}
+
+func TestXFSWrappedLog(t *testing.T) {
+	// The log wrapped: blocks 0 to 3 were written by the current cycle, and
+	// the rest of the log still holds records of the previous cycle. The
+	// head is at block 4, and the unmount record is the last one before it.
+	fs := newTestXFS()
+	fs.logCycle = 1
+	fs.records = []xfsLogRecord{
+		{block: 0, cycle: 2, numOps: 3},
+		{block: 2, cycle: 2, numOps: 1, unmount: true},
+		{block: 4, cycle: 1, numOps: 3},
+		{block: 10, cycle: 1, numOps: 3},
+	}
+	image := fs.build()
+	used, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRanges(t, toRanges(testXFSUsed, testXFSBlockSize), used)
+}
+
+func TestXFSDirtyLog(t *testing.T) {
+	// The last record is a transaction, not an unmount record. The free
+	// space B+trees may not hold the latest allocations yet.
+	fs := newTestXFS()
+	fs.records = []xfsLogRecord{
+		{block: 0, cycle: 1, numOps: 1, unmount: true},
+		{block: 2, cycle: 1, numOps: 4},
+	}
+	image := fs.build()
+	if _, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image))); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected a dirty log to be unsupported, got %v", err)
+	}
+
+	// A single operation that is not an unmount is just as dirty.
+	fs.records = []xfsLogRecord{
+		{block: 0, cycle: 1, numOps: 1},
+	}
+	image = fs.build()
+	if _, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image))); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected a dirty log to be unsupported, got %v", err)
+	}
+}
+
+func TestXFSUnsupported(t *testing.T) {
+	image := newTestXFS().build()
+
+	// The filesystem is larger than its partition.
+	if _, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image))-testXFSBlockSize); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected a truncated filesystem to be unsupported, got %v", err)
+	}
+
+	// Free space records must be sorted, and must not overlap.
+	fs := newTestXFS()
+	fs.freeSpace[1] = [][][2]uint32{{{36, 28}, {8, 24}}}
+	image = fs.build()
+	if _, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image))); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected unsorted free space records to be unsupported, got %v", err)
+	}
+
+	// A free extent past the end of the AG.
+	fs = newTestXFS()
+	fs.freeSpace[2] = [][][2]uint32{{{4, 40}}}
+	image = fs.build()
+	if _, err := UsedRanges(bytes.NewReader(image), "xfs", 0, uint64(len(image))); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected an invalid free space record to be unsupported, got %v", err)
+	}
+}
@@ -72,14 +72,15 @@ import "C"
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"syscall"
 	"unsafe"
 
 	"github.com/pkg/errors"
 
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/internal/types"
 	"coriolis-snapshot-agent/internal/util"
 )
@@ -203,7 +204,8 @@ func getKernelEntryAddress(name string) (uint64, error) {
 // cap to the binary. This is due to the fact that non-root users are not allowed to read kernel entry addresses from
 // /proc/kallsyms, for security reasons. To set the CAP_SYSLOG to the binary run:
 // 		sudo setcap 'CAP_SYSLOG+ep' coriolis-snapshot-agent
-func SetMissingKernelEntries() error {
+func SetMissingKernelEntries(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
 	dev, err := os.OpenFile(VEEAM_DEV, os.O_RDWR, 0600)
 	if err != nil {
 		return errors.Wrap(err, "opening veeamsnap")
@@ -220,13 +222,13 @@ func SetMissingKernelEntries() error {
 		return errors.Wrap(errno, "getting unresolved kernel entries")
 	}
 	if r1 == 0 {
-		log.Println("No unresolved kernel entries found!")
+		logger.Infof("No unresolved kernel entries found")
 		return nil
 	}
 
 	// NOTE: The IOCTL_GET_UNRESOLVED_KERNEL_ENTRIES call only saves one kernel entry in the return buffer, no need for word separation.
 	unresolvedEntryName = C.GoString(&unresolvedEntries.buf[0])
-	log.Printf("Found unresolved kernel entry: %s\n", unresolvedEntryName)
+	logger.Infof("Found unresolved kernel entry: %s", unresolvedEntryName)
 
 	// Before adding any kernel entry, we need to also send "__request_module" entry as init entry
 	reqModuleEntryAddress, err := getKernelEntryAddress(KERNEL_ENTRY_BASE_NAME)
@@ -271,6 +273,38 @@ func SetMissingKernelEntries() error {
 	return nil
 }
 
+// CheckDevice verifies that the veeamsnap character device exists and can be opened.
+func CheckDevice() error {
+	dev, err := os.OpenFile(VEEAM_DEV, os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening veeamsnap")
+	}
+	return dev.Close()
+}
+
+// GetUnresolvedKernelEntry returns the name of a kernel entry the veeamsnap module
+// could not resolve, or an empty string if all entries are resolved.
+func GetUnresolvedKernelEntry() (string, error) {
+	dev, err := os.OpenFile(VEEAM_DEV, os.O_RDWR, 0600)
+	if err != nil {
+		return "", errors.Wrap(err, "opening veeamsnap")
+	}
+	defer dev.Close()
+
+	var buffer [4096]C.char
+	unresolvedEntries := C.struct_ioctl_get_unresolved_kernel_entries_s{
+		buf: buffer,
+	}
+	r1, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), IOCTL_GET_UNRESOLVED_KERNEL_ENTRIES, uintptr(unsafe.Pointer(&unresolvedEntries)))
+	if int(errno) != 0 {
+		return "", errors.Wrap(errno, "getting unresolved kernel entries")
+	}
+	if r1 == 0 {
+		return "", nil
+	}
+	return C.GoString(&unresolvedEntries.buf[0]), nil
+}
+
 func AddDeviceToTracking(device types.DevID) error {
 	dev, err := os.OpenFile(VEEAM_DEV, os.O_RDWR, 0600)
 	if err != nil {
@@ -0,0 +1,104 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader is the header that holds the ID of an API request. It is set
+// on every response. A valid ID sent by the client in this header is used
+// instead of a new one, so requests can be followed across services.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID we accept from clients.
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a copy of ctx that holds logger.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger held by ctx, or the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return logger
+	}
+	return Default()
+}
+
+// WithFields returns a copy of ctx, whose logger adds the key/value pairs in
+// keyvals to every line.
+func WithFields(ctx context.Context, keyvals ...interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(keyvals...))
+}
+
+// WithRequestID returns a copy of ctx that holds requestID. Lines logged using
+// the logger of the returned context carry a request_id field. An empty
+// requestID returns ctx unchanged.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, requestIDKey, requestID)
+	return WithFields(ctx, "request_id", requestID)
+}
+
+// RequestID returns the request ID held by ctx, or an empty string.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// validRequestID returns true if a request ID sent by a client is safe to log.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range requestID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDMiddleware assigns an ID to every request, and returns it to the
+// client in the RequestIDHeader header. The ID is stored in the context of the
+// request.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+	})
+}
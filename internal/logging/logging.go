@@ -0,0 +1,347 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package logging implements a leveled logger, that writes structured lines
+// as plain text, logfmt or JSON. Loggers carry key/value fields, and can be
+// stored in a context, so all lines logged on behalf of a request or an
+// operation share the same request ID.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+const (
+	// LevelDebug is used for details that are only useful while debugging.
+	LevelDebug Level = iota
+	// LevelInfo is used for normal activity.
+	LevelInfo
+	// LevelWarn is used for unexpected conditions the agent recovers from.
+	LevelWarn
+	// LevelError is used for failures.
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel returns the level called name. An empty name is LevelInfo.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return LevelInfo, nil
+	case "warning":
+		return LevelWarn, nil
+	}
+	for level, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
+		}
+	}
+	return LevelInfo, vErrors.NewValueError("invalid log level %q", name)
+}
+
+// Format is the layout of a log line.
+type Format string
+
+const (
+	// FormatText writes lines the same way the standard library logger does,
+	// followed by the level and the fields of the logger.
+	FormatText Format = "text"
+	// FormatLogfmt writes lines as key=value pairs.
+	FormatLogfmt Format = "logfmt"
+	// FormatJSON writes every line as a JSON object.
+	FormatJSON Format = "json"
+)
+
+// ParseFormat returns the format called name. An empty name is FormatText.
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case "", FormatText:
+		return FormatText, nil
+	case FormatLogfmt:
+		return FormatLogfmt, nil
+	case FormatJSON:
+		return FormatJSON, nil
+	}
+	return FormatText, vErrors.NewValueError("invalid log format %q", name)
+}
+
+// field is a key/value pair added to every line of a logger.
+type field struct {
+	key   string
+	value interface{}
+}
+
+// output is shared by a logger, and all the loggers derived from it, so lines
+// written from different goroutines do not get mixed up.
+type output struct {
+	mux    sync.Mutex
+	writer io.Writer
+}
+
+// New returns a logger that writes lines of at least level to writer.
+func New(writer io.Writer, format Format, level Level) *Logger {
+	return &Logger{
+		out:    &output{writer: writer},
+		format: format,
+		level:  level,
+	}
+}
+
+// Logger is a leveled, structured logger. It is safe to use a Logger from
+// multiple goroutines.
+type Logger struct {
+	out    *output
+	format Format
+	level  Level
+	fields []field
+}
+
+// With returns a logger that adds the key/value pairs in keyvals to every line.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if len(keyvals) == 0 {
+		return l
+	}
+	fields := make([]field, len(l.fields), len(l.fields)+(len(keyvals)+1)/2)
+	copy(fields, l.fields)
+	for idx := 0; idx < len(keyvals); idx += 2 {
+		var value interface{}
+		if idx+1 < len(keyvals) {
+			value = keyvals[idx+1]
+		}
+		fields = append(fields, field{key: fmt.Sprint(keyvals[idx]), value: value})
+	}
+
+	ret := *l
+	ret.fields = fields
+	return &ret
+}
+
+// WithOutput returns a logger that has the same fields as l, but writes to writer.
+func (l *Logger) WithOutput(writer io.Writer) *Logger {
+	ret := *l
+	ret.out = &output{writer: writer}
+	return &ret
+}
+
+// Enabled returns true if lines of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debugf logs a message at LevelDebug.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs a message at LevelInfo.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a message at LevelWarn.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs a message at LevelError.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(time.Now(), level, fmt.Sprintf(format, args...))
+}
+
+// write formats a line, and writes it to the output of the logger.
+func (l *Logger) write(now time.Time, level Level, msg string) {
+	msg = strings.TrimRight(msg, "\n")
+
+	var buf bytes.Buffer
+	switch l.format {
+	case FormatJSON:
+		l.formatJSON(&buf, now, level, msg)
+	case FormatLogfmt:
+		l.formatLogfmt(&buf, now, level, msg)
+	default:
+		l.formatText(&buf, now, level, msg)
+	}
+	buf.WriteByte('\n')
+
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	l.out.writer.Write(buf.Bytes())
+}
+
+func (l *Logger) formatText(buf *bytes.Buffer, now time.Time, level Level, msg string) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05"))
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for _, f := range l.fields {
+		buf.WriteByte(' ')
+		writeLogfmtPair(buf, f.key, f.value)
+	}
+}
+
+func (l *Logger) formatLogfmt(buf *bytes.Buffer, now time.Time, level Level, msg string) {
+	writeLogfmtPair(buf, "time", now.UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(' ')
+	writeLogfmtPair(buf, "level", level.String())
+	buf.WriteByte(' ')
+	writeLogfmtPair(buf, "msg", msg)
+	for _, f := range l.fields {
+		buf.WriteByte(' ')
+		writeLogfmtPair(buf, f.key, f.value)
+	}
+}
+
+func (l *Logger) formatJSON(buf *bytes.Buffer, now time.Time, level Level, msg string) {
+	buf.WriteByte('{')
+	writeJSONPair(buf, "time", now.UTC().Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeJSONPair(buf, "level", level.String())
+	buf.WriteByte(',')
+	writeJSONPair(buf, "msg", msg)
+	for _, f := range l.fields {
+		buf.WriteByte(',')
+		writeJSONPair(buf, f.key, f.value)
+	}
+	buf.WriteByte('}')
+}
+
+// stringValue returns the text form of a field value.
+func stringValue(value interface{}) string {
+	switch val := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case error:
+		return val.Error()
+	case fmt.Stringer:
+		return val.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func writeLogfmtPair(buf *bytes.Buffer, key string, value interface{}) {
+	buf.WriteString(key)
+	buf.WriteByte('=')
+
+	str := stringValue(value)
+	if str == "" || strings.ContainsAny(str, " =\"\\") || strings.IndexFunc(str, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		str = strconv.Quote(str)
+	}
+	buf.WriteString(str)
+}
+
+func writeJSONPair(buf *bytes.Buffer, key string, value interface{}) {
+	asJSON, _ := json.Marshal(key)
+	buf.Write(asJSON)
+	buf.WriteByte(':')
+
+	switch value.(type) {
+	case error, fmt.Stringer:
+		value = stringValue(value)
+	}
+	asJSON, err := json.Marshal(value)
+	if err != nil {
+		asJSON, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(asJSON)
+}
+
+// Writer returns a writer that logs every line written to it. It is used to
+// send the output of the standard library logger through l. Lines that start
+// with "failed" or "error" are logged at LevelError, lines that start with
+// "warning" at LevelWarn, and everything else at LevelInfo.
+func (l *Logger) Writer() io.Writer {
+	return stdWriter{logger: l}
+}
+
+type stdWriter struct {
+	logger *Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level := stdLevel(msg)
+	if w.logger.Enabled(level) {
+		w.logger.write(time.Now(), level, msg)
+	}
+	return len(p), nil
+}
+
+func stdLevel(msg string) Level {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(lower, "failed"), strings.HasPrefix(lower, "error"), strings.HasPrefix(lower, "unhandled error"):
+		return LevelError
+	case strings.HasPrefix(lower, "warning"):
+		return LevelWarn
+	}
+	return LevelInfo
+}
+
+var (
+	defaultMux    sync.Mutex
+	defaultLogger = New(os.Stderr, FormatText, LevelInfo)
+)
+
+// SetDefault sets the logger returned by Default, and by FromContext for
+// contexts that hold no logger.
+func SetDefault(l *Logger) {
+	defaultMux.Lock()
+	defer defaultMux.Unlock()
+	defaultLogger = l
+}
+
+// Default returns the default logger. Unless SetDefault is called, it writes
+// text lines of LevelInfo and above to stderr.
+func Default() *Logger {
+	defaultMux.Lock()
+	defer defaultMux.Unlock()
+	return defaultLogger
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatJSON, LevelInfo).With("request_id", "abc", "error", errors.New("boom"), "size", 10)
+	logger.Infof("hello %s", "world")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("failed to parse %q: %s", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"level":      "info",
+		"msg":        "hello world",
+		"request_id": "abc",
+		"error":      "boom",
+		"size":       float64(10),
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("expected %s to be %v, got %v", key, value, line[key])
+		}
+	}
+	if _, ok := line["time"]; !ok {
+		t.Errorf("missing time in %q", buf.String())
+	}
+
+	buf.Reset()
+	logger = New(&buf, FormatLogfmt, LevelInfo).With("request_id", "abc", "path", "/a b")
+	logger.Warnf("disk %q is gone", "sda")
+	got := strings.TrimSpace(buf.String())
+	if !strings.Contains(got, ` level=warn msg="disk \"sda\" is gone" request_id=abc path="/a b"`) {
+		t.Errorf("unexpected logfmt line %q", got)
+	}
+
+	buf.Reset()
+	logger = New(&buf, FormatText, LevelInfo).With("request_id", "abc")
+	logger.Errorf("failed")
+	got = strings.TrimSpace(buf.String())
+	if !strings.HasSuffix(got, " ERROR failed request_id=abc") {
+		t.Errorf("unexpected text line %q", got)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatLogfmt, LevelWarn)
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("expected invalid level to fail")
+	}
+	if level, err := ParseLevel("WARNING"); err != nil || level != LevelWarn {
+		t.Errorf("expected WARNING to be parsed as warn, got %s (%v)", level, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("expected invalid format to fail")
+	}
+}
+
+func TestStdWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := New(&buf, FormatLogfmt, LevelInfo).Writer()
+	writer.Write([]byte("failed to get disk: not found\n"))
+	writer.Write([]byte("adding disk to tracking\n"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "level=error") || !strings.Contains(lines[1], "level=info") {
+		t.Errorf("unexpected levels in %q", buf.String())
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	defer SetDefault(Default())
+	SetDefault(New(&buf, FormatLogfmt, LevelInfo))
+
+	var seen string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		FromContext(r.Context()).Infof("handling request")
+	}))
+
+	req := httptest.NewRequest("GET", "/api/v1/disks", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	header := rec.Header().Get(RequestIDHeader)
+	if header == "" || header != seen {
+		t.Fatalf("expected header %q to match request ID %q", header, seen)
+	}
+	if !strings.Contains(buf.String(), "request_id="+seen) {
+		t.Errorf("expected log line to carry request ID, got %q", buf.String())
+	}
+
+	// Valid IDs sent by clients are kept, others are replaced.
+	req = httptest.NewRequest("GET", "/api/v1/disks", nil)
+	req.Header.Set(RequestIDHeader, "client-id.1")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get(RequestIDHeader); got != "client-id.1" {
+		t.Errorf("expected client request ID to be kept, got %q", got)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/disks", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get(RequestIDHeader); got == "" || got == "bad id\n" {
+		t.Errorf("expected invalid request ID to be replaced, got %q", got)
+	}
+
+	// Fields of the request logger are kept by contexts derived from it.
+	ctx := WithFields(WithRequestID(context.Background(), "abc"), "operation_id", "op1")
+	if RequestID(ctx) != "abc" {
+		t.Errorf("expected request ID abc, got %q", RequestID(ctx))
+	}
+	buf.Reset()
+	FromContext(ctx).Infof("working")
+	if !strings.Contains(buf.String(), "request_id=abc operation_id=op1") {
+		t.Errorf("unexpected line %q", buf.String())
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics holds the prometheus metrics exported by the agent.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Namespace is prepended to the name of all agent metrics.
+const Namespace = "coriolis_snapshot_agent"
+
+var (
+	// Registry holds all agent metrics. It is served by the /metrics endpoint.
+	Registry = prometheus.NewRegistry()
+
+	// SnapStoreHalfFill counts the half fill notifications received from the
+	// kernel module, per snap store.
+	SnapStoreHalfFill = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "snap_store_half_fill_total",
+		Help:      "Number of half fill notifications received for a snap store.",
+	}, []string{"snap_store_id"})
+
+	// SnapStoreOverflow counts the overflow notifications received from the
+	// kernel module, per snap store.
+	SnapStoreOverflow = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "snap_store_overflow_total",
+		Help:      "Number of overflow notifications received for a snap store.",
+	}, []string{"snap_store_id"})
+
+	// SnapshotCreateDuration tracks how long snapshot creation takes.
+	SnapshotCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "snapshot_create_duration_seconds",
+		Help:      "Time it takes to create a snapshot.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"status"})
+
+	// SnapshotDeleteDuration tracks how long snapshot deletion takes.
+	SnapshotDeleteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "snapshot_delete_duration_seconds",
+		Help:      "Time it takes to delete a snapshot.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"status"})
+
+	// BytesServed counts the bytes of snapshot data sent to clients, per
+	// tracked disk.
+	BytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "consumed_bytes_total",
+		Help:      "Number of bytes of snapshot data sent to clients.",
+	}, []string{"tracked_disk_id"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		SnapStoreHalfFill,
+		SnapStoreOverflow,
+		SnapshotCreateDuration,
+		SnapshotDeleteDuration,
+		BytesServed,
+	)
+}
+
+// ObserveDuration records the time elapsed since start in a histogram. The
+// status label is set to "failed" if err is not nil, and "succeeded" otherwise.
+func ObserveDuration(histogram *prometheus.HistogramVec, start time.Time, err error) {
+	status := "succeeded"
+	if err != nil {
+		status = "failed"
+	}
+	histogram.WithLabelValues(status).Observe(time.Since(start).Seconds())
+}
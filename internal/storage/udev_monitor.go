@@ -3,12 +3,14 @@ package storage
 import (
 	"context"
 	"fmt"
-	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	udev "github.com/farjump/go-libudev"
 	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/internal/logging"
 )
 
 type DeviceStatus string
@@ -17,8 +19,8 @@ const (
 	DeviceStatusActive   DeviceStatus = "active"
 	DeviceStatusInactive DeviceStatus = "inactive"
 	DeviceStatusUnknown  DeviceStatus = "unknown"
-	udevActionAdd                     = "add"
-	udevActionRemove                  = "remove"
+	UdevActionAdd                     = "add"
+	UdevActionRemove                  = "remove"
 )
 
 type UdevDevice struct {
@@ -26,11 +28,46 @@ type UdevDevice struct {
 	DeviceStatus DeviceStatus
 }
 
+// UdevEvent describes a block device that was added or removed.
+type UdevEvent struct {
+	Action     string
+	DeviceNode string
+	Major      int
+	Minor      int
+}
+
 type UdevMonitor struct {
 	cancel  context.CancelFunc
 	ctx     context.Context
 	monitor *udev.Monitor
 	devices sync.Map
+	// running is set to 1 while Start is processing udev events.
+	running int32
+
+	eventChannels []chan UdevEvent
+	eventMux      sync.Mutex
+}
+
+// RegisterEventChannel registers a channel that will receive add and remove events.
+// Events are dropped if the channel is full.
+func (m *UdevMonitor) RegisterEventChannel(ch chan UdevEvent) {
+	m.eventMux.Lock()
+	defer m.eventMux.Unlock()
+
+	m.eventChannels = append(m.eventChannels, ch)
+}
+
+func (m *UdevMonitor) sendEvent(evt UdevEvent) {
+	m.eventMux.Lock()
+	defer m.eventMux.Unlock()
+
+	for _, ch := range m.eventChannels {
+		select {
+		case ch <- evt:
+		default:
+			logging.FromContext(m.ctx).Warnf("dropping udev event for %s: channel is full", evt.DeviceNode)
+		}
+	}
 }
 
 func NewUdevMonitor(ctx context.Context, cancel context.CancelFunc) (monitor *UdevMonitor) {
@@ -48,23 +85,40 @@ func NewUdevMonitor(ctx context.Context, cancel context.CancelFunc) (monitor *Ud
 }
 
 func (m *UdevMonitor) Start() {
-	ch, _ := m.monitor.DeviceChan(m.ctx)
+	atomic.StoreInt32(&m.running, 1)
+	defer atomic.StoreInt32(&m.running, 0)
+
+	ch, err := m.monitor.DeviceChan(m.ctx)
+	if err != nil {
+		logging.FromContext(m.ctx).Errorf("failed to start udev monitor: %q", err)
+		return
+	}
 	for d := range ch {
 		device := UdevDevice{
 			DeviceNode:   d.Devnode(),
 		}
 		devKey := fmt.Sprintf("%d-%d", d.Devnum().Major(), d.Devnum().Minor())
 		switch d.Action() {
-		case udevActionAdd:
+		case UdevActionAdd:
 			device.DeviceStatus = DeviceStatusActive
-		case udevActionRemove:
+		case UdevActionRemove:
 			m.devices.Delete(devKey)
 		default:
 			device.DeviceStatus = DeviceStatusUnknown
 		}
 
-		log.Printf("Udev device event detected, adding to monitor devices: %s -> %+v", devKey, device)
+		logging.FromContext(m.ctx).Debugf("Udev device event detected, adding to monitor devices: %s -> %+v", devKey, device)
 		m.devices.Store(devKey, device)
+
+		switch d.Action() {
+		case UdevActionAdd, UdevActionRemove:
+			m.sendEvent(UdevEvent{
+				Action:     d.Action(),
+				DeviceNode: d.Devnode(),
+				Major:      d.Devnum().Major(),
+				Minor:      d.Devnum().Minor(),
+			})
+		}
 	}
 }
 
@@ -72,7 +126,18 @@ func (m *UdevMonitor) Stop() {
 	m.cancel()
 }
 
+// Alive returns true while the monitor is processing udev events.
+func (m *UdevMonitor) Alive() bool {
+	return atomic.LoadInt32(&m.running) == 1
+}
+
 func (m *UdevMonitor) GetUdevDevice(major int, minor int) (UdevDevice, error) {
+	return m.GetUdevDeviceWithContext(context.Background(), major, minor)
+}
+
+// GetUdevDeviceWithContext waits for udev to report a device, for up to 60 seconds.
+// It returns early if ctx is cancelled.
+func (m *UdevMonitor) GetUdevDeviceWithContext(ctx context.Context, major int, minor int) (UdevDevice, error) {
 	devKey := fmt.Sprintf("%d-%d", major, minor)
 	attempts := 0
 	for {
@@ -81,10 +146,14 @@ func (m *UdevMonitor) GetUdevDevice(major int, minor int) (UdevDevice, error) {
 		}
 		if foundDev, ok := m.devices.Load(devKey); ok {
 			device := foundDev.(UdevDevice)
-			log.Printf("Detected udev device with ID %d:%d -> %+v", major, minor, device)
+			logging.FromContext(ctx).Infof("Detected udev device with ID %d:%d -> %+v", major, minor, device)
 			return device, nil
 		}
 		attempts++
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return UdevDevice{}, errors.Wrapf(ctx.Err(), "waiting for device %d:%d", major, minor)
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
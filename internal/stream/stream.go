@@ -0,0 +1,99 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package stream implements the framing used when sending multiple disk
+// ranges in a single response. Each range is sent as a frame:
+//
+//	+----------------+----------------+-----------------+
+//	| offset (8 B)   | length (8 B)   | payload         |
+//	| uint64, BE     | uint64, BE     | (length) bytes  |
+//	+----------------+----------------+-----------------+
+//
+// The stream is terminated by a frame with a length of 0, whose offset
+// is set to the size of the disk. A stream that ends without this frame
+// was interrupted.
+package stream
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// FrameHeaderSize is the size in bytes of a frame header.
+const FrameHeaderSize = 16
+
+// FrameHeader describes the payload that follows it.
+type FrameHeader struct {
+	// Offset is the offset on disk of the payload.
+	Offset uint64
+	// Length is the length of the payload.
+	Length uint64
+}
+
+// IsEnd returns true if this header marks the end of the stream.
+func (f FrameHeader) IsEnd() bool {
+	return f.Length == 0
+}
+
+// MarshalBinary returns the wire representation of the frame header.
+func (f FrameHeader) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, FrameHeaderSize)
+	binary.BigEndian.PutUint64(buf[0:8], f.Offset)
+	binary.BigEndian.PutUint64(buf[8:16], f.Length)
+	return buf, nil
+}
+
+// WriteFrame writes a frame header, followed by length bytes read from src,
+// starting at offset.
+func WriteFrame(w io.Writer, src io.ReaderAt, offset, length uint64) error {
+	hdr, _ := FrameHeader{Offset: offset, Length: length}.MarshalBinary()
+	if _, err := w.Write(hdr); err != nil {
+		return errors.Wrap(err, "writing frame header")
+	}
+
+	reader := io.NewSectionReader(src, int64(offset), int64(length))
+	written, err := io.Copy(w, reader)
+	if err != nil {
+		return errors.Wrap(err, "writing frame payload")
+	}
+	if uint64(written) != length {
+		return errors.Errorf("short read at offset %d: expected %d bytes, got %d", offset, length, written)
+	}
+	return nil
+}
+
+// WriteEnd writes the frame that marks the end of the stream.
+func WriteEnd(w io.Writer, diskSize uint64) error {
+	hdr, _ := FrameHeader{Offset: diskSize}.MarshalBinary()
+	if _, err := w.Write(hdr); err != nil {
+		return errors.Wrap(err, "writing end of stream")
+	}
+	return nil
+}
+
+// ReadFrameHeader reads the next frame header from r. The caller must consume
+// exactly Length bytes of payload before reading the next header.
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	buf := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return FrameHeader{}, errors.Wrap(err, "reading frame header")
+	}
+	return FrameHeader{
+		Offset: binary.BigEndian.Uint64(buf[0:8]),
+		Length: binary.BigEndian.Uint64(buf[8:16]),
+	}, nil
+}
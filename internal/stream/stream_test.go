@@ -0,0 +1,128 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRoundTrip(t *testing.T) {
+	disk := make([]byte, 4096)
+	for i := range disk {
+		disk[i] = byte(i % 251)
+	}
+	src := bytes.NewReader(disk)
+	ranges := []FrameHeader{
+		{Offset: 0, Length: 512},
+		{Offset: 1024, Length: 1},
+		{Offset: 3072, Length: 1024},
+	}
+
+	var buf bytes.Buffer
+	for _, rng := range ranges {
+		if err := WriteFrame(&buf, src, rng.Offset, rng.Length); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WriteEnd(&buf, uint64(len(disk))); err != nil {
+		t.Fatal(err)
+	}
+	expectedSize := FrameHeaderSize*(len(ranges)+1) + 512 + 1 + 1024
+	if buf.Len() != expectedSize {
+		t.Fatalf("expected a stream of %d bytes, got %d", expectedSize, buf.Len())
+	}
+
+	for _, rng := range ranges {
+		hdr, err := ReadFrameHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr != rng || hdr.IsEnd() {
+			t.Fatalf("expected frame %+v, got %+v", rng, hdr)
+		}
+		payload := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(&buf, payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, disk[hdr.Offset:hdr.Offset+hdr.Length]) {
+			t.Fatalf("payload of frame at offset %d does not match the disk", hdr.Offset)
+		}
+	}
+
+	end, err := ReadFrameHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !end.IsEnd() || end.Offset != uint64(len(disk)) {
+		t.Fatalf("expected end of stream with disk size %d, got %+v", len(disk), end)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes left after the end of stream", buf.Len())
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	hdr, err := FrameHeader{Offset: 0x0102030405060708, Length: 0x10}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0, 0, 0, 0, 0x10}
+	if !bytes.Equal(hdr, expected) {
+		t.Fatalf("expected %x, got %x", expected, hdr)
+	}
+}
+
+func TestTruncatedHeader(t *testing.T) {
+	hdr, _ := FrameHeader{Offset: 512, Length: 512}.MarshalBinary()
+
+	if _, err := ReadFrameHeader(bytes.NewReader(nil)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF on an empty stream, got %v", err)
+	}
+	for _, size := range []int{1, 8, FrameHeaderSize - 1} {
+		if _, err := ReadFrameHeader(bytes.NewReader(hdr[:size])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected unexpected EOF on a %d byte header, got %v", size, err)
+		}
+	}
+}
+
+func TestTruncatedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, bytes.NewReader(make([]byte, 1024)), 0, 1024); err != nil {
+		t.Fatal(err)
+	}
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-100])
+
+	hdr, err := ReadFrameHeader(truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(truncated, make([]byte, hdr.Length)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected unexpected EOF on a truncated payload, got %v", err)
+	}
+}
+
+func TestWriteFrameShortRead(t *testing.T) {
+	src := bytes.NewReader(make([]byte, 1024))
+	// The range ends past the end of the source.
+	if err := WriteFrame(ioutil.Discard, src, 512, 1024); err == nil {
+		t.Fatal("expected an error for a range past the end of the source")
+	}
+}
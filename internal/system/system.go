@@ -16,9 +16,9 @@
 package system
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path"
@@ -30,6 +30,7 @@ import (
 	"github.com/shirou/gopsutil/v3/mem"
 
 	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/worker/manager"
 )
 
@@ -80,14 +81,14 @@ type SystemInfo struct {
 	FirmwareType    string                `json:"firmware_type"`
 }
 
-func getOSInfo() (OSInfo, error) {
+func getOSInfo(ctx context.Context) (OSInfo, error) {
 	var name string
 	var version string
 	osDetails, err := FetchOSDetails()
 	if err != nil {
 		name = ""
 		version = ""
-		log.Printf("failed to get os info: %+v", err)
+		logging.FromContext(ctx).Warnf("failed to get os info: %+v", err)
 	} else {
 		name = osDetails.Name
 		version = osDetails.Version
@@ -139,7 +140,8 @@ func getInterfaceTypeCode(interfacePath string) (int, error) {
 	return code, nil
 }
 
-func getBridgeInterfaceSlaves(bridge NetworkInterface, nicNameMapping map[string]*NetworkInterface) ([]*NetworkInterface, error) {
+func getBridgeInterfaceSlaves(ctx context.Context, bridge NetworkInterface, nicNameMapping map[string]*NetworkInterface) ([]*NetworkInterface, error) {
+	logger := logging.FromContext(ctx)
 	var slaves []*NetworkInterface
 
 	interfacePath := path.Join(NET_CLASS_PATH, bridge.Name)
@@ -155,23 +157,24 @@ func getBridgeInterfaceSlaves(bridge NetworkInterface, nicNameMapping map[string
 	if pathInfo.IsDir() {
 		files, err := ioutil.ReadDir(bridgedInterfacesPath)
 		if err != nil {
-			log.Printf("Could not list directory %v: %+v", bridgedInterfacesPath, err)
+			logger.Warnf("Could not list directory %v: %+v", bridgedInterfacesPath, err)
 			return []*NetworkInterface{}, errors.Wrap(err, "listing bridge slaves directory")
 		}
 
 		for _, f := range files {
 			slaves = append(slaves, nicNameMapping[f.Name()])
 		}
-		log.Printf("Interfaces linked to bridge %v: %+v\n", bridge.Name, slaves)
+		logger.Debugf("Interfaces linked to bridge %v: %+v", bridge.Name, slaves)
 	} else {
-		log.Println(bridgedInterfacesPath, "is not a directory. Skipping")
+		logger.Debugf("%s is not a directory. Skipping", bridgedInterfacesPath)
 		return []*NetworkInterface{}, nil
 	}
 
 	return slaves, nil
 }
 
-func getNICInfo() ([]NetworkInterface, error) {
+func getNICInfo(ctx context.Context) ([]NetworkInterface, error) {
+	logger := logging.FromContext(ctx)
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, errors.Wrap(err, "fetching interfaces")
@@ -181,7 +184,7 @@ func getNICInfo() ([]NetworkInterface, error) {
 	ret := []NetworkInterface{}
 	for _, val := range ifaces {
 		if val.Flags&net.FlagLoopback != 0 {
-			log.Println("Skipping loopback network interface:", val.Name)
+			logger.Debugf("Skipping loopback network interface: %s", val.Name)
 			continue
 		}
 
@@ -194,7 +197,7 @@ func getNICInfo() ([]NetworkInterface, error) {
 		interfacePath := path.Join(NET_CLASS_PATH, val.Name)
 		interfaceLinkPath, err := filepath.EvalSymlinks(interfacePath)
 		if err != nil {
-			log.Printf("Could not get network interface's symlink: %+v", err)
+			logger.Warnf("Could not get network interface's symlink: %+v", err)
 			continue
 		}
 
@@ -229,7 +232,7 @@ func getNICInfo() ([]NetworkInterface, error) {
 
 	for idx, nic := range ret {
 		if nic.InterfaceType == IfaceTypeBridge {
-			slaves, err := getBridgeInterfaceSlaves(nic, nicNameMapping)
+			slaves, err := getBridgeInterfaceSlaves(ctx, nic, nicNameMapping)
 			if err != nil {
 				continue
 			}
@@ -240,7 +243,7 @@ func getNICInfo() ([]NetworkInterface, error) {
 	return ret, nil
 }
 
-func GetSystemInfo(mgr *manager.Snapshot) (SystemInfo, error) {
+func GetSystemInfo(ctx context.Context, mgr *manager.Snapshot) (SystemInfo, error) {
 	cpuInfo, err := getCPUInfo()
 	if err != nil {
 		return SystemInfo{}, errors.Wrap(err, "fetching CPU info")
@@ -256,12 +259,12 @@ func GetSystemInfo(mgr *manager.Snapshot) (SystemInfo, error) {
 		return SystemInfo{}, errors.Wrap(err, "fetching memory info")
 	}
 
-	nics, err := getNICInfo()
+	nics, err := getNICInfo(ctx)
 	if err != nil {
 		return SystemInfo{}, errors.Wrap(err, "fetching nic info")
 	}
 
-	osInfo, err := getOSInfo()
+	osInfo, err := getOSInfo(ctx)
 	if err != nil {
 		return SystemInfo{}, errors.Wrap(err, "fetching os info")
 	}
@@ -0,0 +1,312 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package throttle limits the number of snapshot reads that run at the same
+// time, and the bandwidth they use. Limits apply globally and per disk, and
+// can be changed at any time. New limits also apply to reads that are
+// already running.
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxChunkSize is the largest read we let through at once. Smaller reads
+// make the bandwidth smoother.
+const maxChunkSize = 256 * 1024
+
+// ErrLimitReached is returned by Acquire when no stream slot was freed in time.
+var ErrLimitReached = errors.New("stream limit reached")
+
+// Limits are the limits enforced by a Throttle. A limit of 0 means unlimited.
+type Limits struct {
+	// MaxStreams is the number of streams that can run at the same time.
+	MaxStreams int
+	// MaxStreamsPerDisk is the number of streams of the same disk that can
+	// run at the same time.
+	MaxStreamsPerDisk int
+	// Bandwidth is the number of bytes per second shared by all streams.
+	Bandwidth int64
+	// BandwidthPerDisk is the number of bytes per second shared by the
+	// streams of the same disk.
+	BandwidthPerDisk int64
+}
+
+// bucket is a token bucket, that holds at most one second worth of tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   int64
+}
+
+// reserve takes n tokens from the bucket, and returns how long the caller
+// must wait before using them. Tokens may be taken before they are
+// available, in which case later callers wait longer.
+func (b *bucket) reserve(now time.Time, n int, rate int64) time.Duration {
+	if rate <= 0 {
+		b.rate = 0
+		return 0
+	}
+	if b.rate == 0 {
+		b.tokens = float64(rate)
+		b.last = now
+	}
+	b.rate = rate
+
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+type disk struct {
+	streams int
+	bucket  bucket
+}
+
+// New returns a new Throttle that enforces limits.
+func New(limits Limits) *Throttle {
+	return &Throttle{
+		limits:  limits,
+		disks:   map[string]*disk{},
+		changed: make(chan struct{}),
+	}
+}
+
+// Throttle limits concurrent streams, and their bandwidth.
+type Throttle struct {
+	mux    sync.Mutex
+	limits Limits
+	active int
+	queued int
+	disks  map[string]*disk
+	global bucket
+	// changed is closed, and replaced, every time a stream is released or
+	// the limits change. It wakes up queued streams.
+	changed chan struct{}
+}
+
+// notify wakes up queued streams. The caller must hold t.mux.
+func (t *Throttle) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// SetLimits replaces the limits of the throttle. Running streams are not
+// stopped if the new stream limits are lower, but their bandwidth is.
+func (t *Throttle) SetLimits(limits Limits) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	t.limits = limits
+	t.notify()
+}
+
+// Limits returns the limits currently enforced.
+func (t *Throttle) Limits() Limits {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.limits
+}
+
+// Stats returns the number of running streams, and the number of streams
+// waiting for a free slot.
+func (t *Throttle) Stats() (active int, queued int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.active, t.queued
+}
+
+// hasSlot returns true if a new stream of diskID can start. The caller must
+// hold t.mux.
+func (t *Throttle) hasSlot(diskID string) bool {
+	if t.limits.MaxStreams > 0 && t.active >= t.limits.MaxStreams {
+		return false
+	}
+	if d, ok := t.disks[diskID]; ok && t.limits.MaxStreamsPerDisk > 0 && d.streams >= t.limits.MaxStreamsPerDisk {
+		return false
+	}
+	return true
+}
+
+// Acquire starts a new stream of diskID. If the stream limits are reached, it
+// waits up to timeout for another stream to be released, and returns
+// ErrLimitReached if none was. The stream must be released when done.
+func (t *Throttle) Acquire(ctx context.Context, diskID string, timeout time.Duration) (*Stream, error) {
+	deadline := time.Now().Add(timeout)
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for !t.hasSlot(diskID) {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrLimitReached
+		}
+
+		changed := t.changed
+		t.queued++
+		t.mux.Unlock()
+		timer := time.NewTimer(remaining)
+		var err error
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		timer.Stop()
+		t.mux.Lock()
+		t.queued--
+		if err != nil {
+			return nil, errors.Wrap(err, "waiting for a stream slot")
+		}
+	}
+
+	d, ok := t.disks[diskID]
+	if !ok {
+		d = &disk{}
+		t.disks[diskID] = d
+	}
+	d.streams++
+	t.active++
+	return &Stream{
+		throttle: t,
+		diskID:   diskID,
+	}, nil
+}
+
+// Stream is a running stream. It is safe to call the methods of a nil
+// stream, which is not limited in any way.
+type Stream struct {
+	throttle *Throttle
+	diskID   string
+	once     sync.Once
+}
+
+// Release frees the slot used by the stream.
+func (s *Stream) Release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		t := s.throttle
+		t.mux.Lock()
+		defer t.mux.Unlock()
+
+		t.active--
+		if d, ok := t.disks[s.diskID]; ok {
+			d.streams--
+			if d.streams <= 0 {
+				delete(t.disks, s.diskID)
+			}
+		}
+		t.notify()
+	})
+}
+
+// wait blocks until the stream is allowed to read n bytes.
+func (s *Stream) wait(ctx context.Context, n int) error {
+	t := s.throttle
+	t.mux.Lock()
+	now := time.Now()
+	delay := t.global.reserve(now, n, t.limits.Bandwidth)
+	if d, ok := t.disks[s.diskID]; ok {
+		if diskDelay := d.bucket.reserve(now, n, t.limits.BandwidthPerDisk); diskDelay > delay {
+			delay = diskDelay
+		}
+	}
+	t.mux.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "waiting for bandwidth")
+	}
+}
+
+// File is the part of *os.File used to serve snapshot data.
+type File interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// Reader returns a File that reads from src, within the bandwidth limits of
+// the stream. Reads fail once ctx is cancelled. A nil stream returns src.
+func (s *Stream) Reader(ctx context.Context, src File) File {
+	if s == nil {
+		return src
+	}
+	return &reader{
+		ctx:    ctx,
+		stream: s,
+		src:    src,
+	}
+}
+
+type reader struct {
+	ctx    context.Context
+	stream *Stream
+	src    File
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxChunkSize {
+		p = p[:maxChunkSize]
+	}
+	if err := r.stream.wait(r.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return r.src.Read(p)
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	var read int
+	for read < len(p) {
+		chunk := p[read:]
+		if len(chunk) > maxChunkSize {
+			chunk = chunk[:maxChunkSize]
+		}
+		if err := r.stream.wait(r.ctx, len(chunk)); err != nil {
+			return read, err
+		}
+		n, err := r.src.ReadAt(chunk, off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	return r.src.Seek(offset, whence)
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestStreamLimits(t *testing.T) {
+	th := New(Limits{MaxStreams: 2, MaxStreamsPerDisk: 1})
+	ctx := context.Background()
+
+	first, err := th.Acquire(ctx, "disk1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := th.Acquire(ctx, "disk1", 0); !errors.Is(err, ErrLimitReached) {
+		t.Fatalf("expected per disk limit to be reached, got %v", err)
+	}
+	second, err := th.Acquire(ctx, "disk2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := th.Acquire(ctx, "disk3", 0); !errors.Is(err, ErrLimitReached) {
+		t.Fatalf("expected global limit to be reached, got %v", err)
+	}
+
+	// Queued streams start when a slot is released.
+	done := make(chan error, 1)
+	go func() {
+		stream, err := th.Acquire(ctx, "disk1", 10*time.Second)
+		if err == nil {
+			stream.Release()
+		}
+		done <- err
+	}()
+	for {
+		if _, queued := th.Stats(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	first.Release()
+	first.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("queued stream failed: %v", err)
+	}
+
+	// Raising the limits also wakes up queued streams.
+	th.SetLimits(Limits{MaxStreams: 1})
+	go func() {
+		stream, err := th.Acquire(ctx, "disk1", 10*time.Second)
+		if err == nil {
+			stream.Release()
+		}
+		done <- err
+	}()
+	for {
+		if _, queued := th.Stats(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	th.SetLimits(Limits{})
+	if err := <-done; err != nil {
+		t.Fatalf("queued stream failed: %v", err)
+	}
+
+	second.Release()
+	if active, queued := th.Stats(); active != 0 || queued != 0 {
+		t.Fatalf("expected no streams, got %d active and %d queued", active, queued)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	const rate = 1024 * 1024
+	th := New(Limits{BandwidthPerDisk: rate})
+	stream, err := th.Acquire(context.Background(), "disk1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Release()
+
+	// The first second worth of data is sent right away, the rest at the
+	// configured rate.
+	data := make([]byte, rate+rate/2)
+	src := stream.Reader(context.Background(), bytes.NewReader(data))
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, src)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d bytes: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("unexpected transfer time %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := stream.Reader(ctx, bytes.NewReader(data)).ReadAt(make([]byte, rate), 0); err == nil {
+		t.Fatalf("expected read with a cancelled context to fail")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+// appendRange adds a range to a list of ranges, merging it with the last
+// range in the list, if they are contiguous.
+func appendRange(ranges []params.DiskRange, offset, length uint64) []params.DiskRange {
+	if len(ranges) > 0 {
+		last := &ranges[len(ranges)-1]
+		if last.StartOffset+last.Length == offset {
+			last.Length += length
+			return ranges
+		}
+	}
+	return append(ranges, params.DiskRange{
+		StartOffset: offset,
+		Length:      length,
+	})
+}
+
+// SplitZeroRanges reads the supplied ranges from src, one block at a time, and
+// separates blocks that hold only zeroes from blocks that hold data. Ranges that
+// extend beyond size are truncated. Contiguous blocks of the same kind are merged.
+func SplitZeroRanges(src io.ReaderAt, size uint64, ranges []params.DiskRange, blockSize int) (data []params.DiskRange, zero []params.DiskRange, err error) {
+	data = []params.DiskRange{}
+	zero = []params.DiskRange{}
+	for _, rng := range ranges {
+		err := WalkZeroRanges(src, size, rng, blockSize, func(offset, length uint64, isZero bool) error {
+			if isZero {
+				zero = appendRange(zero, offset, length)
+			} else {
+				data = appendRange(data, offset, length)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, zero, nil
+}
+
+// WalkZeroRanges reads a range from src, one block at a time, and calls fn for every
+// block, with isZero set if the block holds only zeroes. The range is truncated if it
+// extends beyond size. If fn returns an error, the walk stops and the error is returned.
+func WalkZeroRanges(src io.ReaderAt, size uint64, rng params.DiskRange, blockSize int, fn func(offset, length uint64, isZero bool) error) error {
+	if blockSize <= 0 {
+		return errors.Errorf("invalid block size: %d", blockSize)
+	}
+
+	end := rng.StartOffset + rng.Length
+	if end > size {
+		end = size
+	}
+
+	buf := make([]byte, blockSize)
+	zeroes := make([]byte, blockSize)
+	for pos := rng.StartOffset; pos < end; pos += uint64(blockSize) {
+		toRead := uint64(blockSize)
+		if pos+toRead > end {
+			toRead = end - pos
+		}
+
+		if _, err := src.ReadAt(buf[:toRead], int64(pos)); err != nil {
+			return errors.Wrapf(err, "reading block at offset %d", pos)
+		}
+
+		if err := fn(pos, toRead, bytes.Equal(buf[:toRead], zeroes[:toRead])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+const testBlockSize = 512
+
+// testImage returns an image of the given number of blocks, with data in the
+// listed byte ranges, and zeroes everywhere else.
+func testImage(blocks int, data ...params.DiskRange) []byte {
+	image := make([]byte, blocks*testBlockSize)
+	for _, rng := range data {
+		for idx := rng.StartOffset; idx < rng.StartOffset+rng.Length; idx++ {
+			image[idx] = 0xAA
+		}
+	}
+	return image
+}
+
+func blocks(first, count uint64) params.DiskRange {
+	return params.DiskRange{StartOffset: first * testBlockSize, Length: count * testBlockSize}
+}
+
+func checkDiskRanges(t *testing.T, kind string, expected, got []params.DiskRange) {
+	t.Helper()
+	if len(expected) != len(got) {
+		t.Fatalf("expected %d %s ranges, got %d: %+v", len(expected), kind, len(got), got)
+	}
+	for idx := range expected {
+		if expected[idx] != got[idx] {
+			t.Fatalf("%s range %d: expected %+v, got %+v", kind, idx, expected[idx], got[idx])
+		}
+	}
+}
+
+func TestSplitZeroRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		image  []byte
+		ranges []params.DiskRange
+		data   []params.DiskRange
+		zero   []params.DiskRange
+	}{
+		{
+			name:   "all zeroes",
+			image:  testImage(8),
+			ranges: []params.DiskRange{blocks(0, 8)},
+			data:   []params.DiskRange{},
+			zero:   []params.DiskRange{blocks(0, 8)},
+		},
+		{
+			name:   "no zeroes",
+			image:  testImage(8, blocks(0, 8)),
+			ranges: []params.DiskRange{blocks(0, 8)},
+			data:   []params.DiskRange{blocks(0, 8)},
+			zero:   []params.DiskRange{},
+		},
+		{
+			// Zeroes run from the middle of block 1 to the middle of
+			// block 4. Only blocks 2 and 3 are entirely zero.
+			name: "zero run crosses blocks",
+			image: testImage(6,
+				params.DiskRange{StartOffset: 0, Length: testBlockSize + 100},
+				params.DiskRange{StartOffset: 4*testBlockSize + 100, Length: 2*testBlockSize - 100}),
+			ranges: []params.DiskRange{blocks(0, 6)},
+			data:   []params.DiskRange{blocks(0, 2), blocks(4, 2)},
+			zero:   []params.DiskRange{blocks(2, 2)},
+		},
+		{
+			// A zero run shorter than a block is not reported.
+			name: "zero run shorter than a block",
+			image: testImage(3,
+				params.DiskRange{StartOffset: 0, Length: testBlockSize + 10},
+				params.DiskRange{StartOffset: testBlockSize + 400, Length: 2*testBlockSize - 400}),
+			ranges: []params.DiskRange{blocks(0, 3)},
+			data:   []params.DiskRange{blocks(0, 3)},
+			zero:   []params.DiskRange{},
+		},
+		{
+			// Contiguous ranges are merged across input ranges.
+			name:   "contiguous input ranges",
+			image:  testImage(8, blocks(0, 1), blocks(7, 1)),
+			ranges: []params.DiskRange{blocks(0, 2), blocks(2, 2), blocks(6, 2)},
+			data:   []params.DiskRange{blocks(0, 1), blocks(7, 1)},
+			zero:   []params.DiskRange{blocks(1, 3), blocks(6, 1)},
+		},
+		{
+			// Ranges that do not start on a block boundary are read in
+			// blocks from their start. The last block of the range is short.
+			name:   "unaligned range",
+			image:  testImage(4, blocks(3, 1)),
+			ranges: []params.DiskRange{{StartOffset: 100, Length: 3 * testBlockSize}},
+			data:   []params.DiskRange{{StartOffset: 100 + 2*testBlockSize, Length: testBlockSize}},
+			zero:   []params.DiskRange{{StartOffset: 100, Length: 2 * testBlockSize}},
+		},
+		{
+			// Ranges are truncated at the end of the image.
+			name:   "past the end",
+			image:  testImage(4, blocks(3, 1)),
+			ranges: []params.DiskRange{blocks(2, 10)},
+			data:   []params.DiskRange{blocks(3, 1)},
+			zero:   []params.DiskRange{blocks(2, 1)},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data, zero, err := SplitZeroRanges(bytes.NewReader(tc.image), uint64(len(tc.image)), tc.ranges, testBlockSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDiskRanges(t, "data", tc.data, data)
+			checkDiskRanges(t, "zero", tc.zero, zero)
+		})
+	}
+}
+
+func TestSplitZeroRangesErrors(t *testing.T) {
+	image := testImage(4)
+	if _, _, err := SplitZeroRanges(bytes.NewReader(image), uint64(len(image)), []params.DiskRange{blocks(0, 4)}, 0); err == nil {
+		t.Fatal("expected an error for a block size of 0")
+	}
+	// The size is larger than what can be read.
+	if _, _, err := SplitZeroRanges(bytes.NewReader(image), uint64(len(image))*2, []params.DiskRange{blocks(0, 8)}, testBlockSize); err == nil {
+		t.Fatal("expected an error for a read past the end of the image")
+	}
+}
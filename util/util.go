@@ -30,22 +30,32 @@ import (
 func GetLoggingWriter(cfg *config.Config) (io.Writer, error) {
 	var writer io.Writer = os.Stdout
 	if cfg.LogFile != "" {
-		dirname := path.Dir(cfg.LogFile)
-		if _, err := os.Stat(dirname); err != nil {
-			if !os.IsNotExist(err) {
-				return nil, fmt.Errorf("failed to create log folder")
-			}
-			if err := os.MkdirAll(dirname, 0o711); err != nil {
-				return nil, fmt.Errorf("failed to create log folder")
-			}
-		}
-		writer = &lumberjack.Logger{
-			Filename:   cfg.LogFile,
-			MaxSize:    500, // megabytes
-			MaxBackups: 3,
-			MaxAge:     28,   //days
-			Compress:   true, // disabled by default
+		rotating, err := NewRotatingFileWriter(cfg.LogFile)
+		if err != nil {
+			return nil, err
 		}
+		writer = rotating
 	}
 	return writer, nil
 }
+
+// NewRotatingFileWriter returns a writer that appends to the file at path, and
+// rotates it once it grows too large. The parent folder is created if needed.
+func NewRotatingFileWriter(filePath string) (*lumberjack.Logger, error) {
+	dirname := path.Dir(filePath)
+	if _, err := os.Stat(dirname); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to create log folder")
+		}
+		if err := os.MkdirAll(dirname, 0o711); err != nil {
+			return nil, fmt.Errorf("failed to create log folder")
+		}
+	}
+	return &lumberjack.Logger{
+		Filename:   filePath,
+		MaxSize:    500, // megabytes
+		MaxBackups: 3,
+		MaxAge:     28,   //days
+		Compress:   true, // disabled by default
+	}, nil
+}
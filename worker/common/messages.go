@@ -27,12 +27,11 @@ type SnapStoreDeletedMessage struct {
 	SnapStoreID uuid.UUID
 }
 
-type SnapStoreAddFileMessage struct {
+// SnapStoreHalfFillMessage is sent when the kernel reports that a snap store is
+// half full, and needs a new file.
+type SnapStoreHalfFillMessage struct {
 	SnapStoreID uuid.UUID
 
-	FilePath string
-	FileSize uint64
-
 	FillStatus uint64
 }
 
@@ -23,4 +23,7 @@ type CreateSnapStoreParams struct {
 	SnapDeviceID      types.DevID
 	DeviceID          types.DevID
 	SnapStoreFileSize uint64
+	// AllocationEnabled indicates whether or not the watcher is allowed
+	// to allocate new disk space for the snap store.
+	AllocationEnabled bool
 }
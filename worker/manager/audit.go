@@ -0,0 +1,60 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/audit"
+	"coriolis-snapshot-agent/internal/logging"
+)
+
+// AuditLog returns the audit log, or nil if no audit log is configured.
+func (m *Snapshot) AuditLog() *audit.Log {
+	return m.audit
+}
+
+// QueryAuditLog returns the most recent audit log entries that match query.
+func (m *Snapshot) QueryAuditLog(query params.AuditQuery) ([]params.AuditEntry, error) {
+	return m.audit.Query(query)
+}
+
+// auditOperation records the outcome of a background operation. The entry of
+// the API call that started the operation holds its ID.
+func (m *Snapshot) auditOperation(ctx context.Context, op params.OperationResponse) {
+	entry := params.AuditEntry{
+		RequestID: op.RequestID,
+		Operation: string(op.Type),
+		ResourceIDs: map[string]string{
+			"operationID": op.ID,
+		},
+		Result:   params.AuditResultSuccess,
+		Error:    op.Error,
+		Duration: op.UpdatedAt.Sub(op.CreatedAt).Seconds(),
+		Time:     time.Now().UTC(),
+	}
+	if op.ResourceID != "" {
+		entry.ResourceIDs["resourceID"] = op.ResourceID
+	}
+	if op.Status != params.OperationStatusSucceeded {
+		entry.Result = params.AuditResultFailure
+	}
+	if err := m.audit.Record(entry); err != nil {
+		logging.FromContext(ctx).Errorf("failed to record operation %s in audit log: %+v", op.ID, err)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/util"
+)
+
+const testCBTBlockSize = 16
+
+// testBitmap holds the snapshot number that last changed each block. Blocks 1-2,
+// 4 and 6-7 changed in snapshot 2, block 5 in snapshot 1.
+var testBitmap = []byte{0, 2, 2, 0, 2, 1, 2, 2}
+
+// walkChanges collects the ranges of an incremental listing of testBitmap, between
+// start and end, capped at limit ranges. If image is set, zero ranges are detected.
+func walkChanges(t *testing.T, start, end uint64, limit int, image []byte) ([]params.ChangedRange, uint64, error) {
+	t.Helper()
+
+	var ranges []params.ChangedRange
+	w := &rangeWriter{
+		fn: func(rng params.ChangedRange) error {
+			ranges = append(ranges, rng)
+			return nil
+		},
+		limit: limit,
+	}
+	emit := func(offset, length uint64) error {
+		return w.add(offset, length, false)
+	}
+	if image != nil {
+		emit = func(offset, length uint64) error {
+			rng := params.DiskRange{StartOffset: offset, Length: length}
+			return util.WalkZeroRanges(bytes.NewReader(image), uint64(len(image)), rng, testCBTBlockSize, w.add)
+		}
+	}
+
+	m := &Snapshot{}
+	err := m.walkIncrements(testBitmap, 1, 2, testCBTBlockSize, start, end, emit)
+	if err == nil {
+		err = w.flush()
+	}
+	return ranges, w.next, err
+}
+
+func dataRange(offset, length uint64) params.ChangedRange {
+	return params.ChangedRange{StartOffset: offset, Length: length}
+}
+
+func zeroRange(offset, length uint64) params.ChangedRange {
+	return params.ChangedRange{StartOffset: offset, Length: length, Zero: true}
+}
+
+func TestWalkIncrements(t *testing.T) {
+	ranges, _, err := walkChanges(t, 0, 128, 0, nil)
+	if err != nil {
+		t.Fatalf("walking changes: %v", err)
+	}
+	want := []params.ChangedRange{dataRange(16, 32), dataRange(64, 16), dataRange(96, 32)}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+}
+
+func TestWalkIncrementsFull(t *testing.T) {
+	var ranges [][2]uint64
+	m := &Snapshot{}
+	err := m.walkIncrements(testBitmap, 0, 2, testCBTBlockSize, 0, 128, func(offset, length uint64) error {
+		ranges = append(ranges, [2]uint64{offset, length})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking changes: %v", err)
+	}
+	want := [][2]uint64{{0, 128}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+}
+
+func TestWalkIncrementsWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end uint64
+		want       []params.ChangedRange
+	}{
+		{"clipped start", 20, 128, []params.ChangedRange{dataRange(20, 28), dataRange(64, 16), dataRange(96, 32)}},
+		{"clipped end", 0, 70, []params.ChangedRange{dataRange(16, 32), dataRange(64, 6)}},
+		{"inside a range", 100, 110, []params.ChangedRange{dataRange(100, 10)}},
+		{"no changes", 48, 64, nil},
+		{"past the end", 128, 256, nil},
+		{"empty", 64, 64, nil},
+	}
+	for _, tc := range tests {
+		ranges, _, err := walkChanges(t, tc.start, tc.end, 0, nil)
+		if err != nil {
+			t.Fatalf("%s: walking changes: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(ranges, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, ranges)
+		}
+	}
+}
+
+func TestWalkWindow(t *testing.T) {
+	allocated := []params.DiskRange{
+		{StartOffset: 0, Length: 10},
+		{StartOffset: 20, Length: 10},
+		{StartOffset: 40, Length: 10},
+	}
+	var ranges [][2]uint64
+	err := walkWindow(allocated, 5, 45, func(offset, length uint64) error {
+		ranges = append(ranges, [2]uint64{offset, length})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking window: %v", err)
+	}
+	want := [][2]uint64{{5, 5}, {20, 10}, {40, 5}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+}
+
+func TestWalkZeroes(t *testing.T) {
+	// Blocks 2 and 6 hold data, all other blocks are zero.
+	image := make([]byte, 128)
+	image[40] = 1
+	image[100] = 1
+
+	ranges, _, err := walkChanges(t, 0, 128, 0, image)
+	if err != nil {
+		t.Fatalf("walking changes: %v", err)
+	}
+	want := []params.ChangedRange{
+		zeroRange(16, 16),
+		dataRange(32, 16),
+		zeroRange(64, 16),
+		dataRange(96, 16),
+		zeroRange(112, 16),
+	}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+}
+
+func TestMaxRanges(t *testing.T) {
+	image := make([]byte, 128)
+	image[40] = 1
+	image[100] = 1
+
+	ranges, next, err := walkChanges(t, 0, 128, 2, image)
+	if !errors.Is(err, errRangeLimit) {
+		t.Fatalf("expected range limit, got %v", err)
+	}
+	want := []params.ChangedRange{zeroRange(16, 16), dataRange(32, 16)}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+	if next != 48 {
+		t.Fatalf("expected next offset 48, got %d", next)
+	}
+
+	// Resuming from the next offset returns the rest of the ranges.
+	ranges, _, err = walkChanges(t, next, 128, 2, image)
+	if !errors.Is(err, errRangeLimit) {
+		t.Fatalf("expected range limit, got %v", err)
+	}
+	want = []params.ChangedRange{zeroRange(64, 16), dataRange(96, 16)}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+
+	// A page that holds exactly the remaining ranges is the last one.
+	ranges, _, err = walkChanges(t, 112, 128, 1, image)
+	if err != nil {
+		t.Fatalf("walking changes: %v", err)
+	}
+	want = []params.ChangedRange{zeroRange(112, 16)}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+}
+
+func TestChangesPageToken(t *testing.T) {
+	token := changesPageToken("snap", "disk", 4096)
+	offset, err := parseChangesPageToken(token, "snap", "disk")
+	if err != nil {
+		t.Fatalf("parsing page token: %v", err)
+	}
+	if offset != 4096 {
+		t.Fatalf("expected offset 4096, got %d", offset)
+	}
+}
+
+func TestChangesPageTokenInvalid(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	tests := map[string]string{
+		"not base64":     "!!!",
+		"other snapshot": changesPageToken("other", "disk", 4096),
+		"other disk":     changesPageToken("snap", "other", 4096),
+		"bad offset":     encode("snap/disk/abc"),
+		"no offset":      encode("snap/disk/"),
+		"tampered":       encode("snap/disk/-1"),
+	}
+	for name, token := range tests {
+		_, err := parseChangesPageToken(token, "snap", "disk")
+		if _, ok := errors.Cause(err).(*vErrors.BadRequestError); !ok {
+			t.Errorf("%s: expected bad request error, got %v", name, err)
+		}
+	}
+}
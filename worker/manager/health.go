@@ -0,0 +1,158 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/internal/ioctl"
+	"coriolis-snapshot-agent/internal/util"
+)
+
+// healthCheck is a single health check. The check passes if fn returns nil.
+type healthCheck struct {
+	name string
+	fn   func() error
+}
+
+func runHealthChecks(checks []healthCheck) params.HealthResponse {
+	resp := params.HealthResponse{
+		Status: params.HealthStatusOK,
+		Checks: make([]params.HealthCheck, len(checks)),
+	}
+	for idx, check := range checks {
+		result := params.HealthCheck{
+			Name:   check.name,
+			Status: params.HealthStatusOK,
+		}
+		if err := check.fn(); err != nil {
+			result.Status = params.HealthStatusFailed
+			result.Reason = err.Error()
+			resp.Status = params.HealthStatusFailed
+		}
+		resp.Checks[idx] = result
+	}
+	return resp
+}
+
+// livenessChecks returns the checks that fail when the agent itself is broken,
+// and needs to be restarted.
+func (m *Snapshot) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "database", fn: m.checkDatabase},
+		{name: "udev_monitor", fn: m.checkUdevMonitor},
+		{name: "snap_store_watchers", fn: m.checkSnapStoreWatchers},
+	}
+}
+
+// Health reports whether the agent is alive. It checks the database, the udev
+// monitor and the snap store watchers.
+func (m *Snapshot) Health() params.HealthResponse {
+	return runHealthChecks(m.livenessChecks())
+}
+
+// Ready reports whether the agent can serve requests. Along with the liveness
+// checks, it verifies that the veeamsnap kernel module is usable, and that every
+// enabled snap store location has enough free disk space.
+func (m *Snapshot) Ready() params.HealthResponse {
+	checks := []healthCheck{
+		{name: "kernel_module", fn: ioctl.CheckDevice},
+		{name: "kernel_entries", fn: checkKernelEntries},
+	}
+	checks = append(checks, m.livenessChecks()...)
+	checks = append(checks, healthCheck{name: "snap_store_locations", fn: m.checkSnapStoreLocations})
+	return runHealthChecks(checks)
+}
+
+func checkKernelEntries() error {
+	entry, err := ioctl.GetUnresolvedKernelEntry()
+	if err != nil {
+		return err
+	}
+	if entry != "" {
+		return errors.Errorf("kernel entry %s is not resolved", entry)
+	}
+	return nil
+}
+
+func (m *Snapshot) checkDatabase() error {
+	return m.db.Ping()
+}
+
+func (m *Snapshot) checkUdevMonitor() error {
+	if m.udevMonitor == nil || !m.udevMonitor.Alive() {
+		return errors.New("udev monitor is not running")
+	}
+	return nil
+}
+
+// checkSnapStoreWatchers verifies that every snap store has a character device
+// watcher that is still running.
+func (m *Snapshot) checkSnapStoreWatchers() error {
+	stores, err := m.db.ListSnapStores()
+	if err != nil {
+		return errors.Wrap(err, "listing snap stores")
+	}
+
+	m.regMux.Lock()
+	defer m.regMux.Unlock()
+
+	var missing []string
+	for _, store := range stores {
+		watcher, ok := m.snapStoreCharacterDeviceWatchers[store.SnapStoreID]
+		if !ok || !watcher.Alive() {
+			missing = append(missing, store.SnapStoreID)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("snap stores without a running watcher: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkSnapStoreLocations verifies that every enabled snap store location has
+// more free disk space than the configured threshold.
+func (m *Snapshot) checkSnapStoreLocations() error {
+	locations, err := m.db.ListSnapStoreFilesLocations()
+	if err != nil {
+		return errors.Wrap(err, "listing snap store locations")
+	}
+
+	minFree := m.cfg.Health.MinFreeSpaceBytes()
+	var problems []string
+	for _, location := range locations {
+		if !location.Enabled {
+			continue
+		}
+		fsInfo, err := util.GetFileSystemInfoFromPath(location.Path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", location.Path, err))
+			continue
+		}
+		available := fsInfo.BlocksAvailable * uint64(fsInfo.BlockSize)
+		if available < minFree {
+			problems = append(problems, fmt.Sprintf("%s has %d bytes free, needs %d", location.Path, available, minFree))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
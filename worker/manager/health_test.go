@@ -0,0 +1,72 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	pass := func() error { return nil }
+	fail := func() error { return errors.New("broken") }
+
+	tests := []struct {
+		name   string
+		checks []healthCheck
+		want   params.HealthResponse
+	}{
+		{
+			name: "no checks",
+			want: params.HealthResponse{
+				Status: params.HealthStatusOK,
+				Checks: []params.HealthCheck{},
+			},
+		},
+		{
+			name:   "all pass",
+			checks: []healthCheck{{name: "a", fn: pass}, {name: "b", fn: pass}},
+			want: params.HealthResponse{
+				Status: params.HealthStatusOK,
+				Checks: []params.HealthCheck{
+					{Name: "a", Status: params.HealthStatusOK},
+					{Name: "b", Status: params.HealthStatusOK},
+				},
+			},
+		},
+		{
+			name:   "one fails",
+			checks: []healthCheck{{name: "a", fn: fail}, {name: "b", fn: pass}},
+			want: params.HealthResponse{
+				Status: params.HealthStatusFailed,
+				Checks: []params.HealthCheck{
+					{Name: "a", Status: params.HealthStatusFailed, Reason: "broken"},
+					{Name: "b", Status: params.HealthStatusOK},
+				},
+			},
+		},
+	}
+	for _, tc := range tests {
+		got := runHealthChecks(tc.checks)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.want, got)
+		}
+	}
+}
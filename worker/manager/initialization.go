@@ -18,12 +18,12 @@ package manager
 import (
 	"coriolis-snapshot-agent/apiserver/params"
 	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/internal/types"
 	"coriolis-snapshot-agent/worker/common"
 	"coriolis-snapshot-agent/worker/snapstore"
 	"io/fs"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 
@@ -64,7 +64,6 @@ func deviceIsTracked(major, minor uint32, cbtInfo []types.CBTInfo) bool {
 	for _, cbt := range cbtInfo {
 		if cbt.DevID.Major == major && cbt.DevID.Minor == minor {
 			if cbt.CBTMapSize > 0 {
-				log.Printf("device %d:%d is already tracked", major, minor)
 				return true
 			}
 		}
@@ -104,13 +103,14 @@ func (m *Snapshot) initTrackedDisks() (err error) {
 		return errors.Wrap(err, "fetching disks list")
 	}
 
+	logger := logging.FromContext(m.ctx)
 	for _, val := range disks {
-		log.Printf("checking disk %s\n", val.Path)
+		logger.Infof("checking disk %s", val.Path)
 		newDevParams := params.AddTrackedDiskRequest{
 			DevicePath: val.Path,
 		}
 
-		_, err = m.AddTrackedDisk(newDevParams)
+		_, err = m.AddTrackedDisk(m.ctx, newDevParams)
 		if err != nil {
 			return errors.Wrapf(err, "adding disk %s to tracking", val.Path)
 		}
@@ -150,9 +150,14 @@ func (m *Snapshot) PopulateSnapStoreWatcher() error {
 			Minor: store.TrackedDisk.Minor,
 		}
 
+		location, err := m.db.GetSnapStoreFilesLocation(store.StorageLocation.Path)
+		if err != nil {
+			return errors.Wrap(err, "fetching snap store location")
+		}
+
 		snapDisk := types.DevID{
-			Major: store.StorageLocation.Major,
-			Minor: store.StorageLocation.Minor,
+			Major: location.Major,
+			Minor: location.Minor,
 		}
 		snapCharacterDeviceWatcherParams := common.CreateSnapStoreParams{
 			ID:                [16]byte(storeID),
@@ -160,8 +165,9 @@ func (m *Snapshot) PopulateSnapStoreWatcher() error {
 			SnapDeviceID:      snapDisk,
 			DeviceID:          deviceID,
 			SnapStoreFileSize: m.cfg.SnapStoreFileSize,
+			AllocationEnabled: location.Enabled,
 		}
-		snapCharacterDeviceWatcher, err := snapstore.NewSnapStoreCharacterDeviceWatcher(snapCharacterDeviceWatcherParams, m.msgChan)
+		snapCharacterDeviceWatcher, err := snapstore.NewSnapStoreCharacterDeviceWatcher(snapCharacterDeviceWatcherParams, m.msgChan, logging.FromContext(m.ctx))
 		if err != nil {
 			return errors.Wrap(err, "creating snap store")
 		}
@@ -17,13 +17,17 @@ package manager
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -33,8 +37,13 @@ import (
 	"coriolis-snapshot-agent/config"
 	"coriolis-snapshot-agent/db"
 	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/audit"
+	"coriolis-snapshot-agent/internal/fsmap"
 	"coriolis-snapshot-agent/internal/ioctl"
+	"coriolis-snapshot-agent/internal/logging"
+	"coriolis-snapshot-agent/internal/metrics"
 	"coriolis-snapshot-agent/internal/storage"
+	"coriolis-snapshot-agent/internal/throttle"
 	"coriolis-snapshot-agent/internal/types"
 	"coriolis-snapshot-agent/internal/util"
 	"coriolis-snapshot-agent/worker/snapstore"
@@ -46,6 +55,31 @@ var (
 	SnapStoreEvent NotificationType = "snapStoreCreate"
 )
 
+const (
+	SnapshotCreatedEvent    NotificationType = "snapshot_created"
+	SnapshotDeletedEvent    NotificationType = "snapshot_deleted"
+	SnapStoreFileAddedEvent NotificationType = "snap_store_file_added"
+	SnapStoreOverflowEvent  NotificationType = "snap_store_overflow"
+	WatcherErrorEvent       NotificationType = "watcher_error"
+	DiskAddedEvent          NotificationType = "disk_added"
+	DiskRemovedEvent        NotificationType = "disk_removed"
+	// ResetEvent is sent to event stream clients that resume a stream of a
+	// previous agent process. It cannot be subscribed to, and is not sent to
+	// webhooks.
+	ResetEvent NotificationType = "reset"
+)
+
+// EventTypes lists the notifications that are sent as params.Event payloads.
+var EventTypes = []NotificationType{
+	SnapshotCreatedEvent,
+	SnapshotDeletedEvent,
+	SnapStoreFileAddedEvent,
+	SnapStoreOverflowEvent,
+	WatcherErrorEvent,
+	DiskAddedEvent,
+	DiskRemovedEvent,
+}
+
 func NewManager(ctx context.Context, cfg *config.Config, udevMonitor *storage.UdevMonitor) (manager *Snapshot, err error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -60,20 +94,64 @@ func NewManager(ctx context.Context, cfg *config.Config, udevMonitor *storage.Ud
 		dbNeedsInit = true
 	}
 
+	tokenKey, err := loadTokenSigningKey(cfg.APIServer.TokenAuth)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading token signing key")
+	}
+
+	var auditLog *audit.Log
+	if cfg.AuditLogFile != "" {
+		auditLog, err = audit.NewLog(cfg.AuditLogFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening audit log")
+		}
+	}
+
 	database, err := db.NewDatabase(cfg.DBFile)
 	if err != nil {
 		return nil, errors.Wrapf(err, "opening database %s", cfg.DBFile)
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	var webhookQueue *db.Database
+	defer func() {
+		if err != nil {
+			cancel()
+			database.Close()
+			if webhookQueue != nil {
+				webhookQueue.Close()
+			}
+			auditLog.Close()
+		}
+	}()
+
+	if len(cfg.Webhooks) > 0 {
+		webhookQueue, err = db.NewDatabase(cfg.WebhookQueueFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening webhook queue %s", cfg.WebhookQueueFile)
+		}
+	}
+
 	snapshotMaganer := &Snapshot{
 		cfg:                              cfg,
 		ctx:                              ctx,
+		cancel:                           cancel,
+		workers:                          map[string]chan struct{}{},
+		shuttingDown:                     make(chan struct{}),
 		db:                               database,
 		notifyChannels:                   map[NotificationType][]chan interface{}{},
+		eventEpoch:                       uuid.New().String(),
 		snapStoreCharacterDeviceWatchers: map[string]*snapstore.CharacterDeviceWatcher{},
 		msgChan:                          make(chan interface{}, 50),
 		udevMonitor:                      udevMonitor,
-	}
+		operations:                       map[string]*operation{},
+		reads:                            map[string]*snapshotReads{},
+		webhookQueue:                     webhookQueue,
+		tokenKey:                         tokenKey,
+		audit:                            auditLog,
+	}
+	limits, _ := cfg.Throttle.LimitsAt(time.Now())
+	snapshotMaganer.throttle = throttle.New(toThrottleLimits(limits))
 	if dbNeedsInit {
 		defer func() {
 			// The database requires init, but we failed to initialize
@@ -109,6 +187,17 @@ type Snapshot struct {
 	cfg            *config.Config
 	db             *db.Database
 	notifyChannels map[NotificationType][]chan interface{}
+	notifyMux      sync.Mutex
+	// eventSeq is the ID of the last event that was sent.
+	eventSeq uint64
+	// eventEpoch identifies this agent process. Event IDs start over in
+	// every epoch.
+	eventEpoch string
+	// webhookSenders deliver events to the configured webhooks. Their
+	// delivery queues are kept in webhookQueue, which, unlike db, is not
+	// on tmpfs, and survives reboots.
+	webhookSenders []*webhookSender
+	webhookQueue   *db.Database
 
 	// snapStores is a list of snap stores we currently track
 	snapStoreCharacterDeviceWatchers map[string]*snapstore.CharacterDeviceWatcher
@@ -117,12 +206,41 @@ type Snapshot struct {
 	// event, will be sent back through this channel.
 	msgChan chan interface{}
 
-	watcherMessagesQuit chan struct{}
-	ctx                 context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// workers holds the goroutines started by goWorker that are still
+	// running, by name. Wait uses it to report workers that do not stop.
+	workers   map[string]chan struct{}
+	workerMux sync.Mutex
+	// shuttingDown is closed by BeginShutdown.
+	shuttingDown chan struct{}
+	shutdownOnce sync.Once
 
 	mux         sync.Mutex
 	regMux      sync.Mutex
 	udevMonitor *storage.UdevMonitor
+
+	// reads holds the snapshot reads in progress, by snapshot ID.
+	reads   map[string]*snapshotReads
+	readMux sync.Mutex
+
+	// operations holds long running operations, by ID.
+	operations map[string]*operation
+	opMux      sync.Mutex
+
+	// tokenKey is used to sign API tokens.
+	tokenKey []byte
+
+	// throttle limits snapshot reads. The override, if set, replaces
+	// the limits from the config.
+	throttle         *throttle.Throttle
+	throttleOverride *throttleOverride
+	throttleMux      sync.Mutex
+
+	// audit records API calls and background operations. It is nil if
+	// no audit log is configured.
+	audit *audit.Log
 }
 
 func (m *Snapshot) RecordWatcher(snapstoreID string, watcher *snapstore.CharacterDeviceWatcher) {
@@ -151,9 +269,9 @@ func (m *Snapshot) GetCharacterDeviceWatcher(snapstoreID string) (*snapstore.Cha
 }
 
 func (m *Snapshot) RegisterNotificationChannel(notifyType NotificationType, ch chan interface{}) {
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	log.Printf("registering new notification channel for %s", notifyType)
+	m.notifyMux.Lock()
+	defer m.notifyMux.Unlock()
+	logging.FromContext(m.ctx).Debugf("registering new notification channel for %s", notifyType)
 	_, ok := m.notifyChannels[notifyType]
 	if !ok {
 		m.notifyChannels[notifyType] = []chan interface{}{
@@ -164,7 +282,34 @@ func (m *Snapshot) RegisterNotificationChannel(notifyType NotificationType, ch c
 	}
 }
 
+// UnregisterNotificationChannel removes a channel from all notification types it
+// was registered for.
+func (m *Snapshot) UnregisterNotificationChannel(ch chan interface{}) {
+	m.notifyMux.Lock()
+	defer m.notifyMux.Unlock()
+
+	for notifyType, channels := range m.notifyChannels {
+		var remaining []chan interface{}
+		for _, val := range channels {
+			if val != ch {
+				remaining = append(remaining, val)
+			}
+		}
+		m.notifyChannels[notifyType] = remaining
+	}
+}
+
+// SendNotify sends payload to all channels registered for notifyType. Sending never
+// blocks. If a channel is full, the payload is dropped for that channel.
 func (m *Snapshot) SendNotify(notifyType NotificationType, payload interface{}) {
+	m.notifyMux.Lock()
+	defer m.notifyMux.Unlock()
+
+	m.sendNotifyLocked(notifyType, payload)
+}
+
+// sendNotifyLocked does the work of SendNotify. The caller must hold notifyMux.
+func (m *Snapshot) sendNotifyLocked(notifyType NotificationType, payload interface{}) {
 	notify, ok := m.notifyChannels[notifyType]
 	if !ok {
 		return
@@ -174,10 +319,62 @@ func (m *Snapshot) SendNotify(notifyType NotificationType, payload interface{})
 	}
 
 	for _, val := range notify {
-		val <- payload
+		select {
+		case val <- payload:
+		default:
+			logging.FromContext(m.ctx).Warnf("dropping %s notification: channel is full", notifyType)
+		}
 	}
 }
 
+// sendEvent wraps data in a params.Event and sends it to subscribers of eventType.
+func (m *Snapshot) sendEvent(eventType NotificationType, data interface{}) {
+	asJSON, err := json.Marshal(data)
+	if err != nil {
+		logging.FromContext(m.ctx).Errorf("failed to marshal %s event: %q", eventType, err)
+		return
+	}
+
+	m.notifyMux.Lock()
+	defer m.notifyMux.Unlock()
+
+	// IDs are assigned under the lock, so subscribers get events in ID order.
+	m.eventSeq++
+	evt := params.Event{
+		ID:        m.eventSeq,
+		Epoch:     m.eventEpoch,
+		Type:      string(eventType),
+		Timestamp: time.Now().UTC(),
+		Data:      asJSON,
+	}
+	m.queueWebhookEventLocked(evt)
+	m.sendNotifyLocked(eventType, evt)
+}
+
+// LastEvent returns the epoch of this agent process, and the ID of the last event
+// sent in it.
+func (m *Snapshot) LastEvent() (epoch string, seq uint64) {
+	m.notifyMux.Lock()
+	defer m.notifyMux.Unlock()
+	return m.eventEpoch, m.eventSeq
+}
+
+// FormatEventID returns the ID of an event as sent to event stream clients and
+// webhooks. IDs are made of the epoch and the sequence number of the event, so
+// IDs sent by different agent processes never collide.
+func FormatEventID(epoch string, seq uint64) string {
+	return fmt.Sprintf("%s-%d", epoch, seq)
+}
+
+// EventIDEpoch returns the epoch of an event ID returned by FormatEventID.
+func EventIDEpoch(eventID string) string {
+	idx := strings.LastIndex(eventID, "-")
+	if idx < 0 {
+		return ""
+	}
+	return eventID[:idx]
+}
+
 // Expose the internal mutex. We need to lock the manager while we download ranges.
 // TODO: find a better solution for this.
 func (m *Snapshot) Lock() {
@@ -194,7 +391,10 @@ func (m *Snapshot) listDisks(includeVirtual bool, includeSwap bool) ([]storage.B
 		return nil, errors.Wrap(err, "listing devices")
 	}
 
-	toExclude := m.cfg.CowDestinationDevices()
+	toExclude, err := m.snapStoreLocationDevices()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching snap store location devices")
+	}
 
 	var ret []storage.BlockVolume
 	for _, val := range devices {
@@ -284,7 +484,7 @@ func (m *Snapshot) findDiskByPath(path string) (storage.BlockVolume, error) {
 	return storage.BlockVolume{}, vErrors.NewNotFoundError("could not find %s", path)
 }
 
-func (m *Snapshot) AddTrackedDisk(disk params.AddTrackedDiskRequest) (params.BlockVolume, error) {
+func (m *Snapshot) AddTrackedDisk(ctx context.Context, disk params.AddTrackedDiskRequest) (params.BlockVolume, error) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
@@ -314,12 +514,15 @@ func (m *Snapshot) AddTrackedDisk(disk params.AddTrackedDiskRequest) (params.Blo
 		Minor: volume.Minor,
 	}
 
+	logger := logging.FromContext(ctx)
 	if !deviceIsTracked(volume.Major, volume.Minor, cbtInfo) {
-		log.Printf("Adding %s to tracking", volume.Path)
+		logger.Infof("Adding %s to tracking", volume.Path)
 		if err := ioctl.AddDeviceToTracking(devID); err != nil {
-			log.Printf("error adding %s to tracking: %s", volume.Path, err)
+			logger.Errorf("error adding %s to tracking: %s", volume.Path, err)
 			return params.BlockVolume{}, errors.Wrapf(err, "adding %s to tracking", volume.Path)
 		}
+	} else {
+		logger.Debugf("device %d:%d is already tracked", volume.Major, volume.Minor)
 	}
 
 	var dbObject db.TrackedDisk
@@ -345,6 +548,76 @@ func (m *Snapshot) AddTrackedDisk(disk params.AddTrackedDiskRequest) (params.Blo
 	return ret, nil
 }
 
+// RemoveTrackedDisk removes a disk from tracking. Disks that still have snapshots
+// or snap stores associated with them, cannot be removed. Any snap store mapping
+// defined for the disk is removed as well.
+func (m *Snapshot) RemoveTrackedDisk(ctx context.Context, diskID string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if diskID == "" {
+		return vErrors.NewBadRequestError("invalid disk id")
+	}
+
+	disk, err := m.db.GetTrackedDiskByTrackingID(diskID)
+	if err != nil {
+		if errors.Is(err, bolthold.ErrNotFound) {
+			return vErrors.NewNotFoundError("disk with id %s not found", diskID)
+		}
+		return errors.Wrap(err, "fetching from db")
+	}
+
+	snapshots, err := m.db.ListSnapshotsForDisk(disk.TrackingID)
+	if err != nil {
+		return errors.Wrap(err, "listing snapshots")
+	}
+	if len(snapshots) > 0 {
+		return vErrors.NewConflictError("disk %s has %d snapshot(s)", disk.TrackingID, len(snapshots))
+	}
+
+	if _, err := m.db.GetSnapStoreByDiskID(disk.TrackingID); err != nil {
+		if !errors.Is(err, vErrors.ErrNotFound) {
+			return errors.Wrap(err, "fetching snap stores")
+		}
+	} else {
+		return vErrors.NewConflictError("disk %s has a snap store", disk.TrackingID)
+	}
+
+	// The disk is removed from the kernel first. If that fails, the disk is
+	// still tracked, and the DB must keep reflecting that.
+	cbtInfo, err := ioctl.GetCBTInfo()
+	if err != nil {
+		return errors.Wrap(err, "fetching CBT info")
+	}
+
+	if deviceIsTracked(disk.Major, disk.Minor, cbtInfo) {
+		logging.FromContext(ctx).Infof("Removing %s from tracking", disk.Path)
+		devID := types.DevID{
+			Major: disk.Major,
+			Minor: disk.Minor,
+		}
+		if err := ioctl.RemoveDeviceFromTracking(devID); err != nil {
+			return errors.Wrapf(err, "removing %s from tracking", disk.Path)
+		}
+	}
+
+	mapping, err := m.db.GetSnapStoreMappingByDeviceID(disk.TrackingID)
+	if err != nil {
+		if !errors.Is(err, vErrors.ErrNotFound) {
+			return errors.Wrap(err, "fetching snap store mapping")
+		}
+	} else {
+		if err := m.db.DeleteSnapStoreMapping(mapping.TrackingID); err != nil {
+			return errors.Wrap(err, "removing snap store mapping")
+		}
+	}
+
+	if err := m.db.RemoveTrackedDisk(disk.TrackingID); err != nil {
+		return errors.Wrap(err, "removing tracked disk")
+	}
+	return nil
+}
+
 ////////////////////////
 // Snap store mapping //
 ////////////////////////
@@ -387,6 +660,14 @@ func (m *Snapshot) CreateSnapStoreMapping(param params.CreateSnapStoreMappingReq
 	}, nil
 }
 
+func snapStoreMappingToResponse(mapping db.SnapStoreMapping) params.SnapStoreMappingResponse {
+	return params.SnapStoreMappingResponse{
+		ID:                mapping.TrackingID,
+		TrackedDiskID:     mapping.TrackedDisk.TrackingID,
+		StorageLocationID: mapping.SnapStoreFilesLocation.Path,
+	}
+}
+
 func (m *Snapshot) ListSnapStoreMappings() ([]params.SnapStoreMappingResponse, error) {
 	storeMappings, err := m.db.ListSnapStoreMappings()
 	if err != nil {
@@ -394,20 +675,92 @@ func (m *Snapshot) ListSnapStoreMappings() ([]params.SnapStoreMappingResponse, e
 	}
 	ret := make([]params.SnapStoreMappingResponse, len(storeMappings))
 	for idx, val := range storeMappings {
-		ret[idx] = params.SnapStoreMappingResponse{
-			ID:                val.TrackingID,
-			TrackedDiskID:     val.TrackedDisk.TrackingID,
-			StorageLocationID: val.SnapStoreFilesLocation.Path,
-		}
+		ret[idx] = snapStoreMappingToResponse(val)
 	}
 	return ret, nil
 }
 
+func (m *Snapshot) GetSnapStoreMapping(mappingID string) (params.SnapStoreMappingResponse, error) {
+	mapping, err := m.db.GetSnapStoreMappingByID(mappingID)
+	if err != nil {
+		return params.SnapStoreMappingResponse{}, errors.Wrap(err, "fetching snap store mapping")
+	}
+	return snapStoreMappingToResponse(mapping), nil
+}
+
+// ensureSnapStoreMappingNotInUse returns a conflict error if a snap store was
+// created for the tracked disk of a mapping. The mapping cannot be changed
+// while that snap store exists.
+func (m *Snapshot) ensureSnapStoreMappingNotInUse(mapping db.SnapStoreMapping) error {
+	store, err := m.db.GetSnapStoreByDiskID(mapping.TrackedDisk.TrackingID)
+	if err != nil {
+		if !errors.Is(err, vErrors.ErrNotFound) {
+			return errors.Wrap(err, "fetching snap store")
+		}
+		return nil
+	}
+	return vErrors.NewConflictError("mapping %s is in use by snap store %s", mapping.TrackingID, store.SnapStoreID)
+}
+
+// UpdateSnapStoreMapping points the tracked disk of a mapping to a different
+// snap store location.
+func (m *Snapshot) UpdateSnapStoreMapping(mappingID string, param params.UpdateSnapStoreMappingRequest) (params.SnapStoreMappingResponse, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if param.SnapStoreLocation == "" {
+		return params.SnapStoreMappingResponse{}, vErrors.NewBadRequestError("missing snap store location")
+	}
+
+	mapping, err := m.db.GetSnapStoreMappingByID(mappingID)
+	if err != nil {
+		return params.SnapStoreMappingResponse{}, errors.Wrap(err, "fetching snap store mapping")
+	}
+
+	if err := m.ensureSnapStoreMappingNotInUse(mapping); err != nil {
+		return params.SnapStoreMappingResponse{}, err
+	}
+
+	storeLocation, err := m.db.GetSnapStoreFilesLocationByID(param.SnapStoreLocation)
+	if err != nil {
+		return params.SnapStoreMappingResponse{}, errors.Wrap(err, "fetching store location")
+	}
+
+	if !storeLocation.Enabled {
+		return params.SnapStoreMappingResponse{}, vErrors.NewConflictError("snap store location %s is disabled", storeLocation.Path)
+	}
+
+	mapping.SnapStoreFilesLocation = storeLocation
+	if err := m.db.UpdateSnapStoreMapping(mapping); err != nil {
+		return params.SnapStoreMappingResponse{}, errors.Wrap(err, "updating mapping")
+	}
+	return snapStoreMappingToResponse(mapping), nil
+}
+
+func (m *Snapshot) DeleteSnapStoreMapping(mappingID string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	mapping, err := m.db.GetSnapStoreMappingByID(mappingID)
+	if err != nil {
+		return errors.Wrap(err, "fetching snap store mapping")
+	}
+
+	if err := m.ensureSnapStoreMappingNotInUse(mapping); err != nil {
+		return err
+	}
+
+	if err := m.db.DeleteSnapStoreMapping(mapping.TrackingID); err != nil {
+		return errors.Wrap(err, "deleting mapping")
+	}
+	return nil
+}
+
 ///////////////
 // Snapshots //
 ///////////////
 
-func (m *Snapshot) ensureSnapStoreForDisk(diskID string) (db.SnapStore, error) {
+func (m *Snapshot) ensureSnapStoreForDisk(ctx context.Context, diskID string) (db.SnapStore, error) {
 	trackedDisk, err := m.db.GetTrackedDiskByTrackingID(diskID)
 	if err != nil {
 		return db.SnapStore{}, errors.Wrap(err, "fetching disk info")
@@ -422,7 +775,7 @@ func (m *Snapshot) ensureSnapStoreForDisk(diskID string) (db.SnapStore, error) {
 		return store, nil
 	}
 
-	newStore, err := m.CreateSnapStore(diskID)
+	newStore, err := m.CreateSnapStore(ctx, diskID)
 	if err != nil {
 		return db.SnapStore{}, errors.Wrap(err, "creating snap store")
 	}
@@ -432,13 +785,12 @@ func (m *Snapshot) ensureSnapStoreForDisk(diskID string) (db.SnapStore, error) {
 		return db.SnapStore{}, errors.Wrap(err, "fetching snapstore watcher")
 	}
 	// Allocates 20% of device size.
-	filePath, size, err := watcher.AllocateInitialStorage()
+	size, err := watcher.InitialStorageSize()
 	if err != nil {
-		return db.SnapStore{}, errors.Wrap(err, "allocating disk space")
+		return db.SnapStore{}, errors.Wrap(err, "fetching initial snap store size")
 	}
-
-	if err := m.RecordSnapStoreFileInDB(newStore.SnapStoreID, filePath, size); err != nil {
-		return db.SnapStore{}, errors.Wrap(err, "recording file in DB")
+	if _, _, err := m.addSnapStoreFile(ctx, watcher, newStore.SnapStoreID, size); err != nil {
+		return db.SnapStore{}, errors.Wrap(err, "allocating disk space")
 	}
 	return newStore, nil
 }
@@ -471,23 +823,57 @@ func (m *Snapshot) cleanupSnapStore(snapStore db.SnapStore) error {
 	return nil
 }
 
-// CreateSnapshot creates a new snapshot of one or more disks.
-func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.SnapshotResponse, error) {
-	m.mux.Lock()
-	defer m.mux.Unlock()
-	var err error
+// validateCreateSnapshot checks that all disks in a snapshot request exist, and do not
+// already have a snapshot.
+func (m *Snapshot) validateCreateSnapshot(param params.CreateSnapshotRequest) error {
+	if len(param.TrackedDiskIDs) == 0 {
+		return vErrors.NewBadRequestError("no disks were specified")
+	}
 
 	// Taking multiple snapshots of the same disk seems to be unstable. Limit to one active
 	// snapshot per disk.
 	for _, disk := range param.TrackedDiskIDs {
+		if _, err := m.db.GetTrackedDiskByTrackingID(disk); err != nil {
+			return errors.Wrap(err, "fetching disk")
+		}
 		snap, err := m.db.ListSnapshotsForDisk(disk)
 		if err != nil {
-			return params.SnapshotResponse{}, errors.Wrap(err, "listing snapshot")
+			return errors.Wrap(err, "listing snapshot")
 		}
 		if len(snap) > 0 {
-			return params.SnapshotResponse{}, vErrors.NewConflictError("disk %s already has a snapshot", disk)
+			return vErrors.NewConflictError("disk %s already has a snapshot", disk)
 		}
 	}
+	return nil
+}
+
+// CreateSnapshot validates a snapshot request, and starts an operation that creates
+// the snapshot in the background.
+func (m *Snapshot) CreateSnapshot(ctx context.Context, param params.CreateSnapshotRequest) (params.OperationResponse, error) {
+	if err := m.validateCreateSnapshot(param); err != nil {
+		return params.OperationResponse{}, err
+	}
+
+	op := m.startOperation(ctx, params.OperationTypeCreateSnapshot, "", func(ctx context.Context, op *operation) (interface{}, error) {
+		start := time.Now()
+		resp, err := m.createSnapshot(ctx, op, param)
+		metrics.ObserveDuration(metrics.SnapshotCreateDuration, start, err)
+		return resp, err
+	})
+	return op, nil
+}
+
+func (m *Snapshot) createSnapshot(ctx context.Context, op *operation, param params.CreateSnapshotRequest) (resp params.SnapshotResponse, err error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	logger := logging.FromContext(ctx)
+
+	op.step("validating disks")
+	// Another operation may have snapshot the same disks while we were waiting.
+	if err = m.validateCreateSnapshot(param); err != nil {
+		return params.SnapshotResponse{}, err
+	}
 
 	// Ensure snap stores
 	var devices []types.DevID
@@ -495,7 +881,11 @@ func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.Sn
 	snapStoreMap := map[types.DevID]db.SnapStore{}
 	var snapStores []db.SnapStore
 	for _, disk := range param.TrackedDiskIDs {
-		store, err := m.ensureSnapStoreForDisk(disk)
+		if err := checkCancelled(ctx); err != nil {
+			return params.SnapshotResponse{}, err
+		}
+		op.step(fmt.Sprintf("creating snap store for disk %s", disk))
+		store, err := m.ensureSnapStoreForDisk(ctx, disk)
 		if err != nil {
 			return params.SnapshotResponse{}, errors.Wrap(err, "creating snap store")
 		}
@@ -519,12 +909,17 @@ func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.Sn
 		if err != nil {
 			for _, val := range snapStores {
 				if cleanupErr := m.cleanupSnapStore(val); cleanupErr != nil {
-					log.Printf("cleaning up snap store: %+v", cleanupErr)
+					logger.Errorf("failed to clean up snap store: %+v", cleanupErr)
 				}
 			}
 		}
 	}()
 
+	if err = checkCancelled(ctx); err != nil {
+		return params.SnapshotResponse{}, err
+	}
+
+	op.step("creating snapshot")
 	// Gather info before snapshot
 	cbtInfoPreSnap, err := ioctl.GetCBTInfo()
 	if err != nil {
@@ -618,12 +1013,13 @@ func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.Sn
 
 		imageMajor := images[0].SnapshotDevID.Major
 		imageMinor := images[0].SnapshotDevID.Minor
-		devFromID, err := m.udevMonitor.GetUdevDevice(int(imageMajor), int(imageMinor))
+		op.step(fmt.Sprintf("waiting for snapshot image %d:%d", imageMajor, imageMinor))
+		devFromID, err := m.udevMonitor.GetUdevDeviceWithContext(ctx, int(imageMajor), int(imageMinor))
 		if err != nil {
 			return params.SnapshotResponse{}, errors.Errorf("failed to udev detect image device by ID (%d:%d): %+v", imageMajor, imageMinor, err)
 		}
 		if devFromID.DeviceStatus != storage.DeviceStatusActive {
-			log.Printf("WARNING! Status of device with ID %d:%d is not %s. Actual device status: %s\n", imageMajor, imageMinor, storage.DeviceStatusActive, devFromID.DeviceStatus)
+			logger.Warnf("status of device with ID %d:%d is not %s. Actual device status: %s", imageMajor, imageMinor, storage.DeviceStatusActive, devFromID.DeviceStatus)
 		}
 
 		// Record resources in the database
@@ -640,9 +1036,9 @@ func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.Sn
 		}
 		defer func(snapImage db.SnapshotImage) {
 			if err != nil {
-				log.Printf("deleting snapshot image %s", snapImage.TrackingID)
+				logger.Infof("deleting snapshot image %s", snapImage.TrackingID)
 				if imgDeleteErr := m.db.DeleteSnapshotImage(snapImage.TrackingID); imgDeleteErr != nil {
-					log.Printf("failed to delete snapshot image fro db: %q", imgDeleteErr)
+					logger.Errorf("failed to delete snapshot image fro db: %q", imgDeleteErr)
 				}
 			}
 		}(newSnapImage)
@@ -654,9 +1050,9 @@ func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.Sn
 
 		defer func(volSnap db.VolumeSnapshot) {
 			if err != nil {
-				log.Printf("cleaning up volume snapshot %s", volSnap.TrackingID)
+				logger.Infof("cleaning up volume snapshot %s", volSnap.TrackingID)
 				if volErr := m.db.DeleteVolumeSnapshot(volSnap.TrackingID); volErr != nil {
-					log.Printf("error deleting volume snapshot %s from database: %q", volSnap.TrackingID, volErr)
+					logger.Errorf("error deleting volume snapshot %s from database: %q", volSnap.TrackingID, volErr)
 				}
 			}
 		}(volumeSnapshot)
@@ -672,23 +1068,62 @@ func (m *Snapshot) CreateSnapshot(param params.CreateSnapshotRequest) (params.Sn
 
 	newSnapshotParams.VolumeSnapshots = newVolumeSnapshots
 
+	op.step("saving snapshot")
 	newSnapStore, err := m.db.CreateSnapshot(newSnapshotParams)
 	if err != nil {
 		return params.SnapshotResponse{}, errors.Wrap(err, "crating snapshot in DB")
 	}
+	op.setResourceID(newSnapStore.SnapshotID)
+	m.sendEvent(SnapshotCreatedEvent, params.SnapshotEvent{
+		SnapshotID:     newSnapStore.SnapshotID,
+		TrackedDiskIDs: param.TrackedDiskIDs,
+	})
 	return internalSnapToSnapResponse(newSnapStore), nil
 }
 
-func (m *Snapshot) DeleteSnapshot(snapshotID string) error {
+// DeleteSnapshot starts an operation that deletes a snapshot, and its snap stores, in
+// the background. A snapshot that does not exist is rejected before an operation is
+// started.
+func (m *Snapshot) DeleteSnapshot(ctx context.Context, snapshotID string) (params.OperationResponse, error) {
+	if _, err := m.db.GetSnapshot(snapshotID); err != nil {
+		return params.OperationResponse{}, errors.Wrap(err, "fetching snapshot")
+	}
+
+	op := m.startOperation(ctx, params.OperationTypeDeleteSnapshot, snapshotID, func(ctx context.Context, op *operation) (interface{}, error) {
+		start := time.Now()
+		err := m.deleteSnapshot(ctx, op, snapshotID)
+		metrics.ObserveDuration(metrics.SnapshotDeleteDuration, start, err)
+		return nil, err
+	})
+	return op, nil
+}
+
+func (m *Snapshot) deleteSnapshot(ctx context.Context, op *operation, snapshotID string) error {
+	logger := logging.FromContext(ctx)
+
+	if err := checkCancelled(ctx); err != nil {
+		return err
+	}
+
+	// Reads of the snapshot images are allowed to finish before the
+	// images go away. We do not hold the manager lock while we wait.
+	op.step("waiting for snapshot reads to finish")
+	readsDone, err := m.waitSnapshotReads(ctx, snapshotID)
+	if err != nil {
+		return err
+	}
+	defer readsDone()
+
 	m.mux.Lock()
 	defer m.mux.Unlock()
 
+	op.step("deleting snapshot")
 	snapshot, err := m.db.GetSnapshot(snapshotID)
 	if err != nil {
 		if !errors.Is(err, vErrors.ErrNotFound) {
 			return errors.Wrap(err, "fetching snapshot from DB")
 		}
-		log.Printf("Could not find snapshot with id: %s --> %+v", snapshotID, err)
+		logger.Warnf("Could not find snapshot with id: %s --> %+v", snapshotID, err)
 		return nil
 	}
 
@@ -701,6 +1136,7 @@ func (m *Snapshot) DeleteSnapshot(snapshotID string) error {
 	}
 
 	for _, vol := range snapshot.VolumeSnapshots {
+		op.step(fmt.Sprintf("cleaning up snap store %s", vol.SnapStore.SnapStoreID))
 		snapStoreUUID, err := uuid.Parse(vol.SnapStore.SnapStoreID)
 		if err != nil {
 			return errors.Wrap(err, "parsing snap store ID")
@@ -721,7 +1157,7 @@ func (m *Snapshot) DeleteSnapshot(snapshotID string) error {
 
 		for _, file := range files {
 			if err := m.db.DeleteSnapStoreFile(file.TrackingID); err != nil {
-				log.Printf("failed to delete snap store file %s from db", file.TrackingID)
+				logger.Errorf("failed to delete snap store file %s from db", file.TrackingID)
 			}
 		}
 
@@ -730,13 +1166,23 @@ func (m *Snapshot) DeleteSnapshot(snapshotID string) error {
 		}
 
 	}
+	op.step("removing snapshot from database")
 	if err := m.db.DeleteSnapshot(snapshotID); err != nil {
-		log.Printf("removing snapshot %s from DB", snapshotID)
+		logger.Infof("removing snapshot %s from DB", snapshotID)
 		if !errors.Is(err, vErrors.ErrNotFound) {
 			return errors.Wrapf(err, "removing snapshot %s from DB", snapshotID)
 		}
-		log.Printf("snapshot %s not in DB", snapshotID)
+		logger.Infof("snapshot %s not in DB", snapshotID)
 	}
+
+	var diskIDs []string
+	for _, vol := range snapshot.VolumeSnapshots {
+		diskIDs = append(diskIDs, vol.OriginalDevice.TrackingID)
+	}
+	m.sendEvent(SnapshotDeletedEvent, params.SnapshotEvent{
+		SnapshotID:     snapshotID,
+		TrackedDiskIDs: diskIDs,
+	})
 	return nil
 }
 
@@ -766,6 +1212,21 @@ func (m *Snapshot) FindVolumeSnapshotForDisk(snapshotID string, diskTrackingID s
 	return volSnap, nil
 }
 
+// GetCBTBitmap returns the volume snapshot of a disk, which holds the CBT bitmap
+// saved when the snapshot was taken, along with the CBT block size.
+func (m *Snapshot) GetCBTBitmap(snapshotID string, trackedDiskID string) (db.VolumeSnapshot, int, error) {
+	volumeSnapshot, err := m.FindVolumeSnapshotForDisk(snapshotID, trackedDiskID)
+	if err != nil {
+		return db.VolumeSnapshot{}, 0, errors.Wrap(err, "finding volume snapshot")
+	}
+
+	cbtBlkSize, err := ioctl.GetTrackingBlockSize()
+	if err != nil {
+		return db.VolumeSnapshot{}, 0, errors.Wrap(err, "fetching CBT block size")
+	}
+	return volumeSnapshot, int(cbtBlkSize), nil
+}
+
 func (m *Snapshot) ListSnapshots() ([]params.SnapshotResponse, error) {
 	snapshots, err := m.db.ListAllSnapshots()
 	if err != nil {
@@ -782,51 +1243,219 @@ func (m *Snapshot) ListSnapshots() ([]params.SnapshotResponse, error) {
 
 // Snapshot consumption
 
-func (m *Snapshot) fetchIncrements(bitmap []byte, prevNumber, currentNumber int, cbtBlkSize int) []params.DiskRange {
-	var ranges []params.DiskRange
-	var tmpStartSector int
-	var tmpLength int
-	for i := 0; i < len(bitmap); i++ {
-		if prevNumber != 0 {
-			if int(bitmap[i]) <= prevNumber || int(bitmap[i]) > currentNumber {
-				continue
+// errRangeLimit ends a walk over changed ranges, once a page is full.
+var errRangeLimit = errors.New("range limit reached")
+
+// rangeWriter merges contiguous ranges of the same kind, and passes them on to fn, in
+// offset order. Once limit ranges were passed on, the next range ends the walk with
+// errRangeLimit. A limit of 0 disables the cap.
+type rangeWriter struct {
+	fn    func(params.ChangedRange) error
+	limit int
+	count int
+	// pending is the last range added. It is passed on once we know it does
+	// not continue with the next range.
+	pending params.ChangedRange
+	// next is the offset right after the last range that was passed on.
+	next uint64
+}
+
+func (w *rangeWriter) add(offset, length uint64, zero bool) error {
+	if length == 0 {
+		return nil
+	}
+	if w.pending.Length > 0 {
+		if w.pending.Zero == zero && w.pending.StartOffset+w.pending.Length == offset {
+			w.pending.Length += length
+			return nil
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.pending = params.ChangedRange{
+		StartOffset: offset,
+		Length:      length,
+		Zero:        zero,
+	}
+	return nil
+}
+
+// flush passes on the pending range.
+func (w *rangeWriter) flush() error {
+	if w.pending.Length == 0 {
+		return nil
+	}
+	if w.limit > 0 && w.count >= w.limit {
+		return errRangeLimit
+	}
+	rng := w.pending
+	w.pending = params.ChangedRange{}
+	w.count++
+	w.next = rng.StartOffset + rng.Length
+	return w.fn(rng)
+}
+
+// walkIncrements calls fn for every range of blocks that changed after prevNumber, up to
+// and including currentNumber. If prevNumber is 0, all blocks are returned. Only the bytes
+// between start and end are considered, and ranges are clipped to that window. Ranges are
+// produced while the bitmap is read, so memory use does not depend on the number of ranges.
+func (m *Snapshot) walkIncrements(bitmap []byte, prevNumber, currentNumber int, cbtBlkSize int, start, end uint64, fn func(offset, length uint64) error) error {
+	blkSize := uint64(cbtBlkSize)
+	if blkSize == 0 || start >= end {
+		return nil
+	}
+
+	lastBlock := (end + blkSize - 1) / blkSize
+	if lastBlock > uint64(len(bitmap)) {
+		lastBlock = uint64(len(bitmap))
+	}
+
+	addRange := func(firstBlock, endBlock uint64) error {
+		rngStart := firstBlock * blkSize
+		rngEnd := endBlock * blkSize
+		if rngStart < start {
+			rngStart = start
+		}
+		if rngEnd > end {
+			rngEnd = end
+		}
+		return fn(rngStart, rngEnd-rngStart)
+	}
+
+	runStart := int64(-1)
+	for i := start / blkSize; i < lastBlock; i++ {
+		changed := prevNumber == 0 || (int(bitmap[i]) > prevNumber && int(bitmap[i]) <= currentNumber)
+		if changed {
+			if runStart < 0 {
+				runStart = int64(i)
 			}
-			if tmpStartSector == 0 {
-				tmpStartSector = i
-				tmpLength = int(cbtBlkSize)
-				continue
+			continue
+		}
+		if runStart >= 0 {
+			if err := addRange(uint64(runStart), i); err != nil {
+				return err
 			}
+			runStart = -1
 		}
+	}
+	if runStart >= 0 {
+		return addRange(uint64(runStart), lastBlock)
+	}
+	return nil
+}
 
-		if tmpStartSector*cbtBlkSize+tmpLength != i*cbtBlkSize {
-			ranges = append(ranges, params.DiskRange{
-				StartOffset: uint64(tmpStartSector * cbtBlkSize),
-				Length:      uint64(tmpLength),
-			})
-			tmpStartSector = i
-			tmpLength = cbtBlkSize
+// walkWindow calls fn for every range of a sorted list that is between start and end.
+// Ranges are clipped to that window.
+func walkWindow(ranges []params.DiskRange, start, end uint64, fn func(offset, length uint64) error) error {
+	for _, rng := range ranges {
+		rngStart := rng.StartOffset
+		rngEnd := rng.StartOffset + rng.Length
+		if rngEnd <= start || rngStart >= end {
 			continue
 		}
-		tmpLength += cbtBlkSize
+		if rngStart < start {
+			rngStart = start
+		}
+		if rngEnd > end {
+			rngEnd = end
+		}
+		if err := fn(rngStart, rngEnd-rngStart); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	ranges = append(ranges, params.DiskRange{
-		StartOffset: uint64(tmpStartSector * cbtBlkSize),
-		Length:      uint64(tmpLength),
-	})
-	return ranges
+// changesPageToken returns the continuation token used to resume listing the changes
+// of a disk, starting at offset.
+func changesPageToken(snapshotID, trackedDiskID string, offset uint64) string {
+	token := fmt.Sprintf("%s/%s/%d", snapshotID, trackedDiskID, offset)
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// parseChangesPageToken validates a continuation token generated by changesPageToken,
+// and returns the offset it holds.
+func parseChangesPageToken(token, snapshotID, trackedDiskID string) (uint64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, vErrors.NewBadRequestError("invalid page token")
+	}
+	prefix := fmt.Sprintf("%s/%s/", snapshotID, trackedDiskID)
+	if !strings.HasPrefix(string(decoded), prefix) {
+		return 0, vErrors.NewBadRequestError("page token does not belong to this disk snapshot")
+	}
+	offset, err := strconv.ParseUint(strings.TrimPrefix(string(decoded), prefix), 10, 64)
+	if err != nil {
+		return 0, vErrors.NewBadRequestError("invalid page token")
+	}
+	return offset, nil
+}
+
+// ChangedSectorsOptions holds optional settings for GetChangedSectors.
+type ChangedSectorsOptions struct {
+	// DetectZeroes enables scanning the snapshot image for blocks that hold
+	// only zeroes. Those blocks are returned separately, in ZeroRanges.
+	DetectZeroes bool
+	// AllocatedOnly limits full backups to the blocks that are in use by the
+	// filesystems on the disk. Partition tables, unknown filesystems and space
+	// outside of partitions are always included.
+	AllocatedOnly bool
+	// Offset and Length limit the returned ranges to a window of the disk.
+	// Ranges that cross the edges of the window are clipped. A Length of 0
+	// extends the window to the end of the disk.
+	Offset uint64
+	Length uint64
+	// MaxRanges caps the number of ranges (including zero ranges) that are
+	// returned. If more ranges are available in the window, NextPageToken is
+	// set in the response. A value of 0 disables the cap.
+	MaxRanges int
+	// PageToken resumes a listing that was capped by MaxRanges. The same
+	// window must be requested when resuming.
+	PageToken string
+}
+
+// ChangesListing walks the changed ranges of a disk snapshot. It holds a read of the
+// snapshot, and must be closed once it is no longer needed.
+type ChangesListing struct {
+	TrackedDiskID string
+	SnapshotID    string
+	BackupType    params.BackupType
+	CBTBlockSize  int
+
+	m              *Snapshot
+	volumeSnapshot db.VolumeSnapshot
+	release        func()
+	opts           ChangedSectorsOptions
+	previousNumber uint32
+	windowStart    uint64
+	windowEnd      uint64
+	// allocated holds the ranges in use by the filesystems on the disk, if
+	// only those are listed.
+	allocated []params.DiskRange
 }
 
-func (m *Snapshot) GetChangedSectors(currentSnapshotID string, trackedDiskID string, previousGenerationID string, previousNumber uint32) (params.ChangesResponse, error) {
+// ListChangedSectors prepares a listing of the ranges of a disk that changed since the
+// snapshot identified by previousGenerationID and previousNumber. If the previous snapshot
+// is not part of the current generation, the entire disk is listed, or only its allocated
+// blocks if opts.AllocatedOnly is set. Invalid options are reported here, before any
+// range is produced.
+func (m *Snapshot) ListChangedSectors(ctx context.Context, currentSnapshotID string, trackedDiskID string, previousGenerationID string, previousNumber uint32, opts ChangedSectorsOptions) (listing *ChangesListing, err error) {
 	if previousGenerationID != "" {
 		if _, err := uuid.Parse(previousGenerationID); err != nil {
-			return params.ChangesResponse{}, errors.Wrap(err, "parsing generation ID")
+			return nil, vErrors.NewBadRequestError("invalid generation ID %q", previousGenerationID)
 		}
 	}
-	volumeSnapshot, err := m.FindVolumeSnapshotForDisk(currentSnapshotID, trackedDiskID)
+	// Mapping allocated blocks and detecting zeroes read the snapshot image.
+	volumeSnapshot, release, err := m.AcquireSnapshotRead(currentSnapshotID, trackedDiskID)
 	if err != nil {
-		return params.ChangesResponse{}, errors.Wrap(err, "finding volume snapshot")
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
 
 	var backupType params.BackupType = params.BackupTypeIncremental
 	if previousNumber == 0 || previousGenerationID != volumeSnapshot.GenerationID {
@@ -837,18 +1466,231 @@ func (m *Snapshot) GetChangedSectors(currentSnapshotID string, trackedDiskID str
 
 	cbtBlkSize, err := ioctl.GetTrackingBlockSize()
 	if err != nil {
-		return params.ChangesResponse{}, errors.Wrap(err, "fetching CBT block size")
+		return nil, errors.Wrap(err, "fetching CBT block size")
 	}
 
-	ranges := m.fetchIncrements(volumeSnapshot.Bitmap, int(previousNumber), int(volumeSnapshot.SnapshotNumber), int(cbtBlkSize))
+	blkSize := uint64(cbtBlkSize)
+	diskSize := uint64(len(volumeSnapshot.Bitmap)) * blkSize
+	windowEnd := diskSize
+	if opts.Length > 0 && opts.Offset+opts.Length < windowEnd {
+		windowEnd = opts.Offset + opts.Length
+	}
+	windowStart := opts.Offset
+	if opts.PageToken != "" {
+		windowStart, err = parseChangesPageToken(opts.PageToken, currentSnapshotID, trackedDiskID)
+		if err != nil {
+			return nil, err
+		}
+		if windowStart < opts.Offset || windowStart > windowEnd {
+			return nil, vErrors.NewBadRequestError("page token is outside of the requested window")
+		}
+	}
+
+	listing = &ChangesListing{
+		TrackedDiskID:  trackedDiskID,
+		SnapshotID:     currentSnapshotID,
+		BackupType:     backupType,
+		CBTBlockSize:   int(cbtBlkSize),
+		m:              m,
+		volumeSnapshot: volumeSnapshot,
+		release:        release,
+		opts:           opts,
+		previousNumber: previousNumber,
+		windowStart:    windowStart,
+		windowEnd:      windowEnd,
+	}
+
+	if backupType == params.BackupTypeFull && opts.AllocatedOnly {
+		allocated, err := m.allocatedRanges(ctx, volumeSnapshot, int(cbtBlkSize))
+		if err != nil {
+			// Sending the entire disk is always safe.
+			logging.FromContext(ctx).Warnf("failed to map allocated ranges of %s, sending entire disk: %+v", trackedDiskID, err)
+		} else {
+			listing.allocated = allocated
+		}
+	}
+	return listing, nil
+}
+
+// Walk calls fn for every changed range, in offset order, as soon as the range is found.
+// Zero ranges are interleaved with data ranges, and are flagged as such. If the number of
+// ranges is capped, Walk returns the token of the next page. If fn returns an error, the
+// walk stops and the error is returned.
+func (l *ChangesListing) Walk(fn func(params.ChangedRange) error) (string, error) {
+	w := &rangeWriter{
+		fn:    fn,
+		limit: l.opts.MaxRanges,
+	}
+
+	emit := func(offset, length uint64) error {
+		return w.add(offset, length, false)
+	}
+	if l.opts.DetectZeroes {
+		fp, err := os.Open(l.volumeSnapshot.SnapshotImage.DevicePath)
+		if err != nil {
+			return "", errors.Wrap(err, "opening snapshot image")
+		}
+		defer fp.Close()
+
+		size, err := fp.Seek(0, io.SeekEnd)
+		if err != nil {
+			return "", errors.Wrap(err, "fetching snapshot image size")
+		}
+		emit = func(offset, length uint64) error {
+			rng := params.DiskRange{StartOffset: offset, Length: length}
+			return util.WalkZeroRanges(fp, uint64(size), rng, l.CBTBlockSize, w.add)
+		}
+	}
+
+	var err error
+	if l.allocated != nil {
+		err = walkWindow(l.allocated, l.windowStart, l.windowEnd, emit)
+	} else {
+		err = l.m.walkIncrements(l.volumeSnapshot.Bitmap, int(l.previousNumber), int(l.volumeSnapshot.SnapshotNumber), l.CBTBlockSize, l.windowStart, l.windowEnd, emit)
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		if errors.Is(err, errRangeLimit) {
+			return changesPageToken(l.SnapshotID, l.TrackedDiskID, w.next), nil
+		}
+		return "", err
+	}
+	return "", nil
+}
+
+// Close releases the read of the snapshot.
+func (l *ChangesListing) Close() {
+	l.release()
+}
+
+// GetChangedSectors returns the ranges of a disk that changed since the snapshot identified by
+// previousGenerationID and previousNumber. It collects the ranges of ListChangedSectors in a
+// single response.
+func (m *Snapshot) GetChangedSectors(ctx context.Context, currentSnapshotID string, trackedDiskID string, previousGenerationID string, previousNumber uint32, opts ChangedSectorsOptions) (params.ChangesResponse, error) {
+	listing, err := m.ListChangedSectors(ctx, currentSnapshotID, trackedDiskID, previousGenerationID, previousNumber, opts)
 	if err != nil {
-		return params.ChangesResponse{}, errors.Wrap(err, "fetching ranges")
+		return params.ChangesResponse{}, err
 	}
-	return params.ChangesResponse{
+	defer listing.Close()
+
+	resp := params.ChangesResponse{
 		TrackedDiskID: trackedDiskID,
 		SnapshotID:    currentSnapshotID,
-		BackupType:    backupType,
-		CBTBlockSize:  int(cbtBlkSize),
-		Ranges:        ranges,
-	}, nil
+		BackupType:    listing.BackupType,
+		CBTBlockSize:  listing.CBTBlockSize,
+		Ranges:        []params.DiskRange{},
+	}
+	if opts.DetectZeroes {
+		resp.ZeroRanges = []params.DiskRange{}
+	}
+	resp.NextPageToken, err = listing.Walk(func(rng params.ChangedRange) error {
+		diskRange := params.DiskRange{
+			StartOffset: rng.StartOffset,
+			Length:      rng.Length,
+		}
+		if rng.Zero {
+			resp.ZeroRanges = append(resp.ZeroRanges, diskRange)
+		} else {
+			resp.Ranges = append(resp.Ranges, diskRange)
+		}
+		return nil
+	})
+	if err != nil {
+		return params.ChangesResponse{}, errors.Wrap(err, "listing changed ranges")
+	}
+	return resp, nil
+}
+
+// allocatedRanges returns the ranges of a volume snapshot that are in use. Filesystems are
+// mapped using the partition layout of the original disk. Anything that is not part of a
+// supported filesystem is considered in use. The returned ranges are aligned to the CBT
+// block size. The caller must hold a read of the snapshot, from AcquireSnapshotRead.
+func (m *Snapshot) allocatedRanges(ctx context.Context, volumeSnapshot db.VolumeSnapshot, cbtBlkSize int) ([]params.DiskRange, error) {
+	volume, err := m.findDiskByPath(volumeSnapshot.OriginalDevice.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching disk info")
+	}
+
+	fp, err := os.Open(volumeSnapshot.SnapshotImage.DevicePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening snapshot image")
+	}
+	defer fp.Close()
+
+	size, err := fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching snapshot image size")
+	}
+	diskSize := uint64(size)
+
+	var used []fsmap.Range
+	mapFilesystem := func(name, fsType string, offset, length uint64) {
+		fsRanges, err := fsmap.UsedRanges(fp, fsType, offset, length)
+		if err != nil {
+			if !errors.Is(err, fsmap.ErrUnsupported) {
+				logging.FromContext(ctx).Warnf("failed to map %s: %+v", name, err)
+			}
+			used = append(used, fsmap.Range{Offset: offset, Length: length})
+			return
+		}
+		for _, val := range fsRanges {
+			used = append(used, fsmap.Range{Offset: offset + val.Offset, Length: val.Length})
+		}
+	}
+
+	if len(volume.Partitions) == 0 {
+		mapFilesystem(volume.Path, volume.FilesystemType, 0, diskSize)
+	} else {
+		var partitions []fsmap.Range
+		for _, part := range volume.Partitions {
+			// sysfs reports partition start and size in 512 byte sectors,
+			// regardless of the logical sector size of the disk.
+			start := uint64(part.StartSector) * 512
+			length := uint64(part.Sectors) * 512
+			if start >= diskSize {
+				continue
+			}
+			if start+length > diskSize {
+				length = diskSize - start
+			}
+			partitions = append(partitions, fsmap.Range{Offset: start, Length: length})
+			mapFilesystem(part.Path, part.FilesystemType, start, length)
+		}
+
+		// Partition tables and any space not assigned to a partition
+		// are sent as is.
+		var pos uint64
+		for _, part := range fsmap.Merge(partitions) {
+			if part.Offset > pos {
+				used = append(used, fsmap.Range{Offset: pos, Length: part.Offset - pos})
+			}
+			pos = part.End()
+		}
+		if pos < diskSize {
+			used = append(used, fsmap.Range{Offset: pos, Length: diskSize - pos})
+		}
+	}
+
+	blkSize := uint64(cbtBlkSize)
+	aligned := make([]fsmap.Range, 0, len(used))
+	for _, val := range used {
+		if val.Length == 0 {
+			continue
+		}
+		start := val.Offset / blkSize * blkSize
+		end := (val.End() + blkSize - 1) / blkSize * blkSize
+		aligned = append(aligned, fsmap.Range{Offset: start, Length: end - start})
+	}
+
+	merged := fsmap.Merge(aligned)
+	ret := make([]params.DiskRange, len(merged))
+	for idx, val := range merged {
+		ret[idx] = params.DiskRange{
+			StartOffset: val.Offset,
+			Length:      val.Length,
+		}
+	}
+	return ret, nil
 }
@@ -0,0 +1,126 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/db"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// newDBManager returns a manager backed by an empty database. The kernel module
+// is not available, so only code paths that fail before reaching it can be tested.
+func newDBManager(t *testing.T) *Snapshot {
+	database, err := db.NewDatabase(filepath.Join(t.TempDir(), "agent.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return &Snapshot{db: database}
+}
+
+func createTrackedDisk(t *testing.T, m *Snapshot, trackingID string, minor uint32) db.TrackedDisk {
+	disk, err := m.db.CreateTrackedDisk(db.TrackedDisk{
+		TrackingID: trackingID,
+		Path:       "/dev/" + trackingID,
+		Major:      252,
+		Minor:      minor,
+		SectorSize: 512,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return disk
+}
+
+func TestRemoveTrackedDiskConflicts(t *testing.T) {
+	m := newDBManager(t)
+
+	withSnapshot := createTrackedDisk(t, m, "with-snapshot", 16)
+	volumeSnapshot, err := m.db.CreateVolumeSnapshot(db.VolumeSnapshot{
+		TrackingID:     "volume-snapshot",
+		SnapshotID:     "snapshot",
+		OriginalDevice: withSnapshot,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.db.CreateSnapshot(db.Snapshot{
+		SnapshotID:      "snapshot",
+		VolumeSnapshots: []db.VolumeSnapshot{volumeSnapshot},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	withSnapStore := createTrackedDisk(t, m, "with-snap-store", 32)
+	if _, err := m.db.CreateSnapStore(db.SnapStore{
+		SnapStoreID: "snap-store",
+		TrackedDisk: withSnapStore,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		diskID string
+		check  func(error) bool
+	}{
+		{"", func(err error) bool { _, ok := err.(*vErrors.BadRequestError); return ok }},
+		{"missing", func(err error) bool { _, ok := err.(*vErrors.NotFoundError); return ok }},
+		{withSnapshot.TrackingID, func(err error) bool { _, ok := err.(*vErrors.ConflictError); return ok }},
+		{withSnapStore.TrackingID, func(err error) bool { _, ok := err.(*vErrors.ConflictError); return ok }},
+	}
+	for _, tc := range tests {
+		err := m.RemoveTrackedDisk(context.Background(), tc.diskID)
+		if !tc.check(errors.Cause(err)) {
+			t.Errorf("%q: unexpected error: %v", tc.diskID, err)
+		}
+	}
+
+	// Disks that could not be removed are still tracked.
+	for _, disk := range []db.TrackedDisk{withSnapshot, withSnapStore} {
+		if _, err := m.db.GetTrackedDiskByTrackingID(disk.TrackingID); err != nil {
+			t.Errorf("disk %s was removed from the database: %v", disk.TrackingID, err)
+		}
+	}
+}
+
+func TestDeleteMissingSnapshot(t *testing.T) {
+	m := newDBManager(t)
+
+	_, err := m.DeleteSnapshot(context.Background(), "missing")
+	if _, ok := errors.Cause(err).(*vErrors.NotFoundError); !ok {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if len(m.operations) != 0 {
+		t.Errorf("an operation was started for a missing snapshot")
+	}
+}
+
+func TestEventIDEpoch(t *testing.T) {
+	epoch := "0b5c4ba6-3d0e-4d8e-9a5f-1c2d3e4f5a6b"
+	if got := EventIDEpoch(FormatEventID(epoch, 42)); got != epoch {
+		t.Errorf("expected epoch %s, got %s", epoch, got)
+	}
+	// IDs sent by older agents have no epoch.
+	if got := EventIDEpoch("42"); got != "" {
+		t.Errorf("expected no epoch, got %s", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"coriolis-snapshot-agent/internal/logging"
+	"coriolis-snapshot-agent/internal/metrics"
+)
+
+var (
+	trackedDisksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "tracked_disks"),
+		"Number of disks added to tracking.", nil, nil)
+	activeSnapshotsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "active_snapshots"),
+		"Number of snapshots that currently exist.", nil, nil)
+	snapStoreAllocatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "snap_store", "allocated_bytes"),
+		"Disk space allocated to a snap store.", []string{"snap_store_id", "tracked_disk_id"}, nil)
+	snapStoreUsedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "snap_store", "used_bytes"),
+		"Disk space used by CoW data in a snap store.", []string{"snap_store_id", "tracked_disk_id"}, nil)
+	locationAllocatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "snap_store_location", "allocated_bytes"),
+		"Disk space allocated to snap stores in a snap store location.", []string{"path"}, nil)
+	locationAvailableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "snap_store_location", "available_bytes"),
+		"Free disk space in a snap store location.", []string{"path"}, nil)
+	locationTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "snap_store_location", "total_bytes"),
+		"Total capacity of a snap store location.", []string{"path"}, nil)
+)
+
+// metricsCollector reports the resources managed by the agent. Values are read
+// when metrics are scraped.
+type metricsCollector struct {
+	mgr *Snapshot
+}
+
+// MetricsCollector returns a prometheus collector that reports tracked disks,
+// snapshots, snap stores and snap store locations.
+func (m *Snapshot) MetricsCollector() prometheus.Collector {
+	return &metricsCollector{mgr: m}
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- trackedDisksDesc
+	ch <- activeSnapshotsDesc
+	ch <- snapStoreAllocatedDesc
+	ch <- snapStoreUsedDesc
+	ch <- locationAllocatedDesc
+	ch <- locationAvailableDesc
+	ch <- locationTotalDesc
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	logger := logging.FromContext(c.mgr.ctx)
+	if disks, err := c.mgr.db.GetAllTrackedDisks(); err != nil {
+		logger.Errorf("failed to list tracked disks: %+v", err)
+		ch <- prometheus.NewInvalidMetric(trackedDisksDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(trackedDisksDesc, prometheus.GaugeValue, float64(len(disks)))
+	}
+
+	if snapshots, err := c.mgr.db.ListAllSnapshots(); err != nil {
+		logger.Errorf("failed to list snapshots: %+v", err)
+		ch <- prometheus.NewInvalidMetric(activeSnapshotsDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(activeSnapshotsDesc, prometheus.GaugeValue, float64(len(snapshots)))
+	}
+
+	if stores, err := c.mgr.ListSnapStores(); err != nil {
+		logger.Errorf("failed to list snap stores: %+v", err)
+		ch <- prometheus.NewInvalidMetric(snapStoreUsedDesc, err)
+	} else {
+		for _, store := range stores {
+			ch <- prometheus.MustNewConstMetric(
+				snapStoreAllocatedDesc, prometheus.GaugeValue,
+				float64(store.AllocatedDiskSpace), store.ID, store.TrackedDiskID)
+			ch <- prometheus.MustNewConstMetric(
+				snapStoreUsedDesc, prometheus.GaugeValue,
+				float64(store.StorageUsage), store.ID, store.TrackedDiskID)
+		}
+	}
+
+	if locations, err := c.mgr.ListAvailableSnapStoreLocations(); err != nil {
+		logger.Errorf("failed to list snap store locations: %+v", err)
+		ch <- prometheus.NewInvalidMetric(locationAvailableDesc, err)
+	} else {
+		for _, location := range locations {
+			ch <- prometheus.MustNewConstMetric(
+				locationAllocatedDesc, prometheus.GaugeValue,
+				float64(location.AllocatedCapacity), location.Path)
+			ch <- prometheus.MustNewConstMetric(
+				locationAvailableDesc, prometheus.GaugeValue,
+				float64(location.AvailableCapacity), location.Path)
+			ch <- prometheus.MustNewConstMetric(
+				locationTotalDesc, prometheus.GaugeValue,
+				float64(location.TotalCapacity), location.Path)
+		}
+	}
+}
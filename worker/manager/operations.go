@@ -0,0 +1,262 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/logging"
+)
+
+// operationRetention is the amount of time finished operations are kept around,
+// so clients can fetch their result.
+const operationRetention = 1 * time.Hour
+
+// operationFunc does the actual work of an operation. The returned value is
+// saved as the result of the operation.
+type operationFunc func(ctx context.Context, op *operation) (interface{}, error)
+
+// operation tracks the progress of work that runs in the background.
+type operation struct {
+	mux    sync.Mutex
+	state  params.OperationResponse
+	cancel context.CancelFunc
+	// stopped is closed when the goroutine running the operation returns.
+	// It is set under the opMux of the manager.
+	stopped <-chan struct{}
+}
+
+// done returns true if the operation has finished. The caller must hold o.mux.
+func (o *operation) done() bool {
+	switch o.state.Status {
+	case params.OperationStatusSucceeded, params.OperationStatusFailed, params.OperationStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// finishStep marks the step that is currently running as finished.
+func (o *operation) finishStep(status params.OperationStatus, now time.Time) {
+	if len(o.state.Steps) == 0 {
+		return
+	}
+	last := &o.state.Steps[len(o.state.Steps)-1]
+	if last.Status == params.OperationStatusRunning {
+		last.Status = status
+		last.FinishedAt = &now
+	}
+}
+
+// step marks the current step as done, and starts a new one. It is safe to call
+// step on a nil operation.
+func (o *operation) step(name string) {
+	if o == nil {
+		return
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	now := time.Now().UTC()
+	o.finishStep(params.OperationStatusSucceeded, now)
+	o.state.Steps = append(o.state.Steps, params.OperationStep{
+		Name:      name,
+		Status:    params.OperationStatusRunning,
+		StartedAt: now,
+	})
+	o.state.Status = params.OperationStatusRunning
+	o.state.UpdatedAt = now
+}
+
+// setResourceID records the ID of the resource this operation acts upon. It is
+// safe to call setResourceID on a nil operation.
+func (o *operation) setResourceID(resourceID string) {
+	if o == nil {
+		return
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.state.ResourceID = resourceID
+	o.state.UpdatedAt = time.Now().UTC()
+}
+
+// finish records the outcome of an operation. Operations that fail after their
+// context was cancelled are marked as cancelled.
+func (o *operation) finish(ctx context.Context, result interface{}, opErr error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	switch {
+	case opErr == nil:
+		o.state.Status = params.OperationStatusSucceeded
+		if result != nil {
+			asJSON, err := json.Marshal(result)
+			if err != nil {
+				logging.FromContext(ctx).Errorf("failed to marshal result of operation %s: %q", o.state.ID, err)
+			} else {
+				o.state.Result = asJSON
+			}
+		}
+	case ctx.Err() != nil:
+		o.state.Status = params.OperationStatusCancelled
+		o.state.Error = opErr.Error()
+	default:
+		o.state.Status = params.OperationStatusFailed
+		o.state.Error = opErr.Error()
+	}
+
+	now := time.Now().UTC()
+	o.finishStep(o.state.Status, now)
+	o.state.UpdatedAt = now
+}
+
+// response returns a copy of the current state of the operation.
+func (o *operation) response() params.OperationResponse {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	ret := o.state
+	ret.Steps = make([]params.OperationStep, len(o.state.Steps))
+	copy(ret.Steps, o.state.Steps)
+	return ret
+}
+
+// checkCancelled returns an error if the context of an operation was cancelled.
+func checkCancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "operation cancelled")
+	}
+	return nil
+}
+
+// startOperation runs fn in the background, and returns the initial state of the
+// new operation. The operation outlives reqCtx, the context of the API request
+// that started it, but inherits its request ID, so everything the operation logs
+// can be traced back to the request.
+func (m *Snapshot) startOperation(reqCtx context.Context, opType params.OperationType, resourceID string, fn operationFunc) params.OperationResponse {
+	opID := uuid.New().String()
+	requestID := logging.RequestID(reqCtx)
+	ctx, cancel := context.WithCancel(m.ctx)
+	ctx = logging.WithRequestID(ctx, requestID)
+	ctx = logging.WithFields(ctx, "operation_id", opID, "operation_type", opType)
+	logger := logging.FromContext(ctx)
+
+	now := time.Now().UTC()
+	op := &operation{
+		cancel: cancel,
+		state: params.OperationResponse{
+			ID:         opID,
+			RequestID:  requestID,
+			Type:       opType,
+			Status:     params.OperationStatusPending,
+			ResourceID: resourceID,
+			Steps:      []params.OperationStep{},
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+	}
+
+	initial := op.response()
+	logger.Infof("operation %s (%s) started", opID, opType)
+
+	m.opMux.Lock()
+	defer m.opMux.Unlock()
+	m.pruneOperations(now)
+	m.operations[op.state.ID] = op
+	op.stopped = m.goWorker(fmt.Sprintf("operation %s (%s)", opID, opType), func() {
+		defer cancel()
+		result, err := fn(ctx, op)
+		if err != nil {
+			logger.Errorf("operation %s (%s) failed: %+v", opID, opType, err)
+		} else {
+			logger.Infof("operation %s (%s) succeeded", opID, opType)
+		}
+		op.finish(ctx, result, err)
+		m.auditOperation(ctx, op.response())
+	})
+	return initial
+}
+
+// pruneOperations removes finished operations that are older than operationRetention.
+// The caller must hold opMux.
+func (m *Snapshot) pruneOperations(now time.Time) {
+	for id, op := range m.operations {
+		op.mux.Lock()
+		expired := op.done() && now.Sub(op.state.UpdatedAt) > operationRetention
+		op.mux.Unlock()
+		if expired {
+			delete(m.operations, id)
+		}
+	}
+}
+
+// ListOperations returns all operations that are running, or that finished recently.
+func (m *Snapshot) ListOperations() []params.OperationResponse {
+	m.opMux.Lock()
+	defer m.opMux.Unlock()
+
+	m.pruneOperations(time.Now().UTC())
+	ret := make([]params.OperationResponse, 0, len(m.operations))
+	for _, op := range m.operations {
+		ret = append(ret, op.response())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+	return ret
+}
+
+// GetOperation returns the current state of an operation.
+func (m *Snapshot) GetOperation(operationID string) (params.OperationResponse, error) {
+	m.opMux.Lock()
+	defer m.opMux.Unlock()
+
+	op, ok := m.operations[operationID]
+	if !ok {
+		return params.OperationResponse{}, vErrors.NewNotFoundError("operation %s not found", operationID)
+	}
+	return op.response(), nil
+}
+
+// CancelOperation requests the cancellation of a running operation. Operations stop
+// at the next step boundary, and undo any work they have done.
+func (m *Snapshot) CancelOperation(operationID string) (params.OperationResponse, error) {
+	m.opMux.Lock()
+	defer m.opMux.Unlock()
+
+	op, ok := m.operations[operationID]
+	if !ok {
+		return params.OperationResponse{}, vErrors.NewNotFoundError("operation %s not found", operationID)
+	}
+	op.mux.Lock()
+	finished := op.done()
+	op.mux.Unlock()
+	if finished {
+		return params.OperationResponse{}, vErrors.NewConflictError("operation %s has already finished", operationID)
+	}
+	op.cancel()
+	return op.response(), nil
+}
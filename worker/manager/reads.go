@@ -0,0 +1,125 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/db"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// snapshotReads counts the reads in progress on the images of a snapshot.
+type snapshotReads struct {
+	readers int
+	// deleting is the number of delete operations that wait for the readers
+	// to finish. New reads are refused while it is greater than 0.
+	deleting int
+	// idle is closed when the last reader is released.
+	idle chan struct{}
+}
+
+// AcquireSnapshotRead returns the volume snapshot of a disk, and protects its image
+// from being deleted until the returned release function is called. The manager lock
+// is only held while the snapshot is looked up, so reads do not block each other, or
+// any other operation. Deleting the snapshot waits for all reads to be released.
+func (m *Snapshot) AcquireSnapshotRead(snapshotID, trackedDiskID string) (db.VolumeSnapshot, func(), error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	volSnap, err := m.FindVolumeSnapshotForDisk(snapshotID, trackedDiskID)
+	if err != nil {
+		return db.VolumeSnapshot{}, nil, errors.Wrap(err, "finding volume snapshot")
+	}
+
+	m.readMux.Lock()
+	defer m.readMux.Unlock()
+
+	reads, ok := m.reads[snapshotID]
+	if !ok {
+		reads = &snapshotReads{}
+		m.reads[snapshotID] = reads
+	}
+	if reads.deleting > 0 {
+		return db.VolumeSnapshot{}, nil, vErrors.NewConflictError("snapshot %s is being deleted", snapshotID)
+	}
+	if reads.readers == 0 {
+		reads.idle = make(chan struct{})
+	}
+	reads.readers++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			m.releaseSnapshotRead(snapshotID)
+		})
+	}
+	return volSnap, release, nil
+}
+
+func (m *Snapshot) releaseSnapshotRead(snapshotID string) {
+	m.readMux.Lock()
+	defer m.readMux.Unlock()
+
+	reads := m.reads[snapshotID]
+	reads.readers--
+	if reads.readers > 0 {
+		return
+	}
+	close(reads.idle)
+	if reads.deleting == 0 {
+		delete(m.reads, snapshotID)
+	}
+}
+
+// waitSnapshotReads refuses new reads of a snapshot, and waits for the reads in
+// progress to be released. The returned function allows reads again, and must be
+// called once the snapshot is deleted, or the delete failed.
+func (m *Snapshot) waitSnapshotReads(ctx context.Context, snapshotID string) (func(), error) {
+	m.readMux.Lock()
+	reads, ok := m.reads[snapshotID]
+	if !ok {
+		reads = &snapshotReads{}
+		m.reads[snapshotID] = reads
+	}
+	reads.deleting++
+	busy := reads.readers > 0
+	idle := reads.idle
+	m.readMux.Unlock()
+
+	done := func() {
+		m.readMux.Lock()
+		defer m.readMux.Unlock()
+
+		reads.deleting--
+		if reads.deleting == 0 && reads.readers == 0 {
+			delete(m.reads, snapshotID)
+		}
+	}
+
+	if busy {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			done()
+			return nil, checkCancelled(ctx)
+		}
+	}
+	return done, nil
+}
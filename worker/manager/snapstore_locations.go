@@ -16,6 +16,10 @@
 package manager
 
 import (
+	"io/fs"
+	"os"
+	"path/filepath"
+
 	"coriolis-snapshot-agent/apiserver/params"
 	"coriolis-snapshot-agent/db"
 	vErrors "coriolis-snapshot-agent/errors"
@@ -32,6 +36,25 @@ import (
 // AddSnapStoreLocation creates a new snap store location. Locations hosted on a device
 // that is currently tracked, will err out.
 func (m *Snapshot) AddSnapStoreLocation(path string) (params.SnapStoreLocation, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if !filepath.IsAbs(path) {
+		return params.SnapStoreLocation{}, vErrors.NewBadRequestError("location path must be absolute")
+	}
+	path = filepath.Clean(path)
+
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return params.SnapStoreLocation{}, vErrors.NewBadRequestError("location %s does not exist", path)
+		}
+		return params.SnapStoreLocation{}, errors.Wrap(err, "checking location")
+	}
+	if !pathInfo.IsDir() {
+		return params.SnapStoreLocation{}, vErrors.NewBadRequestError("location %s is not a folder", path)
+	}
+
 	fsInfo, err := util.GetFileSystemInfoFromPath(path)
 	if err != nil {
 		return params.SnapStoreLocation{}, errors.Wrap(err, "fetching filesystem info")
@@ -80,6 +103,7 @@ func (m *Snapshot) AddSnapStoreLocation(path string) (params.SnapStoreLocation,
 		Major:         deviceInfo.Major,
 		Minor:         deviceInfo.Minor,
 		Enabled:       true,
+		Devices:       allInvolvedDevices,
 	}
 
 	createdStore, err := m.db.CreateSnapStoreFileLocation(newLocParams)
@@ -105,9 +129,27 @@ func (m *Snapshot) AddSnapStoreLocation(path string) (params.SnapStoreLocation,
 		DevicePath:        createdStore.DevicePath,
 		Major:             createdStore.Major,
 		Minor:             createdStore.Minor,
+		Enabled:           createdStore.Enabled,
 	}, nil
 }
 
+// snapStoreLocationDevices returns the paths of all devices that host snap store
+// locations, either configured or added at runtime. These devices must never be
+// added to tracking.
+func (m *Snapshot) snapStoreLocationDevices() ([]string, error) {
+	ret := append([]string{}, m.cfg.CowDestinationDevices()...)
+
+	locations, err := m.db.ListSnapStoreFilesLocations()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing snap store files locations")
+	}
+
+	for _, location := range locations {
+		ret = append(ret, location.Devices...)
+	}
+	return ret, nil
+}
+
 func (m *Snapshot) getSnapStoreLoctionInfo(location db.SnapStoreFilesLocation) (params.SnapStoreLocation, error) {
 	fsInfo, err := util.GetFileSystemInfoFromPath(location.Path)
 	if err != nil {
@@ -132,6 +174,7 @@ func (m *Snapshot) getSnapStoreLoctionInfo(location db.SnapStoreFilesLocation) (
 		DevicePath:        location.DevicePath,
 		Major:             location.Major,
 		Minor:             location.Minor,
+		Enabled:           location.Enabled,
 	}, nil
 }
 
@@ -154,38 +197,142 @@ func (m *Snapshot) GetSnapStoreLocationByID(locationID string) (params.SnapStore
 }
 
 func (m *Snapshot) ListAvailableSnapStoreLocations() ([]params.SnapStoreLocation, error) {
-	ret := make([]params.SnapStoreLocation, len(m.cfg.CoWDestination))
-
 	snapStoreFilesLocations, err := m.db.ListSnapStoreFilesLocations()
 	if err != nil {
 		return nil, errors.Wrap(err, "listing snap store files locations")
 	}
 
+	ret := make([]params.SnapStoreLocation, len(snapStoreFilesLocations))
 	for idx, val := range snapStoreFilesLocations {
-		fsInfo, err := util.GetFileSystemInfoFromPath(val.Path)
+		locationInfo, err := m.getSnapStoreLoctionInfo(val)
 		if err != nil {
-			return nil, errors.Wrap(err, "fetching filesystem info")
+			return nil, errors.Wrap(err, "fetching location info")
 		}
+		ret[idx] = locationInfo
+	}
+	return ret, nil
+}
 
-		files, err := m.db.FindSnapStoreLocationFiles(val.Path)
-		if err != nil {
-			return []params.SnapStoreLocation{}, errors.Wrap(err, "fetching snap store files")
+// UpdateSnapStoreLocation updates the administrative state of a snap store location.
+// Disabling a location prevents new snap stores from being created in that location,
+// and prevents existing snap stores from growing.
+func (m *Snapshot) UpdateSnapStoreLocation(path string, param params.UpdateSnapStoreLocationRequest) (params.SnapStoreLocation, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	location, err := m.db.GetSnapStoreFilesLocation(path)
+	if err != nil {
+		return params.SnapStoreLocation{}, errors.Wrap(err, "fetching snap store location info")
+	}
+
+	if param.Enabled != nil {
+		if err := m.setSnapStoreLocationEnabled(location, *param.Enabled); err != nil {
+			return params.SnapStoreLocation{}, errors.Wrap(err, "updating snap store location")
 		}
-		var totalAllocated uint64
-		for _, file := range files {
-			totalAllocated += file.Size
+		location.Enabled = *param.Enabled
+	}
+	return m.getSnapStoreLoctionInfo(location)
+}
+
+func (m *Snapshot) setSnapStoreLocationEnabled(location db.SnapStoreFilesLocation, enabled bool) error {
+	if location.Enabled != enabled {
+		location.Enabled = enabled
+		if err := m.db.UpdateSnapStoreFilesLocation(location); err != nil {
+			return errors.Wrap(err, "updating db entry")
 		}
+	}
 
-		ret[idx] = params.SnapStoreLocation{
-			// ID:                val.TrackingID,
-			AllocatedCapacity: totalAllocated,
-			AvailableCapacity: fsInfo.BlocksAvailable * uint64(fsInfo.BlockSize),
-			TotalCapacity:     val.TotalCapacity,
-			Path:              val.Path,
-			DevicePath:        val.DevicePath,
-			Major:             val.Major,
-			Minor:             val.Minor,
+	stores, err := m.db.ListSnapStoresForLocation(location.Path)
+	if err != nil {
+		return errors.Wrap(err, "listing snap stores")
+	}
+
+	for _, store := range stores {
+		watcher, err := m.GetCharacterDeviceWatcher(store.SnapStoreID)
+		if err != nil {
+			if !errors.Is(err, vErrors.ErrNotFound) {
+				return errors.Wrap(err, "fetching snap store watcher")
+			}
+			continue
 		}
+		watcher.SetAllocationEnabled(enabled)
 	}
-	return ret, nil
+	return nil
+}
+
+// DrainSnapStoreLocation disables a snap store location and returns the list of snap
+// stores that still hold files there. Files are released once the snapshots that use
+// those snap stores are deleted. A location is drained when no files remain.
+func (m *Snapshot) DrainSnapStoreLocation(path string) (params.SnapStoreLocationDrainResponse, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	location, err := m.db.GetSnapStoreFilesLocation(path)
+	if err != nil {
+		return params.SnapStoreLocationDrainResponse{}, errors.Wrap(err, "fetching snap store location info")
+	}
+
+	if err := m.setSnapStoreLocationEnabled(location, false); err != nil {
+		return params.SnapStoreLocationDrainResponse{}, errors.Wrap(err, "disabling snap store location")
+	}
+
+	files, err := m.db.FindSnapStoreLocationFiles(location.Path)
+	if err != nil {
+		return params.SnapStoreLocationDrainResponse{}, errors.Wrap(err, "fetching snap store files")
+	}
+
+	snapStores := []string{}
+	seen := map[string]bool{}
+	var totalAllocated uint64
+	for _, file := range files {
+		totalAllocated += file.Size
+		if seen[file.SnapStore.SnapStoreID] {
+			continue
+		}
+		seen[file.SnapStore.SnapStoreID] = true
+		snapStores = append(snapStores, file.SnapStore.SnapStoreID)
+	}
+
+	return params.SnapStoreLocationDrainResponse{
+		Path:              location.Path,
+		Enabled:           false,
+		SnapStores:        snapStores,
+		AllocatedCapacity: totalAllocated,
+		Drained:           len(files) == 0,
+	}, nil
+}
+
+// RemoveSnapStoreLocation removes a snap store location. Locations that still hold
+// snap store files, or that are referenced by a snap store mapping, cannot be removed.
+// Locations that are part of the snapstore_destinations config option will be added
+// back when the agent restarts.
+func (m *Snapshot) RemoveSnapStoreLocation(path string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	location, err := m.db.GetSnapStoreFilesLocation(path)
+	if err != nil {
+		return errors.Wrap(err, "fetching snap store location info")
+	}
+
+	files, err := m.db.FindSnapStoreLocationFiles(location.Path)
+	if err != nil {
+		return errors.Wrap(err, "fetching snap store files")
+	}
+	if len(files) > 0 {
+		return vErrors.NewConflictError("location %s still holds %d snap store file(s)", location.Path, len(files))
+	}
+
+	mappings, err := m.db.ListSnapStoreMappingsByLocationID(location.Path)
+	if err != nil {
+		return errors.Wrap(err, "fetching snap store mappings")
+	}
+	if len(mappings) > 0 {
+		return vErrors.NewConflictError("location %s is used by %d snap store mapping(s)", location.Path, len(mappings))
+	}
+
+	if err := m.db.DeleteSnapStoreFilesLocation(location.Path); err != nil {
+		return errors.Wrap(err, "removing snap store location")
+	}
+	return nil
 }
@@ -16,19 +16,20 @@
 package manager
 
 import (
+	"context"
 	"coriolis-snapshot-agent/apiserver/params"
 	"coriolis-snapshot-agent/db"
 	vErrors "coriolis-snapshot-agent/errors"
 	"coriolis-snapshot-agent/internal/ioctl"
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/internal/types"
 	"coriolis-snapshot-agent/internal/util"
 	"coriolis-snapshot-agent/worker/common"
 	"coriolis-snapshot-agent/worker/snapstore"
+	"fmt"
 	"io/fs"
-	"log"
 	"os"
 	"path"
-	"path/filepath"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
@@ -69,7 +70,6 @@ func (m *Snapshot) snapStoreUsedBytes(snapStoreID string) (uint64, error) {
 		return 0, nil
 	}
 
-	// log.Printf("fetching info about %s", snapStoreID)
 	snapStoreRet, err := ioctl.SnapStoreCleanup(snapStoreParams)
 	if err != nil {
 		return 0, errors.Wrap(err, "fetching snap store usage")
@@ -77,14 +77,14 @@ func (m *Snapshot) snapStoreUsedBytes(snapStoreID string) (uint64, error) {
 	if snapStoreRet.FilledBytes == ioctl.SNAP_STORE_NOT_FOUND {
 		return 0, vErrors.NewNotFoundError("snap store %s does not exist", snapStoreID)
 	}
-	// log.Printf("Filled bytes for %s is %d", snapStoreID, snapStoreRet.FilledBytes)
 	return snapStoreRet.FilledBytes, nil
 }
 
 // CreateSnapStore creates a new snap store via ioctl.
-func (m *Snapshot) CreateSnapStore(trackedDisk string) (db.SnapStore, error) {
+func (m *Snapshot) CreateSnapStore(ctx context.Context, trackedDisk string) (db.SnapStore, error) {
 	var err error
-	log.Printf("creating snap store for disk %s", trackedDisk)
+	logger := logging.FromContext(ctx)
+	logger.Infof("creating snap store for disk %s", trackedDisk)
 	_, err = m.db.FindSnapStoresForDevice(trackedDisk)
 	if err != nil {
 		if !errors.Is(err, bolthold.ErrNotFound) {
@@ -104,6 +104,10 @@ func (m *Snapshot) CreateSnapStore(trackedDisk string) (db.SnapStore, error) {
 		return db.SnapStore{}, errors.Wrap(err, "fetching snap store location")
 	}
 
+	if !snapStoreLocation.Enabled {
+		return db.SnapStore{}, vErrors.NewConflictError("snap store location %s is disabled", snapStoreLocation.Path)
+	}
+
 	disk, err := m.db.GetTrackedDiskByTrackingID(trackedDisk)
 	if err != nil {
 		if errors.Is(err, bolthold.ErrNotFound) {
@@ -117,7 +121,7 @@ func (m *Snapshot) CreateSnapStore(trackedDisk string) (db.SnapStore, error) {
 		Minor: disk.Minor,
 	}
 
-	log.Printf("tracked disk ID is %d:%d", disk.Major, disk.Minor)
+	logger.Infof("tracked disk ID is %d:%d", disk.Major, disk.Minor)
 	snapDisk := types.DevID{
 		Major: snapStoreLocation.Major,
 		Minor: snapStoreLocation.Minor,
@@ -147,21 +151,21 @@ func (m *Snapshot) CreateSnapStore(trackedDisk string) (db.SnapStore, error) {
 		return db.SnapStore{}, errors.Errorf("snap store is invalid")
 	}
 
-	log.Printf("Checking for snap store location folder: %s", store.Path())
+	logger.Infof("Checking for snap store location folder: %s", store.Path())
 	if _, statErr := os.Stat(store.Path()); statErr != nil {
 		if !errors.Is(statErr, fs.ErrNotExist) {
 			return db.SnapStore{}, errors.Wrap(statErr, "checking storage location")
 		}
-		log.Printf("Creating snap store location folder: %s", store.Path())
+		logger.Infof("Creating snap store location folder: %s", store.Path())
 
 		if mkdirErr := os.MkdirAll(store.Path(), 00770); mkdirErr != nil {
-			log.Printf("Error creating snap store location folder %s: %q", store.Path(), mkdirErr)
+			logger.Errorf("Error creating snap store location folder %s: %q", store.Path(), mkdirErr)
 			return db.SnapStore{}, errors.Wrap(mkdirErr, "creating storage location")
 		}
 
 		defer func(storageNeedsInit bool) {
 			if err != nil && storageNeedsInit {
-				log.Printf("Cleaning snap store location folder %s due to error: %q", store.Path(), err)
+				logger.Infof("Cleaning snap store location folder %s due to error: %q", store.Path(), err)
 				os.RemoveAll(store.Path())
 			}
 		}(true)
@@ -173,8 +177,9 @@ func (m *Snapshot) CreateSnapStore(trackedDisk string) (db.SnapStore, error) {
 		SnapDeviceID:      snapDisk,
 		DeviceID:          deviceID,
 		SnapStoreFileSize: m.cfg.SnapStoreFileSize,
+		AllocationEnabled: snapStoreLocation.Enabled,
 	}
-	snapCharacterDeviceWatcher, err := snapstore.NewSnapStoreCharacterDeviceWatcher(snapCharacterDeviceWatcherParams, m.msgChan)
+	snapCharacterDeviceWatcher, err := snapstore.NewSnapStoreCharacterDeviceWatcher(snapCharacterDeviceWatcherParams, m.msgChan, logging.FromContext(m.ctx))
 	if err != nil {
 		return db.SnapStore{}, errors.Wrap(err, "creating snap store")
 	}
@@ -236,9 +241,24 @@ func (m *Snapshot) GetSnapStore(storeID string) (params.SnapStoreResponse, error
 	resp := internalSnapStoreToParamsSnapStore(store)
 	resp.StorageUsage = snapStoreUsage
 	resp.AllocatedDiskSpace = totalAllocated
+	resp.Files = make([]params.SnapStoreFile, len(files))
+	for idx, file := range files {
+		extents, err := util.GetExtents(file.Path)
+		if err != nil {
+			return params.SnapStoreResponse{}, errors.Wrapf(err, "fetching extents for %s", file.Path)
+		}
+		resp.Files[idx] = params.SnapStoreFile{
+			ID:      file.TrackingID,
+			Path:    file.Path,
+			Size:    file.Size,
+			Extents: len(extents),
+		}
+	}
 	return resp, nil
 }
 
+// RecordSnapStoreFileInDB records a new snap store file, and adds its size to the
+// snap store. The caller must hold m.mux.
 func (m *Snapshot) RecordSnapStoreFileInDB(snapStoreID string, filePath string, size uint64) error {
 	snapStore, err := m.db.GetSnapStore(snapStoreID)
 	if err != nil {
@@ -261,75 +281,159 @@ func (m *Snapshot) RecordSnapStoreFileInDB(snapStoreID string, filePath string,
 
 	snapStore.TotalAllocatedSize += size
 	if err := m.db.UpdateSnapStore(snapStore); err != nil {
+		if delErr := m.db.DeleteSnapStoreFile(name); delErr != nil {
+			return errors.Wrapf(err, "updating snap store (also failed to remove file record: %s)", delErr)
+		}
 		return errors.Wrap(err, "updating snap store")
 	}
 	return nil
 }
 
-func (m *Snapshot) AddCapacityToSnapStore(snapStoreID string, capacity uint64) error {
-	var err error
+// forgetSnapStoreFile undoes RecordSnapStoreFileInDB, for a file that could not be
+// added to the snap store.
+func (m *Snapshot) forgetSnapStoreFile(snapStoreID string, filePath string, size uint64) error {
 	snapStore, err := m.db.GetSnapStore(snapStoreID)
 	if err != nil {
 		return errors.Wrap(err, "fetching snap store from DB")
 	}
 
-	locationInfo, err := m.getSnapStoreLoctionInfo(snapStore.StorageLocation)
-	if err != nil {
-		return errors.Wrap(err, "getting location info")
+	if err := m.db.DeleteSnapStoreFile(path.Base(filePath)); err != nil {
+		return errors.Wrap(err, "removing snap store file")
 	}
 
-	if locationInfo.AvailableCapacity < uint64(capacity) {
-		return errors.Errorf("Cannot allocate %d bytes for snap store %s. Location only has %d bytes available", capacity, snapStore.StorageLocation.Path, locationInfo.AvailableCapacity)
+	snapStore.TotalAllocatedSize -= size
+	if err := m.db.UpdateSnapStore(snapStore); err != nil {
+		return errors.Wrap(err, "updating snap store")
 	}
+	return nil
+}
 
-	newFileName := uuid.New()
-	snapStoreFilePath := filepath.Join(snapStore.Path(), newFileName.String())
-	if err := util.CreateSnapStoreFile(snapStoreFilePath, capacity); err != nil {
-		return errors.Errorf("failed to create %s: %+v", snapStoreFilePath, err)
+// addSnapStoreFile creates a file of the given size for a snap store, records it in
+// the DB, and hands it to the kernel. The file is recorded first: once the kernel
+// uses it, it can no longer be removed, so it must not go untracked. If the kernel
+// does not take the file, the record and the file are removed. The caller must hold
+// m.mux.
+func (m *Snapshot) addSnapStoreFile(ctx context.Context, watcher *snapstore.CharacterDeviceWatcher, snapStoreID string, size uint64) (string, uint64, error) {
+	filePath, fileSize, err := watcher.CreateStorageFile(size)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "creating snap store file")
 	}
-	defer func() {
-		if err != nil {
-			os.Remove(snapStoreFilePath)
+
+	logger := logging.FromContext(ctx)
+	if err := m.RecordSnapStoreFileInDB(snapStoreID, filePath, fileSize); err != nil {
+		if rmErr := os.Remove(filePath); rmErr != nil {
+			logger.Errorf("failed to remove %s: %+v", filePath, rmErr)
 		}
-	}()
+		return "", 0, errors.Wrap(err, "recording file in DB")
+	}
 
-	snapFileParams := db.SnapStoreFile{
-		TrackingID:             newFileName.String(),
-		SnapStore:              snapStore,
-		SnapStoreFilesLocation: snapStore.StorageLocation,
-		Path:                   snapStoreFilePath,
-		Size:                   capacity,
+	if err := watcher.AddStorageFile(filePath); err != nil {
+		if dbErr := m.forgetSnapStoreFile(snapStoreID, filePath, fileSize); dbErr != nil {
+			// The record stays, and the file with it, so the two agree.
+			logger.Errorf("failed to remove %s from DB: %+v", filePath, dbErr)
+		} else if rmErr := os.Remove(filePath); rmErr != nil {
+			logger.Errorf("failed to remove %s: %+v", filePath, rmErr)
+		}
+		return "", 0, errors.Wrap(err, "adding file to snap store")
 	}
+	return filePath, fileSize, nil
+}
 
-	_, err = m.db.CreateSnapStoreFile(snapFileParams)
+// growSnapStore adds a file to a snap store the kernel reported as half full.
+func (m *Snapshot) growSnapStore(snapStoreID string, fillStatus uint64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	watcher, err := m.GetCharacterDeviceWatcher(snapStoreID)
 	if err != nil {
-		return errors.Wrap(err, "adding snap store file")
+		return errors.Wrap(err, "fetching snap store watcher")
 	}
 
-	defer func() {
-		if err != nil {
-			m.db.DeleteSnapStoreFile(snapFileParams.TrackingID)
+	filePath, size, err := m.addSnapStoreFile(m.ctx, watcher, snapStoreID, watcher.SnapStoreFileSize())
+	if err != nil {
+		return errors.Wrap(err, "allocating file")
+	}
+	m.sendEvent(SnapStoreFileAddedEvent, params.SnapStoreFileEvent{
+		SnapStoreID: snapStoreID,
+		FilePath:    filePath,
+		FileSize:    size,
+		FillStatus:  &fillStatus,
+	})
+	return nil
+}
+
+// AddCapacityToSnapStore starts an operation that grows a snap store by capacity bytes,
+// in the background.
+func (m *Snapshot) AddCapacityToSnapStore(ctx context.Context, snapStoreID string, capacity uint64) (params.OperationResponse, error) {
+	if capacity == 0 {
+		return params.OperationResponse{}, vErrors.NewBadRequestError("invalid capacity")
+	}
+
+	if _, err := m.db.GetSnapStore(snapStoreID); err != nil {
+		return params.OperationResponse{}, errors.Wrap(err, "fetching snap store from DB")
+	}
+
+	op := m.startOperation(ctx, params.OperationTypeAddSnapStoreCapacity, snapStoreID, func(ctx context.Context, op *operation) (interface{}, error) {
+		if err := m.addCapacityToSnapStore(ctx, op, snapStoreID, capacity); err != nil {
+			return nil, err
 		}
-	}()
+		return m.GetSnapStore(snapStoreID)
+	})
+	return op, nil
+}
 
-	snapStoreIDFromString, err := uuid.Parse(snapStore.SnapStoreID)
+func (m *Snapshot) addCapacityToSnapStore(ctx context.Context, op *operation, snapStoreID string, capacity uint64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if err := checkCancelled(ctx); err != nil {
+		return err
+	}
+
+	op.step("checking snap store location")
+	snapStore, err := m.db.GetSnapStore(snapStoreID)
 	if err != nil {
-		return errors.Wrap(err, "parsing snap store ID")
+		return errors.Wrap(err, "fetching snap store from DB")
 	}
-	snapStoreParam := types.SnapStore{
-		ID: [16]byte(snapStoreIDFromString),
-		SnapshotDeviceID: types.DevID{
-			Major: snapStore.StorageLocation.Major,
-			Minor: snapStore.StorageLocation.Minor,
-		},
+
+	location, err := m.db.GetSnapStoreFilesLocation(snapStore.StorageLocation.Path)
+	if err != nil {
+		return errors.Wrap(err, "fetching snap store location")
 	}
 
-	if err := ioctl.SnapStoreAddFile(snapStoreParam, snapStoreFilePath); err != nil {
-		return errors.Wrap(err, "adding file to snap store")
+	if !location.Enabled {
+		return vErrors.NewConflictError("snap store location %s is disabled", location.Path)
 	}
-	snapStore.TotalAllocatedSize += capacity
-	if err := m.db.UpdateSnapStore(snapStore); err != nil {
-		return errors.Wrap(err, "updating snap store")
+
+	locationInfo, err := m.getSnapStoreLoctionInfo(location)
+	if err != nil {
+		return errors.Wrap(err, "getting location info")
+	}
+
+	if locationInfo.AvailableCapacity < capacity {
+		return vErrors.NewConflictError("cannot allocate %d bytes for snap store %s. Location only has %d bytes available", capacity, snapStore.SnapStoreID, locationInfo.AvailableCapacity)
+	}
+
+	// The snap store was created through the character device, so new files must
+	// be added by the watcher, the same way it reacts to half-fill events.
+	watcher, err := m.GetCharacterDeviceWatcher(snapStore.SnapStoreID)
+	if err != nil {
+		return errors.Wrap(err, "fetching snap store watcher")
+	}
+
+	if err := checkCancelled(ctx); err != nil {
+		return err
+	}
+
+	op.step(fmt.Sprintf("allocating %d bytes", capacity))
+	filePath, size, err := m.addSnapStoreFile(ctx, watcher, snapStore.SnapStoreID, capacity)
+	if err != nil {
+		return errors.Wrap(err, "allocating disk space")
 	}
+	m.sendEvent(SnapStoreFileAddedEvent, params.SnapStoreFileEvent{
+		SnapStoreID: snapStore.SnapStoreID,
+		FilePath:    filePath,
+		FileSize:    size,
+	})
 	return nil
 }
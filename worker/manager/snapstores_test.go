@@ -0,0 +1,93 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/db"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+func TestForgetSnapStoreFile(t *testing.T) {
+	m := newDBManager(t)
+
+	disk := createTrackedDisk(t, m, "disk", 16)
+	if _, err := m.db.CreateSnapStore(db.SnapStore{
+		SnapStoreID:        "snap-store",
+		TrackedDisk:        disk,
+		TotalAllocatedSize: 100,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RecordSnapStoreFileInDB("snap-store", "/var/lib/snapstores/snap-store/file", 50); err != nil {
+		t.Fatalf("failed to record file: %+v", err)
+	}
+	store, err := m.db.GetSnapStore("snap-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.TotalAllocatedSize != 150 {
+		t.Fatalf("expected 150 allocated bytes, got %d", store.TotalAllocatedSize)
+	}
+
+	if err := m.forgetSnapStoreFile("snap-store", "/var/lib/snapstores/snap-store/file", 50); err != nil {
+		t.Fatalf("failed to forget file: %+v", err)
+	}
+	store, err = m.db.GetSnapStore("snap-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.TotalAllocatedSize != 100 {
+		t.Fatalf("expected 100 allocated bytes, got %d", store.TotalAllocatedSize)
+	}
+	files, err := m.db.ListSnapStoreFilesForSnapStore("snap-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected no files, got %+v", files)
+	}
+}
+
+func TestGrowSnapStoreWithoutWatcher(t *testing.T) {
+	m := newDBManager(t)
+
+	disk := createTrackedDisk(t, m, "disk", 16)
+	if _, err := m.db.CreateSnapStore(db.SnapStore{
+		SnapStoreID: "snap-store",
+		TrackedDisk: disk,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is recorded for a snap store that has no watcher to add the
+	// file to the kernel.
+	err := m.growSnapStore("snap-store", 1024)
+	if _, ok := errors.Cause(err).(*vErrors.NotFoundError); !ok {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	files, err := m.db.ListSnapStoreFilesForSnapStore("snap-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected no files, got %+v", files)
+	}
+}
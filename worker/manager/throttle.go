@@ -0,0 +1,175 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/throttle"
+)
+
+const (
+	mib = 1024 * 1024
+	// throttleScheduleInterval is how often we check whether a throttle
+	// schedule started or ended.
+	throttleScheduleInterval = 30 * time.Second
+)
+
+// throttleOverride holds limits set through the API. They replace the limits
+// from the config until they expire.
+type throttleOverride struct {
+	limits config.ThrottleLimits
+	// expiresAt is nil for overrides that do not expire.
+	expiresAt *time.Time
+}
+
+func toThrottleLimits(limits config.ThrottleLimits) throttle.Limits {
+	return throttle.Limits{
+		MaxStreams:        limits.MaxStreams,
+		MaxStreamsPerDisk: limits.MaxStreamsPerDisk,
+		Bandwidth:         limits.MaxBandwidth * mib,
+		BandwidthPerDisk:  limits.MaxBandwidthPerDisk * mib,
+	}
+}
+
+func throttleLimitsToParam(limits config.ThrottleLimits) params.ThrottleLimits {
+	return params.ThrottleLimits{
+		MaxStreams:          limits.MaxStreams,
+		MaxStreamsPerDisk:   limits.MaxStreamsPerDisk,
+		MaxBandwidth:        limits.MaxBandwidth,
+		MaxBandwidthPerDisk: limits.MaxBandwidthPerDisk,
+	}
+}
+
+// currentThrottleLimits returns the limits in effect at the given time, along
+// with where they come from. Expired overrides are removed. The caller must
+// hold throttleMux.
+func (m *Snapshot) currentThrottleLimits(now time.Time) (config.ThrottleLimits, params.ThrottleResponse) {
+	if m.throttleOverride != nil && m.throttleOverride.expiresAt != nil && !now.Before(*m.throttleOverride.expiresAt) {
+		m.throttleOverride = nil
+	}
+	if m.throttleOverride != nil {
+		return m.throttleOverride.limits, params.ThrottleResponse{
+			Limits:            throttleLimitsToParam(m.throttleOverride.limits),
+			Source:            params.ThrottleSourceOverride,
+			OverrideExpiresAt: m.throttleOverride.expiresAt,
+		}
+	}
+
+	limits, schedule := m.cfg.Throttle.LimitsAt(now)
+	ret := params.ThrottleResponse{
+		Limits: throttleLimitsToParam(limits),
+		Source: params.ThrottleSourceConfig,
+	}
+	if schedule != "" {
+		ret.Source = params.ThrottleSourceSchedule
+		ret.Schedule = schedule
+	}
+	return limits, ret
+}
+
+// applyThrottleLimits makes the throttle enforce the limits currently in
+// effect, and returns them.
+func (m *Snapshot) applyThrottleLimits() params.ThrottleResponse {
+	m.throttleMux.Lock()
+	defer m.throttleMux.Unlock()
+
+	limits, current := m.currentThrottleLimits(time.Now())
+	m.throttle.SetLimits(toThrottleLimits(limits))
+	current.ActiveStreams, current.QueuedStreams = m.throttle.Stats()
+	return current
+}
+
+// runThrottleScheduler switches limits when schedules start or end, and when
+// overrides expire.
+func (m *Snapshot) runThrottleScheduler() {
+	ticker := time.NewTicker(throttleScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.applyThrottleLimits()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// AcquireStream reserves a snapshot read slot for a tracked disk. If the stream
+// limits are reached, it waits for the queue timeout set in the config, and
+// returns a TooManyRequestsError if no slot was freed. The stream must be
+// released when the read is done.
+func (m *Snapshot) AcquireStream(ctx context.Context, trackedDiskID string) (*throttle.Stream, error) {
+	timeout := time.Duration(m.cfg.Throttle.QueueTimeout) * time.Second
+	stream, err := m.throttle.Acquire(ctx, trackedDiskID, timeout)
+	if err != nil {
+		if errors.Is(err, throttle.ErrLimitReached) {
+			retryAfter := time.Duration(m.cfg.Throttle.RetryAfter) * time.Second
+			return nil, vErrors.NewTooManyRequestsError(retryAfter, "too many snapshot reads are running")
+		}
+		return nil, errors.Wrap(err, "acquiring stream")
+	}
+	return stream, nil
+}
+
+// GetThrottle returns the throttle limits in effect.
+func (m *Snapshot) GetThrottle() params.ThrottleResponse {
+	return m.applyThrottleLimits()
+}
+
+// SetThrottleOverride replaces the limits set in the config, until the override
+// expires or is removed. Overrides are not saved across restarts.
+func (m *Snapshot) SetThrottleOverride(param params.SetThrottleRequest) (params.ThrottleResponse, error) {
+	limits := config.ThrottleLimits{
+		MaxStreams:          param.Limits.MaxStreams,
+		MaxStreamsPerDisk:   param.Limits.MaxStreamsPerDisk,
+		MaxBandwidth:        param.Limits.MaxBandwidth,
+		MaxBandwidthPerDisk: param.Limits.MaxBandwidthPerDisk,
+	}
+	if err := limits.Validate(); err != nil {
+		return params.ThrottleResponse{}, vErrors.NewBadRequestError("%s", err)
+	}
+	if param.Duration < 0 {
+		return params.ThrottleResponse{}, vErrors.NewBadRequestError("duration must not be negative")
+	}
+
+	override := &throttleOverride{
+		limits: limits,
+	}
+	if param.Duration > 0 {
+		expiresAt := time.Now().UTC().Add(time.Duration(param.Duration) * time.Second)
+		override.expiresAt = &expiresAt
+	}
+
+	m.throttleMux.Lock()
+	m.throttleOverride = override
+	m.throttleMux.Unlock()
+	return m.applyThrottleLimits(), nil
+}
+
+// RemoveThrottleOverride goes back to the limits set in the config.
+func (m *Snapshot) RemoveThrottleOverride() params.ThrottleResponse {
+	m.throttleMux.Lock()
+	m.throttleOverride = nil
+	m.throttleMux.Unlock()
+	return m.applyThrottleLimits()
+}
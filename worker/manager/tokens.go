@@ -0,0 +1,207 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"coriolis-snapshot-agent/apiserver/auth"
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+	"coriolis-snapshot-agent/db"
+	vErrors "coriolis-snapshot-agent/errors"
+)
+
+// minSigningKeySize is the smallest signing key we accept, in bytes.
+const minSigningKeySize = 32
+
+// dummySecretHash is compared against the secret sent with unknown credential
+// names, so they take as long to reject as wrong secrets.
+var dummySecretHash = []byte("$2a$10$7BBpX1iGvBmVhobyB0WltexqATZCWd/y.uClxSI5aLeqK6p9IV9fe")
+
+// loadTokenSigningKey reads the key used to sign API tokens. If no key file is
+// configured, a random key is generated.
+func loadTokenSigningKey(cfg config.TokenAuth) ([]byte, error) {
+	if cfg.SigningKeyFile == "" {
+		key := make([]byte, minSigningKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrap(err, "generating token signing key")
+		}
+		return key, nil
+	}
+
+	key, err := ioutil.ReadFile(cfg.SigningKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading token signing key")
+	}
+	if len(key) < minSigningKeySize {
+		return nil, vErrors.NewValueError("token signing key must be at least %d bytes long", minSigningKeySize)
+	}
+	return key, nil
+}
+
+func (m *Snapshot) findCredential(name string) (config.Credential, bool) {
+	for _, credential := range m.cfg.APIServer.TokenAuth.Credentials {
+		if credential.Name == name {
+			return credential, true
+		}
+	}
+	return config.Credential{}, false
+}
+
+func internalAPITokenToParam(token db.APIToken) params.TokenResponse {
+	return params.TokenResponse{
+		ID:        token.TrackingID,
+		Name:      token.Name,
+		IssuedAt:  token.IssuedAt,
+		ExpiresAt: token.ExpiresAt,
+		Revoked:   token.Revoked,
+	}
+}
+
+// Login checks a credential, and issues a new API token.
+func (m *Snapshot) Login(param params.LoginRequest) (params.LoginResponse, error) {
+	tokenCfg := m.cfg.APIServer.TokenAuth
+	if !tokenCfg.Enabled() {
+		return params.LoginResponse{}, vErrors.NewNotFoundError("token authentication is not enabled")
+	}
+
+	credential, ok := m.findCredential(param.Name)
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummySecretHash, []byte(param.Secret))
+		return params.LoginResponse{}, vErrors.NewUnauthorizedError("invalid credentials")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(credential.SecretHash), []byte(param.Secret)); err != nil {
+		return params.LoginResponse{}, vErrors.NewUnauthorizedError("invalid credentials")
+	}
+
+	lifetime := tokenCfg.DefaultLifetime
+	if param.Lifetime != 0 {
+		if param.Lifetime < 0 || param.Lifetime > tokenCfg.MaxLifetime {
+			return params.LoginResponse{}, vErrors.NewBadRequestError("lifetime must be between 1 and %d seconds", tokenCfg.MaxLifetime)
+		}
+		lifetime = param.Lifetime
+	}
+
+	now := time.Now().UTC()
+	if err := m.db.DeleteExpiredAPITokens(now); err != nil {
+		return params.LoginResponse{}, errors.Wrap(err, "removing expired tokens")
+	}
+
+	token := db.APIToken{
+		TrackingID: uuid.New().String(),
+		Name:       credential.Name,
+		IssuedAt:   now,
+		ExpiresAt:  now.Add(time.Duration(lifetime) * time.Second),
+	}
+	signed, err := auth.SignToken(m.tokenKey, auth.TokenClaims{
+		ID:        token.TrackingID,
+		Name:      token.Name,
+		IssuedAt:  token.IssuedAt.Unix(),
+		ExpiresAt: token.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return params.LoginResponse{}, errors.Wrap(err, "signing token")
+	}
+	if _, err := m.db.CreateAPIToken(token); err != nil {
+		return params.LoginResponse{}, errors.Wrap(err, "recording token")
+	}
+
+	return params.LoginResponse{
+		Token:     signed,
+		TokenID:   token.TrackingID,
+		ExpiresAt: token.ExpiresAt,
+	}, nil
+}
+
+// ValidateToken checks that a token was signed by us, and that it has neither
+// expired nor been revoked. It returns the name and the role of the credential
+// used to get the token. Changes to the role of a credential apply to existing
+// tokens.
+func (m *Snapshot) ValidateToken(token string) (string, string, error) {
+	claims, err := auth.ParseToken(m.tokenKey, token, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+
+	dbToken, err := m.db.GetAPIToken(claims.ID)
+	if err != nil {
+		if errors.Is(err, vErrors.ErrNotFound) {
+			return "", "", vErrors.NewUnauthorizedError("unknown token")
+		}
+		return "", "", errors.Wrap(err, "fetching token")
+	}
+	if dbToken.Revoked {
+		return "", "", vErrors.NewUnauthorizedError("token has been revoked")
+	}
+
+	credential, ok := m.findCredential(dbToken.Name)
+	if !ok {
+		return "", "", vErrors.NewUnauthorizedError("credential %s no longer exists", dbToken.Name)
+	}
+	return credential.Name, credential.Role, nil
+}
+
+// TokenID returns the ID of a valid token.
+func (m *Snapshot) TokenID(token string) (string, error) {
+	claims, err := auth.ParseToken(m.tokenKey, token, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return claims.ID, nil
+}
+
+// ListTokens returns the tokens that have not yet expired.
+func (m *Snapshot) ListTokens() ([]params.TokenResponse, error) {
+	now := time.Now().UTC()
+	if err := m.db.DeleteExpiredAPITokens(now); err != nil {
+		return nil, errors.Wrap(err, "removing expired tokens")
+	}
+	tokens, err := m.db.ListAPITokens()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing tokens")
+	}
+
+	ret := make([]params.TokenResponse, len(tokens))
+	for idx, val := range tokens {
+		ret[idx] = internalAPITokenToParam(val)
+	}
+	return ret, nil
+}
+
+// RevokeToken revokes a token. Revoked tokens are kept until they expire.
+func (m *Snapshot) RevokeToken(tokenID string) (params.TokenResponse, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	token, err := m.db.GetAPIToken(tokenID)
+	if err != nil {
+		return params.TokenResponse{}, errors.Wrap(err, "fetching token")
+	}
+	if !token.Revoked {
+		token.Revoked = true
+		if err := m.db.UpdateAPIToken(token); err != nil {
+			return params.TokenResponse{}, errors.Wrap(err, "updating token")
+		}
+	}
+	return internalAPITokenToParam(token), nil
+}
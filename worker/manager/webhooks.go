@@ -0,0 +1,267 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+	"coriolis-snapshot-agent/db"
+	vErrors "coriolis-snapshot-agent/errors"
+	"coriolis-snapshot-agent/internal/logging"
+)
+
+const (
+	// webhookMaxBackoff is the longest we wait between two attempts to deliver
+	// an event to a webhook.
+	webhookMaxBackoff = 5 * time.Minute
+	// webhookIdleInterval is how often we look at the delivery queue of a
+	// webhook, when we are not woken up by new events.
+	webhookIdleInterval = 1 * time.Minute
+)
+
+// webhookSender delivers events to one webhook.
+type webhookSender struct {
+	cfg    config.Webhook
+	client *http.Client
+	// events holds the event types sent to this webhook. If nil, all
+	// events are sent.
+	events map[string]bool
+	// wake is signaled when new deliveries are queued.
+	wake chan struct{}
+}
+
+func newWebhookSender(cfg config.Webhook) (*webhookSender, error) {
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading TLS config")
+	}
+
+	var events map[string]bool
+	if len(cfg.Events) > 0 {
+		events = map[string]bool{}
+		for _, name := range cfg.Events {
+			found := false
+			for _, known := range EventTypes {
+				if string(known) == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, vErrors.NewValueError("unknown event type %s", name)
+			}
+			events[name] = true
+		}
+	}
+
+	return &webhookSender{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsCfg,
+			},
+		},
+		events: events,
+		wake:   make(chan struct{}, 1),
+	}, nil
+}
+
+func (s *webhookSender) wants(eventType string) bool {
+	return s.events == nil || s.events[eventType]
+}
+
+func (s *webhookSender) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send posts a single event to the webhook. Any response other than 2xx is an error.
+func (s *webhookSender) send(delivery db.WebhookDelivery) error {
+	req, err := http.NewRequest("POST", s.cfg.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", delivery.EventType)
+	req.Header.Set("X-Event-ID", FormatEventID(delivery.EventEpoch, delivery.EventID))
+	req.Header.Set("X-Delivery-ID", delivery.TrackingID)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending request")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookBackoff returns the time to wait before the next delivery attempt.
+func webhookBackoff(attempts int) time.Duration {
+	if attempts > 16 {
+		return webhookMaxBackoff
+	}
+	backoff := time.Duration(1<<uint(attempts-1)) * time.Second
+	if backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+// startWebhooks starts a sender for every configured webhook. Deliveries left in the
+// queue by a previous run are sent first.
+func (m *Snapshot) startWebhooks() error {
+	if len(m.cfg.Webhooks) == 0 {
+		return nil
+	}
+
+	var senders []*webhookSender
+	for _, webhookCfg := range m.cfg.Webhooks {
+		sender, err := newWebhookSender(webhookCfg)
+		if err != nil {
+			return errors.Wrapf(err, "setting up webhook %s", webhookCfg.Name)
+		}
+		senders = append(senders, sender)
+	}
+
+	m.notifyMux.Lock()
+	m.webhookSenders = senders
+	m.notifyMux.Unlock()
+
+	for _, sender := range senders {
+		sender := sender
+		m.goWorker(fmt.Sprintf("webhook sender %s", sender.cfg.Name), func() { m.runWebhookSender(sender) })
+	}
+	return nil
+}
+
+// queueWebhookEventLocked saves an event in the delivery queue of the webhooks that
+// want it. It is called by sendEvent for every event, before the event is sent to
+// any subscriber, so no event is lost once it is sent. The caller must hold notifyMux.
+func (m *Snapshot) queueWebhookEventLocked(evt params.Event) {
+	if len(m.webhookSenders) == 0 {
+		return
+	}
+
+	logger := logging.FromContext(m.ctx)
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		logger.Errorf("failed to marshal event %d: %q", evt.ID, err)
+		return
+	}
+	for _, sender := range m.webhookSenders {
+		if !sender.wants(evt.Type) {
+			continue
+		}
+		now := time.Now().UTC()
+		delivery := db.WebhookDelivery{
+			TrackingID:  uuid.New().String(),
+			Webhook:     sender.cfg.Name,
+			EventID:     evt.ID,
+			EventEpoch:  evt.Epoch,
+			EventType:   evt.Type,
+			Payload:     payload,
+			CreatedAt:   now,
+			NextAttempt: now,
+		}
+		if _, err := m.webhookQueue.CreateWebhookDelivery(delivery); err != nil {
+			logger.Errorf("failed to queue event %d for webhook %s: %+v", evt.ID, sender.cfg.Name, err)
+			continue
+		}
+		sender.notify()
+	}
+}
+
+func (m *Snapshot) runWebhookSender(sender *webhookSender) {
+	for {
+		timer := time.NewTimer(m.deliverWebhookEvents(sender))
+		select {
+		case <-sender.wake:
+		case <-timer.C:
+		case <-m.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// deliverWebhookEvents sends queued events to a webhook, in the order they were
+// queued. If a delivery fails, the ones after it wait until it succeeds, or until
+// it runs out of retries. It returns the time to wait before trying again.
+func (m *Snapshot) deliverWebhookEvents(sender *webhookSender) time.Duration {
+	logger := logging.FromContext(m.ctx).With("webhook", sender.cfg.Name)
+
+	deliveries, err := m.webhookQueue.ListWebhookDeliveries(sender.cfg.Name)
+	if err != nil {
+		logger.Errorf("failed to list webhook deliveries: %+v", err)
+		return webhookIdleInterval
+	}
+
+	for _, delivery := range deliveries {
+		if m.ctx.Err() != nil {
+			return webhookIdleInterval
+		}
+
+		now := time.Now().UTC()
+		if delivery.NextAttempt.After(now) {
+			return delivery.NextAttempt.Sub(now)
+		}
+
+		if err := sender.send(delivery); err != nil {
+			delivery.Attempts++
+			delivery.LastError = err.Error()
+			if delivery.Attempts > sender.cfg.MaxRetries {
+				logger.Errorf("giving up on sending event %d after %d attempts: %s", delivery.EventID, delivery.Attempts, delivery.LastError)
+				if err := m.webhookQueue.DeleteWebhookDelivery(delivery.TrackingID); err != nil {
+					logger.Errorf("failed to remove webhook delivery %s: %+v", delivery.TrackingID, err)
+				}
+				continue
+			}
+
+			backoff := webhookBackoff(delivery.Attempts)
+			logger.Warnf("failed to send event %d (attempt %d), retrying in %s: %s", delivery.EventID, delivery.Attempts, backoff, delivery.LastError)
+			delivery.NextAttempt = now.Add(backoff)
+			if err := m.webhookQueue.UpdateWebhookDelivery(delivery); err != nil {
+				logger.Errorf("failed to update webhook delivery %s: %+v", delivery.TrackingID, err)
+			}
+			return backoff
+		}
+
+		if err := m.webhookQueue.DeleteWebhookDelivery(delivery.TrackingID); err != nil {
+			logger.Errorf("failed to remove webhook delivery %s: %+v", delivery.TrackingID, err)
+		}
+	}
+	return webhookIdleInterval
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/config"
+	"coriolis-snapshot-agent/db"
+)
+
+// webhookServer is a TLS webhook endpoint that fails the first failures requests
+// it gets.
+type webhookServer struct {
+	*httptest.Server
+
+	mux      sync.Mutex
+	failures int
+	attempts int
+	received []params.Event
+	ids      []string
+}
+
+func newWebhookServer(t *testing.T, failures int) *webhookServer {
+	srv := &webhookServer{failures: failures}
+	srv.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mux.Lock()
+		defer srv.mux.Unlock()
+
+		srv.attempts++
+		if srv.attempts <= srv.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var evt params.Event
+		if err := json.NewDecoder(r.Body).Decode(&evt); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		srv.received = append(srv.received, evt)
+		srv.ids = append(srv.ids, r.Header.Get("X-Delivery-ID"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (s *webhookServer) stats() (int, []params.Event, []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.attempts, s.received, s.ids
+}
+
+// newWebhookManager returns a manager that only has what is needed to queue and
+// deliver webhook events, along with the sender of the webhook.
+func newWebhookManager(t *testing.T, queueFile string, srv *webhookServer, maxRetries int) (*Snapshot, *webhookSender) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := newWebhookSender(config.Webhook{
+		Name:       "test",
+		URL:        srv.URL,
+		CACert:     caFile,
+		MaxRetries: maxRetries,
+		Timeout:    5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := db.NewDatabase(queueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &Snapshot{
+		ctx:            ctx,
+		cancel:         cancel,
+		notifyChannels: map[NotificationType][]chan interface{}{},
+		webhookSenders: []*webhookSender{sender},
+		webhookQueue:   queue,
+	}, sender
+}
+
+func queuedDeliveries(t *testing.T, m *Snapshot) []db.WebhookDelivery {
+	deliveries, err := m.webhookQueue.ListWebhookDeliveries("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+// retryNow makes the first queued delivery due.
+func retryNow(t *testing.T, m *Snapshot) {
+	delivery := queuedDeliveries(t, m)[0]
+	delivery.NextAttempt = time.Now().UTC().Add(-time.Second)
+	if err := m.webhookQueue.UpdateWebhookDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	expected := map[int]time.Duration{
+		1:  1 * time.Second,
+		2:  2 * time.Second,
+		5:  16 * time.Second,
+		9:  256 * time.Second,
+		10: webhookMaxBackoff,
+		64: webhookMaxBackoff,
+	}
+	for attempts, backoff := range expected {
+		if got := webhookBackoff(attempts); got != backoff {
+			t.Errorf("attempt %d: expected a backoff of %s, got %s", attempts, backoff, got)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	srv := newWebhookServer(t, 2)
+	m, sender := newWebhookManager(t, filepath.Join(t.TempDir(), "queue.db"), srv, 10)
+
+	// Events are queued as soon as they are sent, even if nobody reads
+	// the notification channels.
+	m.sendEvent(SnapshotCreatedEvent, params.SnapshotEvent{SnapshotID: "1"})
+	m.sendEvent(SnapshotDeletedEvent, params.SnapshotEvent{SnapshotID: "1"})
+	if deliveries := queuedDeliveries(t, m); len(deliveries) != 2 {
+		t.Fatalf("expected 2 queued deliveries, got %d", len(deliveries))
+	}
+
+	if wait := m.deliverWebhookEvents(sender); wait != time.Second {
+		t.Fatalf("expected to retry in 1s after the first failure, got %s", wait)
+	}
+	first := queuedDeliveries(t, m)[0]
+	if first.Attempts != 1 || first.LastError == "" || first.EventID != 1 {
+		t.Fatalf("unexpected delivery state after the first failure: %+v", first)
+	}
+
+	// Nothing is sent before the next attempt is due.
+	if wait := m.deliverWebhookEvents(sender); wait <= 0 || wait > time.Second {
+		t.Fatalf("expected to wait at most 1s for the next attempt, got %s", wait)
+	}
+	if attempts, _, _ := srv.stats(); attempts != 1 {
+		t.Fatalf("expected 1 request before the retry is due, got %d", attempts)
+	}
+
+	retryNow(t, m)
+	if wait := m.deliverWebhookEvents(sender); wait != 2*time.Second {
+		t.Fatalf("expected to retry in 2s after the second failure, got %s", wait)
+	}
+
+	retryNow(t, m)
+	if wait := m.deliverWebhookEvents(sender); wait != webhookIdleInterval {
+		t.Fatalf("expected the queue to be empty, got a retry in %s", wait)
+	}
+	if deliveries := queuedDeliveries(t, m); len(deliveries) != 0 {
+		t.Fatalf("expected an empty queue, got %d deliveries", len(deliveries))
+	}
+
+	// Events are delivered in order, and a failing delivery holds back
+	// the ones after it.
+	attempts, received, ids := srv.stats()
+	if attempts != 4 || len(received) != 2 {
+		t.Fatalf("expected 4 requests and 2 deliveries, got %d and %d", attempts, len(received))
+	}
+	if received[0].Type != string(SnapshotCreatedEvent) || received[1].Type != string(SnapshotDeletedEvent) {
+		t.Fatalf("events were delivered out of order: %+v", received)
+	}
+	if ids[0] != first.TrackingID {
+		t.Fatalf("expected retries to keep delivery ID %s, got %s", first.TrackingID, ids[0])
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	srv := newWebhookServer(t, 100)
+	m, sender := newWebhookManager(t, filepath.Join(t.TempDir(), "queue.db"), srv, 1)
+
+	m.sendEvent(SnapshotCreatedEvent, params.SnapshotEvent{SnapshotID: "1"})
+	m.deliverWebhookEvents(sender)
+	retryNow(t, m)
+	if wait := m.deliverWebhookEvents(sender); wait != webhookIdleInterval {
+		t.Fatalf("expected the delivery to be dropped, got a retry in %s", wait)
+	}
+	if deliveries := queuedDeliveries(t, m); len(deliveries) != 0 {
+		t.Fatalf("expected an empty queue, got %d deliveries", len(deliveries))
+	}
+	if attempts, _, _ := srv.stats(); attempts != 2 {
+		t.Fatalf("expected 2 requests, got %d", attempts)
+	}
+}
+
+func TestWebhookRedeliveryAfterRestart(t *testing.T) {
+	queueFile := filepath.Join(t.TempDir(), "queue.db")
+	srv := newWebhookServer(t, 1)
+
+	m, sender := newWebhookManager(t, queueFile, srv, 10)
+	m.sendEvent(SnapStoreOverflowEvent, params.SnapStoreOverflowEvent{SnapStoreID: "store"})
+	m.deliverWebhookEvents(sender)
+	queued := queuedDeliveries(t, m)
+	if len(queued) != 1 {
+		t.Fatalf("expected 1 queued delivery, got %d", len(queued))
+	}
+	m.cancel()
+	if err := m.webhookQueue.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new manager picks up the delivery from the queue file.
+	m, sender = newWebhookManager(t, queueFile, srv, 10)
+	retryNow(t, m)
+	if wait := m.deliverWebhookEvents(sender); wait != webhookIdleInterval {
+		t.Fatalf("expected the queue to be empty, got a retry in %s", wait)
+	}
+	_, received, ids := srv.stats()
+	if len(received) != 1 || received[0].Type != string(SnapStoreOverflowEvent) {
+		t.Fatalf("expected the overflow event to be delivered, got %+v", received)
+	}
+	if ids[0] != queued[0].TrackingID {
+		t.Fatalf("expected delivery %s, got %s", queued[0].TrackingID, ids[0])
+	}
+}
@@ -16,39 +16,218 @@
 package manager
 
 import (
-	"log"
-	"time"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
 
+	"coriolis-snapshot-agent/apiserver/params"
 	"coriolis-snapshot-agent/db"
+	"coriolis-snapshot-agent/internal/logging"
+	"coriolis-snapshot-agent/internal/metrics"
+	"coriolis-snapshot-agent/internal/storage"
 	"coriolis-snapshot-agent/worker/common"
 
 	"github.com/pkg/errors"
 )
 
 func (m *Snapshot) Start() error {
-	go m.handleWatcherMessages()
+	if err := m.startWebhooks(); err != nil {
+		return errors.Wrap(err, "starting webhooks")
+	}
+	m.goWorker("watcher message handler", m.handleWatcherMessages)
+	m.goWorker("throttle scheduler", m.runThrottleScheduler)
+	if m.udevMonitor != nil {
+		udevEvents := make(chan storage.UdevEvent, 50)
+		m.udevMonitor.RegisterEventChannel(udevEvents)
+		m.goWorker("udev event handler", func() { m.handleUdevEvents(udevEvents) })
+	}
+	return nil
+}
+
+// goWorker runs fn in a new goroutine. The goroutine is tracked by name until fn
+// returns, so Wait can tell which workers did not stop. Names must be unique. The
+// returned channel is closed when fn returns.
+func (m *Snapshot) goWorker(name string, fn func()) <-chan struct{} {
+	done := make(chan struct{})
+	m.workerMux.Lock()
+	m.workers[name] = done
+	m.workerMux.Unlock()
+
+	go func() {
+		defer func() {
+			m.workerMux.Lock()
+			delete(m.workers, name)
+			m.workerMux.Unlock()
+			close(done)
+		}()
+		fn()
+	}()
+	return done
+}
+
+// BeginShutdown ends the API requests that would otherwise never end, like event
+// streams. It is called when the API server starts shutting down. Snapshot reads
+// are left alone, so they can finish.
+func (m *Snapshot) BeginShutdown() {
+	m.shutdownOnce.Do(func() {
+		close(m.shuttingDown)
+	})
+}
+
+// ShuttingDown returns a channel that is closed when shutdown begins.
+func (m *Snapshot) ShuttingDown() <-chan struct{} {
+	return m.shuttingDown
+}
+
+// Stop stops the background workers, and cancels the running operations, which
+// undo the work they have done so far. Operations may need the snap store watchers
+// while they undo their work, so Stop waits for them to finish, or for ctx to
+// expire, before it stops the watchers and closes their character devices. Stop
+// does not wait for the watchers or the other workers. Use Wait.
+func (m *Snapshot) Stop(ctx context.Context) error {
+	m.BeginShutdown()
+	m.cancel()
+
+	logger := logging.FromContext(ctx)
+	opErr := m.waitOperations(ctx)
+	if opErr != nil {
+		logger.Warnf("stopping snap store watchers while operations are running: %+v", opErr)
+	}
+
+	m.regMux.Lock()
+	defer m.regMux.Unlock()
+
+	var failed []string
+	for id, watcher := range m.snapStoreCharacterDeviceWatchers {
+		if err := watcher.Stop(); err != nil {
+			failed = append(failed, id)
+			logger.Errorf("failed to stop watcher for snap store %s: %+v", id, err)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return errors.Errorf("failed to stop watchers for snap stores: %s", strings.Join(failed, ", "))
+	}
+	return opErr
+}
+
+// waitOperations waits for the running operations to finish. If ctx expires first,
+// the error lists the ones that are still running.
+func (m *Snapshot) waitOperations(ctx context.Context) error {
+	running := func() map[string]<-chan struct{} {
+		m.opMux.Lock()
+		defer m.opMux.Unlock()
+
+		ret := map[string]<-chan struct{}{}
+		for id, op := range m.operations {
+			select {
+			case <-op.stopped:
+			default:
+				ret[id] = op.stopped
+			}
+		}
+		return ret
+	}
+
+	for _, stopped := range running() {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+		}
+	}
+
+	var ids []string
+	for id := range running() {
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		sort.Strings(ids)
+		return errors.Errorf("timed out waiting for operations %s to finish", strings.Join(ids, ", "))
+	}
 	return nil
 }
 
-func (m *Snapshot) Stop() error {
-	close(m.msgChan)
+// running returns the workers, operations, snap store watchers and snapshot reads
+// that have not stopped yet, by name.
+func (m *Snapshot) running() map[string]<-chan struct{} {
+	ret := map[string]<-chan struct{}{}
+
+	m.workerMux.Lock()
+	for name, done := range m.workers {
+		ret[name] = done
+	}
+	m.workerMux.Unlock()
+
+	m.regMux.Lock()
+	for id, watcher := range m.snapStoreCharacterDeviceWatchers {
+		select {
+		case <-watcher.Done():
+		default:
+			ret[fmt.Sprintf("watcher for snap store %s", id)] = watcher.Done()
+		}
+	}
+	m.regMux.Unlock()
+
+	// API requests that were cut off when the API server shut down may still
+	// be reading snapshot images.
+	m.readMux.Lock()
+	for id, reads := range m.reads {
+		if reads.readers > 0 {
+			ret[fmt.Sprintf("reads of snapshot %s", id)] = reads.idle
+		}
+	}
+	m.readMux.Unlock()
+	return ret
+}
+
+// Wait waits for the background workers, the operations, the snap store watchers
+// and the snapshot reads to stop, after a call to Stop. If ctx expires first, the
+// error lists the ones that are still running.
+func (m *Snapshot) Wait(ctx context.Context) error {
+	for _, done := range m.running() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+
+	var names []string
+	for name := range m.running() {
+		names = append(names, name)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return errors.Errorf("timed out waiting for %s to stop", strings.Join(names, ", "))
+	}
+	logging.FromContext(ctx).Infof("all workers, snap store watchers and snapshot reads have stopped")
 	return nil
 }
 
-func (m *Snapshot) Wait() error {
-	select {
-	case <-m.watcherMessagesQuit:
-		log.Printf("snapstore watcher has stopped")
-		return nil
-	case <-time.After(20 * time.Second):
-		return errors.Errorf("timed out waiting for worker to stop")
+// Close closes the audit log, the webhook queue and the database. It is called
+// last, after Wait.
+func (m *Snapshot) Close() error {
+	auditErr := m.audit.Close()
+	var queueErr error
+	if m.webhookQueue != nil {
+		queueErr = m.webhookQueue.Close()
+	}
+	if err := m.db.Close(); err != nil {
+		return err
 	}
+	if queueErr != nil {
+		return errors.Wrap(queueErr, "closing webhook queue")
+	}
+	if auditErr != nil {
+		return errors.Wrap(auditErr, "closing audit log")
+	}
+	return nil
 }
 
 // In case of any error, we only log. Should we treat errors as critical
 // and send it up to the main function where we exit?
 func (m *Snapshot) handleWatcherMessages() {
-	defer close(m.watcherMessagesQuit)
+	logger := logging.FromContext(m.ctx)
 	for {
 		select {
 		case msg, ok := <-m.msgChan:
@@ -57,44 +236,88 @@ func (m *Snapshot) handleWatcherMessages() {
 				return
 			}
 			switch val := msg.(type) {
-			case common.SnapStoreAddFileMessage:
-				log.Printf("a new file was added to snap store %s (fill status: %d)", val.SnapStoreID.String(), val.FillStatus)
-				if err := m.RecordSnapStoreFileInDB(val.SnapStoreID.String(), val.FilePath, val.FileSize); err != nil {
-					log.Printf("failed to add snap store %s file to DB: %+v", val.FilePath, err)
+			case common.SnapStoreHalfFillMessage:
+				logger.Infof("snap store %s is half full (fill status: %d)", val.SnapStoreID.String(), val.FillStatus)
+				metrics.SnapStoreHalfFill.WithLabelValues(val.SnapStoreID.String()).Inc()
+				if err := m.growSnapStore(val.SnapStoreID.String(), val.FillStatus); err != nil {
+					logger.Errorf("failed to add a file to snap store %s: %+v", val.SnapStoreID.String(), err)
+					m.sendEvent(WatcherErrorEvent, params.WatcherErrorEvent{
+						SnapStoreID: val.SnapStoreID.String(),
+						Error:       err.Error(),
+					})
 				}
 			case common.SnapStoreDeletedMessage:
 				files, err := m.db.ListSnapStoreFilesForSnapStore(val.SnapStoreID.String())
 				if err != nil {
-					log.Printf("failed to fetch snap store file list from db")
+					logger.Errorf("failed to fetch snap store file list from db: %+v", err)
 				} else {
 					for _, file := range files {
 						if err := m.db.DeleteSnapStoreFile(file.TrackingID); err != nil {
-							log.Printf("failed to delete snap store file %s from db: %+v", file.TrackingID, err)
+							logger.Errorf("failed to delete snap store file %s from db: %+v", file.TrackingID, err)
 						}
 					}
 				}
 				if err := m.db.DeleteSnapStore(val.SnapStoreID.String()); err != nil {
-					log.Printf("failed to delete snapstore %s from db %+v", val.SnapStoreID.String(), err)
+					logger.Errorf("failed to delete snapstore %s from db %+v", val.SnapStoreID.String(), err)
 				}
 			case common.SnapStoreOverflowMessage:
+				metrics.SnapStoreOverflow.WithLabelValues(val.SnapStoreID.String()).Inc()
 				// The snapshots are now, most likely, invalid. Mark them as invalid in the DB, and delete
 				// them from the system.
 				volumeSnapshots, err := m.db.ListVolumeSnapshotsBySnapstoreID(val.SnapStoreID.String())
 				if err != nil {
-					log.Printf("failed to fetch volume snapshots by snap store ID")
+					logger.Errorf("failed to fetch volume snapshots by snap store ID: %+v", err)
 					continue
 				}
+				overflowEvent := params.SnapStoreOverflowEvent{
+					SnapStoreID: val.SnapStoreID.String(),
+					SnapshotIDs: []string{},
+				}
+				if val.Error != nil {
+					overflowEvent.Error = val.Error.Error()
+				}
 				for _, val := range volumeSnapshots {
 					val.Status = db.VolumeStatusOverflow
 					if err := m.db.UpdateVolumeSnapshot(val); err != nil {
-						log.Printf("failed to update volume snapshot %s in DB", val.TrackingID)
+						logger.Errorf("failed to update volume snapshot %s in DB: %+v", val.TrackingID, err)
 					}
+					overflowEvent.SnapshotIDs = append(overflowEvent.SnapshotIDs, val.SnapshotID)
 				}
+				m.sendEvent(SnapStoreOverflowEvent, overflowEvent)
 			case common.ErrorMessage:
 				// TODO: Do something more meaningful here.
-				log.Printf("watcher for snapstore %s encountered an error %+v", val.SnapstoreID.String(), val.Error)
+				logger.Errorf("watcher for snapstore %s encountered an error %+v", val.SnapstoreID.String(), val.Error)
+				errorEvent := params.WatcherErrorEvent{
+					SnapStoreID: val.SnapstoreID.String(),
+				}
+				if val.Error != nil {
+					errorEvent.Error = val.Error.Error()
+				}
+				m.sendEvent(WatcherErrorEvent, errorEvent)
 			default:
-				log.Printf("got invalid message type: %T", val)
+				logger.Warnf("got invalid message type: %T", val)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// handleUdevEvents turns block device add and remove events into disk hotplug events.
+func (m *Snapshot) handleUdevEvents(events chan storage.UdevEvent) {
+	for {
+		select {
+		case evt := <-events:
+			diskEvent := params.DiskEvent{
+				DevicePath: evt.DeviceNode,
+				Major:      uint32(evt.Major),
+				Minor:      uint32(evt.Minor),
+			}
+			switch evt.Action {
+			case storage.UdevActionAdd:
+				m.sendEvent(DiskAddedEvent, diskEvent)
+			case storage.UdevActionRemove:
+				m.sendEvent(DiskRemovedEvent, diskEvent)
 			}
 		case <-m.ctx.Done():
 			return
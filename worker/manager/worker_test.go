@@ -0,0 +1,115 @@
+// Copyright 2019 Cloudbase Solutions Srl
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-snapshot-agent/apiserver/params"
+	"coriolis-snapshot-agent/worker/snapstore"
+)
+
+func newStoppableManager(t *testing.T) *Snapshot {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &Snapshot{
+		ctx:                              ctx,
+		cancel:                           cancel,
+		workers:                          map[string]chan struct{}{},
+		shuttingDown:                     make(chan struct{}),
+		operations:                       map[string]*operation{},
+		reads:                            map[string]*snapshotReads{},
+		snapStoreCharacterDeviceWatchers: map[string]*snapstore.CharacterDeviceWatcher{},
+	}
+}
+
+func TestStopWaitsForOperations(t *testing.T) {
+	m := newStoppableManager(t)
+
+	cleanedUp := make(chan struct{})
+	m.startOperation(context.Background(), params.OperationTypeCreateSnapshot, "", func(ctx context.Context, op *operation) (interface{}, error) {
+		<-ctx.Done()
+		// Undoing the work of an operation takes a while.
+		time.Sleep(50 * time.Millisecond)
+		close(cleanedUp)
+		return nil, checkCancelled(ctx)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop manager: %+v", err)
+	}
+	select {
+	case <-cleanedUp:
+	default:
+		t.Fatalf("Stop returned before the operation finished")
+	}
+	ops := m.ListOperations()
+	if len(ops) != 1 || ops[0].Status != params.OperationStatusCancelled {
+		t.Fatalf("expected a cancelled operation, got %+v", ops)
+	}
+}
+
+func TestStopTimesOut(t *testing.T) {
+	m := newStoppableManager(t)
+
+	release := make(chan struct{})
+	defer close(release)
+	m.startOperation(context.Background(), params.OperationTypeCreateSnapshot, "", func(ctx context.Context, op *operation) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := m.Stop(ctx)
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for operations") {
+		t.Fatalf("expected Stop to time out, got %v", err)
+	}
+	if err := m.Wait(ctx); err == nil || !strings.Contains(err.Error(), "operation ") {
+		t.Fatalf("expected Wait to report the operation, got %v", err)
+	}
+}
+
+func TestWaitForSnapshotReads(t *testing.T) {
+	m := newStoppableManager(t)
+
+	// Reads are normally acquired with AcquireSnapshotRead, which looks up
+	// the snapshot in the database.
+	m.reads["snap"] = &snapshotReads{readers: 1, idle: make(chan struct{})}
+	release := func() { m.releaseSnapshotRead("snap") }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop manager: %+v", err)
+	}
+
+	short, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	if err := m.Wait(short); err == nil || !strings.Contains(err.Error(), "reads of snapshot snap") {
+		t.Fatalf("expected Wait to report the snapshot read, got %v", err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, release)
+	if err := m.Wait(ctx); err != nil {
+		t.Fatalf("failed to wait for snapshot reads: %+v", err)
+	}
+}
@@ -18,22 +18,26 @@ package snapstore
 import (
 	"encoding/binary"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
 	vErrors "coriolis-snapshot-agent/errors"
 	"coriolis-snapshot-agent/internal/ioctl"
+	"coriolis-snapshot-agent/internal/logging"
 	"coriolis-snapshot-agent/internal/storage"
 	"coriolis-snapshot-agent/internal/types"
 	"coriolis-snapshot-agent/internal/util"
 	"coriolis-snapshot-agent/worker/common"
 )
 
-func NewSnapStoreCharacterDeviceWatcher(param common.CreateSnapStoreParams, watcherChan chan interface{}) (*CharacterDeviceWatcher, error) {
+// NewSnapStoreCharacterDeviceWatcher creates a snap store through the veeamsnap character
+// device, and starts watching it. Messages for the manager are sent on watcherChan. The
+// watcher outlives the request that created it, so it logs using logger.
+func NewSnapStoreCharacterDeviceWatcher(param common.CreateSnapStoreParams, watcherChan chan interface{}, logger *logging.Logger) (*CharacterDeviceWatcher, error) {
 	charDev, err := os.OpenFile(ioctl.VEEAM_DEV, os.O_RDWR, 0600)
 	if err != nil {
 		return nil, errors.Wrapf(err, "opening char device %s", ioctl.VEEAM_DEV)
@@ -46,8 +50,11 @@ func NewSnapStoreCharacterDeviceWatcher(param common.CreateSnapStoreParams, watc
 		snapDeviceID:         param.SnapDeviceID,
 		basedir:              param.BaseDir,
 		charDevice:           charDev,
+		allocationEnabled:    param.AllocationEnabled,
 		messageChan:          watcherChan,
 		charDeviceReaderQuit: make(chan struct{}),
+		stop:                 make(chan struct{}),
+		logger:               logger.With("snap_store_id", asUUID.String()),
 	}
 
 	if err := watcher.Start(); err != nil {
@@ -71,8 +78,19 @@ type CharacterDeviceWatcher struct {
 	// to this snap store.
 	allocatedSpace int64
 
+	// allocationEnabled mirrors the Enabled flag of the snap store
+	// location. When false, no new disk space is added to the snap store.
+	allocationEnabled bool
+	mux               sync.Mutex
+
 	charDeviceReaderQuit chan struct{}
 	messageChan          chan interface{}
+
+	// stop is closed by Stop.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	logger *logging.Logger
 }
 
 func (w *CharacterDeviceWatcher) Start() error {
@@ -84,17 +102,63 @@ func (w *CharacterDeviceWatcher) Start() error {
 	return nil
 }
 
+// Alive returns true while the watcher is reading messages from the snap store
+// character device.
+func (w *CharacterDeviceWatcher) Alive() bool {
+	if w.charDevice == nil {
+		return false
+	}
+	select {
+	case <-w.charDeviceReaderQuit:
+		return false
+	default:
+		return true
+	}
+}
+
+// Stop closes the character device. The reader exits once the read it is
+// blocked in returns. Messages the watcher has not yet passed on to the
+// manager are dropped.
+func (w *CharacterDeviceWatcher) Stop() error {
+	var err error
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		if w.charDevice == nil {
+			return
+		}
+		if closeErr := w.charDevice.Close(); closeErr != nil && !errors.Is(closeErr, os.ErrClosed) {
+			err = errors.Wrapf(closeErr, "closing char device of snap store %s", w.ID.String())
+		}
+	})
+	return err
+}
+
+// Done returns a channel that is closed when the watcher stops reading from
+// the character device.
+func (w *CharacterDeviceWatcher) Done() <-chan struct{} {
+	return w.charDeviceReaderQuit
+}
+
+// sendMessage passes msg to the manager. It gives up if the watcher is stopped,
+// as the manager may no longer read messages.
+func (w *CharacterDeviceWatcher) sendMessage(msg interface{}) {
+	select {
+	case w.messageChan <- msg:
+	case <-w.stop:
+	}
+}
+
 func (w *CharacterDeviceWatcher) removeSnapStoreFiles() error {
-	log.Printf("removing basedir: %s", w.basedir)
+	w.logger.Infof("removing basedir: %s", w.basedir)
 	if err := os.RemoveAll(w.basedir); err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
 			return errors.Wrap(err, "removing files")
 		}
 	}
 
-	w.messageChan <- common.SnapStoreDeletedMessage{
+	w.sendMessage(common.SnapStoreDeletedMessage{
 		SnapStoreID: w.ID,
-	}
+	})
 	return nil
 }
 
@@ -107,7 +171,7 @@ func (w *CharacterDeviceWatcher) GetTrackedDeviceSize() (uint64, error) {
 }
 
 func (w *CharacterDeviceWatcher) create() error {
-	log.Printf("empty limit for device %d:%d is %d bytes", w.devID.Major, w.devID.Minor, w.snapStoreFileSize)
+	w.logger.Infof("empty limit for device %d:%d is %d bytes", w.devID.Major, w.devID.Minor, w.snapStoreFileSize)
 	snapStoreParams := SnapStoreStretchInitiateParams{
 		ID:                [16]byte(w.ID),
 		EmptyLimit:        w.snapStoreFileSize,
@@ -131,18 +195,45 @@ func (w *CharacterDeviceWatcher) create() error {
 	return nil
 }
 
-func (w *CharacterDeviceWatcher) AllocateInitialStorage() (string, uint64, error) {
+// InitialStorageSize returns the size of the first file of the snap store, which is
+// 20% of the size of the tracked device.
+func (w *CharacterDeviceWatcher) InitialStorageSize() (uint64, error) {
 	deviceSize, err := w.GetTrackedDeviceSize()
 	if err != nil {
-		return "", 0, errors.Wrap(err, "fetching device size")
+		return 0, errors.Wrap(err, "fetching device size")
 	}
+	return uint64(float64(deviceSize) * 0.2), nil
+}
+
+// SnapStoreFileSize returns the size of the files added to the snap store when it
+// is half full.
+func (w *CharacterDeviceWatcher) SnapStoreFileSize() uint64 {
+	return w.snapStoreFileSize
+}
+
+// SetAllocationEnabled enables or disables the allocation of new disk space
+// for this snap store.
+func (w *CharacterDeviceWatcher) SetAllocationEnabled(enabled bool) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
 
-	// allocate 20% of device size.
-	toAllocate := uint64(float64(deviceSize) * 0.2)
-	return w.AllocateStorage(toAllocate)
+	w.allocationEnabled = enabled
 }
 
-func (w *CharacterDeviceWatcher) AllocateStorage(size uint64) (string, uint64, error) {
+func (w *CharacterDeviceWatcher) isAllocationEnabled() bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return w.allocationEnabled
+}
+
+// CreateStorageFile creates a new snap store file of the given size, on the device
+// of the snap store, without adding it to the snap store. Use AddStorageFile to hand
+// it to the kernel. This allows callers to record the file first.
+func (w *CharacterDeviceWatcher) CreateStorageFile(size uint64) (string, uint64, error) {
+	if !w.isAllocationEnabled() {
+		return "", 0, vErrors.NewConflictError("allocation is disabled for the location of snap store %s", w.ID.String())
+	}
 
 	if _, err := os.Stat(w.basedir); err != nil {
 		if !errors.Is(err, fs.ErrExist) {
@@ -169,15 +260,43 @@ func (w *CharacterDeviceWatcher) AllocateStorage(size uint64) (string, uint64, e
 		return "", 0, errors.Errorf("failed to create %s: %+v", filePath, err)
 	}
 
-	ranges, devID, err := util.GetFileRanges(filePath)
+	info, err := os.Stat(filePath)
+	if err == nil {
+		_, err = w.storageFileRanges(filePath)
+	}
 	if err != nil {
-		if err != nil {
-			return "", 0, errors.Wrap(err, "fetching file ranges")
+		if rmErr := os.Remove(filePath); rmErr != nil {
+			w.logger.Errorf("failed to remove %s: %+v", filePath, rmErr)
 		}
+		return "", 0, errors.Wrapf(err, "checking %s", filePath)
+	}
+	return filePath, uint64(info.Size()), nil
+}
+
+// storageFileRanges returns the ranges of the snap store device that hold a snap
+// store file. The file must live on the snap store device.
+func (w *CharacterDeviceWatcher) storageFileRanges(filePath string) ([]types.Range, error) {
+	ranges, devID, err := util.GetFileRanges(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching file ranges")
 	}
 
 	if devID != w.snapDeviceID {
-		return "", 0, vErrors.NewInvalidDeviceErr("snap device %d:%d differs from snap file location device %d:%d", w.snapDeviceID.Major, w.snapDeviceID.Minor, devID.Major, devID.Minor)
+		return nil, vErrors.NewInvalidDeviceErr("snap device %d:%d differs from snap file location device %d:%d", w.snapDeviceID.Major, w.snapDeviceID.Minor, devID.Major, devID.Minor)
+	}
+	return ranges, nil
+}
+
+// AddStorageFile hands a file created by CreateStorageFile to the kernel, which uses
+// it to grow the snap store. Once added, the file must not be removed while the snap
+// store exists.
+func (w *CharacterDeviceWatcher) AddStorageFile(filePath string) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	ranges, err := w.storageFileRanges(filePath)
+	if err != nil {
+		return err
 	}
 
 	params := NextPortionParams{
@@ -186,23 +305,23 @@ func (w *CharacterDeviceWatcher) AllocateStorage(size uint64) (string, uint64, e
 		Ranges: ranges,
 	}
 
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return errors.Wrap(err, "fetching file info")
+	}
+
 	msgBytes := params.Serialize()
 	wr, err := w.charDevice.Write(msgBytes)
 	if err != nil {
-		return "", 0, errors.Wrap(err, "adding file to snap store")
+		return errors.Wrap(err, "adding file to snap store")
 	}
 
 	if len(msgBytes) != wr {
-		return "", 0, errors.Errorf("written bytes length (%d) does not match message bytes length (%d)", wr, len(msgBytes))
-	}
-
-	info, err := os.Stat(filePath)
-	if err != nil {
-		return "", 0, errors.Wrap(err, "fetching file info")
+		return errors.Errorf("written bytes length (%d) does not match message bytes length (%d)", wr, len(msgBytes))
 	}
 
 	w.allocatedSpace += info.Size()
-	return filePath, uint64(info.Size()), nil
+	return nil
 }
 
 func (w *CharacterDeviceWatcher) charDeviceReader() {
@@ -216,20 +335,20 @@ func (w *CharacterDeviceWatcher) charDeviceReader() {
 		n, err := w.charDevice.Read(buff)
 		if err != nil {
 			if errors.Is(err, os.ErrClosed) {
-				log.Print("character device was closed; terminating char device reader")
+				w.logger.Infof("character device was closed; terminating char device reader")
 				return
 			}
-			log.Printf("error reading from char device: %+v", err)
+			w.logger.Errorf("error reading from char device: %+v", err)
 			// return error back to the main function and decide what to do there.
-			w.messageChan <- common.ErrorMessage{
+			w.sendMessage(common.ErrorMessage{
 				SnapstoreID: w.ID,
 				Error:       err,
-			}
+			})
 			w.charDevice.Close()
 			return
 		}
 		if n < 4 {
-			log.Printf("got invalid buffer length from character device: %d", n)
+			w.logger.Warnf("got invalid buffer length from character device: %d", n)
 			continue
 		}
 		command := binary.LittleEndian.Uint32(buff[:4])
@@ -246,75 +365,63 @@ func (w *CharacterDeviceWatcher) charDeviceReader() {
 			// operation already has the status of the call, and
 			// can cleanup.
 			code := binary.LittleEndian.Uint32(buff[4:])
-			log.Printf("got acknowledge message with exit code %d for snapstore %s (%d:%d)", code, w.ID.String(), w.devID.Major, w.devID.Minor)
+			w.logger.Infof("got acknowledge message with exit code %d for snapstore %s (%d:%d)", code, w.ID.String(), w.devID.Major, w.devID.Minor)
 			if code != 0 {
-				log.Printf("exiting watcher for snap store %s", w.ID.String())
+				w.logger.Errorf("exiting watcher for snap store %s", w.ID.String())
 				w.charDevice.Close()
 				return
 			}
 			continue
 		case CHARCMD_INVALID:
 			// This call is not used anywhere in the kernel module.
-			log.Printf("got CHARCMD_INVALID message type")
+			w.logger.Warnf("got CHARCMD_INVALID message type")
 			continue
 		case CHARCMD_HALFFILL:
-			if err := w.halfFillHandler(buff[4:]); err != nil {
-				log.Printf("got error from halfFill handler: %q", err)
-				w.messageChan <- common.ErrorMessage{
-					SnapstoreID: w.ID,
-					Error:       err,
-				}
-			}
+			w.halfFillHandler(buff[4:])
 		case CHARCMD_OVERFLOW:
 			// it's likely that the snapshot image is now corrupt,
 			// and the snapshot needs to be deleted.
 			if err := w.overflowHandler(buff[4:]); err != nil {
-				log.Printf("got error from overflow handler: %q", err)
-				w.messageChan <- common.ErrorMessage{
+				w.logger.Errorf("got error from overflow handler: %q", err)
+				w.sendMessage(common.ErrorMessage{
 					SnapstoreID: w.ID,
 					Error:       err,
-				}
+				})
 			}
 		case CHARCMD_TERMINATE:
 			// Snap store we are watching has been deleted. We can quit.
-			log.Printf("got terminate notification for snap store %s", w.ID)
+			w.logger.Infof("got terminate notification for snap store %s", w.ID)
 			if err := w.removeSnapStoreFiles(); err != nil {
-				log.Printf("failed to delete files for snap store %s: %+v", w.ID, err)
-				w.messageChan <- common.ErrorMessage{
+				w.logger.Errorf("failed to delete files for snap store %s: %+v", w.ID, err)
+				w.sendMessage(common.ErrorMessage{
 					SnapstoreID: w.ID,
 					Error:       err,
-				}
+				})
 			}
 			w.charDevice.Close()
 			return
 		default:
-			log.Printf("Unknown command: %d", command)
+			w.logger.Warnf("Unknown command: %d", command)
 		}
 	}
 }
 
-func (w *CharacterDeviceWatcher) halfFillHandler(msg []byte) error {
-	log.Printf("Got halffill notification from kernel module for snapstore %s", w.ID.String())
+// halfFillHandler asks the manager to add a file to the snap store. The manager
+// records the file before handing it to the kernel, which the watcher can not do.
+func (w *CharacterDeviceWatcher) halfFillHandler(msg []byte) {
+	w.logger.Infof("Got halffill notification from kernel module for snapstore %s", w.ID.String())
 	// the amount of filled bytes is an uint64
 	// split up in 2, 32 bit ranges.
 	fillStatus1 := binary.LittleEndian.Uint32(msg[0:4])
 	fillStatus2 := binary.LittleEndian.Uint32(msg[4:8])
 	// We need to combine the 2 bit ranges to get the actual value.
 	filledStatusVal := uint64(fillStatus2)<<32 | uint64(fillStatus1)
-	log.Printf("snapstore %s fill status is %d MB", w.ID.String(), filledStatusVal/1024/1024)
-
-	filePath, size, err := w.AllocateStorage(w.snapStoreFileSize)
-	if err != nil {
-		return errors.Wrap(err, "allocating file")
-	}
+	w.logger.Infof("snapstore %s fill status is %d MB", w.ID.String(), filledStatusVal/1024/1024)
 
-	w.messageChan <- common.SnapStoreAddFileMessage{
+	w.sendMessage(common.SnapStoreHalfFillMessage{
 		SnapStoreID: w.ID,
-		FilePath:    filePath,
-		FileSize:    size,
 		FillStatus:  filledStatusVal,
-	}
-	return nil
+	})
 }
 
 func (w *CharacterDeviceWatcher) overflowHandler(msg []byte) error {
@@ -326,15 +433,15 @@ func (w *CharacterDeviceWatcher) overflowHandler(msg []byte) error {
 	fillStatus2 := binary.LittleEndian.Uint32(msg[8:12])
 	filledStatusVal := uint64(fillStatus2)<<32 | uint64(fillStatus1)
 
-	log.Printf("snap store %s fill status is: %d bytes", w.ID.String(), filledStatusVal)
+	w.logger.Errorf("snap store %s fill status is: %d bytes", w.ID.String(), filledStatusVal)
 	// We send a snapstore overflow error back to the manager, which in turn will delete
 	// the snapshot, and mark the error in the database.
 
-	w.messageChan <- common.SnapStoreOverflowMessage{
+	w.sendMessage(common.SnapStoreOverflowMessage{
 		SnapStoreID: w.ID,
 		// TODO: define a proper overflow error.
 		Error: errors.Errorf("overflow error code %d", errorCode),
-	}
+	})
 	return vErrors.NewSnapStoreOverflowError(
 		"snap store %s has overflown with error code %d", w.ID.String(), errorCode)
 }